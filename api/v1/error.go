@@ -4,6 +4,7 @@ import (
 	"fmt"
 
 	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
 
@@ -13,7 +14,7 @@ type ErrOffsetOutOfRange struct {
 
 func (e ErrOffsetOutOfRange) GRPCStatus() *status.Status {
 	st := status.New(
-		404,
+		codes.OutOfRange,
 		fmt.Sprintf("offset out of range: %d", e.Offset),
 	)
 
@@ -39,3 +40,80 @@ func (e ErrOffsetOutOfRange) GRPCStatus() *status.Status {
 func (e ErrOffsetOutOfRange) Error() string {
 	return e.GRPCStatus().Err().Error()
 }
+
+// ErrOffsetNotFound is returned for an offset within the log's range that has no record, because it was skipped or the
+// records around it were removed. Unlike ErrOffsetOutOfRange, waiting won't make the record appear, so consumers
+// should move on to the next offset
+type ErrOffsetNotFound struct {
+	Offset uint64
+}
+
+func (e ErrOffsetNotFound) GRPCStatus() *status.Status {
+	return status.New(codes.NotFound, e.Error())
+}
+
+func (e ErrOffsetNotFound) Error() string {
+	return fmt.Sprintf("no record at offset: %d", e.Offset)
+}
+
+// ErrCompacted is returned for an offset that a log skipped, because the record at it had been compacted away by the
+// time it was replicated. Like ErrOffsetNotFound, consumers should move on to the next offset
+type ErrCompacted struct {
+	Offset uint64
+}
+
+func (e ErrCompacted) GRPCStatus() *status.Status {
+	return status.New(codes.NotFound, e.Error())
+}
+
+func (e ErrCompacted) Error() string {
+	return fmt.Sprintf("offset %d was compacted", e.Offset)
+}
+
+// ErrChecksumMismatch is returned when stored data doesn't match the checksum that was stored along with it
+type ErrChecksumMismatch struct {
+	// Name is the file, or other storage, the mismatch was found in
+	Name string
+}
+
+func (e ErrChecksumMismatch) GRPCStatus() *status.Status {
+	return status.New(codes.DataLoss, e.Error())
+}
+
+func (e ErrChecksumMismatch) Error() string {
+	return fmt.Sprintf("checksum mismatch: %s", e.Name)
+}
+
+// ErrClosed is returned when a log is used after it has been closed
+type ErrClosed struct{}
+
+func (e ErrClosed) GRPCStatus() *status.Status {
+	return status.New(codes.Unavailable, e.Error())
+}
+
+func (e ErrClosed) Error() string {
+	return "log is closed"
+}
+
+// ErrLogUnavailable is returned by appends while the log is refusing them after too many failed writes in a row, to
+// give the disk a chance to recover
+type ErrLogUnavailable struct{}
+
+func (e ErrLogUnavailable) GRPCStatus() *status.Status {
+	return status.New(codes.Unavailable, e.Error())
+}
+
+func (e ErrLogUnavailable) Error() string {
+	return "log is unavailable after repeated write failures"
+}
+
+// ErrEmptyLog is returned by operations that need at least one record in the log
+type ErrEmptyLog struct{}
+
+func (e ErrEmptyLog) GRPCStatus() *status.Status {
+	return status.New(codes.FailedPrecondition, e.Error())
+}
+
+func (e ErrEmptyLog) Error() string {
+	return "log is empty"
+}
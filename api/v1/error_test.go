@@ -0,0 +1,29 @@
+package log_v1
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestErrorCodes(t *testing.T) {
+	for scenario, want := range map[string]struct {
+		err  error
+		code codes.Code
+	}{
+		"offset out of range": {err: ErrOffsetOutOfRange{Offset: 1}, code: codes.OutOfRange},
+		"offset not found":    {err: ErrOffsetNotFound{Offset: 1}, code: codes.NotFound},
+		"compacted":           {err: ErrCompacted{Offset: 1}, code: codes.NotFound},
+		"checksum mismatch":   {err: ErrChecksumMismatch{Name: "0.index"}, code: codes.DataLoss},
+		"closed":              {err: ErrClosed{}, code: codes.Unavailable},
+		"log unavailable":     {err: ErrLogUnavailable{}, code: codes.Unavailable},
+		"empty log":           {err: ErrEmptyLog{}, code: codes.FailedPrecondition},
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			require.Equal(t, want.code, status.Code(want.err))
+			require.NotEmpty(t, want.err.Error())
+		})
+	}
+}
@@ -0,0 +1,128 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	api "github.com/burmudar/prolog/api/v1"
+)
+
+var ErrNoIdentify = fmt.Errorf("DedupConfig.Identify is required")
+
+type DedupConfig struct {
+	// Identify returns the ID of the producer of a record and the sequence number the producer gave it. Sequence
+	// numbers have to increase with every record a producer produces. Records it can't identify are always delivered
+	Identify func(*api.Record) (producerID string, seq uint64, ok bool)
+	// WatermarkFile is where the highest sequence number delivered for every producer is kept, so that duplicates are
+	// dropped across reconnects and restarts. The watermarks are only kept in memory when it is empty
+	WatermarkFile string
+}
+
+// Deduplicator delivers records to the application once per producer sequence number, dropping the duplicates that
+// producers retrying after a failure, or consumers rereading the log after reconnecting, give rise to
+type Deduplicator struct {
+	config DedupConfig
+
+	mu sync.Mutex
+	// watermarks is the highest sequence number delivered for every producer
+	watermarks map[string]uint64
+}
+
+// NewDeduplicator creates a Deduplicator which carries on from the watermarks in config.WatermarkFile, if there are any
+func NewDeduplicator(config DedupConfig) (*Deduplicator, error) {
+	if config.Identify == nil {
+		return nil, ErrNoIdentify
+	}
+
+	d := &Deduplicator{
+		config:     config,
+		watermarks: make(map[string]uint64),
+	}
+	if config.WatermarkFile == "" {
+		return d, nil
+	}
+
+	p, err := ioutil.ReadFile(config.WatermarkFile)
+	switch {
+	case os.IsNotExist(err):
+		return d, nil
+	case err != nil:
+		return nil, err
+	}
+	if err := json.Unmarshal(p, &d.watermarks); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// Handle calls fn with the record unless a record with the same or a later sequence number from the same producer has
+// been delivered already. The record only counts as delivered when fn succeeds, so that it is delivered again when it
+// is read again after fn failed
+func (d *Deduplicator) Handle(record *api.Record, fn func(*api.Record) error) error {
+	id, seq, ok := d.config.Identify(record)
+	if !ok {
+		return fn(record)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if watermark, seen := d.watermarks[id]; seen && seq <= watermark {
+		return nil
+	}
+	if err := fn(record); err != nil {
+		return err
+	}
+
+	d.watermarks[id] = seq
+	return d.save()
+}
+
+// Consume reads the log from offset from on, passing every record through Handle, until the context is cancelled, the
+// stream fails or fn returns an error. Call it again with the offset after the last record handled to reconnect
+func (d *Deduplicator) Consume(
+	ctx context.Context,
+	client api.LogClient,
+	from uint64,
+	fn func(*api.Record) error,
+) error {
+	stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{Offset: from})
+	if err != nil {
+		return err
+	}
+
+	for {
+		res, err := stream.Recv()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		if err := d.Handle(res.Record, fn); err != nil {
+			return err
+		}
+	}
+}
+
+// save writes the watermarks to a temporary file which is renamed over WatermarkFile, so that a crash midway leaves
+// either the old or the new watermarks behind. The caller is expected to hold mu
+func (d *Deduplicator) save() error {
+	if d.config.WatermarkFile == "" {
+		return nil
+	}
+
+	p, err := json.Marshal(d.watermarks)
+	if err != nil {
+		return err
+	}
+	tmp := d.config.WatermarkFile + ".tmp"
+	if err := ioutil.WriteFile(tmp, p, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, d.config.WatermarkFile)
+}
@@ -0,0 +1,95 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+
+	api "github.com/burmudar/prolog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+// identify reads records with values of the form "<producer>:<seq>:<payload>"
+func identify(record *api.Record) (string, uint64, bool) {
+	parts := strings.SplitN(string(record.Value), ":", 3)
+	if len(parts) != 3 {
+		return "", 0, false
+	}
+	seq, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		return "", 0, false
+	}
+	return parts[0], seq, true
+}
+
+func TestDeduplicator(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dedup-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	config := DedupConfig{Identify: identify, WatermarkFile: path.Join(dir, "watermarks")}
+	d, err := NewDeduplicator(config)
+	require.NoError(t, err)
+
+	var delivered []string
+	deliver := func(record *api.Record) error {
+		delivered = append(delivered, string(record.Value))
+		return nil
+	}
+	handle := func(d *Deduplicator, values ...string) {
+		for _, v := range values {
+			require.NoError(t, d.Handle(&api.Record{Value: []byte(v)}, deliver))
+		}
+	}
+
+	// a retried produce shows up twice, and records that can't be identified are always delivered
+	handle(d, "p1:1:a", "p2:1:b", "p1:1:a", "p1:2:c", "unidentified", "unidentified", "p2:1:b")
+	require.Equal(t, []string{"p1:1:a", "p2:1:b", "p1:2:c", "unidentified", "unidentified"}, delivered)
+
+	// a failed delivery is tried again when the record comes around again
+	require.Error(t, d.Handle(&api.Record{Value: []byte("p1:3:d")}, func(*api.Record) error {
+		return fmt.Errorf("application failed")
+	}))
+
+	// after reconnecting the consumer reads some of the same records again, which are dropped
+	delivered = nil
+	d, err = NewDeduplicator(config)
+	require.NoError(t, err)
+	handle(d, "p1:2:c", "p2:1:b", "p1:3:d", "p2:2:e")
+	require.Equal(t, []string{"p1:3:d", "p2:2:e"}, delivered)
+
+	_, err = NewDeduplicator(DedupConfig{})
+	require.Equal(t, ErrNoIdentify, err)
+}
+
+func TestDeduplicatorConsume(t *testing.T) {
+	client, tearDown := setupTest(t)
+	defer tearDown()
+
+	ctx := context.Background()
+	for _, v := range []string{"p1:1:a", "p1:2:b", "p1:2:b", "p1:3:c"} {
+		_, err := client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte(v)}})
+		require.NoError(t, err)
+	}
+
+	d, err := NewDeduplicator(DedupConfig{Identify: identify})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var delivered []string
+	err = d.Consume(ctx, client, 0, func(record *api.Record) error {
+		delivered = append(delivered, string(record.Value))
+		if record.Offset == 3 {
+			cancel()
+		}
+		return nil
+	})
+	require.Equal(t, context.Canceled, err)
+	require.Equal(t, []string{"p1:1:a", "p1:2:b", "p1:3:c"}, delivered)
+}
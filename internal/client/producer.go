@@ -0,0 +1,142 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	api "github.com/burmudar/prolog/api/v1"
+)
+
+var ErrProducerClosed = fmt.Errorf("producer is closed")
+
+type ProducerConfig struct {
+	// MaxBatchSize is how many records are accumulated before the batch is sent. Defaults to 100
+	MaxBatchSize int
+	// FlushInterval is the longest a record waits in a batch before the batch is sent. Defaults to 10ms
+	FlushInterval time.Duration
+}
+
+// Result is the outcome of producing a single record through a Producer
+type Result struct {
+	done   chan struct{}
+	offset uint64
+	err    error
+}
+
+// Wait blocks until the record's batch has been sent and returns the offset the record was appended at
+func (r *Result) Wait() (uint64, error) {
+	<-r.done
+	return r.offset, r.err
+}
+
+func (r *Result) complete(offset uint64, err error) {
+	r.offset, r.err = offset, err
+	close(r.done)
+}
+
+// Producer accumulates records and sends them to the log with ProduceBatch once there are MaxBatchSize of them, or
+// FlushInterval has passed since the first record of the batch was produced
+type Producer struct {
+	client api.LogClient
+	config ProducerConfig
+
+	mu      sync.Mutex
+	records []*api.Record
+	results []*Result
+	timer   *time.Timer
+	closed  bool
+	// sendMu makes sure batches are sent one at a time, in the order they were filled
+	sendMu sync.Mutex
+}
+
+func NewProducer(client api.LogClient, config ProducerConfig) *Producer {
+	if config.MaxBatchSize <= 0 {
+		config.MaxBatchSize = 100
+	}
+	if config.FlushInterval <= 0 {
+		config.FlushInterval = 10 * time.Millisecond
+	}
+
+	return &Producer{
+		client: client,
+		config: config,
+	}
+}
+
+// Produce adds the record to the current batch. The returned Result is completed once the batch has been sent
+func (p *Producer) Produce(record *api.Record) *Result {
+	r := &Result{done: make(chan struct{})}
+
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		r.complete(0, ErrProducerClosed)
+		return r
+	}
+
+	p.records = append(p.records, record)
+	p.results = append(p.results, r)
+	full := len(p.records) >= p.config.MaxBatchSize
+	if !full && p.timer == nil {
+		p.timer = time.AfterFunc(p.config.FlushInterval, func() {
+			p.Flush(context.Background())
+		})
+	}
+	p.mu.Unlock()
+
+	if full {
+		p.Flush(context.Background())
+	}
+	return r
+}
+
+// Flush sends the current batch. An error is only returned when the batch as a whole couldn't be sent, errors for
+// single records are reported through their Result
+func (p *Producer) Flush(ctx context.Context) error {
+	p.sendMu.Lock()
+	defer p.sendMu.Unlock()
+
+	p.mu.Lock()
+	records, results := p.records, p.results
+	p.records, p.results = nil, nil
+	if p.timer != nil {
+		p.timer.Stop()
+		p.timer = nil
+	}
+	p.mu.Unlock()
+
+	if len(records) == 0 {
+		return nil
+	}
+
+	res, err := p.client.ProduceBatch(ctx, &api.ProduceBatchRequest{Records: records})
+	if err == nil && len(res.Results) != len(records) {
+		err = fmt.Errorf("got %d results for a batch of %d records", len(res.Results), len(records))
+	}
+	if err != nil {
+		for _, r := range results {
+			r.complete(0, err)
+		}
+		return err
+	}
+
+	for i, r := range results {
+		if res.Results[i].Error != "" {
+			r.complete(0, fmt.Errorf("%s", res.Results[i].Error))
+			continue
+		}
+		r.complete(res.Results[i].Offset, nil)
+	}
+	return nil
+}
+
+// Close sends whatever records are left in the batch. Records produced after Close fail with ErrProducerClosed
+func (p *Producer) Close(ctx context.Context) error {
+	p.mu.Lock()
+	p.closed = true
+	p.mu.Unlock()
+
+	return p.Flush(ctx)
+}
@@ -0,0 +1,125 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	api "github.com/burmudar/prolog/api/v1"
+	"github.com/burmudar/prolog/internal/log"
+	"github.com/burmudar/prolog/internal/server"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+)
+
+func TestProducer(t *testing.T) {
+	for scenario, fn := range map[string]func(
+		t *testing.T,
+		client api.LogClient,
+	){
+		"records are readable at their offsets": testProducerOffsets,
+		"records are sent after FlushInterval":  testProducerFlushInterval,
+		"per record errors are reported":        testProducerRecordErrors,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			client, tearDown := setupTest(t)
+			defer tearDown()
+			fn(t, client)
+		})
+	}
+}
+
+func testProducerOffsets(t *testing.T, client api.LogClient) {
+	p := NewProducer(client, ProducerConfig{MaxBatchSize: 10, FlushInterval: time.Hour})
+
+	n := 25
+	results := make([]*Result, n)
+	for i := 0; i < n; i++ {
+		results[i] = p.Produce(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+	}
+	// the last 5 records only go out when the producer is closed
+	require.NoError(t, p.Close(context.Background()))
+
+	for i, r := range results {
+		off, err := r.Wait()
+		require.NoError(t, err)
+		require.Equal(t, uint64(i), off)
+
+		res, err := client.Consume(context.Background(), &api.ConsumeRequest{Offset: off})
+		require.NoError(t, err)
+		require.Equal(t, []byte(fmt.Sprintf("record %d", i)), res.Record.Value)
+	}
+
+	_, err := p.Produce(&api.Record{Value: []byte("too late")}).Wait()
+	require.Equal(t, ErrProducerClosed, err)
+}
+
+func testProducerFlushInterval(t *testing.T, client api.LogClient) {
+	p := NewProducer(client, ProducerConfig{MaxBatchSize: 100, FlushInterval: 10 * time.Millisecond})
+	defer p.Close(context.Background())
+
+	off, err := p.Produce(&api.Record{Value: []byte("hello world")}).Wait()
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+}
+
+func testProducerRecordErrors(t *testing.T, client api.LogClient) {
+	p := NewProducer(client, ProducerConfig{MaxBatchSize: 3, FlushInterval: time.Hour})
+	defer p.Close(context.Background())
+
+	first := p.Produce(&api.Record{Value: []byte("first")})
+	empty := p.Produce(&api.Record{})
+	last := p.Produce(&api.Record{Value: []byte("last")})
+
+	off, err := first.Wait()
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+
+	_, err = empty.Wait()
+	require.Error(t, err)
+
+	off, err = last.Wait()
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), off)
+}
+
+func setupTest(t *testing.T) (client api.LogClient, tearDown func()) {
+	t.Helper()
+
+	l, err := net.Listen("tcp", ":0")
+	require.NoError(t, err)
+
+	cc, err := grpc.Dial(l.Addr().String(), grpc.WithInsecure())
+	require.NoError(t, err)
+
+	dir, err := ioutil.TempDir("", "producer-test")
+	require.NoError(t, err)
+
+	clog, err := log.NewLog(dir, log.Config{})
+	require.NoError(t, err)
+
+	srv, err := server.NewGRPCServer(&server.Config{
+		CommitLog: clog,
+		Validator: func(r *api.Record) error {
+			if len(r.Value) == 0 {
+				return fmt.Errorf("record value is empty")
+			}
+			return nil
+		},
+	})
+	require.NoError(t, err)
+
+	go func() {
+		srv.Serve(l)
+	}()
+
+	return api.NewLogClient(cc), func() {
+		srv.Stop()
+		cc.Close()
+		l.Close()
+		clog.Remove()
+	}
+}
@@ -0,0 +1,62 @@
+package log
+
+import (
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// alignmentPadding returns how many bytes of padding a record of n bytes, length included, written at pos in the store
+// needs for the record after it to start at a multiple of alignment. Padding is written as a field of its own, which
+// takes at least two bytes, so a single byte short is made up for by padding up to the boundary after
+func alignmentPadding(pos, n, alignment uint64) int {
+	if alignment <= 1 {
+		return 0
+	}
+
+	pad := (alignment - (pos+n)%alignment) % alignment
+	if pad == 1 {
+		pad += alignment
+	}
+	return int(pad)
+}
+
+// appendPadding appends a padding field that is exactly n bytes long to the encoded record p. Record doesn't define the
+// field, so it is skipped when the record is read. n has to be at least two, or zero for no padding
+func appendPadding(p []byte, n int) []byte {
+	if n == 0 {
+		return p
+	}
+
+	p = protowire.AppendTag(p, tombstonePaddingField, protowire.BytesType)
+	rest := n - 1
+	// as for tombstones, the length is spread over as many bytes as the whole rest would need
+	w := protowire.SizeVarint(uint64(rest))
+	p = appendPaddedVarint(p, uint64(rest-w), w)
+	return append(p, make([]byte, rest-w)...)
+}
+
+// dropPadding removes the padding fields of tombstones and aligned records from the unknown fields of a record that was
+// read, so that it isn't passed on. Other unknown fields are kept
+func dropPadding(m protoreflect.Message) {
+	unknown := m.GetUnknown()
+	if len(unknown) == 0 {
+		return
+	}
+
+	var kept protoreflect.RawFields
+	for b := []byte(unknown); len(b) > 0; {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return
+		}
+		m := protowire.ConsumeFieldValue(num, typ, b[n:])
+		if m < 0 {
+			return
+		}
+		if num != tombstonePaddingField {
+			kept = append(kept, b[:n+m]...)
+		}
+		b = b[n+m:]
+	}
+	m.SetUnknown(kept)
+}
@@ -0,0 +1,109 @@
+package log
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	api "github.com/burmudar/prolog/api/v1"
+)
+
+// ErrInvalidArchive is returned by ExtractTar for archives holding something other than the files of a log
+var ErrInvalidArchive = fmt.Errorf("archive holds something other than the files of a log")
+
+// ArchiveTar writes the log's segments to w as a tar archive, which ExtractTar turns back into a log directory. Every
+// segment is archived as the files Clone would copy, so the log keeps serving reads while it is archived, but appends
+// wait until the archive is written. Unlike Clone it works whatever the segments are stored in
+func (l *Log) ArchiveTar(w io.Writer) error {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if l.closed {
+		return api.ErrClosed{}
+	}
+
+	tw := tar.NewWriter(w)
+	now := l.Config.Clock.Now()
+	for _, s := range l.segments {
+		release, err := l.open.acquire(s)
+		if err != nil {
+			return err
+		}
+		err = archiveSegment(tw, s, now)
+		release()
+		if err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// archiveSegment writes the segment's files to tw
+func archiveSegment(tw *tar.Writer, s *segment, now time.Time) error {
+	files, err := s.files()
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		header := &tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     file.name,
+			Size:     file.size,
+			Mode:     int64(s.config.fileMode()),
+			ModTime:  now,
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if _, err := io.Copy(tw, file.r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ExtractTar extracts an archive written by ArchiveTar into dir, which is created if it doesn't exist. The log can then
+// be opened with NewLog. Archives holding anything other than the files of segments fail with ErrInvalidArchive,
+// without anything being written outside of dir
+func ExtractTar(dir string, r io.Reader) error {
+	if err := os.MkdirAll(dir, defaultDirMode); err != nil {
+		return err
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		if header.Typeflag != tar.TypeReg || !isSegmentFile(header.Name) {
+			return ErrInvalidArchive
+		}
+
+		f, err := os.OpenFile(filepath.Join(dir, header.Name), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, defaultFileMode)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(f, tr); err != nil {
+			f.Close()
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+	}
+
+	return syncDir(dir)
+}
+
+// isSegmentFile reports whether name is the name of one of the files ArchiveTar archives for a segment
+func isSegmentFile(name string) bool {
+	_, ext, ok := parseSegmentFileName(name)
+	return ok && ext != timeIndexExt
+}
@@ -0,0 +1,71 @@
+package log
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	api "github.com/burmudar/prolog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogArchiveTar(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 64
+	log, err := NewLog(filepath.Join(dir, "src"), c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	for i := 0; i < 10; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.Greater(t, log.SegmentCount(), 2)
+
+	var buf bytes.Buffer
+	require.NoError(t, log.ArchiveTar(&buf))
+
+	dst := filepath.Join(dir, "dst")
+	require.NoError(t, ExtractTar(dst, &buf))
+
+	extracted, err := NewLog(dst, c)
+	require.NoError(t, err)
+	defer extracted.Close()
+
+	require.Equal(t, log.SegmentCount(), extracted.SegmentCount())
+	require.Equal(t, log.PeekNextOffset(), extracted.PeekNextOffset())
+	for off := uint64(0); off < log.PeekNextOffset(); off++ {
+		want, err := log.Read(off)
+		require.NoError(t, err)
+		got, err := extracted.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, want.Value, got.Value)
+		require.Equal(t, want.Timestamp, got.Timestamp)
+	}
+}
+
+func TestExtractTarInvalid(t *testing.T) {
+	for _, name := range []string{"../0.store", "0.store/x", "config.json", "x0.index"} {
+		t.Run(name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "extract-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			var buf bytes.Buffer
+			tw := tar.NewWriter(&buf)
+			require.NoError(t, tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: 0644}))
+			require.NoError(t, tw.Close())
+
+			require.Equal(t, ErrInvalidArchive, ExtractTar(filepath.Join(dir, "log"), &buf))
+			_, err = os.Stat(filepath.Join(dir, "0.store"))
+			require.True(t, os.IsNotExist(err))
+		})
+	}
+}
@@ -0,0 +1,150 @@
+package log
+
+import (
+	api "github.com/burmudar/prolog/api/v1"
+)
+
+const defaultAsyncQueueSize = 256
+
+// AppendResult is the outcome of an append made with AppendAsync. Err can be set along with Offset when the record was
+// appended but syncing it, with SyncOnAppend set, failed
+type AppendResult struct {
+	Offset uint64
+	Err    error
+}
+
+// asyncAppend is a record queued by AppendAsync and the channel its result is sent on
+type asyncAppend struct {
+	record *api.Record
+	result chan AppendResult
+}
+
+// asyncQueue holds the records queued by AppendAsync until its worker appends them. stop is closed by Close, after
+// which the worker appends whatever is left in the queue and closes done
+type asyncQueue struct {
+	records chan asyncAppend
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// AppendAsync queues the record to be appended by a worker in the background and returns a channel that the record's
+// offset, or the error appending it failed with, is sent on once it has been appended. With SyncOnAppend set, that is
+// once it has been synced as well. The worker appends all the records that are queued by the time it gets to them in
+// one go, taking the log's lock and syncing once for all of them, so producers that don't need to wait for every
+// record can keep going while the disk catches up.
+//
+// The queue holds Config.AsyncQueueSize records, and AppendAsync blocks while it is full. Records still in the queue
+// when the log is closed are appended before Close closes the segments, and records queued after that fail with
+// api.ErrClosed
+func (l *Log) AppendAsync(record *api.Record) <-chan AppendResult {
+	result := make(chan AppendResult, 1)
+
+	l.asyncMu.RLock()
+	defer l.asyncMu.RUnlock()
+
+	if l.asyncStopped {
+		result <- AppendResult{Err: api.ErrClosed{}}
+		return result
+	}
+
+	l.asyncOnce.Do(func() {
+		size := l.Config.AsyncQueueSize
+		if size == 0 {
+			size = defaultAsyncQueueSize
+		}
+		l.async = &asyncQueue{
+			records: make(chan asyncAppend, size),
+			stop:    make(chan struct{}),
+			done:    make(chan struct{}),
+		}
+		go l.runAsync(l.async)
+	})
+
+	l.async.records <- asyncAppend{record: record, result: result}
+	return result
+}
+
+// runAsync appends the records queued in q until q is stopped and there are none left
+func (l *Log) runAsync(q *asyncQueue) {
+	defer close(q.done)
+
+	for {
+		select {
+		case a := <-q.records:
+			l.appendAsync(q.take(a))
+		case <-q.stop:
+			// nothing can be queued any more, so whatever is in the queue now is all there is left
+			for {
+				select {
+				case a := <-q.records:
+					l.appendAsync(q.take(a))
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// take returns first along with the records queued behind it, as many as there are right now
+func (q *asyncQueue) take(first asyncAppend) []asyncAppend {
+	batch := []asyncAppend{first}
+	for len(batch) < cap(q.records) {
+		select {
+		case a := <-q.records:
+			batch = append(batch, a)
+		default:
+			return batch
+		}
+	}
+	return batch
+}
+
+// appendAsync appends the batch of queued records and sends each one its result
+func (l *Log) appendAsync(batch []asyncAppend) {
+	results := make([]AppendResult, len(batch))
+	appended := false
+
+	l.mu.Lock()
+	for i, a := range batch {
+		if l.closed {
+			results[i].Err = api.ErrClosed{}
+			continue
+		}
+		results[i].Offset, results[i].Err = l.appendRecord(a.record)
+		appended = appended || results[i].Err == nil
+	}
+	l.mu.Unlock()
+
+	if appended && l.Config.SyncOnAppend {
+		if err := l.Sync(); err != nil {
+			for i := range results {
+				if results[i].Err == nil {
+					results[i].Err = err
+				}
+			}
+		}
+	}
+
+	for i, a := range batch {
+		a.result <- results[i]
+	}
+}
+
+// stopAsync stops AppendAsync from queueing records and waits for the worker to append the ones that are queued
+// already. It must be called without holding the log's lock, which the worker needs
+func (l *Log) stopAsync() {
+	l.asyncMu.Lock()
+	if l.asyncStopped {
+		l.asyncMu.Unlock()
+		return
+	}
+	l.asyncStopped = true
+	q := l.async
+	l.asyncMu.Unlock()
+
+	if q != nil {
+		close(q.stop)
+		<-q.done
+	}
+}
@@ -0,0 +1,98 @@
+package log
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+
+	api "github.com/burmudar/prolog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogAppendAsync(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T, log *Log){
+		"results have unique offsets": testAppendAsyncUnique,
+		"close appends queued":        testAppendAsyncClose,
+		"sync on append":              testAppendAsyncSync,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "append-async-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			c := Config{}
+			c.Segment.MaxStoreBytes = 1024
+			c.AsyncQueueSize = 16
+			c.SyncOnAppend = scenario == "sync on append"
+			log, err := NewLog(dir, c)
+			require.NoError(t, err)
+			defer log.Close()
+
+			fn(t, log)
+		})
+	}
+}
+
+func testAppendAsyncUnique(t *testing.T, log *Log) {
+	const producers, records = 8, 100
+
+	var wg sync.WaitGroup
+	results := make([][]<-chan AppendResult, producers)
+	for p := 0; p < producers; p++ {
+		wg.Add(1)
+		go func(p int) {
+			defer wg.Done()
+			for i := 0; i < records; i++ {
+				value := []byte(fmt.Sprintf("%d-%d", p, i))
+				results[p] = append(results[p], log.AppendAsync(&api.Record{Value: value}))
+			}
+		}(p)
+	}
+	wg.Wait()
+
+	seen := make(map[uint64]bool)
+	for p := range results {
+		for i, ch := range results[p] {
+			result := <-ch
+			require.NoError(t, result.Err)
+			require.False(t, seen[result.Offset], "offset %d handed out twice", result.Offset)
+			seen[result.Offset] = true
+
+			read, err := log.Read(result.Offset)
+			require.NoError(t, err)
+			require.Equal(t, fmt.Sprintf("%d-%d", p, i), string(read.Value))
+		}
+	}
+	require.Len(t, seen, producers*records)
+	require.Equal(t, uint64(producers*records), log.PeekNextOffset())
+}
+
+func testAppendAsyncClose(t *testing.T, log *Log) {
+	var results []<-chan AppendResult
+	for i := 0; i < 10; i++ {
+		results = append(results, log.AppendAsync(&api.Record{Value: []byte("hello world")}))
+	}
+	require.NoError(t, log.Close())
+
+	// everything queued before the log was closed is appended
+	for i, ch := range results {
+		result := <-ch
+		require.NoError(t, result.Err)
+		require.Equal(t, uint64(i), result.Offset)
+	}
+
+	result := <-log.AppendAsync(&api.Record{Value: []byte("hello world")})
+	require.Equal(t, api.ErrClosed{}, result.Err)
+}
+
+func testAppendAsyncSync(t *testing.T, log *Log) {
+	result := <-log.AppendAsync(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, result.Err)
+
+	// the record was synced by the time its result arrived
+	log.durableMu.Lock()
+	defer log.durableMu.Unlock()
+	require.Greater(t, log.durable, result.Offset)
+}
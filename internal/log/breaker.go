@@ -0,0 +1,75 @@
+package log
+
+import (
+	"io"
+	"time"
+)
+
+const defaultBreakerCooldown = 30 * time.Second
+
+// breaker is a circuit breaker for appends. A failing disk, a full one for instance, fails every write, so once enough
+// of them have failed in a row there's no point in trying again for a while
+type breaker struct {
+	// failures is the number of appends in a row that failed to write
+	failures int
+	// openUntil is when appends are tried again. It is zero while the breaker is closed
+	openUntil time.Time
+}
+
+// allow reports whether an append may be tried at now
+func (b *breaker) allow(now time.Time) bool {
+	return b.openUntil.IsZero() || !now.Before(b.openUntil)
+}
+
+// record keeps track of the outcome of an append, opening the breaker once BreakerThreshold appends in a row have
+// failed to write. Only errors marked by writeFailed count as failures; any other error leaves the count as it is
+func (b *breaker) record(now time.Time, err error, c Config) {
+	if err == nil {
+		b.failures, b.openUntil = 0, time.Time{}
+		return
+	}
+	if _, ok := err.(writeFailure); !ok {
+		return
+	}
+
+	b.failures++
+	if c.BreakerThreshold > 0 && b.failures >= c.BreakerThreshold {
+		cooldown := c.BreakerCooldown
+		if cooldown <= 0 {
+			cooldown = defaultBreakerCooldown
+		}
+		b.openUntil = now.Add(cooldown)
+	}
+}
+
+// writeFailure marks an error that came from writing to storage, as opposed to one with the record appended, so that
+// only failures of the disk count toward opening the breaker
+type writeFailure struct {
+	err error
+}
+
+func (e writeFailure) Error() string {
+	return e.err.Error()
+}
+
+// writeFailed marks err, if there is one, as a failure to write to storage. An index that is full fails its writes
+// with io.EOF, and an encrypted store fails to seal a record before it gets as far as the disk, neither of which is a
+// fault of the disk
+func writeFailed(err error) error {
+	switch err.(type) {
+	case nil, sealError:
+		return err
+	}
+	if err == io.EOF || err == ErrEncrypted {
+		return err
+	}
+	return writeFailure{err: err}
+}
+
+// unwrapWriteFailure returns the error marked by writeFailed, for handing back to the caller
+func unwrapWriteFailure(err error) error {
+	if wf, ok := err.(writeFailure); ok {
+		return wf.err
+	}
+	return err
+}
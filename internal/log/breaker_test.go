@@ -0,0 +1,128 @@
+package log
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	api "github.com/burmudar/prolog/api/v1"
+	"github.com/burmudar/prolog/internal/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+var errDiskFull = fmt.Errorf("no space left on device")
+
+// failingStore fails appends while full is set, counting the appends that were tried
+type failingStore struct {
+	StoreBackend
+	full     *bool
+	attempts *int
+}
+
+func (s *failingStore) Append(p []byte) (uint64, uint64, error) {
+	*s.attempts++
+	if *s.full {
+		return 0, 0, errDiskFull
+	}
+	return s.StoreBackend.Append(p)
+}
+
+func TestLogCircuitBreaker(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-breaker-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	full, attempts := false, 0
+	clock := testutil.NewFakeClock(time.Now())
+	c := Config{Clock: clock, BreakerThreshold: 3, BreakerCooldown: time.Minute}
+	c.Segment.NewStore = func(dir string, baseOffset uint64, c Config) (StoreBackend, error) {
+		s, err := NewMemoryStore(dir, baseOffset, c)
+		return &failingStore{StoreBackend: s, full: &full, attempts: &attempts}, err
+	}
+	c.Segment.NewIndex = NewMemoryIndex
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	record := func() *api.Record {
+		return &api.Record{Value: []byte("hello world")}
+	}
+
+	full = true
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(record())
+		require.Equal(t, errDiskFull, err)
+	}
+	require.Equal(t, 3, attempts)
+
+	// the breaker is open, so the store isn't even tried
+	_, err = log.Append(record())
+	require.Equal(t, api.ErrLogUnavailable{}, err)
+	require.Equal(t, 3, attempts)
+
+	// after the cooldown the store is tried again, and another failure opens the breaker straight away
+	clock.Advance(time.Minute)
+	_, err = log.Append(record())
+	require.Equal(t, errDiskFull, err)
+	_, err = log.Append(record())
+	require.Equal(t, api.ErrLogUnavailable{}, err)
+	require.Equal(t, 4, attempts)
+
+	// once the disk recovers appends succeed and the breaker is closed again
+	full = false
+	clock.Advance(time.Minute)
+	off, err := log.Append(record())
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+
+	full = true
+	_, err = log.Append(record())
+	require.Equal(t, errDiskFull, err)
+	_, err = log.Append(record())
+	require.Equal(t, errDiskFull, err)
+}
+
+// failingReader fails every read, like a client that goes away partway through sending a record
+type failingReader struct{}
+
+func (failingReader) Read(p []byte) (int, error) {
+	return 0, errClientGone
+}
+
+var errClientGone = fmt.Errorf("client went away")
+
+func TestLogCircuitBreakerBadRecords(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-breaker-bad-records-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// an allocator that hands out the same offset again and again
+	allocator := &strideAllocator{}
+	c := Config{OffsetAllocator: allocator, BreakerThreshold: 2}
+	c.Segment.MaxStoreBytes = 1024
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	_, err = log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+
+	// none of these errors are failures to write, so the breaker stays closed however many of them there are
+	for i := 0; i < 3; i++ {
+		_, err = log.Append(&api.Record{Value: []byte("hello world")})
+		require.Equal(t, ErrOffsetNotSequential, err)
+	}
+	allocator.next, allocator.stride = 1, 1
+	for i := 0; i < 3; i++ {
+		_, err = log.AppendReader(failingReader{}, 5)
+		require.Equal(t, errClientGone, err)
+		_, err = log.Append(&api.Record{Value: make([]byte, 2048)})
+		require.Equal(t, ErrRecordTooLarge, err)
+	}
+
+	off, err := log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), off)
+}
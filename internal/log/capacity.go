@@ -0,0 +1,67 @@
+package log
+
+import (
+	"fmt"
+
+	"github.com/golang/protobuf/proto"
+)
+
+var ErrDiskFull = fmt.Errorf("record doesn't fit in the log's MaxTotalBytes")
+
+// TotalBytes returns how many bytes the stores and indexes of the log's segments take up
+func (l *Log) TotalBytes() uint64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	return l.totalBytes()
+}
+
+// totalBytes is TotalBytes for callers that hold a lock
+func (l *Log) totalBytes() uint64 {
+	var n uint64
+	for _, s := range l.segments {
+		n += s.size()
+	}
+	return n
+}
+
+// makeRoom removes the oldest segments until n more bytes fit within MaxTotalBytes. When that means removing the active
+// segment as well, it is sealed first and a new one started in its place. The caller is expected to hold the write lock
+func (l *Log) makeRoom(n uint64) error {
+	max := l.Config.MaxTotalBytes
+	if max == 0 {
+		return nil
+	}
+	if n > max {
+		return ErrDiskFull
+	}
+
+	removed := false
+	for l.totalBytes()+n > max {
+		if len(l.segments) == 1 {
+			if err := l.roll(l.activeSegment.nextOffset); err != nil {
+				return err
+			}
+		}
+
+		oldest := l.segments[0]
+		l.open.remove(oldest)
+		if err := oldest.Remove(); err != nil {
+			return err
+		}
+		l.segments = l.segments[1:]
+		removed = true
+	}
+
+	if !removed {
+		return nil
+	}
+	l.Config.Observer.SegmentCount(len(l.segments))
+	return l.writeManifest()
+}
+
+// recordBytes estimates how many bytes appending the record takes up, from the size of its protobuf encoding plus room
+// for the offset it has yet to be given
+func recordBytes(record proto.Message) uint64 {
+	return maxFrameOverhead + uint64(proto.Size(record)) + 1 + maxVarintLen + entWidth
+}
@@ -0,0 +1,63 @@
+package log
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	api "github.com/burmudar/prolog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogMaxTotalBytes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-max-total-bytes-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	record := func() *api.Record {
+		return &api.Record{Value: []byte("hello world")}
+	}
+
+	// room for five records, in segments of two
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 2
+	c.MaxTotalBytes = 5 * recordBytes(record())
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	for i := uint64(0); i < 20; i++ {
+		off, err := log.Append(record())
+		require.NoError(t, err)
+		require.Equal(t, i, off)
+		require.LessOrEqual(t, log.TotalBytes(), c.MaxTotalBytes)
+	}
+
+	// the oldest records were evicted to make room for the newest ones
+	lowest, err := log.LowestOffset()
+	require.NoError(t, err)
+	require.Greater(t, lowest, uint64(10))
+	_, err = log.Read(0)
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: 0}, err)
+	read, err := log.Read(19)
+	require.NoError(t, err)
+	require.Equal(t, record().Value, read.Value)
+
+	_, err = log.Append(&api.Record{Value: bytes.Repeat([]byte("a"), int(c.MaxTotalBytes))})
+	require.Equal(t, ErrDiskFull, err)
+
+	// a log reopened with a smaller cap evicts enough for the next record
+	require.NoError(t, log.Close())
+	// the record is timestamped before it is appended, which makes it a little larger
+	c.MaxTotalBytes = 2 * recordBytes(record())
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	off, err := log.Append(record())
+	require.NoError(t, err)
+	require.Equal(t, uint64(20), off)
+	require.LessOrEqual(t, log.TotalBytes(), c.MaxTotalBytes)
+	lowest, err = log.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(20), lowest)
+}
@@ -0,0 +1,120 @@
+package log
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+
+	api "github.com/burmudar/prolog/api/v1"
+)
+
+var ErrCloneUnsupported = fmt.Errorf("only logs with file backed segments can be cloned")
+
+// Clone copies the log into dstDir and opens a new log over the copy, which comes in handy as a fixture in tests. The
+// log keeps serving reads while it is copied, but appends wait until the copy is done. The clone is independent of the
+// log, appending to one doesn't affect the other
+func (l *Log) Clone(dstDir string) (*Log, error) {
+	if l.Config.Segment.NewStore != nil || l.Config.Segment.NewIndex != nil {
+		return nil, ErrCloneUnsupported
+	}
+
+	if err := l.copyTo(dstDir); err != nil {
+		return nil, err
+	}
+	return NewLog(dstDir, l.Config)
+}
+
+func (l *Log) copyTo(dstDir string) error {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if l.closed {
+		return api.ErrClosed{}
+	}
+	if err := makeDir(dstDir, l.Config); err != nil {
+		return err
+	}
+
+	for _, s := range l.segments {
+		release, err := l.open.acquire(s)
+		if err != nil {
+			return err
+		}
+		err = s.copyTo(dstDir)
+		release()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// segmentFile is one of the files a copy of a segment is made up of, with its contents in r
+type segmentFile struct {
+	name string
+	size int64
+	r    io.Reader
+}
+
+// files returns the files of a copy of the segment: its store, index and header. The index is copied entry by entry,
+// since the file of an open index is padded out to MaxIndexBytes. The time index is left behind, it is rebuilt when the
+// copy is opened. The copies are in the current format, whatever format the segment's own files are in, apart from the
+// store's records, which are copied as they are. A store whose records are in bare frames gets the header of the last
+// version that held them
+func (s *segment) files() ([]segmentFile, error) {
+	p := make([]byte, indexHeaderWidth+s.index.Size())
+	copy(p, formatHeader(indexMagic, indexHeaderWidth))
+	entries := p[indexHeaderWidth:]
+	for i := uint64(0); i < s.index.Size()/entWidth; i++ {
+		out, pos, err := s.index.Read(int64(i))
+		if err != nil {
+			return nil, err
+		}
+		enc.PutUint32(entries[i*entWidth:], out)
+		enc.PutUint64(entries[i*entWidth+offWidth:], pos)
+	}
+
+	size := s.store.Size()
+	version := formatVersion
+	if s.layout.bare {
+		version = framedFormatVersion - 1
+	}
+	header := segmentHeader{codec: s.codec, indexInterval: s.indexInterval}.bytes()
+	return []segmentFile{
+		{name: segmentFileName(s.baseOffset, headerExt), size: int64(len(header)), r: bytes.NewReader(header)},
+		{
+			name: segmentFileName(s.baseOffset, storeExt),
+			size: int64(storeHeaderWidth + size),
+			r: io.MultiReader(
+				bytes.NewReader(formatHeaderVersion(storeMagic, storeHeaderWidth, version)),
+				io.NewSectionReader(s.store, 0, int64(size)),
+			),
+		},
+		{name: segmentFileName(s.baseOffset, indexExt), size: int64(len(p)), r: bytes.NewReader(p)},
+	}, nil
+}
+
+// copyTo copies the segment's files, see files, into dir
+func (s *segment) copyTo(dir string) error {
+	files, err := s.files()
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		f, err := openLogFile(path.Join(dir, file.name), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, s.config)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(f, file.r); err != nil {
+			f.Close()
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package log
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	api "github.com/burmudar/prolog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogClone(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-clone-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 128
+	log, err := NewLog(filepath.Join(dir, "original"), c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	n := 10
+	for i := 0; i < n; i++ {
+		_, err := log.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+	require.Greater(t, len(log.segments), 1)
+
+	clone, err := log.Clone(filepath.Join(dir, "clone"))
+	require.NoError(t, err)
+	defer clone.Close()
+
+	for i := 0; i < n; i++ {
+		want, err := log.Read(uint64(i))
+		require.NoError(t, err)
+		got, err := clone.Read(uint64(i))
+		require.NoError(t, err)
+		require.Equal(t, want.Value, got.Value)
+		require.Equal(t, want.Timestamp, got.Timestamp)
+	}
+
+	// appends to either log leave the other alone
+	off, err := clone.Append(&api.Record{Value: []byte("clone")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(n), off)
+	off, err = log.Append(&api.Record{Value: []byte("original")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(n), off)
+
+	record, err := clone.Read(uint64(n))
+	require.NoError(t, err)
+	require.Equal(t, []byte("clone"), record.Value)
+	record, err = log.Read(uint64(n))
+	require.NoError(t, err)
+	require.Equal(t, []byte("original"), record.Value)
+
+	c.Segment.NewStore = NewMemoryStore
+	memory, err := NewLog(filepath.Join(dir, "memory"), c)
+	require.NoError(t, err)
+	_, err = memory.Clone(filepath.Join(dir, "memory-clone"))
+	require.Equal(t, ErrCloneUnsupported, err)
+}
@@ -0,0 +1,184 @@
+package log
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	api "github.com/burmudar/prolog/api/v1"
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+var (
+	ErrUnknownRecordCodec = fmt.Errorf("unknown record codec")
+	ErrDeleteUnsupported  = fmt.Errorf("record codec doesn't support deleting records")
+)
+
+// RecordCodec turns records into the bytes kept in a segment's store and back. The codec's name is recorded in the
+// header of every segment written with it, so that the segment is read with the same codec even after the log has
+// been configured with another one
+type RecordCodec interface {
+	Name() string
+	Marshal(record *api.Record) ([]byte, error)
+	Unmarshal(p []byte, record *api.Record) error
+}
+
+// tombstoner is implemented by codecs that can encode a deleted record into exactly size bytes, which is what Delete
+// needs to replace a record in place
+type tombstoner interface {
+	Tombstone(record *api.Record, size int) ([]byte, error)
+}
+
+var (
+	// ProtoCodec stores records as protobuf, which is how segments without a header are stored
+	ProtoCodec RecordCodec = protoCodec{}
+	// JSONCodec stores records in the protobuf JSON mapping
+	JSONCodec RecordCodec = jsonCodec{}
+	// MsgpackCodec stores records as a MessagePack map keyed by the protobuf field names. Records stored with it
+	// can't be deleted
+	MsgpackCodec RecordCodec = msgpackCodec{}
+)
+
+var recordCodecs = map[string]RecordCodec{
+	ProtoCodec.Name():   ProtoCodec,
+	JSONCodec.Name():    JSONCodec,
+	MsgpackCodec.Name(): MsgpackCodec,
+}
+
+type protoCodec struct{}
+
+func (protoCodec) Name() string {
+	return "proto"
+}
+
+func (protoCodec) Marshal(record *api.Record) ([]byte, error) {
+	return proto.Marshal(record)
+}
+
+func (protoCodec) Unmarshal(p []byte, record *api.Record) error {
+	return proto.Unmarshal(p, record)
+}
+
+func (protoCodec) Tombstone(record *api.Record, size int) ([]byte, error) {
+	return encodeTombstone(record, size)
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string {
+	return "json"
+}
+
+func (jsonCodec) Marshal(record *api.Record) ([]byte, error) {
+	return protojson.Marshal(record)
+}
+
+func (jsonCodec) Unmarshal(p []byte, record *api.Record) error {
+	return protojson.Unmarshal(p, record)
+}
+
+// Tombstone pads the deleted record with trailing spaces, which JSON ignores
+func (jsonCodec) Tombstone(record *api.Record, size int) ([]byte, error) {
+	p, err := protojson.Marshal(&api.Record{Offset: record.Offset, Timestamp: record.Timestamp, Deleted: true})
+	if err != nil {
+		return nil, err
+	}
+	if len(p) > size {
+		return nil, ErrNothingToDelete
+	}
+
+	return append(p, bytes.Repeat([]byte(" "), size-len(p))...), nil
+}
+
+// segmentHeader is what the "<baseOffset>.header" file of a segment says about how the segment is stored. The file
+// holds the name of the codec the records are stored with, followed by encryptedMarker when they're encrypted and by
+// indexIntervalMarker and the interval when the index has an entry for fewer than every record
+type segmentHeader struct {
+	codec     RecordCodec
+	encrypted bool
+	// indexInterval is how many records apart the entries in the segment's index are
+	indexInterval uint64
+}
+
+// indexIntervalMarker is followed by the segment's index interval in the header of segments with sparse indexes
+const indexIntervalMarker = "\nindex-interval "
+
+// configSegmentHeader is the header of a new segment of a log configured with c
+func configSegmentHeader(c Config) segmentHeader {
+	h := segmentHeader{codec: c.Codec, encrypted: c.AEAD != nil, indexInterval: c.Segment.IndexInterval}
+	if h.codec == nil {
+		h.codec = ProtoCodec
+	}
+	if h.indexInterval == 0 {
+		h.indexInterval = 1
+	}
+	return h
+}
+
+// bytes is the header as it is written to the segment's header file
+func (h segmentHeader) bytes() []byte {
+	header := h.codec.Name()
+	if h.encrypted {
+		header += encryptedMarker
+	}
+	if h.indexInterval > 1 {
+		header += indexIntervalMarker + strconv.FormatUint(h.indexInterval, 10)
+	}
+	return []byte(header)
+}
+
+// readSegmentHeader reads the header of the segment starting at baseOffset. Empty segments get the header of a new
+// segment of a log configured with c. Segments from before headers existed are left without one, since they're always
+// stored as plain protobuf with an entry in the index for every record
+func readSegmentHeader(dir string, baseOffset uint64, c Config, empty bool) (segmentHeader, error) {
+	h := configSegmentHeader(c)
+	name := segmentFilePath(dir, baseOffset, headerExt)
+	if empty && c.ReadOnly {
+		return h, nil
+	}
+	if empty {
+		return h, writeFile(name, h.bytes(), c)
+	}
+
+	p, err := ioutil.ReadFile(name)
+	switch {
+	case os.IsNotExist(err):
+		return segmentHeader{codec: ProtoCodec, indexInterval: 1}, nil
+	case err != nil:
+		return segmentHeader{}, err
+	}
+
+	header := string(p)
+	h.indexInterval = 1
+	if i := strings.Index(header, indexIntervalMarker); i >= 0 {
+		interval, err := strconv.ParseUint(header[i+len(indexIntervalMarker):], 10, 64)
+		if err != nil || interval == 0 {
+			return segmentHeader{}, fmt.Errorf("%s has a malformed index interval", name)
+		}
+		header, h.indexInterval = header[:i], interval
+	}
+	codecName := strings.TrimSuffix(header, encryptedMarker)
+	h.encrypted = len(codecName) < len(header)
+	if codecName == h.codec.Name() {
+		return h, nil
+	}
+	codec, ok := recordCodecs[codecName]
+	if !ok {
+		return segmentHeader{}, ErrUnknownRecordCodec
+	}
+	h.codec = codec
+	return h, nil
+}
+
+// removeSegmentHeader removes the header of the segment starting at baseOffset, if it has one
+func removeSegmentHeader(dir string, baseOffset uint64) error {
+	err := os.Remove(segmentFilePath(dir, baseOffset, headerExt))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package log
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	api "github.com/burmudar/prolog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecordCodecs(t *testing.T) {
+	for _, codec := range []RecordCodec{ProtoCodec, JSONCodec, MsgpackCodec} {
+		t.Run(codec.Name(), func(t *testing.T) {
+			for _, want := range []*api.Record{
+				{},
+				{Value: []byte("hello world"), Offset: 42, Timestamp: 1600000000000000000},
+				{
+					Value:            make([]byte, 70000),
+					Offset:           1 << 40,
+					Timestamp:        -5,
+					CompressionCodec: api.CompressionCodec_COMPRESSION_GZIP,
+				},
+				{Offset: 7, Deleted: true},
+			} {
+				p, err := codec.Marshal(want)
+				require.NoError(t, err)
+
+				got := &api.Record{}
+				require.NoError(t, codec.Unmarshal(p, got))
+				require.Equal(t, want.Value, got.Value)
+				require.Equal(t, want.Offset, got.Offset)
+				require.Equal(t, want.Timestamp, got.Timestamp)
+				require.Equal(t, want.CompressionCodec, got.CompressionCodec)
+				require.Equal(t, want.Deleted, got.Deleted)
+			}
+		})
+	}
+}
+
+func TestLogCodec(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-codec-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// every segment holds a single record, so each codec ends up with a segment of its own
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth
+	codecs := []RecordCodec{ProtoCodec, JSONCodec, MsgpackCodec}
+	for i, codec := range codecs {
+		c.Codec = codec
+		log, err := NewLog(dir, c)
+		require.NoError(t, err)
+
+		off, err := log.Append(&api.Record{Value: []byte(codec.Name())})
+		require.NoError(t, err)
+		require.Equal(t, uint64(i), off)
+		require.NoError(t, log.Close())
+
+		p, err := ioutil.ReadFile(filepath.Join(dir, "0.header"))
+		require.NoError(t, err)
+		require.Equal(t, "proto", string(p))
+	}
+
+	// the records are read with the codec their segment was written with, whatever the log is configured with now
+	c.Codec = JSONCodec
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	for i, codec := range codecs {
+		record, err := log.Read(uint64(i))
+		require.NoError(t, err)
+		require.Equal(t, []byte(codec.Name()), record.Value)
+	}
+
+	require.NoError(t, log.Delete(1))
+	record, err := log.Read(1)
+	require.NoError(t, err)
+	require.True(t, record.Deleted)
+	require.Equal(t, ErrDeleteUnsupported, log.Delete(2))
+}
+
+func TestLogUnknownCodec(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-codec-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "0.header"), []byte("avro"), 0644))
+	// a segment written with a codec we don't know of
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "0.store"), []byte{0, 0, 0, 0, 0, 0, 0, 1, 0}, 0644))
+
+	_, err = NewLog(dir, Config{})
+	require.Equal(t, ErrUnknownRecordCodec, err)
+}
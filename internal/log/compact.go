@@ -0,0 +1,195 @@
+package log
+
+import (
+	"fmt"
+
+	api "github.com/burmudar/prolog/api/v1"
+)
+
+var ErrSegmentActive = fmt.Errorf("the active segment can't be compacted")
+
+// CompactSegment compacts the sealed segment starting at baseOffset on its own, which lets retention work through a log
+// a segment at a time. Of the records in the segment with the same key only the last one is kept, the others are
+// deleted as with Delete so that the offsets of the records after them don't change. keyFn is given records with their
+// values decompressed and records for which it returns nil are kept. Keys are only compared within the segment
+func (l *Log) CompactSegment(baseOffset uint64, keyFn func(*api.Record) []byte) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return api.ErrClosed{}
+	}
+	if l.Config.ReadOnly {
+		return ErrReadOnly
+	}
+
+	seg, err := l.sealedSegment(baseOffset)
+	if err != nil {
+		return err
+	}
+
+	release, err := l.open.acquire(seg)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	return seg.compact(keyFn)
+}
+
+// sealedSegment returns the sealed segment starting at baseOffset. The caller is expected to hold the lock
+func (l *Log) sealedSegment(baseOffset uint64) (*segment, error) {
+	for _, s := range l.segments {
+		if s.baseOffset != baseOffset {
+			continue
+		}
+		if s == l.activeSegment {
+			return nil, ErrSegmentActive
+		}
+		return s, nil
+	}
+	return nil, ErrSegmentNotFound
+}
+
+// compact deletes the records of the segment that are superseded by a later record with the same key
+func (s *segment) compact(keyFn func(*api.Record) []byte) error {
+	superseded, _, err := s.superseded(keyFn)
+	if err != nil {
+		return err
+	}
+
+	for _, off := range superseded {
+		// records without a value take up nothing worth reclaiming
+		if err := s.Delete(off); err != nil && err != ErrNothingToDelete {
+			return err
+		}
+	}
+	return nil
+}
+
+// superseded returns the offsets of the records in the segment that are superseded by a later record with the same
+// key, along with how many bytes of the store would be reclaimed by rewriting those records, and the ones deleted
+// already, as tombstones that are no longer than they need to be
+func (s *segment) superseded(keyFn func(*api.Record) []byte) ([]uint64, uint64, error) {
+	var superseded []uint64
+	var dirty uint64
+	// latest is the offset of the last record seen with each key, and reclaimable how many bytes rewriting each record
+	// as a tombstone would reclaim
+	latest := map[string]uint64{}
+	reclaimable := map[uint64]uint64{}
+	for pos := uint64(0); pos < s.store.Size(); {
+		record, next, err := s.readAt(pos)
+		if err != nil {
+			return nil, 0, err
+		}
+		size := next - pos
+		pos = next
+
+		n, err := s.tombstoneSize(record)
+		if err != nil {
+			return nil, 0, err
+		}
+		if size < n {
+			n = size
+		}
+		if record.Deleted {
+			dirty += size - n
+			continue
+		}
+		reclaimable[record.Offset] = size - n
+
+		if record.Value, err = Decompress(record); err != nil {
+			return nil, 0, err
+		}
+		record.CompressionCodec = api.CompressionCodec_COMPRESSION_NONE
+
+		key := keyFn(record)
+		if key == nil {
+			continue
+		}
+		if prev, ok := latest[string(key)]; ok {
+			superseded = append(superseded, prev)
+			dirty += reclaimable[prev]
+		}
+		latest[string(key)] = record.Offset
+	}
+	return superseded, dirty, nil
+}
+
+// tombstoneSize is roughly the number of bytes the smallest tombstone for record takes up in the store. How much
+// padding an aligned record needs depends on where it ends up, so it is rounded up to the alignment
+func (s *segment) tombstoneSize(record *api.Record) (uint64, error) {
+	p, err := s.codec.Marshal(tombstoneOf(record))
+	if err != nil {
+		return 0, err
+	}
+	n := s.frameSize(uint64(len(p)))
+	if a := s.config.Segment.Alignment; a > 0 && s.codec == ProtoCodec {
+		n = (n + a - 1) / a * a
+	}
+	return n, nil
+}
+
+// tombstoneOf returns the smallest tombstone for record, which only keeps its offset and timestamp
+func tombstoneOf(record *api.Record) *api.Record {
+	return &api.Record{Offset: record.Offset, Timestamp: record.Timestamp, Deleted: true}
+}
+
+// NextAvailable returns the smallest offset at or after off that still has a record, which lets consumers holding on to
+// offsets of records that have since been compacted away carry on from the next record that survived. Offsets that
+// were skipped, truncated or deleted, which is what compaction does to the records it removes, don't count as
+// available. It fails with api.ErrOffsetOutOfRange when there are no records left at or after off
+func (l *Log) NextAvailable(off uint64) (uint64, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if l.closed {
+		return 0, api.ErrClosed{}
+	}
+
+	for _, seg := range l.segments {
+		if seg.nextOffset <= off {
+			continue
+		}
+		if off < seg.baseOffset {
+			off = seg.baseOffset
+		}
+
+		found, err := l.nextAvailableIn(seg, off)
+		if err != nil {
+			return 0, err
+		}
+		if found < seg.nextOffset {
+			return found, nil
+		}
+		off = seg.nextOffset
+	}
+
+	return 0, api.ErrOffsetOutOfRange{Offset: off}
+}
+
+// nextAvailableIn returns the first offset from off on in the segment that has a record which wasn't deleted, or the
+// segment's next offset when there is none
+func (l *Log) nextAvailableIn(seg *segment, off uint64) (uint64, error) {
+	release, err := l.open.acquire(seg)
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+
+	record := &api.Record{}
+	for ; off < seg.nextOffset; off++ {
+		err := seg.readInto(off, record)
+		if _, ok := err.(api.ErrOffsetOutOfRange); ok {
+			// offsets can be skipped
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		if !record.Deleted {
+			break
+		}
+	}
+	return off, nil
+}
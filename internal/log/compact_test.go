@@ -0,0 +1,91 @@
+package log
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	api "github.com/burmudar/prolog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogCompactSegment(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-compact-segment-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 5
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	// records are "key=value", and the first segment has a key that is overwritten twice and one that isn't
+	values := []string{"a=1", "b=1", "a=2", "c", "a=3", "b=2", "a=4"}
+	for _, v := range values {
+		_, err := log.Append(&api.Record{Value: []byte(v)})
+		require.NoError(t, err)
+	}
+	require.Len(t, log.segments, 2)
+
+	keyFn := func(record *api.Record) []byte {
+		i := bytes.IndexByte(record.Value, '=')
+		if i < 0 {
+			return nil
+		}
+		return record.Value[:i]
+	}
+	require.NoError(t, log.CompactSegment(0, keyFn))
+
+	deleted := map[uint64]bool{0: true, 2: true}
+	for off, v := range values {
+		record, err := log.Read(uint64(off))
+		require.NoError(t, err)
+		require.Equal(t, uint64(off), record.Offset)
+		if deleted[uint64(off)] {
+			require.True(t, record.Deleted)
+			require.Empty(t, record.Value)
+			continue
+		}
+		// keys are only compared within the segment, so b=1 outlives b=2 in the next segment
+		require.False(t, record.Deleted)
+		require.Equal(t, []byte(v), record.Value)
+	}
+
+	// compacting again finds nothing left to do
+	require.NoError(t, log.CompactSegment(0, keyFn))
+
+	require.Equal(t, ErrSegmentActive, log.CompactSegment(log.activeSegment.baseOffset, keyFn))
+	require.Equal(t, ErrSegmentNotFound, log.CompactSegment(1, keyFn))
+}
+
+func TestLogNextAvailable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-next-available-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{AllowOffsetGaps: true}
+	c.Segment.MaxIndexBytes = entWidth * 3
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	// offsets 2 to 4 are skipped and 5, 6 and 8 are compacted away below
+	for _, off := range []uint64{0, 1, 5, 6, 7, 8, 9} {
+		require.NoError(t, log.AppendAt(&api.Record{Value: []byte(fmt.Sprintf("record %d", off))}, off))
+	}
+	for _, off := range []uint64{5, 6, 8} {
+		require.NoError(t, log.Delete(off))
+	}
+
+	for off, want := range map[uint64]uint64{0: 0, 1: 1, 2: 7, 3: 7, 5: 7, 7: 7, 8: 9, 9: 9} {
+		got, err := log.NextAvailable(off)
+		require.NoError(t, err)
+		require.Equal(t, want, got, "next available from %d", off)
+	}
+
+	_, err = log.NextAvailable(10)
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: 10}, err)
+}
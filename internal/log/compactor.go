@@ -0,0 +1,163 @@
+package log
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	api "github.com/burmudar/prolog/api/v1"
+)
+
+const defaultDirtyRatioThreshold = 0.5
+
+var ErrCompactionKeyMissing = fmt.Errorf("scheduled compaction needs a CompactionKey")
+
+// compactor runs the compactions scheduled by Config.CompactionInterval. stop is closed by Close, after which the
+// compactor finishes the segment it is compacting, if any, and closes done
+type compactor struct {
+	once sync.Once
+	stop chan struct{}
+	done chan struct{}
+}
+
+// startCompactor starts compacting the log every Config.CompactionInterval. Nothing is scheduled when it is zero
+func (l *Log) startCompactor() {
+	if l.Config.CompactionInterval <= 0 || l.Config.ReadOnly {
+		return
+	}
+
+	l.compactor = &compactor{
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	go l.runCompactor(l.compactor)
+}
+
+// runCompactor compacts the dirty segments of the log every interval until c is stopped
+func (l *Log) runCompactor(c *compactor) {
+	defer close(c.done)
+
+	ticker := time.NewTicker(l.Config.CompactionInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			l.compactDirty(c.stop)
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+// stopCompactor stops the scheduled compactions and waits for the one that is running, if any. It must be called
+// without holding the log's lock, which compactions need
+func (l *Log) stopCompactor() {
+	c := l.compactor
+	if c == nil {
+		return
+	}
+
+	c.once.Do(func() { close(c.stop) })
+	<-c.done
+}
+
+// compactDirty compacts the sealed segments whose ratio of reclaimable bytes is at least Config.DirtyRatioThreshold,
+// one at a time, so that appends and reads only wait for one segment at a time. It gives up as soon as stop is closed
+func (l *Log) compactDirty(stop <-chan struct{}) {
+	l.mu.RLock()
+	if l.closed {
+		l.mu.RUnlock()
+		return
+	}
+	var baseOffsets []uint64
+	for _, s := range l.segments {
+		if s != l.activeSegment {
+			baseOffsets = append(baseOffsets, s.baseOffset)
+		}
+	}
+	l.mu.RUnlock()
+
+	o, observed := l.Config.Observer.(CompactionObserver)
+	for _, baseOffset := range baseOffsets {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		records, reclaimed, err := l.compactIfDirty(baseOffset)
+		if !observed {
+			continue
+		}
+		if err != nil {
+			o.CompactionFailed(baseOffset, err)
+		} else if records > 0 || reclaimed > 0 {
+			o.SegmentCompacted(baseOffset, records, reclaimed)
+		}
+	}
+}
+
+// compactIfDirty compacts the sealed segment starting at baseOffset if enough of it is reclaimable, and returns the
+// number of superseded records it deleted along with the number of bytes its store and index shrank by. Segments that
+// retention removed, or that became the active segment through Truncate, since the round started are skipped
+func (l *Log) compactIfDirty(baseOffset uint64) (int, uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return 0, 0, nil
+	}
+	seg, err := l.sealedSegment(baseOffset)
+	if err == ErrSegmentNotFound || err == ErrSegmentActive {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// rewriting the segment replaces its files, so nobody may be reading it
+	release, err := l.open.lock(seg)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer release()
+
+	superseded, dirty, err := seg.superseded(l.Config.CompactionKey)
+	if err != nil {
+		return 0, 0, err
+	}
+	threshold := l.Config.DirtyRatioThreshold
+	if threshold <= 0 {
+		threshold = defaultDirtyRatioThreshold
+	}
+	if seg.store.Size() == 0 || float64(dirty)/float64(seg.store.Size()) < threshold {
+		return 0, 0, nil
+	}
+
+	before := seg.store.Size() + seg.index.Size()
+	if err := seg.compact(l.Config.CompactionKey); err != nil {
+		return 0, 0, err
+	}
+	// tombstones are as long as the records they replace, so the space is only reclaimed by rewriting the segment.
+	// Segments kept by a custom NewStore can't be rewritten
+	if l.Config.Segment.NewStore == nil {
+		if err := seg.rewrite(shrinkTombstone); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	var reclaimed uint64
+	if after := seg.store.Size() + seg.index.Size(); after < before {
+		reclaimed = before - after
+	}
+	return len(superseded), reclaimed, nil
+}
+
+// shrinkTombstone replaces deleted records by the smallest tombstone for them when a segment is rewritten
+func shrinkTombstone(record *api.Record) *api.Record {
+	if record.Deleted {
+		return tombstoneOf(record)
+	}
+	return record
+}
@@ -0,0 +1,204 @@
+package log
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	api "github.com/burmudar/prolog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+// compactionObserver keeps track of the segments compacted in the background
+type compactionObserver struct {
+	nopObserver
+	mu        sync.Mutex
+	compacted map[uint64]int
+	reclaimed uint64
+	failed    []error
+}
+
+func (o *compactionObserver) SegmentCompacted(baseOffset uint64, records int, reclaimedBytes uint64) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.compacted[baseOffset] += records
+	o.reclaimed += reclaimedBytes
+}
+
+func (o *compactionObserver) CompactionFailed(baseOffset uint64, err error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.failed = append(o.failed, err)
+}
+
+func keyBeforeEquals(record *api.Record) []byte {
+	i := bytes.IndexByte(record.Value, '=')
+	if i < 0 {
+		return nil
+	}
+	return record.Value[:i]
+}
+
+func TestLogScheduledCompaction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-scheduled-compaction-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	o := &compactionObserver{compacted: map[uint64]int{}}
+	c := Config{
+		Observer:           o,
+		CompactionInterval: 10 * time.Millisecond,
+		CompactionKey:      keyBeforeEquals,
+	}
+	c.Segment.MaxIndexBytes = entWidth * 5
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	// the first segment has a key that is overwritten four times, the second one only has keys of their own, and
+	// the active segment overwrites its key but is never compacted
+	value := strings.Repeat("x", 100)
+	values := []string{"a=" + value, "a=" + value, "a=" + value, "a=" + value, "a=" + value, "b=1", "c=1", "d=1",
+		"e=1", "f=1", "g=" + value, "g=" + value}
+	for _, v := range values {
+		_, err := log.Append(&api.Record{Value: []byte(v)})
+		require.NoError(t, err)
+	}
+	require.Len(t, log.segments, 3)
+
+	storeSize := func() uint64 {
+		log.mu.RLock()
+		defer log.mu.RUnlock()
+		return log.segments[0].store.Size()
+	}
+
+	require.Eventually(t, func() bool {
+		o.mu.Lock()
+		defer o.mu.Unlock()
+		return o.compacted[0] > 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	o.mu.Lock()
+	require.Equal(t, map[uint64]int{0: 4}, o.compacted)
+	require.Greater(t, o.reclaimed, uint64(0))
+	require.Empty(t, o.failed)
+	o.mu.Unlock()
+	// five records with long values went in, and all but one of them are down to short tombstones
+	require.Less(t, storeSize(), uint64(3*len(value)))
+
+	for off, v := range values {
+		record, err := log.Read(uint64(off))
+		require.NoError(t, err)
+		require.Equal(t, uint64(off), record.Offset)
+		if off < 4 {
+			require.True(t, record.Deleted)
+			continue
+		}
+		require.False(t, record.Deleted)
+		require.Equal(t, []byte(v), record.Value)
+	}
+
+	// the log carries on appending to the active segment as before
+	off, err := log.Append(&api.Record{Value: []byte("h=1")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(len(values)), off)
+}
+
+func TestLogCompactIfDirty(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T, log *Log){
+		"segment below the threshold is left alone": func(t *testing.T, log *Log) {
+			for _, v := range []string{"a=1", "b=1", "c=1", "a=2", "d=1", "e=1"} {
+				_, err := log.Append(&api.Record{Value: []byte(v)})
+				require.NoError(t, err)
+			}
+
+			records, reclaimed, err := log.compactIfDirty(0)
+			require.NoError(t, err)
+			require.Equal(t, 0, records)
+			require.Equal(t, uint64(0), reclaimed)
+
+			record, err := log.Read(0)
+			require.NoError(t, err)
+			require.False(t, record.Deleted)
+		},
+		"segments removed by retention are skipped": func(t *testing.T, log *Log) {
+			for _, v := range []string{"a=1", "a=2", "a=3", "a=4", "a=5", "b=1"} {
+				_, err := log.Append(&api.Record{Value: []byte(v)})
+				require.NoError(t, err)
+			}
+			require.NoError(t, log.Truncate(4))
+
+			records, _, err := log.compactIfDirty(0)
+			require.NoError(t, err)
+			require.Equal(t, 0, records)
+		},
+		"the active segment is never compacted": func(t *testing.T, log *Log) {
+			for _, v := range []string{"a=1", "a=2", "a=3"} {
+				_, err := log.Append(&api.Record{Value: []byte(v)})
+				require.NoError(t, err)
+			}
+
+			records, _, err := log.compactIfDirty(0)
+			require.NoError(t, err)
+			require.Equal(t, 0, records)
+		},
+		"deleted records are reclaimed once": func(t *testing.T, log *Log) {
+			for _, v := range []string{"a=1", "b=1", "c=1", "d=1", "e=1", "f=1"} {
+				_, err := log.Append(&api.Record{Value: []byte(v + strings.Repeat("x", 100))})
+				require.NoError(t, err)
+			}
+			for off := uint64(0); off < 4; off++ {
+				require.NoError(t, log.Delete(off))
+			}
+
+			// nothing is superseded, but the tombstones are as long as the records were
+			records, reclaimed, err := log.compactIfDirty(0)
+			require.NoError(t, err)
+			require.Equal(t, 0, records)
+			require.Greater(t, reclaimed, uint64(0))
+
+			_, dirty, err := log.segments[0].superseded(keyBeforeEquals)
+			require.NoError(t, err)
+			require.Equal(t, uint64(0), dirty)
+
+			records, reclaimed, err = log.compactIfDirty(0)
+			require.NoError(t, err)
+			require.Equal(t, 0, records)
+			require.Equal(t, uint64(0), reclaimed)
+
+			record, err := log.Read(0)
+			require.NoError(t, err)
+			require.True(t, record.Deleted)
+			record, err = log.Read(4)
+			require.NoError(t, err)
+			require.Equal(t, []byte("e=1"+strings.Repeat("x", 100)), record.Value)
+		},
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "log-compact-if-dirty-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			c := Config{CompactionKey: keyBeforeEquals}
+			c.Segment.MaxIndexBytes = entWidth * 5
+			log, err := NewLog(dir, c)
+			require.NoError(t, err)
+			defer log.Close()
+
+			fn(t, log)
+		})
+	}
+}
+
+func TestNewLogCompactionKeyMissing(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-compaction-key-missing-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	_, err = NewLog(dir, Config{CompactionInterval: time.Second})
+	require.Equal(t, ErrCompactionKeyMissing, err)
+}
@@ -0,0 +1,55 @@
+package log
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+
+	api "github.com/burmudar/prolog/api/v1"
+)
+
+var ErrUnknownCompressionCodec = fmt.Errorf("unknown compression codec")
+
+// compress compresses the record's value with the codec, unless the value has already been compressed
+func compress(record *api.Record, codec api.CompressionCodec) error {
+	if codec == api.CompressionCodec_COMPRESSION_NONE ||
+		record.CompressionCodec != api.CompressionCodec_COMPRESSION_NONE {
+		return nil
+	}
+
+	switch codec {
+	case api.CompressionCodec_COMPRESSION_GZIP:
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(record.Value); err != nil {
+			return err
+		}
+		if err := w.Close(); err != nil {
+			return err
+		}
+		record.Value = buf.Bytes()
+	default:
+		return ErrUnknownCompressionCodec
+	}
+
+	record.CompressionCodec = codec
+	return nil
+}
+
+// Decompress returns the record's value decompressed with the record's codec
+func Decompress(record *api.Record) ([]byte, error) {
+	switch record.CompressionCodec {
+	case api.CompressionCodec_COMPRESSION_NONE:
+		return record.Value, nil
+	case api.CompressionCodec_COMPRESSION_GZIP:
+		r, err := gzip.NewReader(bytes.NewReader(record.Value))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return ioutil.ReadAll(r)
+	default:
+		return nil, ErrUnknownCompressionCodec
+	}
+}
@@ -0,0 +1,62 @@
+package log
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	api "github.com/burmudar/prolog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogCompression(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-compression-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{Compression: api.CompressionCodec_COMPRESSION_GZIP}
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	value := bytes.Repeat([]byte("hello world "), 32)
+
+	// the producer compressed this value already, so it has to be stored exactly as it was produced
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	_, err = w.Write(value)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	precompressed := append([]byte{}, buf.Bytes()...)
+
+	off, err := log.Append(&api.Record{
+		Value:            buf.Bytes(),
+		CompressionCodec: api.CompressionCodec_COMPRESSION_GZIP,
+	})
+	require.NoError(t, err)
+
+	record, err := log.Read(off)
+	require.NoError(t, err)
+	require.Equal(t, api.CompressionCodec_COMPRESSION_GZIP, record.CompressionCodec)
+	require.Equal(t, precompressed, record.Value)
+	got, err := Decompress(record)
+	require.NoError(t, err)
+	require.Equal(t, value, got)
+
+	// this one gets compressed by the log
+	off, err = log.Append(&api.Record{Value: value})
+	require.NoError(t, err)
+
+	record, err = log.Read(off)
+	require.NoError(t, err)
+	require.Equal(t, api.CompressionCodec_COMPRESSION_GZIP, record.CompressionCodec)
+	require.Less(t, len(record.Value), len(value))
+	got, err = Decompress(record)
+	require.NoError(t, err)
+	require.Equal(t, value, got)
+
+	_, err = Decompress(&api.Record{CompressionCodec: 42})
+	require.Equal(t, ErrUnknownCompressionCodec, err)
+}
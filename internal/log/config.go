@@ -1,9 +1,157 @@
 package log
 
+import (
+	"crypto/cipher"
+	"os"
+	"time"
+
+	api "github.com/burmudar/prolog/api/v1"
+)
+
+// NewStoreFn creates the store backend for the segment starting at baseOffset
+type NewStoreFn func(dir string, baseOffset uint64, c Config) (StoreBackend, error)
+
+// NewIndexFn creates the index backend for the segment starting at baseOffset
+type NewIndexFn func(dir string, baseOffset uint64, c Config) (IndexBackend, error)
+
+// OffsetAllocator hands out the offsets of appended records. Offsets may skip ahead, for instance by a stride in sharded
+// setups, but every offset has to be higher than the one before it
+type OffsetAllocator interface {
+	Next() uint64
+}
+
+// OffsetReleaser can be implemented by an OffsetAllocator to take back an offset it handed out when appending the
+// record with it failed, so that the offset isn't lost. The next offset it hands out after Release should be off again.
+// Next is only called once a record is about to be written, so appends that are refused before then don't use up an
+// offset either way
+type OffsetReleaser interface {
+	Release(off uint64)
+}
+
+// Clock tells the log the time, which is used to timestamp records and to expire segments
+type Clock interface {
+	Now() time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
 type Config struct {
-	Segment struct {
+	// Manifest makes the log keep track of its segments in a manifest file instead of finding them by scanning its
+	// directory. The directory is still scanned when there's no manifest yet
+	Manifest bool
+	// Observer is told whenever segments are rolled or removed. Nothing is observed when it is nil
+	Observer Observer
+	// MaxOpenSegments limits how many segments, the active one included, are kept open. Sealed segments that haven't
+	// been read recently are closed and reopened when they're read again. All segments stay open when it is zero.
+	// Segments kept in memory by a custom NewStore are never closed, since they wouldn't survive being reopened
+	MaxOpenSegments int
+	// Compression is the codec values are compressed with when they're appended. Values that the producer compressed
+	// already are kept as they are. Records are read back compressed, use Decompress to get at their values
+	Compression api.CompressionCodec
+	// OffsetAllocator assigns the offsets of appended records. Offsets are sequential when it is nil
+	OffsetAllocator OffsetAllocator
+	// AllowOffsetGaps lets AppendAt skip ahead of the next offset, which followers need when the leader has compacted
+	// records away. Reading a skipped offset fails with ErrCompacted
+	AllowOffsetGaps bool
+	// TrackPageFaults tells the Observer, if it is a PageFaultObserver, how many page faults each read caused. Counting
+	// them takes a system call before and after every read. Only Linux supports it, elsewhere NewLog fails with
+	// ErrPageFaultsUnsupported
+	TrackPageFaults bool
+	// Clock is what the log tells the time with. Defaults to the system clock
+	Clock Clock
+	// FileMode and DirMode are the permissions the log's files and directory are created with, regardless of the
+	// process' umask. They default to 0644 and 0755, which are subject to the umask
+	FileMode os.FileMode
+	DirMode  os.FileMode
+	// Codec is what records are stored with in new segments. Existing segments keep the codec they were written with.
+	// Defaults to ProtoCodec
+	Codec RecordCodec
+	// AllowOversizedRecords lets records that are bigger than MaxStoreBytes by themselves be appended, each to a
+	// segment that is over its limit straight away. Appending them fails with ErrRecordTooLarge otherwise
+	AllowOversizedRecords bool
+	// SyncOnAppend syncs the log after every append, so that records are durable by the time Append returns. Use
+	// AppendContext to bound how long an append waits for a slow disk
+	SyncOnAppend bool
+	// BreakerThreshold is how many appends in a row have to fail writing to storage before the log stops trying, failing
+	// appends with api.ErrLogUnavailable straight away for BreakerCooldown. After that appends are tried again, and
+	// the first one to fail stops the log again. Appends are always tried when it is zero
+	BreakerThreshold int
+	// BreakerCooldown defaults to 30 seconds
+	BreakerCooldown time.Duration
+	// CheckOnOpen runs CheckConsistency when the log is opened, which then fails to open when it finds a problem
+	CheckOnOpen bool
+	// MaxTotalBytes caps the bytes taken up by the stores and indexes of all of the log's segments. Appends that would
+	// take the log over it remove the oldest segments first, the active one included if need be. Appending a record
+	// that doesn't fit even in an empty log fails with ErrDiskFull. The log isn't capped when it is zero
+	MaxTotalBytes uint64
+	// ManualRoll leaves rolling segments to the caller, for instance to line rolls up with checkpoints kept elsewhere.
+	// Segments aren't rolled when they're full or have expired, and appends to a full segment fail with ErrSegmentFull
+	// until Rotate is called. Rotate is the only way a new segment is started
+	ManualRoll bool
+	// AEAD encrypts the records of new segments at rest, for instance with a key handed out by a KMS. Every record is
+	// sealed with a random nonce that is stored along with it. Existing segments stay encrypted, or not, as they were
+	// written, and reading an encrypted segment without an AEAD fails with ErrEncrypted. Records aren't encrypted
+	// when it is nil
+	AEAD cipher.AEAD
+	// IOSyncRetries is how many times syncing, flushing and shrinking the segments' files is retried when it fails,
+	// which rides out spurious failures like interrupted system calls. The first retry waits a millisecond, and every
+	// one after it twice as long as the one before. Nothing is retried when it is zero
+	IOSyncRetries int
+	// ConcurrentSealedReads lets the records of sealed segments, which don't change anymore, be read side by side
+	// instead of one read at a time, so that a consumer catching up on a lot of records doesn't starve the others.
+	// Segments are flushed as they're sealed, which leaves only reads of the active segment waiting for appends
+	ConcurrentSealedReads bool
+	// AsyncQueueSize is how many records AppendAsync queues before it blocks. Defaults to 256
+	AsyncQueueSize int
+	// CompactionInterval is how often the log looks for sealed segments worth compacting, which are compacted as with
+	// CompactSegment and then rewritten to reclaim the space of the records that were deleted. The active segment is
+	// never compacted. Nothing is compacted in the background when it is zero
+	CompactionInterval time.Duration
+	// DirtyRatioThreshold is the share of a sealed segment's store that has to be reclaimable, from superseded and
+	// deleted records, for the segment to be compacted. Defaults to 0.5
+	DirtyRatioThreshold float64
+	// CompactionKey returns the key of a record for scheduled compaction, see CompactSegment. It has to be set along
+	// with CompactionInterval
+	CompactionKey func(*api.Record) []byte
+	// FaultInjector makes the segments' stores fail on purpose, for testing. Nothing fails when it is nil
+	FaultInjector *FaultInjector
+	// ReadOnly opens the log without ever writing to its directory, for tools that mustn't change a log that is in
+	// use. Files are opened and mapped read only, and everything that would change the log fails with ErrReadOnly.
+	// A log without any segments is opened with an empty segment that only lives in memory
+	ReadOnly bool
+	Segment  struct {
 		MaxStoreBytes uint64
 		MaxIndexBytes uint64
 		InitialOffset uint64
+		// MaxAge is how long records are appended to a segment before a new one is rolled, measured from the segment's
+		// first record. Segments don't expire when it is zero
+		MaxAge time.Duration
+		// TimeIndexInterval is how many records apart entries in the time index are. Defaults to 16
+		TimeIndexInterval uint64
+		// IndexChecksum protects the index with a checksum that is written when the index is closed and verified when
+		// it is opened again
+		IndexChecksum bool
+		// IndexInterval is how many records apart the entries in the index are. Reads for records without an entry
+		// scan the store from the closest entry before them, so a bigger interval trades read speed for a smaller
+		// index. Defaults to 1, an entry for every record. Segments in the default file backed store keep the interval
+		// they were created with in their header, so changing it only changes the segments created after
+		IndexInterval uint64
+		// FlushThreshold is how many bytes of appended records the store buffers before flushing them to its file,
+		// which spreads the cost of flushing over appends instead of leaving it all to the next read. Records are
+		// only flushed when they're read or the store is closed when it is zero
+		FlushThreshold uint64
+		// Alignment pads records so that every record starts at a multiple of it in the store, for storage that is
+		// faster at aligned writes. The padding is a field that isn't part of Record, which readers skip, so a log can
+		// be read whatever its alignment. Only records stored with ProtoCodec are padded. Records aren't padded when
+		// it is zero
+		Alignment uint64
+		// NewStore and NewIndex allow the storage used by segments to be swapped out. When they're nil the file
+		// backed store and index are used
+		NewStore NewStoreFn
+		NewIndex NewIndexFn
 	}
 }
@@ -0,0 +1,71 @@
+package log
+
+import (
+	"fmt"
+
+	api "github.com/burmudar/prolog/api/v1"
+)
+
+// ErrInconsistentSegment is returned by CheckConsistency when a segment's index and store don't hold the same number of
+// records, which is what a write torn between the two leaves behind
+type ErrInconsistentSegment struct {
+	BaseOffset   uint64
+	IndexEntries uint64
+	StoreRecords uint64
+}
+
+func (e ErrInconsistentSegment) Error() string {
+	return fmt.Sprintf(
+		"segment %d has %d index entries but %d records in its store",
+		e.BaseOffset, e.IndexEntries, e.StoreRecords,
+	)
+}
+
+// CheckConsistency makes sure that every segment's index has an entry for each of the records in its store. Every
+// store is scanned from start to end, so it takes a while for big logs
+func (l *Log) CheckConsistency() error {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if l.closed {
+		return api.ErrClosed{}
+	}
+	return l.checkConsistency()
+}
+
+func (l *Log) checkConsistency() error {
+	for _, s := range l.segments {
+		release, err := l.open.acquire(s)
+		if err != nil {
+			return err
+		}
+		err = s.checkConsistency()
+		release()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkConsistency compares the number of entries in the index with the number of records in the store, of which every
+// IndexInterval-th has an entry. A record cut short at the end of the store isn't counted, since it can't be read
+// anyway
+func (s *segment) checkConsistency() error {
+	var records uint64
+	for pos := uint64(0); pos < s.store.Size(); records++ {
+		p, err := s.store.Read(pos)
+		if _, ok := err.(ErrTruncatedRecord); ok {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		pos += s.frameSize(uint64(len(p)))
+	}
+
+	if entries := s.index.Size() / entWidth; entries != (records+s.indexInterval-1)/s.indexInterval {
+		return ErrInconsistentSegment{BaseOffset: s.baseOffset, IndexEntries: entries, StoreRecords: records}
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package log
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	api "github.com/burmudar/prolog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogCheckConsistency(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-consistency-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{CheckOnOpen: true}
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.NoError(t, log.CheckConsistency())
+	require.NoError(t, log.Close())
+
+	// a record that made it into the store without making it into the index, like when the log crashes halfway
+	// through an append
+	f, err := os.OpenFile(filepath.Join(dir, "0.store"), os.O_RDWR|os.O_APPEND, 0)
+	require.NoError(t, err)
+	s, err := newStore(f)
+	require.NoError(t, err)
+	_, _, err = s.Append([]byte("torn"))
+	require.NoError(t, err)
+	require.NoError(t, s.Close())
+
+	want := ErrInconsistentSegment{BaseOffset: 0, IndexEntries: 3, StoreRecords: 4}
+	_, err = NewLog(dir, c)
+	require.Equal(t, want, err)
+
+	log, err = NewLog(dir, Config{})
+	require.NoError(t, err)
+	defer log.Close()
+	require.Equal(t, want, log.CheckConsistency())
+}
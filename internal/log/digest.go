@@ -0,0 +1,57 @@
+package log
+
+import (
+	"crypto/sha256"
+
+	api "github.com/burmudar/prolog/api/v1"
+	"github.com/golang/protobuf/proto"
+)
+
+// digestBatch is how many records Digest reads at a time
+const digestBatch = 256
+
+// Digest returns a SHA-256 hash of the records in [start, end), in offset order, which replicas can compare to check
+// that they hold the same records. Records are hashed as they're read, so how the records are spread over segments,
+// their alignment and the like don't affect the digest. Offsets without a record are left out. Ranges that reach past
+// the log's highest offset fail with api.ErrOffsetOutOfRange
+func (l *Log) Digest(start, end uint64) ([]byte, error) {
+	if end < start {
+		return nil, api.ErrOffsetOutOfRange{Offset: end}
+	}
+	if end > l.PeekNextOffset() {
+		return nil, api.ErrOffsetOutOfRange{Offset: end - 1}
+	}
+
+	h := sha256.New()
+	size := make([]byte, recordLenWidth)
+	for off := start; off < end; {
+		max := end - off
+		if max > digestBatch {
+			max = digestBatch
+		}
+		records, next, err := l.ReadBatch(off, int(max))
+		if err != nil {
+			return nil, err
+		}
+		if len(records) == 0 {
+			break
+		}
+
+		for _, record := range records {
+			if record.Offset >= end {
+				break
+			}
+			p, err := proto.Marshal(record)
+			if err != nil {
+				return nil, err
+			}
+			// every record is length prefixed, so that the same bytes split up differently hash differently
+			enc.PutUint64(size, uint64(len(p)))
+			h.Write(size)
+			h.Write(p)
+		}
+		off = next
+	}
+
+	return h.Sum(nil), nil
+}
@@ -0,0 +1,77 @@
+package log
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	api "github.com/burmudar/prolog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogDigest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-digest-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 128
+	log, err := NewLog(filepath.Join(dir, "original"), c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	n := uint64(10)
+	for i := uint64(0); i < n; i++ {
+		_, err := log.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+
+	clone, err := log.Clone(filepath.Join(dir, "clone"))
+	require.NoError(t, err)
+	defer clone.Close()
+
+	// the same records spread over segments of a different size
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.Alignment = 64
+	copied, err := NewLog(filepath.Join(dir, "copy"), c)
+	require.NoError(t, err)
+	defer copied.Close()
+	_, err = log.CopyRange(copied, 0, n)
+	require.NoError(t, err)
+	require.NotEqual(t, log.SegmentCount(), copied.SegmentCount())
+
+	want, err := log.Digest(0, n)
+	require.NoError(t, err)
+	require.Len(t, want, 32)
+	for _, l := range []*Log{clone, copied} {
+		got, err := l.Digest(0, n)
+		require.NoError(t, err)
+		require.Equal(t, want, got)
+	}
+
+	part, err := log.Digest(2, 5)
+	require.NoError(t, err)
+	require.NotEqual(t, want, part)
+	got, err := clone.Digest(2, 5)
+	require.NoError(t, err)
+	require.Equal(t, part, got)
+
+	// changing a record changes the digest of every range it is in
+	require.NoError(t, clone.Delete(3))
+	got, err = clone.Digest(0, n)
+	require.NoError(t, err)
+	require.NotEqual(t, want, got)
+	got, err = clone.Digest(2, 5)
+	require.NoError(t, err)
+	require.NotEqual(t, part, got)
+	got, err = clone.Digest(4, n)
+	require.NoError(t, err)
+	wantTail, err := log.Digest(4, n)
+	require.NoError(t, err)
+	require.Equal(t, wantTail, got)
+
+	_, err = log.Digest(0, n+1)
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: n}, err)
+}
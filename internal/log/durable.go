@@ -0,0 +1,122 @@
+package log
+
+import (
+	"context"
+
+	api "github.com/burmudar/prolog/api/v1"
+)
+
+// Sync flushes every record appended so far to storage and wakes up everyone waiting in WaitDurable for them
+func (l *Log) Sync() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return api.ErrClosed{}
+	}
+
+	for _, s := range l.segments {
+		if s.nextOffset <= l.durable || s.nextOffset == s.baseOffset {
+			continue
+		}
+
+		release, err := l.open.acquire(s)
+		if err != nil {
+			return err
+		}
+		err = s.Sync()
+		release()
+		if err != nil {
+			return err
+		}
+	}
+
+	l.notifyDurable(l.activeSegment.nextOffset)
+	return nil
+}
+
+// Flush writes the records buffered by the log's stores to their files, which makes them visible to anyone reading
+// the files directly. It is cheaper than Sync because it doesn't wait for the records to reach the disk, so flushed
+// records can still be lost when the machine crashes, and WaitDurable isn't woken up
+func (l *Log) Flush() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return api.ErrClosed{}
+	}
+
+	for _, s := range l.segments {
+		// closed segments flushed their stores when they were closed
+		if s.closed {
+			continue
+		}
+		if err := retryIO(l.Config.IOSyncRetries, s.store.Flush); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AppendContext appends the record like Append, but gives up waiting for the sync SyncOnAppend asks for once the
+// context is done. The context's error is returned along with the record's offset in that case: the record has been
+// appended and the sync carries on in the background, so WaitDurable can be used to find out when it completes
+func (l *Log) AppendContext(ctx context.Context, record *api.Record) (uint64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	off, err := l.append(record)
+	if err != nil || !l.Config.SyncOnAppend {
+		return off, err
+	}
+
+	synced := make(chan error, 1)
+	go func() {
+		synced <- l.Sync()
+	}()
+
+	select {
+	case err := <-synced:
+		return off, err
+	case <-ctx.Done():
+		return off, ctx.Err()
+	}
+}
+
+// WaitDurable blocks until the record at the given offset has been synced to storage by Sync, the context is done or
+// the log is closed
+func (l *Log) WaitDurable(ctx context.Context, offset uint64) error {
+	for {
+		l.durableMu.Lock()
+		durable, ch := l.durable, l.durableCh
+		l.durableMu.Unlock()
+
+		if offset < durable {
+			return nil
+		}
+
+		l.mu.RLock()
+		closed := l.closed
+		l.mu.RUnlock()
+		if closed {
+			return api.ErrClosed{}
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ch:
+		}
+	}
+}
+
+// notifyDurable records that everything before next is durable and wakes up the waiters
+func (l *Log) notifyDurable(next uint64) {
+	l.durableMu.Lock()
+	defer l.durableMu.Unlock()
+
+	l.durable = next
+	close(l.durableCh)
+	l.durableCh = make(chan struct{})
+}
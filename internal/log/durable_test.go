@@ -0,0 +1,149 @@
+package log
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	api "github.com/burmudar/prolog/api/v1"
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogWaitDurable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-durable-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 64
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+
+	var off uint64
+	for i := 0; i < 3; i++ {
+		off, err = log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- log.WaitDurable(context.Background(), off)
+	}()
+
+	select {
+	case err := <-done:
+		t.Fatalf("WaitDurable returned before the log was synced: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	require.NoError(t, log.Sync())
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("WaitDurable didn't return after the log was synced")
+	}
+
+	// already durable offsets return straight away
+	require.NoError(t, log.WaitDurable(context.Background(), 0))
+
+	off, err = log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	require.Equal(t, context.DeadlineExceeded, log.WaitDurable(ctx, off))
+
+	go func() {
+		done <- log.WaitDurable(context.Background(), off)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	require.NoError(t, log.Close())
+	require.Equal(t, api.ErrClosed{}, <-done)
+}
+
+func TestLogFlush(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-flush-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	log, err := NewLog(dir, Config{})
+	require.NoError(t, err)
+	defer log.Close()
+
+	record := &api.Record{Value: []byte("hello world")}
+	_, err = log.Append(record)
+	require.NoError(t, err)
+
+	name := filepath.Join(dir, "0.store")
+	p, err := ioutil.ReadFile(name)
+	require.NoError(t, err)
+	require.Equal(t, storeHeaderWidth, uint64(len(p)))
+
+	require.NoError(t, log.Flush())
+
+	// the record is read through a handle of our own, without the log having synced the file
+	p, err = ioutil.ReadFile(name)
+	require.NoError(t, err)
+	r := bytes.NewReader(p[storeHeaderWidth:])
+	f, err := DecodeFrame(r)
+	require.NoError(t, err)
+	require.Zero(t, r.Len())
+
+	var read api.Record
+	require.NoError(t, proto.Unmarshal(f.Payload, &read))
+	require.Equal(t, record.Value, read.Value)
+}
+
+// slowStore takes delay to sync
+type slowStore struct {
+	StoreBackend
+	delay time.Duration
+}
+
+func (s *slowStore) Sync() error {
+	time.Sleep(s.delay)
+	return s.StoreBackend.Sync()
+}
+
+func TestLogAppendContext(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-append-context-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	delay := 200 * time.Millisecond
+	c := Config{SyncOnAppend: true}
+	c.Segment.NewStore = func(dir string, baseOffset uint64, c Config) (StoreBackend, error) {
+		s, err := NewMemoryStore(dir, baseOffset, c)
+		return &slowStore{StoreBackend: s, delay: delay}, err
+	}
+	c.Segment.NewIndex = NewMemoryIndex
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	off, err := log.AppendContext(ctx, &api.Record{Value: []byte("hello world")})
+	require.Equal(t, context.DeadlineExceeded, err)
+	require.Less(t, time.Since(start), delay)
+
+	// the record was appended and becomes durable once the sync in the background is done
+	record, err := log.Read(off)
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello world"), record.Value)
+	require.NoError(t, log.WaitDurable(context.Background(), off))
+
+	// without a deadline the append waits for the sync
+	start = time.Now()
+	off, err = log.AppendContext(context.Background(), &api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), off)
+	require.GreaterOrEqual(t, time.Since(start), delay)
+}
@@ -0,0 +1,103 @@
+package log
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"fmt"
+	"io"
+)
+
+var ErrEncrypted = fmt.Errorf("segment is encrypted and the log has no AEAD to decrypt it with")
+
+// encryptedMarker follows the codec's name in the header of segments whose records are encrypted
+const encryptedMarker = "\nencrypted"
+
+// encryptedStore seals every record with an AEAD before it reaches the store underneath, and opens it again when it is
+// read. Each record gets a random nonce of its own, which goes ahead of the sealed record in its frame:
+//
+//	[ frame header ][ nonce ][ sealed record, tag included ][ crc ]
+//
+// Sealing adds the same number of bytes to every record, so a record rewritten with one of the same length, as Delete
+// does, still fits in its place. Raw reads with ReadAt see the sealed bytes. Without an AEAD every record read or
+// written fails with ErrEncrypted
+type encryptedStore struct {
+	StoreBackend
+	aead cipher.AEAD
+}
+
+var _ sealedReader = (*encryptedStore)(nil)
+
+// sealError is returned when a record can't be sealed, which happens before anything is written to the store
+type sealError struct {
+	err error
+}
+
+func (e sealError) Error() string {
+	return fmt.Sprintf("failed to seal record: %v", e.err)
+}
+
+// encryptStore encrypts the records in s with aead, which may be nil for a log that doesn't have the key
+func encryptStore(s StoreBackend, aead cipher.AEAD) StoreBackend {
+	return &encryptedStore{StoreBackend: s, aead: aead}
+}
+
+// encryptionOverhead is how many bytes aead adds to every record
+func encryptionOverhead(aead cipher.AEAD) uint64 {
+	return uint64(aead.NonceSize() + aead.Overhead())
+}
+
+func (s *encryptedStore) Append(p []byte) (uint64, uint64, error) {
+	sealed, err := s.seal(p)
+	if err != nil {
+		return 0, 0, err
+	}
+	return s.StoreBackend.Append(sealed)
+}
+
+func (s *encryptedStore) Read(pos uint64) ([]byte, error) {
+	return s.read(pos, s.StoreBackend.Read)
+}
+
+func (s *encryptedStore) ReadSealed(pos uint64) ([]byte, error) {
+	return s.read(pos, func(pos uint64) ([]byte, error) {
+		return readSealed(s.StoreBackend, pos)
+	})
+}
+
+// read opens the record at pos, which is read from the store underneath with read
+func (s *encryptedStore) read(pos uint64, read func(uint64) ([]byte, error)) ([]byte, error) {
+	if s.aead == nil {
+		return nil, ErrEncrypted
+	}
+
+	p, err := read(pos)
+	if err != nil {
+		return nil, err
+	}
+	n := s.aead.NonceSize()
+	if len(p) < n {
+		return nil, fmt.Errorf("encrypted record at position %d is too short", pos)
+	}
+	return s.aead.Open(nil, p[:n], p[n:], nil)
+}
+
+func (s *encryptedStore) Rewrite(pos uint64, p []byte) error {
+	sealed, err := s.seal(p)
+	if err != nil {
+		return err
+	}
+	return s.StoreBackend.Rewrite(pos, sealed)
+}
+
+// seal returns p sealed with a new nonce, which it starts with
+func (s *encryptedStore) seal(p []byte) ([]byte, error) {
+	if s.aead == nil {
+		return nil, ErrEncrypted
+	}
+
+	nonce := make([]byte, s.aead.NonceSize(), s.aead.NonceSize()+len(p)+s.aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, sealError{err: err}
+	}
+	return s.aead.Seal(nonce, nonce, p, nil), nil
+}
@@ -0,0 +1,109 @@
+package log
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	api "github.com/burmudar/prolog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestAEAD(t *testing.T, key byte) cipher.AEAD {
+	block, err := aes.NewCipher(bytes.Repeat([]byte{key}, 32))
+	require.NoError(t, err)
+	aead, err := cipher.NewGCM(block)
+	require.NoError(t, err)
+	return aead
+}
+
+func TestLogEncryption(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-encryption-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	secret := []byte("the plaintext nobody should find on disk")
+	c := Config{AEAD: newTestAEAD(t, 1)}
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+
+	for i := 0; i < 3; i++ {
+		off, err := log.Append(&api.Record{Value: secret})
+		require.NoError(t, err)
+		require.Equal(t, uint64(i), off)
+	}
+	for i := 0; i < 3; i++ {
+		record, err := log.Read(uint64(i))
+		require.NoError(t, err)
+		require.Equal(t, secret, record.Value)
+	}
+
+	// deleting rewrites the record in place, sealed with a nonce of its own
+	require.NoError(t, log.Delete(1))
+	meta, err := log.ReadMeta(2)
+	require.NoError(t, err)
+	require.Equal(t, uint64(len(secret)), meta.Size)
+	require.NoError(t, log.Close())
+
+	p, err := ioutil.ReadFile(segmentFilePath(dir, 0, storeExt))
+	require.NoError(t, err)
+	require.NotEmpty(t, p)
+	require.False(t, bytes.Contains(p, secret))
+
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	record, err := log.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, secret, record.Value)
+	record, err = log.Read(1)
+	require.NoError(t, err)
+	require.True(t, record.Deleted)
+	require.NoError(t, log.Close())
+
+	// without the key the segment still opens, but its records can't be read or appended to
+	log, err = NewLog(dir, Config{})
+	require.NoError(t, err)
+	_, err = log.Read(0)
+	require.Equal(t, ErrEncrypted, err)
+	_, err = log.Append(&api.Record{Value: secret})
+	require.Equal(t, ErrEncrypted, err)
+	require.NoError(t, log.Close())
+
+	// a different key fails to open the records, which the log already does to find out when the segment was created
+	_, err = NewLog(dir, Config{AEAD: newTestAEAD(t, 2)})
+	require.Error(t, err)
+}
+
+func TestLogEncryptionExistingSegments(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-encryption-existing-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	_, err = log.Append(&api.Record{Value: []byte("plain")})
+	require.NoError(t, err)
+	require.NoError(t, log.Close())
+
+	// segments that were written without encryption stay readable, and only new ones are encrypted
+	c.AEAD = newTestAEAD(t, 1)
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	_, err = log.Append(&api.Record{Value: []byte("sealed")})
+	require.NoError(t, err)
+	require.NoError(t, log.Close())
+
+	log, err = NewLog(dir, Config{})
+	require.NoError(t, err)
+	defer log.Close()
+	record, err := log.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("plain"), record.Value)
+	_, err = log.Read(1)
+	require.Equal(t, ErrEncrypted, err)
+}
@@ -0,0 +1,195 @@
+package log
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	api "github.com/burmudar/prolog/api/v1"
+	"github.com/golang/protobuf/proto"
+)
+
+// ExportFormat is how records are encoded when exported from a log
+type ExportFormat int
+
+const (
+	// ExportNDJSON writes one JSON object per line containing the record's offset, timestamp and value. The value is
+	// base64 encoded
+	ExportNDJSON ExportFormat = iota
+	// ExportBinary writes each record's protobuf encoding in a Frame, the same way records are kept in a store
+	ExportBinary
+)
+
+// exportFlushEvery is how many records are buffered before they're flushed to the writer
+const exportFlushEvery = 64
+
+var ErrUnknownExportFormat = fmt.Errorf("unknown export format")
+
+// ErrImportOffset is returned by Import when it preserves offsets and comes across a record that doesn't directly
+// follow the previous one
+type ErrImportOffset struct {
+	Want, Got uint64
+}
+
+func (e ErrImportOffset) Error() string {
+	if e.Got > e.Want {
+		return fmt.Sprintf("gap in imported offsets: want %d, got %d", e.Want, e.Got)
+	}
+	return fmt.Sprintf("imported offsets out of order: want %d, got %d", e.Want, e.Got)
+}
+
+// exportRecord is the shape of every line in an NDJSON export
+type exportRecord struct {
+	Offset           uint64               `json:"offset"`
+	Timestamp        int64                `json:"timestamp"`
+	Value            []byte               `json:"value"`
+	CompressionCodec api.CompressionCodec `json:"compression_codec,omitempty"`
+}
+
+// Export writes every record from the given offset up to the end of the log, as it is when Export is called, to w.
+// Records are buffered and flushed every so often, as well as when the export is done. The export stops with the
+// context's error once it is cancelled. Offsets without a record are passed over, and so are corrupt records when
+// opts.SkipCorrupt is set
+func (l *Log) Export(ctx context.Context, from uint64, w io.Writer, format ExportFormat, opts ScanOptions) error {
+	if format != ExportNDJSON && format != ExportBinary {
+		return ErrUnknownExportFormat
+	}
+
+	l.mu.RLock()
+	end := l.activeSegment.nextOffset
+	l.mu.RUnlock()
+
+	buf := bufio.NewWriter(w)
+	for off := from; off < end; off++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		record, err := l.Read(off)
+		if skippedOffset(err) || opts.skipCorrupt(off, err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := encodeExport(buf, record, format); err != nil {
+			return err
+		}
+
+		if (off-from+1)%exportFlushEvery == 0 {
+			if err := buf.Flush(); err != nil {
+				return err
+			}
+		}
+	}
+
+	return buf.Flush()
+}
+
+// Import creates a log in dir from records written by Export. Records imported from NDJSON are assigned sequential
+// offsets as they're appended. Binary exports carry the records' offsets, which are preserved, so the records must be
+// in order without any gaps between them
+func Import(dir string, r io.Reader, format ExportFormat, c Config) (*Log, error) {
+	if format != ExportNDJSON && format != ExportBinary {
+		return nil, ErrUnknownExportFormat
+	}
+
+	l, err := NewLog(dir, c)
+	if err != nil {
+		return nil, err
+	}
+
+	first := true
+	var next uint64
+	err = decodeExport(r, format, func(record *api.Record) error {
+		if format == ExportNDJSON {
+			_, err := l.Append(record)
+			return err
+		}
+
+		if !first && record.Offset != next {
+			return ErrImportOffset{Want: next, Got: record.Offset}
+		}
+		first = false
+		next = record.Offset + 1
+		return l.AppendAt(record, record.Offset)
+	})
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+
+	return l, nil
+}
+
+func encodeExport(w io.Writer, record *api.Record, format ExportFormat) error {
+	switch format {
+	case ExportNDJSON:
+		// Encode terminates every value with a newline, which is exactly what NDJSON needs
+		return json.NewEncoder(w).Encode(exportRecord{
+			Offset:           record.Offset,
+			Timestamp:        record.Timestamp,
+			Value:            record.Value,
+			CompressionCodec: record.CompressionCodec,
+		})
+	case ExportBinary:
+		p, err := proto.Marshal(record)
+		if err != nil {
+			return err
+		}
+		_, err = Frame{Payload: p}.Encode(w)
+		return err
+	default:
+		return ErrUnknownExportFormat
+	}
+}
+
+// decodeExport reads the records written by Export from r, calling fn for every record in the order they were
+// exported
+func decodeExport(r io.Reader, format ExportFormat, fn func(*api.Record) error) error {
+	switch format {
+	case ExportNDJSON:
+		dec := json.NewDecoder(r)
+		for {
+			var e exportRecord
+			if err := dec.Decode(&e); err == io.EOF {
+				return nil
+			} else if err != nil {
+				return err
+			}
+
+			record := &api.Record{
+				Value:            e.Value,
+				Offset:           e.Offset,
+				Timestamp:        e.Timestamp,
+				CompressionCodec: e.CompressionCodec,
+			}
+			if err := fn(record); err != nil {
+				return err
+			}
+		}
+	case ExportBinary:
+		br := bufio.NewReader(r)
+		for {
+			f, err := DecodeFrame(br)
+			if err == io.EOF {
+				return nil
+			} else if err != nil {
+				return err
+			}
+
+			record := &api.Record{}
+			if err := proto.Unmarshal(f.Payload, record); err != nil {
+				return err
+			}
+			if err := fn(record); err != nil {
+				return err
+			}
+		}
+	default:
+		return ErrUnknownExportFormat
+	}
+}
@@ -0,0 +1,143 @@
+package log
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	api "github.com/burmudar/prolog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExport(t *testing.T) {
+	for scenario, format := range map[string]ExportFormat{
+		"ndjson": ExportNDJSON,
+		"binary": ExportBinary,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "export-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			c := Config{}
+			c.Segment.MaxStoreBytes = 128
+			log, err := NewLog(dir, c)
+			require.NoError(t, err)
+
+			for i := 0; i < 10; i++ {
+				_, err := log.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+				require.NoError(t, err)
+			}
+
+			var buf bytes.Buffer
+			require.NoError(t, log.Export(context.Background(), 3, &buf, format, ScanOptions{}))
+			if format == ExportNDJSON {
+				require.Equal(t, 7, strings.Count(buf.String(), "\n"))
+			}
+
+			var got []*api.Record
+			err = decodeExport(&buf, format, func(r *api.Record) error {
+				got = append(got, r)
+				return nil
+			})
+			require.NoError(t, err)
+			require.Len(t, got, 7)
+
+			for i, r := range got {
+				want, err := log.Read(uint64(i + 3))
+				require.NoError(t, err)
+				require.Equal(t, want.Value, r.Value)
+				require.Equal(t, want.Offset, r.Offset)
+				require.Equal(t, want.Timestamp, r.Timestamp)
+			}
+		})
+	}
+}
+
+func TestExportCancelled(t *testing.T) {
+	dir, err := ioutil.TempDir("", "export-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	log, err := NewLog(dir, Config{})
+	require.NoError(t, err)
+	_, err = log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	var buf bytes.Buffer
+	require.Equal(t, context.Canceled, log.Export(ctx, 0, &buf, ExportNDJSON, ScanOptions{}))
+	require.Zero(t, buf.Len())
+}
+
+func TestImport(t *testing.T) {
+	for scenario, format := range map[string]ExportFormat{
+		"ndjson": ExportNDJSON,
+		"binary": ExportBinary,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "import-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			c := Config{}
+			c.Segment.MaxStoreBytes = 128
+			require.NoError(t, os.Mkdir(filepath.Join(dir, "src"), 0755))
+			src, err := NewLog(filepath.Join(dir, "src"), c)
+			require.NoError(t, err)
+
+			for i := 0; i < 10; i++ {
+				_, err := src.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+				require.NoError(t, err)
+			}
+
+			var buf bytes.Buffer
+			require.NoError(t, src.Export(context.Background(), 2, &buf, format, ScanOptions{}))
+
+			dst, err := Import(filepath.Join(dir, "dst"), &buf, format, c)
+			require.NoError(t, err)
+
+			// NDJSON imports start from scratch, binary imports keep the exported offsets
+			start := uint64(0)
+			if format == ExportBinary {
+				start = 2
+			}
+			lowest, err := dst.LowestOffset()
+			require.NoError(t, err)
+			require.Equal(t, start, lowest)
+			highest, err := dst.HighestOffset()
+			require.NoError(t, err)
+			require.Equal(t, start+7, highest)
+
+			for i := uint64(0); i < 8; i++ {
+				want, err := src.Read(i + 2)
+				require.NoError(t, err)
+				got, err := dst.Read(start + i)
+				require.NoError(t, err)
+				require.Equal(t, want.Value, got.Value)
+				require.Equal(t, want.Timestamp, got.Timestamp)
+			}
+		})
+	}
+}
+
+func TestImportOffsetGap(t *testing.T) {
+	dir, err := ioutil.TempDir("", "import-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	var buf bytes.Buffer
+	for _, off := range []uint64{0, 1, 3} {
+		require.NoError(t, encodeExport(&buf, &api.Record{Value: []byte("hello world"), Offset: off}, ExportBinary))
+	}
+
+	_, err = Import(dir, &buf, ExportBinary, Config{})
+	require.Equal(t, ErrImportOffset{Want: 2, Got: 3}, err)
+}
@@ -0,0 +1,126 @@
+package log
+
+import (
+	"fmt"
+	"sync"
+)
+
+var ErrInjectedFault = fmt.Errorf("fault injected by the FaultInjector")
+
+// FaultInjector makes the stores of a log's segments fail on purpose, so that tests can go through the log's error
+// handling and recovery without a failing disk. Write, Read, Flush and Sync are called with how many appends or
+// rewrites, reads, flushes and syncs have been made, this one included, counting from 1 across all of the log's
+// stores. When they return an error the operation fails with it without reaching the store. Operations without a func
+// never fail.
+//
+// Stores with faults injected append records in one go, even the ones appended with AppendReader
+type FaultInjector struct {
+	Write func(n int) error
+	Read  func(n int) error
+	Flush func(n int) error
+	Sync  func(n int) error
+
+	mu      sync.Mutex
+	writes  int
+	reads   int
+	flushes int
+	syncs   int
+}
+
+// FailNth returns a func for a FaultInjector that fails the nth operation with ErrInjectedFault, and only that one
+func FailNth(n int) func(int) error {
+	return func(i int) error {
+		if i == n {
+			return ErrInjectedFault
+		}
+		return nil
+	}
+}
+
+// FailFrom returns a func for a FaultInjector that fails the nth operation and every one after it with
+// ErrInjectedFault
+func FailFrom(n int) func(int) error {
+	return func(i int) error {
+		if i >= n {
+			return ErrInjectedFault
+		}
+		return nil
+	}
+}
+
+// inject counts an operation with count and returns the error fn injects for it, if any
+func (f *FaultInjector) inject(count *int, fn func(int) error) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	*count++
+	if fn == nil {
+		return nil
+	}
+	return fn(*count)
+}
+
+// faultyStore is a store with faults injected into it
+type faultyStore struct {
+	StoreBackend
+	faults *FaultInjector
+}
+
+var _ sealedReader = (*faultyStore)(nil)
+
+// wrap injects the faults into the store. A nil FaultInjector leaves the store as it is
+func (f *FaultInjector) wrap(s StoreBackend) StoreBackend {
+	if f == nil {
+		return s
+	}
+	return &faultyStore{StoreBackend: s, faults: f}
+}
+
+func (s *faultyStore) Append(p []byte) (uint64, uint64, error) {
+	if err := s.faults.inject(&s.faults.writes, s.faults.Write); err != nil {
+		return 0, 0, err
+	}
+	return s.StoreBackend.Append(p)
+}
+
+func (s *faultyStore) Rewrite(pos uint64, p []byte) error {
+	if err := s.faults.inject(&s.faults.writes, s.faults.Write); err != nil {
+		return err
+	}
+	return s.StoreBackend.Rewrite(pos, p)
+}
+
+func (s *faultyStore) Read(pos uint64) ([]byte, error) {
+	if err := s.faults.inject(&s.faults.reads, s.faults.Read); err != nil {
+		return nil, err
+	}
+	return s.StoreBackend.Read(pos)
+}
+
+func (s *faultyStore) ReadSealed(pos uint64) ([]byte, error) {
+	if err := s.faults.inject(&s.faults.reads, s.faults.Read); err != nil {
+		return nil, err
+	}
+	return readSealed(s.StoreBackend, pos)
+}
+
+func (s *faultyStore) ReadAt(p []byte, off int64) (int, error) {
+	if err := s.faults.inject(&s.faults.reads, s.faults.Read); err != nil {
+		return 0, err
+	}
+	return s.StoreBackend.ReadAt(p, off)
+}
+
+func (s *faultyStore) Flush() error {
+	if err := s.faults.inject(&s.faults.flushes, s.faults.Flush); err != nil {
+		return err
+	}
+	return s.StoreBackend.Flush()
+}
+
+func (s *faultyStore) Sync() error {
+	if err := s.faults.inject(&s.faults.syncs, s.faults.Sync); err != nil {
+		return err
+	}
+	return s.StoreBackend.Sync()
+}
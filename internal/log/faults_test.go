@@ -0,0 +1,102 @@
+package log
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	api "github.com/burmudar/prolog/api/v1"
+	"github.com/burmudar/prolog/internal/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogFaultInjector(t *testing.T) {
+	record := func() *api.Record {
+		return &api.Record{Value: []byte("hello world")}
+	}
+
+	for scenario, fn := range map[string]func(t *testing.T, dir string){
+		"a failed append doesn't use up an offset": func(t *testing.T, dir string) {
+			log, err := NewLog(dir, Config{FaultInjector: &FaultInjector{Write: FailNth(2)}})
+			require.NoError(t, err)
+			defer log.Close()
+
+			off, err := log.Append(record())
+			require.NoError(t, err)
+			require.Equal(t, uint64(0), off)
+			_, err = log.Append(record())
+			require.Equal(t, ErrInjectedFault, err)
+			off, err = log.Append(record())
+			require.NoError(t, err)
+			require.Equal(t, uint64(1), off)
+
+			for off := uint64(0); off < 2; off++ {
+				read, err := log.Read(off)
+				require.NoError(t, err)
+				require.Equal(t, record().Value, read.Value)
+			}
+		},
+		"a failed read can be retried": func(t *testing.T, dir string) {
+			log, err := NewLog(dir, Config{FaultInjector: &FaultInjector{Read: FailNth(1)}})
+			require.NoError(t, err)
+			defer log.Close()
+
+			_, err = log.Append(record())
+			require.NoError(t, err)
+			_, err = log.Read(0)
+			require.Equal(t, ErrInjectedFault, err)
+			read, err := log.Read(0)
+			require.NoError(t, err)
+			require.Equal(t, record().Value, read.Value)
+		},
+		"a failed flush can be retried": func(t *testing.T, dir string) {
+			log, err := NewLog(dir, Config{FaultInjector: &FaultInjector{Flush: FailNth(1)}})
+			require.NoError(t, err)
+			defer log.Close()
+
+			_, err = log.Append(record())
+			require.NoError(t, err)
+			require.Equal(t, ErrInjectedFault, log.Flush())
+			require.NoError(t, log.Flush())
+		},
+		"the breaker opens on failing writes and closes once they succeed": func(t *testing.T, dir string) {
+			clock := testutil.NewFakeClock(time.Now())
+			faults := &FaultInjector{Write: func(n int) error {
+				// the first two writes fail, after which the disk recovers
+				if n <= 2 {
+					return ErrInjectedFault
+				}
+				return nil
+			}}
+			log, err := NewLog(dir, Config{
+				Clock:            clock,
+				BreakerThreshold: 2,
+				BreakerCooldown:  time.Minute,
+				FaultInjector:    faults,
+			})
+			require.NoError(t, err)
+			defer log.Close()
+
+			for i := 0; i < 2; i++ {
+				_, err = log.Append(record())
+				require.Equal(t, ErrInjectedFault, err)
+			}
+			_, err = log.Append(record())
+			require.Equal(t, api.ErrLogUnavailable{}, err)
+
+			clock.Advance(time.Minute)
+			off, err := log.Append(record())
+			require.NoError(t, err)
+			require.Equal(t, uint64(0), off)
+		},
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "log-fault-injector-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			fn(t, dir)
+		})
+	}
+}
@@ -0,0 +1,47 @@
+package log
+
+import (
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Every segment is made up of files named after its base offset, one for each part of the segment, told apart by
+// their extension: "<baseOffset>.store", "<baseOffset>.index" and so on. A segment always has a store, the other files
+// may be missing
+const (
+	storeExt     = ".store"
+	indexExt     = ".index"
+	headerExt    = ".header"
+	timeIndexExt = ".tindex"
+	// crcExt is added to the name of the index for the file holding its checksum
+	crcExt = ".crc"
+)
+
+// segmentFileName is the name of the file with the given extension of the segment starting at baseOffset
+func segmentFileName(baseOffset uint64, ext string) string {
+	return strconv.FormatUint(baseOffset, 10) + ext
+}
+
+// segmentFilePath is segmentFileName in dir
+func segmentFilePath(dir string, baseOffset uint64, ext string) string {
+	return path.Join(dir, segmentFileName(baseOffset, ext))
+}
+
+// parseSegmentFileName returns the base offset and extension of a file named by segmentFileName. The third return
+// value is false for any other name, including names that only resemble those of segment files, like "7.store.bak" or
+// "007.store"
+func parseSegmentFileName(name string) (uint64, string, bool) {
+	ext := path.Ext(name)
+	switch ext {
+	case storeExt, indexExt, headerExt, timeIndexExt:
+	default:
+		return 0, "", false
+	}
+
+	off, err := strconv.ParseUint(strings.TrimSuffix(name, ext), 10, 64)
+	if err != nil || segmentFileName(off, ext) != name {
+		return 0, "", false
+	}
+	return off, ext, true
+}
@@ -0,0 +1,83 @@
+package log
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	api "github.com/burmudar/prolog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSegmentFileName(t *testing.T) {
+	for name, want := range map[string]struct {
+		off uint64
+		ext string
+		ok  bool
+	}{
+		"0.store":      {off: 0, ext: storeExt, ok: true},
+		"16.index":     {off: 16, ext: indexExt, ok: true},
+		"16.header":    {off: 16, ext: headerExt, ok: true},
+		"16.tindex":    {off: 16, ext: timeIndexExt, ok: true},
+		"16.index.crc": {},
+		"16.store.bak": {},
+		"016.store":    {},
+		"-1.store":     {},
+		"notes.store":  {},
+		"MANIFEST":     {},
+		".store":       {},
+	} {
+		t.Run(name, func(t *testing.T) {
+			off, ext, ok := parseSegmentFileName(name)
+			require.Equal(t, want.ok, ok)
+			require.Equal(t, want.off, off)
+			require.Equal(t, want.ext, ext)
+		})
+	}
+}
+
+func TestLogDiscoversSegmentsByExtension(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-discovery-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 64
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	for i := 0; i < 6; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	want, err := log.scanBaseOffsets()
+	require.NoError(t, err)
+	require.Greater(t, len(want), 1)
+	next := log.PeekNextOffset()
+	require.NoError(t, log.Close())
+
+	// stray files, which leave an odd number of files in the directory and sort between the segments' files, aren't
+	// taken for segments
+	for _, name := range []string{"1.store.bak", "notes.store", "01.store", "99.index"} {
+		require.NoError(t, ioutil.WriteFile(path.Join(dir, name), []byte("stray"), 0644))
+	}
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	if len(files)%2 == 0 {
+		require.NoError(t, ioutil.WriteFile(path.Join(dir, "README"), []byte("stray"), 0644))
+	}
+
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	got, err := log.scanBaseOffsets()
+	require.NoError(t, err)
+	require.Equal(t, want, got)
+	require.Equal(t, next, log.PeekNextOffset())
+	for off := uint64(0); off < next; off++ {
+		record, err := log.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, []byte("hello world"), record.Value)
+	}
+}
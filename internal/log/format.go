@@ -0,0 +1,66 @@
+package log
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// Store and index files start with a header made up of a magic string followed by the version of the format the file
+// was written in, so that a log written by a newer version isn't misread by an older one:
+//
+//	store: [ "PLGSTR" ][ version - 2 bytes ]
+//	index: [ "PLGIDX" ][ version - 2 bytes ][ padding - 4 bytes ]
+//
+// The index header is padded to the width of an entry, which keeps the entries after it aligned. Files from before
+// there were headers start with a record's length or an index entry instead, neither of which can be mistaken for a
+// header, and are read as version 0. Since version 2, the records in store files are written as frames with a magic,
+// flags and a checksum of their own, see Frame. Files of earlier versions hold bare frames, and keep doing so when
+// appended to.
+const (
+	formatVersion uint16 = 2
+	// framedFormatVersion is the first version whose store files hold frames rather than bare frames
+	framedFormatVersion uint16 = 2
+	formatMagicWidth           = 6
+	storeMagic                 = "PLGSTR"
+	indexMagic                 = "PLGIDX"
+	storeHeaderWidth    uint64 = formatMagicWidth + 2
+)
+
+var indexHeaderWidth = entWidth
+
+// ErrUnsupportedVersion is returned when a file was written in a newer format than this version of the log knows
+type ErrUnsupportedVersion struct {
+	Name    string
+	Version uint16
+}
+
+func (e ErrUnsupportedVersion) Error() string {
+	return fmt.Sprintf("%s has format version %d, the newest supported is %d", e.Name, e.Version, formatVersion)
+}
+
+// formatHeader is the header of a new file with the given magic, padded to width
+func formatHeader(magic string, width uint64) []byte {
+	return formatHeaderVersion(magic, width, formatVersion)
+}
+
+// formatHeaderVersion is formatHeader for a file written in the given version rather than the current one
+func formatHeaderVersion(magic string, width uint64, version uint16) []byte {
+	p := make([]byte, width)
+	copy(p, magic)
+	enc.PutUint16(p[formatMagicWidth:], version)
+	return p
+}
+
+// parseFormatHeader returns the format version of the named file from its first bytes in p. Files without a header
+// are version 0
+func parseFormatHeader(name string, p []byte, magic string) (uint16, error) {
+	if len(p) < formatMagicWidth+2 || !bytes.HasPrefix(p, []byte(magic)) {
+		return 0, nil
+	}
+
+	v := enc.Uint16(p[formatMagicWidth:])
+	if v > formatVersion {
+		return 0, ErrUnsupportedVersion{Name: name, Version: v}
+	}
+	return v, nil
+}
@@ -0,0 +1,127 @@
+package log
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFormatVersion(t *testing.T) {
+	c := Config{}
+	c.Segment.MaxIndexBytes = 1024
+
+	for scenario, fn := range map[string]func(t *testing.T, dir string){
+		"new files are written in the current format": func(t *testing.T, dir string) {
+			s, idx := openStoreIndex(t, dir, c)
+			require.Equal(t, formatVersion, s.FormatVersion())
+			require.Equal(t, formatVersion, idx.FormatVersion())
+
+			_, pos, err := s.Append(write)
+			require.NoError(t, err)
+			require.NoError(t, idx.Write(0, pos))
+			require.NoError(t, s.Close())
+			require.NoError(t, idx.Close())
+
+			s, idx = openStoreIndex(t, dir, c)
+			defer s.Close()
+			defer idx.Close()
+			require.Equal(t, formatVersion, s.FormatVersion())
+			require.Equal(t, formatVersion, idx.FormatVersion())
+			p, err := s.Read(pos)
+			require.NoError(t, err)
+			require.Equal(t, write, p)
+			_, got, err := idx.Read(0)
+			require.NoError(t, err)
+			require.Equal(t, pos, got)
+		},
+		"files from a newer format are rejected": func(t *testing.T, dir string) {
+			s, idx := openStoreIndex(t, dir, c)
+			require.NoError(t, s.Close())
+			require.NoError(t, idx.Close())
+
+			for _, name := range []string{s.Name(), idx.Name()} {
+				p, err := ioutil.ReadFile(name)
+				require.NoError(t, err)
+				enc.PutUint16(p[formatMagicWidth:], formatVersion+1)
+				require.NoError(t, ioutil.WriteFile(name, p, 0600))
+			}
+
+			f, err := os.OpenFile(s.Name(), os.O_RDWR|os.O_APPEND, 0600)
+			require.NoError(t, err)
+			defer f.Close()
+			_, err = newStore(f)
+			require.Equal(t, ErrUnsupportedVersion{Name: s.Name(), Version: formatVersion + 1}, err)
+
+			f, err = os.OpenFile(idx.Name(), os.O_RDWR, 0600)
+			require.NoError(t, err)
+			defer f.Close()
+			_, err = newIndex(f, c)
+			require.Equal(t, ErrUnsupportedVersion{Name: idx.Name(), Version: formatVersion + 1}, err)
+		},
+		"files without a header are version 0": func(t *testing.T, dir string) {
+			// a record and an entry pointing at it, the way they were written before files had headers
+			record := append(bareFrames.header(uint64(len(write))), write...)
+			require.NoError(t, ioutil.WriteFile(dir+"/0.store", record, 0600))
+			require.NoError(t, ioutil.WriteFile(dir+"/0.index", make([]byte, entWidth), 0600))
+
+			s, idx := openStoreIndex(t, dir, c)
+			defer s.Close()
+			defer idx.Close()
+			require.Equal(t, uint16(0), s.FormatVersion())
+			require.Equal(t, uint16(0), idx.FormatVersion())
+			p, err := s.Read(0)
+			require.NoError(t, err)
+			require.Equal(t, write, p)
+			_, pos, err := idx.Read(-1)
+			require.NoError(t, err)
+			require.Equal(t, uint64(0), pos)
+		},
+		"stores from before version 2 keep bare frames": func(t *testing.T, dir string) {
+			header := formatHeaderVersion(storeMagic, storeHeaderWidth, framedFormatVersion-1)
+			record := append(bareFrames.header(uint64(len(write))), write...)
+			require.NoError(t, ioutil.WriteFile(dir+"/0.store", append(header, record...), 0600))
+
+			s, idx := openStoreIndex(t, dir, c)
+			defer idx.Close()
+			require.Equal(t, framedFormatVersion-1, s.FormatVersion())
+			n, pos, err := s.Append(write)
+			require.NoError(t, err)
+			require.Equal(t, uint64(len(record)), n)
+			require.Equal(t, uint64(len(record)), pos)
+			require.NoError(t, s.Close())
+
+			p, err := ioutil.ReadFile(s.Name())
+			require.NoError(t, err)
+			require.Equal(t, append(append(header, record...), record...), p)
+
+			b, err := newFileStore(dir, 0, c)
+			require.NoError(t, err)
+			defer b.Close()
+			for _, pos := range []uint64{0, pos} {
+				p, err := b.Read(pos)
+				require.NoError(t, err)
+				require.Equal(t, write, p)
+			}
+		},
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "format-version-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			fn(t, dir)
+		})
+	}
+}
+
+func openStoreIndex(t *testing.T, dir string, c Config) (*store, *index) {
+	t.Helper()
+
+	s, err := newFileStore(dir, 0, c)
+	require.NoError(t, err)
+	idx, err := newFileIndex(dir, 0, c)
+	require.NoError(t, err)
+	return s.(*store), idx.(*index)
+}
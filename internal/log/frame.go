@@ -0,0 +1,299 @@
+package log
+
+import (
+	"bytes"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+
+	api "github.com/burmudar/prolog/api/v1"
+)
+
+const (
+	// FrameVersion is the version of the frame layout that frames are written in
+	FrameVersion uint8 = 1
+	// FrameHeaderWidth is the number of bytes in front of a frame's payload: its magic, version, flags and length
+	FrameHeaderWidth = frameMagicWidth + 2 + recordLenWidth
+	// FrameTrailerWidth is the number of bytes after a frame's payload, which hold its checksum
+	FrameTrailerWidth = 4
+
+	frameMagic      = "\xfbL"
+	frameMagicWidth = 2
+	// maxFrameOverhead is the most bytes a frame takes up on top of its payload, whichever way it is laid out
+	maxFrameOverhead = FrameHeaderWidth + FrameTrailerWidth
+)
+
+// maxFramePrealloc is how much of a frame's payload DecodeFrame allocates up front. Bigger payloads are read in chunks,
+// so that a corrupt length can't make it allocate more than the frame turns out to hold
+const maxFramePrealloc = 1 << 20
+
+// FrameFlags say how the payload of a frame is to be read
+type FrameFlags uint8
+
+const (
+	// FrameEncrypted is set on frames whose payload is a record sealed with Config.AEAD, preceded by its nonce
+	FrameEncrypted FrameFlags = 1 << iota
+	// FrameJSON is set on frames whose payload is a record encoded with JSONCodec rather than protobuf
+	FrameJSON
+	// FrameMsgpack is set on frames whose payload is a record encoded with MsgpackCodec rather than protobuf
+	FrameMsgpack
+
+	// knownFrameFlags are the flags this version of the log knows how to read payloads with
+	knownFrameFlags = FrameEncrypted | FrameJSON | FrameMsgpack
+)
+
+// ErrUnsupportedFrame is returned for frames written in a newer version of the layout than this version of the log
+// knows, or with flags it doesn't know, either of which means that the payload can't be read the way it was meant to
+type ErrUnsupportedFrame struct {
+	Version uint8
+	Flags   FrameFlags
+}
+
+func (e ErrUnsupportedFrame) Error() string {
+	return fmt.Sprintf("frame has version %d and flags %08b, the newest supported is version %d with flags %08b",
+		e.Version, e.Flags, FrameVersion, knownFrameFlags)
+}
+
+// Frame is a record's payload as the log writes it out, in store files as well as in binary exports:
+//
+//	[ magic - 2 bytes ][ version - 1 byte ][ flags - 1 byte ][ length - 8 bytes ][ payload ][ crc - 4 bytes ]
+//
+// The length of the payload is big endian, as is the crc, a CRC32 (IEEE) of everything in the frame before it, which
+// DecodeFrame checks. Store files from before format version 2 hold bare frames instead, which are only the length
+// followed by the payload. A bare frame would have to be longer than any frame can be to start with the magic, so
+// DecodeFrame tells them apart and reads either. In segments encrypted with Config.AEAD the payload is the sealed
+// record, preceded by its nonce
+type Frame struct {
+	Flags   FrameFlags
+	Payload []byte
+}
+
+// Size is the number of bytes the frame takes up once encoded
+func (f Frame) Size() uint64 {
+	return maxFrameOverhead + uint64(len(f.Payload))
+}
+
+// Encode writes the frame to w and returns the number of bytes written
+func (f Frame) Encode(w io.Writer) (int, error) {
+	layout := frameLayout{flags: f.Flags}
+	header := layout.header(uint64(len(f.Payload)))
+	n, err := w.Write(header)
+	if err != nil {
+		return n, err
+	}
+	m, err := w.Write(f.Payload)
+	n += m
+	if err != nil {
+		return n, err
+	}
+	m, err = w.Write(layout.trailer(frameChecksum(header, f.Payload)))
+	return n + m, err
+}
+
+// AppendTo appends the encoded frame to p and returns the extended slice
+func (f Frame) AppendTo(p []byte) []byte {
+	layout := frameLayout{flags: f.Flags}
+	header := layout.header(uint64(len(f.Payload)))
+	p = append(append(p, header...), f.Payload...)
+	return append(p, layout.trailer(frameChecksum(header, f.Payload))...)
+}
+
+// DecodeFrame reads the next frame from r, which may be a bare frame. It returns io.EOF when r ends before the frame
+// starts, and io.ErrUnexpectedEOF when it ends partway through the frame. A frame whose checksum doesn't match fails
+// with api.ErrChecksumMismatch
+func DecodeFrame(r io.Reader) (Frame, error) {
+	magic := make([]byte, frameMagicWidth)
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return Frame{}, err
+	}
+
+	layout := frameLayout{}
+	if string(magic) != frameMagic {
+		layout = bareFrames
+	}
+	f, err := layout.decode(io.MultiReader(bytes.NewReader(magic), r))
+	return f, unexpectedEOF(err)
+}
+
+// readPayload reads a payload of size bytes from r
+func readPayload(r io.Reader, size uint64) ([]byte, error) {
+	if size > math.MaxInt64 {
+		return nil, fmt.Errorf("frame length %d is too long", size)
+	}
+	if size <= maxFramePrealloc {
+		p := make([]byte, size)
+		if _, err := io.ReadFull(r, p); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		return p, nil
+	}
+
+	var buf bytes.Buffer
+	buf.Grow(maxFramePrealloc)
+	if _, err := io.CopyN(&buf, r, int64(size)); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	return buf.Bytes(), nil
+}
+
+// ReadStoreHeader reads the format header at the start of a store file from r and returns the version the file was
+// written in, along with how many bytes the header takes up. Frames start right after it, bare ones in files from
+// before version 2. Files from before store files had a header are version 0 and have no header to skip
+func ReadStoreHeader(r io.ReaderAt) (version uint16, width uint64, err error) {
+	p := make([]byte, storeHeaderWidth)
+	n, err := r.ReadAt(p, 0)
+	if err != nil && err != io.EOF {
+		return 0, 0, err
+	}
+
+	name := "store"
+	if f, ok := r.(interface{ Name() string }); ok {
+		name = f.Name()
+	}
+	if version, err = parseFormatHeader(name, p[:n], storeMagic); err != nil {
+		return 0, 0, err
+	}
+	if version > 0 {
+		width = storeHeaderWidth
+	}
+	return version, width, nil
+}
+
+// frameLayout is how the frames of a store are laid out, with flags for the frames appended to it. Stores hold frames
+// as Frame describes them, apart from store files from before format version 2 and backends other than the file
+// backed store, which hold bare frames
+type frameLayout struct {
+	bare  bool
+	flags FrameFlags
+}
+
+var bareFrames = frameLayout{bare: true}
+
+// storeFrameLayout is how the frames of a store file with the given format version are laid out
+func storeFrameLayout(version uint16) frameLayout {
+	return frameLayout{bare: version < framedFormatVersion}
+}
+
+// peekFrameLayout tells how the frames of a store that isn't empty are laid out from the start of its first frame
+func peekFrameLayout(s StoreBackend) (frameLayout, error) {
+	magic := make([]byte, frameMagicWidth)
+	if _, err := s.ReadAt(magic, 0); err != nil && err != io.EOF {
+		return frameLayout{}, err
+	}
+	if string(magic) == frameMagic {
+		return frameLayout{}, nil
+	}
+	return bareFrames, nil
+}
+
+// header returns the header of a frame with an n byte payload
+func (l frameLayout) header(n uint64) []byte {
+	p := make([]byte, l.headerWidth())
+	if !l.bare {
+		copy(p, frameMagic)
+		p[frameMagicWidth] = FrameVersion
+		p[frameMagicWidth+1] = byte(l.flags)
+	}
+	enc.PutUint64(p[len(p)-recordLenWidth:], n)
+	return p
+}
+
+// trailer returns the trailer of a frame with the given checksum, which bare frames don't have
+func (l frameLayout) trailer(crc uint32) []byte {
+	if l.bare {
+		return nil
+	}
+	p := make([]byte, FrameTrailerWidth)
+	enc.PutUint32(p, crc)
+	return p
+}
+
+// length returns the length of the payload from the frame's header
+func (l frameLayout) length(header []byte) uint64 {
+	return enc.Uint64(header[l.headerWidth()-recordLenWidth:])
+}
+
+// headerWidth is the number of bytes in front of a frame's payload
+func (l frameLayout) headerWidth() uint64 {
+	if l.bare {
+		return recordLenWidth
+	}
+	return FrameHeaderWidth
+}
+
+// overhead is the number of bytes a frame takes up on top of its payload
+func (l frameLayout) overhead() uint64 {
+	if l.bare {
+		return recordLenWidth
+	}
+	return maxFrameOverhead
+}
+
+// decode reads the next frame laid out as l from r. A frame that should start with the magic but doesn't is taken to
+// be damaged, like one whose checksum doesn't match
+func (l frameLayout) decode(r io.Reader) (Frame, error) {
+	header := make([]byte, l.headerWidth())
+	if _, err := io.ReadFull(r, header); err != nil {
+		return Frame{}, err
+	}
+
+	var f Frame
+	if !l.bare {
+		if string(header[:frameMagicWidth]) != frameMagic {
+			return Frame{}, api.ErrChecksumMismatch{Name: "frame"}
+		}
+		version := header[frameMagicWidth]
+		f.Flags = FrameFlags(header[frameMagicWidth+1])
+		if version > FrameVersion || f.Flags&^knownFrameFlags != 0 {
+			return Frame{}, ErrUnsupportedFrame{Version: version, Flags: f.Flags}
+		}
+	}
+
+	var err error
+	if f.Payload, err = readPayload(r, l.length(header)); err != nil || l.bare {
+		return f, err
+	}
+
+	trailer := make([]byte, FrameTrailerWidth)
+	if _, err := io.ReadFull(r, trailer); err != nil {
+		return Frame{}, unexpectedEOF(err)
+	}
+	if enc.Uint32(trailer) != frameChecksum(header, f.Payload) {
+		return Frame{}, api.ErrChecksumMismatch{Name: "frame"}
+	}
+	return f, nil
+}
+
+// frameChecksum is the checksum of a frame with the given header and payload
+func frameChecksum(header []byte, payload ...[]byte) uint32 {
+	crc := crc32.ChecksumIEEE(header)
+	for _, p := range payload {
+		crc = crc32.Update(crc, crc32.IEEETable, p)
+	}
+	return crc
+}
+
+// frameFlags returns the flags of the frames of a segment whose records are encoded with codec, and sealed when it is
+// encrypted
+func frameFlags(codec RecordCodec, encrypted bool) FrameFlags {
+	var flags FrameFlags
+	if encrypted {
+		flags |= FrameEncrypted
+	}
+	switch codec {
+	case JSONCodec:
+		flags |= FrameJSON
+	case MsgpackCodec:
+		flags |= FrameMsgpack
+	}
+	return flags
+}
+
+// unexpectedEOF turns io.EOF, from a reader ending after a frame's header, into io.ErrUnexpectedEOF
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
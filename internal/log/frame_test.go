@@ -0,0 +1,246 @@
+package log
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	api "github.com/burmudar/prolog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFrame(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T){
+		"round trip":                testFrameRoundTrip,
+		"flags":                     testFrameFlags,
+		"unsupported":               testFrameUnsupported,
+		"checksum mismatch":         testFrameChecksumMismatch,
+		"bare frames":               testFrameBare,
+		"truncated":                 testFrameTruncated,
+		"store records are framed":  testFrameStore,
+		"segment flags":             testFrameSegmentFlags,
+		"store header":              testFrameStoreHeader,
+		"length past end of reader": testFrameLongLength,
+	} {
+		t.Run(scenario, fn)
+	}
+}
+
+func testFrameRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	payloads := [][]byte{
+		{},
+		[]byte("hello world"),
+		bytes.Repeat([]byte("x"), maxFramePrealloc+1),
+	}
+	for _, p := range payloads {
+		f := Frame{Payload: p}
+		n, err := f.Encode(&buf)
+		require.NoError(t, err)
+		require.Equal(t, f.Size(), uint64(n))
+	}
+	require.Equal(t, buf.Bytes(), Frame{Payload: payloads[2]}.AppendTo(
+		Frame{Payload: payloads[1]}.AppendTo(Frame{Payload: payloads[0]}.AppendTo(nil))))
+
+	for _, p := range payloads {
+		f, err := DecodeFrame(&buf)
+		require.NoError(t, err)
+		require.Equal(t, p, f.Payload)
+	}
+	_, err := DecodeFrame(&buf)
+	require.Equal(t, io.EOF, err)
+}
+
+func testFrameFlags(t *testing.T) {
+	for flags := FrameFlags(0); flags <= knownFrameFlags; flags++ {
+		var buf bytes.Buffer
+		f := Frame{Flags: flags, Payload: []byte("hello world")}
+		_, err := f.Encode(&buf)
+		require.NoError(t, err)
+		require.Equal(t, buf.Bytes(), f.AppendTo(nil))
+
+		got, err := DecodeFrame(&buf)
+		require.NoError(t, err)
+		require.Equal(t, f, got, "flags %08b", flags)
+	}
+}
+
+func testFrameUnsupported(t *testing.T) {
+	for scenario, want := range map[string]struct {
+		version uint8
+		flags   FrameFlags
+	}{
+		"newer version": {version: FrameVersion + 1},
+		"unknown flags": {version: FrameVersion, flags: knownFrameFlags + 1},
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			p := Frame{Payload: []byte("hello world")}.AppendTo(nil)
+			p[frameMagicWidth], p[frameMagicWidth+1] = want.version, byte(want.flags)
+			_, err := DecodeFrame(bytes.NewReader(p))
+			require.Equal(t, ErrUnsupportedFrame{Version: want.version, Flags: want.flags}, err)
+		})
+	}
+}
+
+func testFrameChecksumMismatch(t *testing.T) {
+	f := Frame{Flags: FrameJSON, Payload: []byte("hello world")}
+	// a bit flipped in the payload or in the checksum itself is caught
+	for i := FrameHeaderWidth; i < int(f.Size()); i++ {
+		p := f.AppendTo(nil)
+		p[i] ^= 1
+		_, err := DecodeFrame(bytes.NewReader(p))
+		require.Equal(t, api.ErrChecksumMismatch{Name: "frame"}, err, "bit flipped in byte %d", i)
+	}
+
+	// a store whose records are framed doesn't take a frame without the magic for a bare one
+	p := f.AppendTo(nil)
+	p[0] = 0
+	_, err := frameLayout{}.decode(bytes.NewReader(p))
+	require.Equal(t, api.ErrChecksumMismatch{Name: "frame"}, err)
+}
+
+func testFrameBare(t *testing.T) {
+	p := append(bareFrames.header(5), "hello"...)
+	p = append(p, bareFrames.header(0)...)
+	// bare frames and frames are told apart frame by frame
+	p = Frame{Flags: FrameEncrypted, Payload: []byte("world")}.AppendTo(p)
+
+	r := bytes.NewReader(p)
+	for _, want := range []Frame{
+		{Payload: []byte("hello")},
+		{Payload: []byte{}},
+		{Flags: FrameEncrypted, Payload: []byte("world")},
+	} {
+		got, err := DecodeFrame(r)
+		require.NoError(t, err)
+		require.Equal(t, want, got)
+	}
+	_, err := DecodeFrame(r)
+	require.Equal(t, io.EOF, err)
+}
+
+func testFrameTruncated(t *testing.T) {
+	p := Frame{Payload: []byte("hello world")}.AppendTo(nil)
+	for n := 1; n < len(p); n++ {
+		_, err := DecodeFrame(bytes.NewReader(p[:n]))
+		require.Equal(t, io.ErrUnexpectedEOF, err, "cut after %d bytes", n)
+	}
+}
+
+func testFrameStore(t *testing.T) {
+	f, err := ioutil.TempFile("", "frame-store-test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	s, err := newStore(f)
+	require.NoError(t, err)
+	for _, p := range []string{"hello", "", "world"} {
+		_, _, err := s.Append([]byte(p))
+		require.NoError(t, err)
+	}
+	require.NoError(t, s.Close())
+
+	// the store file can be read without the log, by skipping the header and decoding frames
+	f, err = os.Open(f.Name())
+	require.NoError(t, err)
+	defer f.Close()
+
+	version, width, err := ReadStoreHeader(f)
+	require.NoError(t, err)
+	require.Equal(t, formatVersion, version)
+	require.Equal(t, storeHeaderWidth, width)
+
+	_, err = f.Seek(int64(width), io.SeekStart)
+	require.NoError(t, err)
+	var got []string
+	for {
+		frame, err := DecodeFrame(f)
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		got = append(got, string(frame.Payload))
+	}
+	require.Equal(t, []string{"hello", "", "world"}, got)
+}
+
+func testFrameSegmentFlags(t *testing.T) {
+	for scenario, want := range map[string]struct {
+		c     Config
+		flags FrameFlags
+	}{
+		"protobuf":  {c: Config{}},
+		"json":      {c: Config{Codec: JSONCodec}, flags: FrameJSON},
+		"msgpack":   {c: Config{Codec: MsgpackCodec}, flags: FrameMsgpack},
+		"encrypted": {c: Config{AEAD: newTestAEAD(t, 1)}, flags: FrameEncrypted},
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "frame-segment-flags-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			log, err := NewLog(dir, want.c)
+			require.NoError(t, err)
+			_, err = log.Append(&api.Record{Value: []byte("hello world")})
+			require.NoError(t, err)
+			require.NoError(t, log.Close())
+
+			p, err := ioutil.ReadFile(segmentFilePath(dir, 0, storeExt))
+			require.NoError(t, err)
+			f, err := DecodeFrame(bytes.NewReader(p[storeHeaderWidth:]))
+			require.NoError(t, err)
+			require.Equal(t, want.flags, f.Flags)
+		})
+	}
+}
+
+func testFrameStoreHeader(t *testing.T) {
+	for scenario, want := range map[string]struct {
+		p       []byte
+		version uint16
+		width   uint64
+		err     error
+	}{
+		"current":       {p: formatHeader(storeMagic, storeHeaderWidth), version: formatVersion, width: storeHeaderWidth},
+		"no header":     {p: Frame{Payload: []byte("hello")}.AppendTo(nil)},
+		"empty":         {p: nil},
+		"newer version": {p: append([]byte(storeMagic), 0, 9), err: ErrUnsupportedVersion{Name: "store", Version: 9}},
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			version, width, err := ReadStoreHeader(bytes.NewReader(want.p))
+			require.Equal(t, want.err, err)
+			require.Equal(t, want.version, version)
+			require.Equal(t, want.width, width)
+		})
+	}
+}
+
+func testFrameLongLength(t *testing.T) {
+	// a corrupt length doesn't allocate more than the reader holds
+	for _, layout := range []frameLayout{{}, bareFrames} {
+		p := append(layout.header(1<<40), "hello"...)
+		_, err := DecodeFrame(bytes.NewReader(p))
+		require.Equal(t, io.ErrUnexpectedEOF, err)
+	}
+
+	_, err := DecodeFrame(bytes.NewReader(frameLayout{}.header(1 << 63)))
+	require.Error(t, err)
+}
+
+func FuzzFrame(f *testing.F) {
+	f.Add([]byte(""))
+	f.Add([]byte("hello world"))
+	f.Add([]byte("\xfbL\x01\x00"))
+	f.Fuzz(func(t *testing.T, p []byte) {
+		frame, err := DecodeFrame(bytes.NewReader(Frame{Flags: FrameMsgpack, Payload: p}.AppendTo(nil)))
+		require.NoError(t, err)
+		require.Equal(t, FrameMsgpack, frame.Flags)
+		require.Equal(t, len(p), len(frame.Payload))
+		require.True(t, bytes.Equal(p, frame.Payload))
+
+		// decoding arbitrary bytes never panics
+		_, _ = DecodeFrame(bytes.NewReader(p))
+	})
+}
@@ -1,9 +1,13 @@
 package log
 
 import (
+	"bytes"
+	"hash/crc32"
 	"io"
+	"io/ioutil"
 	"os"
 
+	api "github.com/burmudar/prolog/api/v1"
 	"github.com/tysonmote/gommap"
 )
 
@@ -13,30 +17,104 @@ var (
 	entWidth        = offWidth + posWidth
 )
 
-// An entry in the index consists of two parts
+// zeroEntry is what the padding at the end of an open index looks like, entry by entry
+var zeroEntry = make([]byte, entWidth)
+
+// the checksum file holds the checksum followed by the number of bytes of the index it covers
+const (
+	crcWidth     = 4
+	coveredWidth = 8
+)
+
+// An entry in the index consists of two parts, and the entries follow the index's format header
 // <[ off width ][ pos width ]>
 // <[ off width ][ pos width ]>
+//
+// When Config.Segment.IndexChecksum is set, a CRC32 of the used part of the index is written to a "<index>.crc" file
+// next to the index when it is closed, followed by the number of bytes it covers. The checksum is verified when the
+// index is opened again and kept until it is written anew on close. Entries are only ever appended to the index, so
+// the entries it covers don't change in the meantime, even when the index isn't closed cleanly.
+
+// IndexBackend maps a segment's relative offsets to positions in its store
+type IndexBackend interface {
+	Read(in int64) (out uint32, pos uint64, err error)
+	Write(off uint32, pos uint64) error
+	Name() string
+	Size() uint64
+	// Sync makes everything written so far durable
+	Sync() error
+	Close() error
+	// Remove removes the underlying storage. The backend is expected to be closed before Remove is called
+	Remove() error
+}
+
+var _ IndexBackend = (*index)(nil)
 
 type index struct {
 	file *os.File
 	mmap gommap.MMap
-	size uint64
+	// entries is the part of mmap after the format header
+	entries []byte
+	size    uint64
+	header  uint64
+	version uint16
+	// checksum is whether a checksum is written when the index is closed
+	checksum bool
+	// config is what the checksum file is created with
+	config Config
+}
+
+// newFileIndex is the default NewIndexFn which memory maps a "<baseOffset>.index" file in dir
+func newFileIndex(dir string, baseOffset uint64, c Config) (IndexBackend, error) {
+	flag := os.O_RDWR | os.O_CREATE
+	if c.ReadOnly {
+		flag = os.O_RDONLY
+	}
+	f, err := openLogFile(segmentFilePath(dir, baseOffset, indexExt), flag, c)
+	if err != nil {
+		return nil, err
+	}
+
+	return newIndex(f, c)
 }
 
 func newIndex(f *os.File, c Config) (*index, error) {
 	idx := &index{
-		file: f,
+		file:     f,
+		checksum: c.Segment.IndexChecksum,
+		config:   c,
 	}
 
 	fi, err := os.Stat(f.Name())
 	if err != nil {
 		return nil, err
 	}
-	idx.size = uint64(fi.Size())
+	size := uint64(fi.Size())
+	if size == 0 {
+		// a new index, which gets a header in the current format
+		idx.header, idx.version = indexHeaderWidth, formatVersion
+	} else {
+		p := make([]byte, indexHeaderWidth)
+		if _, err := f.ReadAt(p, 0); err != nil && err != io.EOF {
+			return nil, err
+		}
+		if idx.version, err = parseFormatHeader(f.Name(), p, indexMagic); err != nil {
+			return nil, err
+		}
+		if idx.version > 0 {
+			idx.header = indexHeaderWidth
+		}
+		idx.size = size - idx.header
+	}
+
+	if c.ReadOnly {
+		return idx, idx.mapReadOnly(size)
+	}
 
 	// size the file to the max allow sized - essentially creating a "sparse index"
-	// we have to grow the file before hand since we can't do it when the file is memory mapped
-	if err := os.Truncate(f.Name(), int64(c.Segment.MaxIndexBytes)); err != nil {
+	// we have to grow the file before hand since we can't do it when the file is memory mapped. The header doesn't
+	// count towards the max size
+	if err := os.Truncate(f.Name(), int64(idx.header+c.Segment.MaxIndexBytes)); err != nil {
 		return nil, err
 	}
 
@@ -48,10 +126,89 @@ func newIndex(f *os.File, c Config) (*index, error) {
 	); err != nil {
 		return nil, err
 	}
+	if size == 0 {
+		copy(idx.mmap, formatHeader(indexMagic, indexHeaderWidth))
+	}
+	idx.entries = idx.mmap[idx.header:]
+
+	if idx.checksum {
+		if err := idx.verify(); err != nil {
+			idx.mmap.UnsafeUnmap()
+			return nil, err
+		}
+	}
 
 	return idx, nil
 }
 
+// mapReadOnly maps the index file of the given size as it is, for a log that is opened read only. Nothing can be written
+// to the index, and an empty file isn't mapped at all
+func (i *index) mapReadOnly(size uint64) error {
+	if size > 0 {
+		var err error
+		if i.mmap, err = gommap.Map(i.file.Fd(), gommap.PROT_READ, gommap.MAP_SHARED); err != nil {
+			return err
+		}
+		i.entries = i.mmap[i.header:]
+	}
+
+	if i.checksum {
+		if err := i.verify(); err != nil {
+			i.Close()
+			return err
+		}
+	}
+	return nil
+}
+
+// trimPadding leaves the zeros out of the used part of an index that another process still has open, which pads the
+// index out to MaxIndexBytes. Positions are relative to the end of the store's header, so the first entry is all zeros
+// as well when its record starts the store, which is why it is only left out when the store is empty
+func (i *index) trimPadding(emptyStore bool) {
+	i.size -= i.size % entWidth
+	for i.size > 0 && bytes.Equal(i.entries[i.size-entWidth:i.size], zeroEntry) {
+		if i.size == entWidth && !emptyStore {
+			break
+		}
+		i.size -= entWidth
+	}
+}
+
+// FormatVersion is the version of the format the index's file is written in. Indexes from before files had a format
+// header are version 0
+func (i *index) FormatVersion() uint16 {
+	return i.version
+}
+
+func (i *index) crcName() string {
+	return i.file.Name() + crcExt
+}
+
+// verify compares the entries the index held when it was last closed with the checksum written then. Checksums
+// written before they were followed by the number of bytes they cover cover the whole used part of the index
+func (i *index) verify() error {
+	p, err := ioutil.ReadFile(i.crcName())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	covered := i.size
+	switch len(p) {
+	case crcWidth:
+	case crcWidth + coveredWidth:
+		covered = enc.Uint64(p[crcWidth:])
+	default:
+		return api.ErrChecksumMismatch{Name: i.Name()}
+	}
+	if covered > i.size || enc.Uint32(p) != crc32.ChecksumIEEE(i.entries[:covered]) {
+		return api.ErrChecksumMismatch{Name: i.Name()}
+	}
+	return nil
+}
+
 func (i *index) Read(in int64) (out uint32, pos uint64, err error) {
 	// if the index is empty, we have nothing to return
 	if i.size == 0 {
@@ -73,22 +230,22 @@ func (i *index) Read(in int64) (out uint32, pos uint64, err error) {
 	}
 
 	// Read the size of the position
-	out = enc.Uint32(i.mmap[pos : pos+offWidth])
+	out = enc.Uint32(i.entries[pos : pos+offWidth])
 	// the position in the store file
-	pos = enc.Uint64(i.mmap[pos+offWidth : pos+entWidth])
+	pos = enc.Uint64(i.entries[pos+offWidth : pos+entWidth])
 	return out, pos, nil
 }
 
 func (i *index) Write(off uint32, pos uint64) error {
 	// Check if we have space to write the entry
-	if uint64(len(i.mmap)) < i.size+entWidth {
+	if uint64(len(i.entries)) < i.size+entWidth {
 		return io.EOF
 	}
 
 	// store the offset. i.size is the start position for our index entry
-	enc.PutUint32(i.mmap[i.size:i.size+offWidth], off)
+	enc.PutUint32(i.entries[i.size:i.size+offWidth], off)
 	// store the position in the store file after the offset
-	enc.PutUint64(i.mmap[i.size+offWidth:i.size+entWidth], pos)
+	enc.PutUint64(i.entries[i.size+offWidth:i.size+entWidth], pos)
 	// increment the size, so that the next write goes to the write position
 	i.size += uint64(entWidth)
 	return nil
@@ -98,21 +255,69 @@ func (i *index) Name() string {
 	return i.file.Name()
 }
 
+func (i *index) Size() uint64 {
+	return i.size
+}
+
+func (i *index) Remove() error {
+	if err := os.Remove(i.crcName()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return os.Remove(i.Name())
+}
+
+func (i *index) Sync() error {
+	if i.config.ReadOnly {
+		return nil
+	}
+
+	if err := i.mmap.Sync(gommap.MS_SYNC); err != nil {
+		return err
+	}
+
+	return i.file.Sync()
+}
+
 func (i *index) Close() error {
+	if i.config.ReadOnly {
+		if i.mmap != nil {
+			if err := i.mmap.UnsafeUnmap(); err != nil {
+				return err
+			}
+		}
+		return i.file.Close()
+	}
+
 	// Closing happens in three stages:
 	// 1. Sync the memory contents to file
 	// 2. Sync the file to storage
 	// 3. Shrink the file to it's ACTUAL size
-	// finally close the file
-	if err := i.mmap.Sync(gommap.MS_SYNC); err != nil {
+	// finally unmap and close the file
+	if err := retryIO(i.config.IOSyncRetries, func() error { return i.mmap.Sync(gommap.MS_SYNC) }); err != nil {
+		return err
+	}
+
+	if err := retryIO(i.config.IOSyncRetries, i.file.Sync); err != nil {
 		return err
 	}
 
-	if err := i.file.Sync(); err != nil {
+	if i.checksum {
+		p := make([]byte, crcWidth+coveredWidth)
+		enc.PutUint32(p, crc32.ChecksumIEEE(i.entries[:i.size]))
+		enc.PutUint64(p[crcWidth:], i.size)
+		if err := writeFile(i.crcName(), p, i.config); err != nil {
+			return err
+		}
+	}
+
+	// the mapping would outlive the file otherwise, which adds up when segments are closed and reopened
+	if err := i.mmap.UnsafeUnmap(); err != nil {
 		return err
 	}
 
-	if err := os.Truncate(i.file.Name(), int64(i.size)); err != nil {
+	truncate := func() error { return os.Truncate(i.file.Name(), int64(i.header+i.size)) }
+	if err := retryIO(i.config.IOSyncRetries, truncate); err != nil {
 		return err
 	}
 
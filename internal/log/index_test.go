@@ -6,6 +6,7 @@ import (
 	"os"
 	"testing"
 
+	api "github.com/burmudar/prolog/api/v1"
 	"github.com/stretchr/testify/require"
 )
 
@@ -53,3 +54,51 @@ func TestIndex(t *testing.T) {
 	require.Equal(t, uint32(1), off)
 	require.Equal(t, entries[1].Pos, pos)
 }
+
+func TestIndexChecksum(t *testing.T) {
+	f, err := ioutil.TempFile("", "index_checksum_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	defer os.Remove(f.Name() + ".crc")
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = 1024
+	c.Segment.IndexChecksum = true
+
+	idx, err := newIndex(f, c)
+	require.NoError(t, err)
+	for i := uint32(0); i < 3; i++ {
+		require.NoError(t, idx.Write(i, uint64(i)*10))
+	}
+	require.NoError(t, idx.Close())
+
+	// a clean close and open verifies
+	f, err = os.OpenFile(f.Name(), os.O_RDWR, 0600)
+	require.NoError(t, err)
+	idx, err = newIndex(f, c)
+	require.NoError(t, err)
+
+	// the checksum is kept while the index is open, and still verifies when the index is opened again without having
+	// been closed after more entries were appended
+	_, err = os.Stat(f.Name() + crcExt)
+	require.NoError(t, err)
+	require.NoError(t, idx.Write(3, 30))
+	require.NoError(t, idx.Sync())
+	f, err = os.OpenFile(f.Name(), os.O_RDWR, 0600)
+	require.NoError(t, err)
+	idx, err = newIndex(f, c)
+	require.NoError(t, err)
+	require.NoError(t, idx.Close())
+
+	// flip a bit in the position of the second entry
+	p, err := ioutil.ReadFile(f.Name())
+	require.NoError(t, err)
+	p[entWidth+offWidth+7] ^= 1
+	require.NoError(t, ioutil.WriteFile(f.Name(), p, 0600))
+
+	f, err = os.OpenFile(f.Name(), os.O_RDWR, 0600)
+	require.NoError(t, err)
+	defer f.Close()
+	_, err = newIndex(f, c)
+	require.Equal(t, api.ErrChecksumMismatch{Name: f.Name()}, err)
+}
@@ -0,0 +1,130 @@
+package log
+
+import (
+	"context"
+	"fmt"
+
+	api "github.com/burmudar/prolog/api/v1"
+)
+
+// ErrTruncated is returned when a record can't be read because the segment holding it was truncated away. Readers
+// can recover from it by carrying on from Lowest
+type ErrTruncated struct {
+	Offset uint64
+	Lowest uint64
+}
+
+func (e ErrTruncated) Error() string {
+	return fmt.Sprintf("offset %d was truncated, the lowest offset is now %d", e.Offset, e.Lowest)
+}
+
+// ScanOptions control how readers going through the log, like Iterator and Export, deal with records they can't read
+type ScanOptions struct {
+	// SkipToLowest carries on from the new lowest offset when records are truncated away while reading, instead of
+	// failing with ErrTruncated
+	SkipToLowest bool
+	// SkipCorrupt skips records that are corrupt, see isCorrupt, instead of failing on them. Each one skipped is passed
+	// to DeadLetter, if it is set, so that the caller can keep a list of them
+	SkipCorrupt bool
+	DeadLetter  func(off uint64, err error)
+}
+
+// skipCorrupt reports whether the record at off, which failed to read with err, is to be skipped
+func (o ScanOptions) skipCorrupt(off uint64, err error) bool {
+	if !o.SkipCorrupt || !isCorrupt(err) {
+		return false
+	}
+	if o.DeadLetter != nil {
+		o.DeadLetter(off, err)
+	}
+	return true
+}
+
+// Iterator sends the records from the given offset up to the end of the log on the returned channel, in order. The
+// records channel is closed once the last record has been sent, and the errors channel receives the error that ended
+// the iteration early, if any.
+//
+// Records that are truncated while iterating end the iteration with ErrTruncated, unless opts.SkipToLowest is set, in
+// which case the iteration carries on from the new lowest offset
+func (l *Log) Iterator(ctx context.Context, from uint64, opts ScanOptions) (<-chan *api.Record, <-chan error) {
+	records := make(chan *api.Record)
+	errs := make(chan error, 1)
+
+	go func() {
+		defer close(records)
+		defer close(errs)
+
+		for off := from; off < l.PeekNextOffset(); off++ {
+			record, err := l.Read(off)
+			if skippedOffset(err) || opts.skipCorrupt(off, err) {
+				continue
+			}
+			if _, ok := err.(api.ErrOffsetOutOfRange); ok {
+				lowest, lerr := l.LowestOffset()
+				if lerr != nil {
+					errs <- lerr
+					return
+				}
+				if off >= lowest {
+					// the log changed between the read and looking up its lowest offset
+					continue
+				}
+				if !opts.SkipToLowest {
+					errs <- ErrTruncated{Offset: off, Lowest: lowest}
+					return
+				}
+				off = lowest - 1
+				continue
+			}
+			if err != nil {
+				errs <- err
+				return
+			}
+
+			select {
+			case records <- record:
+			case <-ctx.Done():
+				errs <- ctx.Err()
+				return
+			}
+		}
+	}()
+
+	return records, errs
+}
+
+// ErrCompacted is returned for offsets that were skipped by AppendAt, because the records at them had been compacted
+// away by the time they were replicated. It lives in the api, so that the server can skip these offsets the way it
+// does those without a record
+type ErrCompacted = api.ErrCompacted
+
+// ErrCorruptRecord is returned when a record's bytes can't be decoded into a record
+type ErrCorruptRecord struct {
+	Offset uint64
+	// Err is the error the record's codec failed with
+	Err error
+}
+
+func (e ErrCorruptRecord) Error() string {
+	return fmt.Sprintf("record at offset %d is corrupt: %v", e.Offset, e.Err)
+}
+
+// isCorrupt reports whether err is from reading a record that is damaged, as opposed to one that isn't there or a
+// failure of the storage itself
+func isCorrupt(err error) bool {
+	switch err.(type) {
+	case ErrCorruptRecord, ErrTruncatedRecord, api.ErrChecksumMismatch:
+		return true
+	}
+	return false
+}
+
+// skippedOffset reports whether err is from reading an offset within the log's range that has no record, which readers
+// going through the log move past
+func skippedOffset(err error) bool {
+	switch err.(type) {
+	case api.ErrOffsetNotFound, ErrCompacted:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,149 @@
+package log
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	api "github.com/burmudar/prolog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogIterator(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T, log *Log){
+		"iterates to the end of the log":                   testIteratorToEnd,
+		"truncation ends the iteration":                    testIteratorTruncated,
+		"truncation skips to the lowest offset if allowed": testIteratorSkipToLowest,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "log-iterator-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			c := Config{}
+			// every segment has room for a single index entry, so each record gets a segment of its own
+			c.Segment.MaxIndexBytes = entWidth
+			log, err := NewLog(dir, c)
+			require.NoError(t, err)
+			defer log.Close()
+
+			for i := 0; i < 10; i++ {
+				_, err := log.Append(&api.Record{Value: []byte("hello world")})
+				require.NoError(t, err)
+			}
+
+			fn(t, log)
+		})
+	}
+}
+
+func testIteratorToEnd(t *testing.T, log *Log) {
+	records, errs := log.Iterator(context.Background(), 3, ScanOptions{})
+
+	want := uint64(3)
+	for record := range records {
+		require.Equal(t, want, record.Offset)
+		want++
+	}
+	require.Equal(t, uint64(10), want)
+	require.NoError(t, <-errs)
+}
+
+// startIterating reads the first two records, after which the log is truncated up to and including offset 4
+func startIterating(t *testing.T, log *Log, skipToLowest bool) (<-chan *api.Record, <-chan error) {
+	records, errs := log.Iterator(context.Background(), 0, ScanOptions{SkipToLowest: skipToLowest})
+	for _, want := range []uint64{0, 1} {
+		record := <-records
+		require.Equal(t, want, record.Offset)
+	}
+
+	require.NoError(t, log.Truncate(4))
+	return records, errs
+}
+
+func testIteratorTruncated(t *testing.T, log *Log) {
+	records, errs := startIterating(t, log, false)
+
+	// the iterator may have read the next record before the log was truncated
+	for record := range records {
+		require.Equal(t, uint64(2), record.Offset)
+	}
+
+	err := <-errs
+	require.IsType(t, ErrTruncated{}, err)
+	require.Equal(t, uint64(5), err.(ErrTruncated).Lowest)
+}
+
+func testIteratorSkipToLowest(t *testing.T, log *Log) {
+	records, errs := startIterating(t, log, true)
+
+	var got []uint64
+	for record := range records {
+		got = append(got, record.Offset)
+	}
+	require.NoError(t, <-errs)
+
+	// the iterator may have read the next record before the log was truncated
+	if len(got) > 0 && got[0] == 2 {
+		got = got[1:]
+	}
+	require.Equal(t, []uint64{5, 6, 7, 8, 9}, got)
+}
+
+func TestLogSkipCorrupt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-skip-corrupt-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	log, err := NewLog(dir, Config{})
+	require.NoError(t, err)
+	defer log.Close()
+
+	for i := 0; i < 5; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+
+	// garble the record at offset 2, leaving its length as it was
+	seg := log.activeSegment
+	pos, err := seg.position(2)
+	require.NoError(t, err)
+	p, err := seg.store.Read(pos)
+	require.NoError(t, err)
+	require.NoError(t, seg.store.Rewrite(pos, bytes.Repeat([]byte{0xff}, len(p))))
+	_, err = log.Read(2)
+	require.IsType(t, ErrCorruptRecord{}, err)
+
+	var deadLetters []uint64
+	opts := ScanOptions{
+		SkipCorrupt: true,
+		DeadLetter: func(off uint64, err error) {
+			require.IsType(t, ErrCorruptRecord{}, err)
+			deadLetters = append(deadLetters, off)
+		},
+	}
+
+	records, errs := log.Iterator(context.Background(), 0, opts)
+	var offsets []uint64
+	for record := range records {
+		offsets = append(offsets, record.Offset)
+	}
+	require.NoError(t, <-errs)
+	require.Equal(t, []uint64{0, 1, 3, 4}, offsets)
+	require.Equal(t, []uint64{2}, deadLetters)
+
+	deadLetters = nil
+	var buf bytes.Buffer
+	require.NoError(t, log.Export(context.Background(), 0, &buf, ExportNDJSON, opts))
+	require.Equal(t, 4, bytes.Count(buf.Bytes(), []byte("\n")))
+	require.Equal(t, []uint64{2}, deadLetters)
+
+	// without SkipCorrupt the corrupt record ends both of them
+	records, errs = log.Iterator(context.Background(), 0, ScanOptions{})
+	for range records {
+	}
+	require.IsType(t, ErrCorruptRecord{}, <-errs)
+	require.IsType(t, ErrCorruptRecord{}, log.Export(context.Background(), 0, &buf, ExportNDJSON, ScanOptions{}))
+}
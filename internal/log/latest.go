@@ -0,0 +1,99 @@
+package log
+
+import (
+	"context"
+	"sort"
+
+	api "github.com/burmudar/prolog/api/v1"
+)
+
+// LatestPerKey sends the most recent record for every key in the log, in offset order, which is what rebuilding a cache
+// from a log of updates needs. It makes two passes over the log: the first finds the offset of each key's latest
+// record and the second sends those records. Records appended after the first pass aren't sent.
+//
+// keyFn is given records with their values decompressed, but the records are sent as they're stored. Records for which
+// keyFn returns nil have no key to be superseded by and are always sent, while deleted records are never sent. As with
+// Iterator, the errors channel receives the error that ended it early, if any
+func (l *Log) LatestPerKey(ctx context.Context, keyFn func(*api.Record) []byte) (<-chan *api.Record, <-chan error) {
+	records := make(chan *api.Record)
+	errs := make(chan error, 1)
+
+	go func() {
+		defer close(records)
+		defer close(errs)
+
+		offsets, err := l.latestOffsets(ctx, keyFn)
+		if err != nil {
+			errs <- err
+			return
+		}
+
+		for _, off := range offsets {
+			record, err := l.Read(off)
+			if _, ok := err.(api.ErrOffsetOutOfRange); ok {
+				lowest, _ := l.LowestOffset()
+				err = ErrTruncated{Offset: off, Lowest: lowest}
+			}
+			if err != nil {
+				errs <- err
+				return
+			}
+			// the record may have been deleted since the first pass
+			if record.Deleted {
+				continue
+			}
+
+			select {
+			case records <- record:
+			case <-ctx.Done():
+				errs <- ctx.Err()
+				return
+			}
+		}
+	}()
+
+	return records, errs
+}
+
+// latestOffsets returns the offsets of the records LatestPerKey sends, in ascending order
+func (l *Log) latestOffsets(ctx context.Context, keyFn func(*api.Record) []byte) ([]uint64, error) {
+	lowest, err := l.LowestOffset()
+	if err != nil {
+		return nil, err
+	}
+
+	// stops the iterator when we return early
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var keyless []uint64
+	latest := map[string]uint64{}
+	records, errs := l.Iterator(ctx, lowest, ScanOptions{})
+	for record := range records {
+		if record.Deleted {
+			continue
+		}
+
+		if record.Value, err = Decompress(record); err != nil {
+			return nil, err
+		}
+		record.CompressionCodec = api.CompressionCodec_COMPRESSION_NONE
+
+		key := keyFn(record)
+		if key == nil {
+			keyless = append(keyless, record.Offset)
+			continue
+		}
+		latest[string(key)] = record.Offset
+	}
+	if err := <-errs; err != nil {
+		return nil, err
+	}
+
+	offsets := keyless
+	for _, off := range latest {
+		offsets = append(offsets, off)
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+	return offsets, nil
+}
@@ -0,0 +1,56 @@
+package log
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	api "github.com/burmudar/prolog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogLatestPerKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-latest-per-key-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{Compression: api.CompressionCodec_COMPRESSION_GZIP}
+	c.Segment.MaxIndexBytes = entWidth * 3
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	// records are "key=value", spread over a few segments so that keys are superseded across them
+	for _, v := range []string{"a=1", "b=1", "c=1", "a=2", "keyless", "b=2", "d=1", "a=3", "c=2"} {
+		_, err := log.Append(&api.Record{Value: []byte(v)})
+		require.NoError(t, err)
+	}
+	require.NoError(t, log.Delete(6))
+
+	keyFn := func(record *api.Record) []byte {
+		i := bytes.IndexByte(record.Value, '=')
+		if i < 0 {
+			return nil
+		}
+		return record.Value[:i]
+	}
+	records, errs := log.LatestPerKey(context.Background(), keyFn)
+
+	var got []string
+	var offsets []uint64
+	for record := range records {
+		// records are sent as they're stored
+		require.Equal(t, api.CompressionCodec_COMPRESSION_GZIP, record.CompressionCodec)
+		value, err := Decompress(record)
+		require.NoError(t, err)
+		got = append(got, string(value))
+		offsets = append(offsets, record.Offset)
+	}
+	require.NoError(t, <-errs)
+
+	// d=1 was deleted, which leaves d without a record
+	require.Equal(t, []string{"keyless", "b=2", "a=3", "c=2"}, got)
+	require.Equal(t, []uint64{4, 5, 7, 8}, offsets)
+}
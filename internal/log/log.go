@@ -1,142 +1,1173 @@
 package log
 
 import (
+	"bytes"
+	"context"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"math"
 	"os"
-	"path"
 	"sort"
-	"strconv"
-	"strings"
 	"sync"
+	"time"
 
 	api "github.com/burmudar/prolog/api/v1"
 )
 
+var (
+	ErrOffsetNotSequential = fmt.Errorf("offset does not follow on from the log's highest offset")
+	ErrNoRecordAtTime      = fmt.Errorf("no record at or after the given time")
+	ErrSegmentNotFound     = fmt.Errorf("no segment with the given base offset")
+	ErrInvalidPosition     = fmt.Errorf("position is past the end of the segment's store")
+	ErrRecordTooLarge      = fmt.Errorf("record is larger than a segment's store may be")
+	ErrNegativeSize        = fmt.Errorf("size of the value to append is negative")
+	ErrReadOnly            = fmt.Errorf("log is opened read only")
+	// ErrNoActiveSegment is returned by appends when the log was left without an active segment, because creating a
+	// new one failed. Reopening the log gives it an active segment again
+	ErrNoActiveSegment = fmt.Errorf("log has no active segment to append to")
+	// ErrSegmentFull is returned by appends to a log with Config.ManualRoll set once its active segment is full. Nothing
+	// is appended until Rotate starts a new segment
+	ErrSegmentFull = fmt.Errorf("active segment is full, rotate the log to append to it")
+	// ErrConcurrentModification is returned by AppendIf when the log's highest offset isn't the one expected, because
+	// something else was appended in the meantime
+	ErrConcurrentModification = fmt.Errorf("log's highest offset is not the one expected")
+)
+
 type Log struct {
 	mu sync.RWMutex
 
-	Dir           string
-	Config        Config
-	activeSegment *segment
-	segments      []*segment
+	Dir           string
+	Config        Config
+	activeSegment *segment
+	segments      []*segment
+	// closed is set by Close and Remove, after which reads and appends fail with api.ErrClosed
+	closed bool
+	// open limits how many sealed segments are open. It is nil when they're all kept open
+	open *segmentCache
+	// durable is the offset from which records haven't been synced to storage yet. durableCh is closed and replaced
+	// whenever durable moves on or the log is closed
+	durableMu sync.Mutex
+	durable   uint64
+	durableCh chan struct{}
+	// breaker keeps track of failed writes. It is guarded by mu
+	breaker breaker
+	// middleware is what Use added, in order. It is guarded by mu
+	middleware []AppendMiddleware
+	// async is the queue of AppendAsync, which is made by the first AppendAsync. asyncMu is held for reading while
+	// records are queued, and for writing when Close sets asyncStopped
+	asyncMu      sync.RWMutex
+	asyncOnce    sync.Once
+	async        *asyncQueue
+	asyncStopped bool
+	// compactor runs the compactions scheduled by Config.CompactionInterval. It is nil when none are scheduled
+	compactor *compactor
+}
+
+func NewLog(dir string, c Config) (*Log, error) {
+	if c.Segment.MaxStoreBytes == 0 {
+		c.Segment.MaxStoreBytes = 1024
+	}
+
+	if c.Segment.MaxIndexBytes == 0 {
+		c.Segment.MaxIndexBytes = 1024
+	}
+
+	if c.Observer == nil {
+		c.Observer = nopObserver{}
+	}
+
+	if c.TrackPageFaults && !pageFaultsSupported() {
+		return nil, ErrPageFaultsUnsupported
+	}
+
+	if c.Clock == nil {
+		c.Clock = realClock{}
+	}
+
+	if c.CompactionInterval > 0 && c.CompactionKey == nil {
+		return nil, ErrCompactionKeyMissing
+	}
+
+	if !c.ReadOnly {
+		if err := makeDir(dir, c); err != nil {
+			return nil, err
+		}
+	}
+
+	l := &Log{
+		Dir:    dir,
+		Config: c,
+	}
+
+	if err := l.setup(); err != nil {
+		return l, err
+	}
+	l.startCompactor()
+	return l, nil
+}
+
+// OpenReadOnly opens the log in dir without ever writing to it, see Config.ReadOnly
+func OpenReadOnly(dir string, c Config) (*Log, error) {
+	c.ReadOnly = true
+	return NewLog(dir, c)
+}
+
+// ErrLogDirMissing is returned when the log's directory has gone missing by the time the log is opened from it. NewLog
+// creates the directory, so it has been removed by something else
+type ErrLogDirMissing struct {
+	Dir string
+	// Err is the error from looking up the directory
+	Err error
+}
+
+func (e ErrLogDirMissing) Error() string {
+	return fmt.Sprintf("log directory %s is missing: %v", e.Dir, e.Err)
+}
+
+func (l *Log) setup() error {
+	l.segments, l.activeSegment, l.open = nil, nil, nil
+	l.closed = false
+
+	if _, err := os.Stat(l.Dir); os.IsNotExist(err) {
+		return ErrLogDirMissing{Dir: l.Dir, Err: err}
+	}
+	if l.Config.MaxOpenSegments > 0 && l.Config.Segment.NewStore == nil {
+		l.open = newSegmentCache(l.Config.MaxOpenSegments - 1)
+	}
+
+	var m *manifest
+	if l.Config.Manifest {
+		var err error
+		if m, err = readManifest(l.Dir); err != nil {
+			return err
+		}
+	}
+
+	var baseOffsets []uint64
+	if m != nil {
+		baseOffsets = m.Segments
+	} else {
+		var err error
+		if baseOffsets, err = l.scanBaseOffsets(); err != nil {
+			return err
+		}
+	}
+
+	for i := 0; i < len(baseOffsets); i++ {
+		if err := l.newSegment(baseOffsets[i]); err != nil {
+			return err
+		}
+	}
+	// in case no previous segments were created - we create one now!
+	if l.segments == nil && l.Config.ReadOnly {
+		if err := l.newMemorySegment(l.Config.Segment.InitialOffset); err != nil {
+			return err
+		}
+	} else if l.segments == nil {
+		if err := l.newSegment(l.Config.Segment.InitialOffset); err != nil {
+			return err
+		}
+	}
+
+	if m != nil {
+		for _, s := range l.segments {
+			if s.baseOffset == m.Active {
+				l.activeSegment = s
+				s.sealed = false
+			}
+		}
+	}
+
+	if l.Config.CheckOnOpen {
+		if err := l.checkConsistency(); err != nil {
+			// closing the segments leaves their files as they were, ready for the log to be repaired
+			for _, s := range l.segments {
+				s.Close()
+			}
+			return err
+		}
+	}
+
+	l.Config.Observer.SegmentCount(len(l.segments))
+	// whatever is in the log when it is opened is considered to have been synced already
+	l.durableMu.Lock()
+	l.durable = l.activeSegment.nextOffset
+	if l.durableCh != nil {
+		close(l.durableCh)
+	}
+	l.durableCh = make(chan struct{})
+	l.durableMu.Unlock()
+
+	return l.writeManifest()
+}
+
+// scanBaseOffsets finds the base offsets of the segments in the log's directory, ordered from oldest to newest
+func (l *Log) scanBaseOffsets() ([]uint64, error) {
+	files, err := ioutil.ReadDir(l.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var baseOffsets []uint64
+	for _, file := range files {
+		// every segment has a store, so we only need to look at those to find all the segments. Other files that happen
+		// to be in the directory are left alone
+		off, ext, ok := parseSegmentFileName(file.Name())
+		if !ok || ext != storeExt || file.IsDir() {
+			continue
+		}
+		baseOffsets = append(baseOffsets, off)
+	}
+
+	// We want the segment ordering to be from oldest to newest, which is why we sort the offsets here
+	sort.Slice(baseOffsets, func(i, j int) bool {
+		return baseOffsets[i] < baseOffsets[j]
+	})
+
+	return baseOffsets, nil
+}
+
+// writeManifest records the log's current segments in the manifest, if the log keeps one and isn't read only. The
+// caller is expected to hold the write lock
+func (l *Log) writeManifest() error {
+	if !l.Config.Manifest || l.Config.ReadOnly {
+		return nil
+	}
+
+	m := &manifest{Active: l.activeSegment.baseOffset}
+	for _, s := range l.segments {
+		m.Segments = append(m.Segments, s.baseOffset)
+	}
+	return writeManifest(l.Dir, m, l.Config)
+}
+
+// roll seals the active segment and starts a new one at off, letting the observer know about it. The caller is expected
+// to hold the write lock
+func (l *Log) roll(off uint64) error {
+	sealed, size := l.activeSegment, l.activeSegment.store.Size()
+	if err := l.rollSegment(off); err != nil {
+		return err
+	}
+
+	l.Config.Observer.SegmentRolled(sealed.baseOffset, size)
+	l.Config.Observer.SegmentCount(len(l.segments))
+	return nil
+}
+
+// Rotate seals the active segment and starts a new one after the highest offset, even though the active segment isn't
+// maxed yet. Rotating before taking a backup leaves little in the active segment, which is the one still changing.
+// Nothing happens when the active segment is empty
+func (l *Log) Rotate() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return api.ErrClosed{}
+	}
+	if l.Config.ReadOnly {
+		return ErrReadOnly
+	}
+	if l.activeSegment.nextOffset == l.activeSegment.baseOffset {
+		return nil
+	}
+
+	return l.roll(l.activeSegment.nextOffset)
+}
+
+// rollSegment creates a new active segment starting at off and updates the manifest. The caller is expected to hold
+// the write lock
+func (l *Log) rollSegment(off uint64) error {
+	if err := l.newSegment(off); err != nil {
+		return err
+	}
+
+	return l.writeManifest()
+}
+
+// newMemorySegment makes an empty segment starting at off the active segment without creating any files, for a log
+// without segments that is opened read only
+func (l *Log) newMemorySegment(off uint64) error {
+	c := l.Config
+	c.Segment.NewStore, c.Segment.NewIndex = NewMemoryStore, NewMemoryIndex
+	s, err := newSegment(l.Dir, off, c)
+	if err != nil {
+		return err
+	}
+
+	l.segments = append(l.segments, s)
+	l.activeSegment = s
+	return nil
+}
+
+// newSegment creates a new segment with the given offsent and appends it to the log segments. The newly created Segment
+// is also set to be the current active segment. The log's directory is synced after the segment's files are created, so
+// that the files are still there after a crash
+func (l *Log) newSegment(off uint64) error {
+	s, err := newSegment(l.Dir, off, l.Config)
+	if err != nil {
+		return err
+	}
+
+	// the segment's files only survive a crash once the directory entries pointing to them have been synced as well
+	if l.Config.Segment.NewStore == nil {
+		if err := syncDir(l.Dir); err != nil {
+			return err
+		}
+	}
+
+	if l.segments == nil {
+		l.segments = make([]*segment, 0)
+	}
+
+	// the active segment is being sealed
+	if l.activeSegment != nil {
+		if err := l.activeSegment.seal(); err != nil {
+			return err
+		}
+		if err := l.open.add(l.activeSegment); err != nil {
+			return err
+		}
+	}
+
+	l.segments = append(l.segments, s)
+	l.activeSegment = s
+	return nil
+}
+
+// Append appends the record and returns its offset. With SyncOnAppend set, the log is synced before Append returns.
+// Appends go straight to the active segment, so unlike reads they never have to look up a segment
+func (l *Log) Append(record *api.Record) (uint64, error) {
+	off, err := l.append(record)
+	if err != nil || !l.Config.SyncOnAppend {
+		return off, err
+	}
+
+	return off, l.Sync()
+}
+
+func (l *Log) append(record *api.Record) (uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return 0, api.ErrClosed{}
+	}
+
+	return l.appendRecord(record)
+}
+
+// AppendIf appends the record like Append, but only when the log's highest offset, as HighestOffset returns it, is
+// expectedHighest. Otherwise nothing is appended and ErrConcurrentModification is returned, which lets a caller that
+// decided what to append from what it read make sure nothing was appended since
+func (l *Log) AppendIf(expectedHighest uint64, record *api.Record) (uint64, error) {
+	off, err := l.appendIf(expectedHighest, record)
+	if err != nil || !l.Config.SyncOnAppend {
+		return off, err
+	}
+
+	return off, l.Sync()
+}
+
+func (l *Log) appendIf(expectedHighest uint64, record *api.Record) (uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return 0, api.ErrClosed{}
+	}
+	if l.highestOffset() != expectedHighest {
+		return 0, ErrConcurrentModification
+	}
+
+	return l.appendRecord(record)
+}
+
+// AppendWithPosition appends the record like Append, and also returns where it was stored: the base offset of its
+// segment and its position in the segment's store, which is what ReadRawAt reads it back with
+func (l *Log) AppendWithPosition(record *api.Record) (off uint64, baseOffset uint64, pos uint64, err error) {
+	off, baseOffset, pos, err = l.appendPositioned(record)
+	if err != nil || !l.Config.SyncOnAppend {
+		return off, baseOffset, pos, err
+	}
+
+	return off, baseOffset, pos, l.Sync()
+}
+
+func (l *Log) appendPositioned(record *api.Record) (uint64, uint64, uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return 0, 0, 0, api.ErrClosed{}
+	}
+
+	return l.appendRecordPos(record)
+}
+
+// AppendMany appends the records in order, taking the log's lock once for all of them, and returns the offset of the
+// first one along with how many were appended. The active segment is rolled whenever it fills up along the way, like
+// it is by Append. Offsets are contiguous unless an OffsetAllocator skips ahead. When appending a record fails, the
+// records before it stay appended and n says how many there are. With SyncOnAppend set, the log is synced once, after
+// the last record
+func (l *Log) AppendMany(records []*api.Record) (firstOffset uint64, n int, err error) {
+	firstOffset, n, err = l.appendMany(records, nil)
+	if n == 0 || !l.Config.SyncOnAppend {
+		return firstOffset, n, err
+	}
+
+	if serr := l.Sync(); err == nil {
+		err = serr
+	}
+	return firstOffset, n, err
+}
+
+// RecordPosition is where a record was stored: the base offset of its segment and its position in the segment's store,
+// which is what ReadRawAt reads it back with
+type RecordPosition struct {
+	BaseOffset uint64
+	Pos        uint64
+}
+
+// AppendManyWithPositions appends the records like AppendMany, and also returns where each of them was stored, like
+// AppendWithPosition does. There are as many positions as records appended, and the records' offsets are set on them
+func (l *Log) AppendManyWithPositions(records []*api.Record) ([]RecordPosition, error) {
+	positions := make([]RecordPosition, 0, len(records))
+	_, n, err := l.appendMany(records, &positions)
+	if n == 0 || !l.Config.SyncOnAppend {
+		return positions, err
+	}
+
+	if serr := l.Sync(); err == nil {
+		err = serr
+	}
+	return positions, err
+}
+
+// appendMany appends the records for AppendMany, adding where each of them was stored to positions unless it is nil
+func (l *Log) appendMany(records []*api.Record, positions *[]RecordPosition) (uint64, int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return 0, 0, api.ErrClosed{}
+	}
+
+	first := l.activeSegment.nextOffset
+	for i, record := range records {
+		off, baseOffset, pos, err := l.appendRecordPos(record)
+		if err != nil {
+			return first, i, err
+		}
+		if i == 0 {
+			first = off
+		}
+		if positions != nil {
+			*positions = append(*positions, RecordPosition{BaseOffset: baseOffset, Pos: pos})
+		}
+	}
+	return first, len(records), nil
+}
+
+// AppendBytes appends a raw payload for callers that don't want to deal with api.Record. The payload is kept as the
+// value of a record, so that it still gets an offset and a timestamp like any other record
+func (l *Log) AppendBytes(p []byte) (uint64, error) {
+	return l.Append(&api.Record{Value: p})
+}
+
+// ReadBytes reads the payload of the record at the given offset, as appended with AppendBytes
+func (l *Log) ReadBytes(off uint64) ([]byte, error) {
+	record, err := l.Read(off)
+	if err != nil {
+		return nil, err
+	}
+
+	return record.Value, nil
+}
+
+// PeekNextOffset returns the offset the next appended record will get, without appending anything. Another append
+// can get in between the peek and the caller's own append, so the offset only holds when there is a single producer
+func (l *Log) PeekNextOffset() uint64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	return l.activeSegment.nextOffset
+}
+
+// appendRecord appends the record to the active segment and rolls over to a new segment once the active one is maxed
+// or older than MaxAge. The caller is expected to hold the write lock
+func (l *Log) appendRecord(record *api.Record) (uint64, error) {
+	off, _, _, err := l.appendRecordPos(record)
+	return off, err
+}
+
+// appendRecordPos is appendRecord that also returns the base offset of the segment the record went to and the record's
+// position in the segment's store
+func (l *Log) appendRecordPos(record *api.Record) (off uint64, baseOffset uint64, pos uint64, err error) {
+	now, err := l.prepare(record)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	off, err = l.appendWith(now, recordBytes(record), func(*segment) (uint64, error) {
+		return l.allocate(func(s *segment, cur uint64) (uint64, error) {
+			var err error
+			off, pos, err = s.appendAt(record, cur)
+			baseOffset = s.baseOffset
+			return off, err
+		})
+	})
+	return off, baseOffset, pos, err
+}
+
+// allocate appends to the active segment with fn at the next offset, which the OffsetAllocator hands out if there is
+// one. It is only asked for an offset now that the record is about to be written, and gets it back if it can take it
+// when the record isn't. An offset that skips too far ahead for the active segment gets a segment of its own first.
+// The caller is expected to hold the write lock
+func (l *Log) allocate(fn func(s *segment, cur uint64) (uint64, error)) (uint64, error) {
+	allocator := l.Config.OffsetAllocator
+	if allocator == nil {
+		return fn(l.activeSegment, l.activeSegment.nextOffset)
+	}
+
+	cur := allocator.Next()
+	off, err := l.appendAllocated(cur, fn)
+	if releaser, ok := allocator.(OffsetReleaser); ok && err != nil {
+		releaser.Release(cur)
+	}
+	return off, err
+}
+
+// appendAllocated appends with fn at the offset handed out by the OffsetAllocator
+func (l *Log) appendAllocated(cur uint64, fn func(s *segment, cur uint64) (uint64, error)) (uint64, error) {
+	if cur < l.activeSegment.nextOffset {
+		return 0, ErrOffsetNotSequential
+	}
+	// relative offsets are kept in 32 bits, so offsets that skip far ahead need a segment of their own
+	if cur-l.activeSegment.baseOffset > math.MaxUint32 {
+		if err := l.roll(cur); err != nil {
+			return 0, writeFailed(err)
+		}
+	}
+	return fn(l.activeSegment, cur)
+}
+
+// appendRecordAt is appendRecordPos for a record with the given offset, which may skip ahead of the log's next offset
+func (l *Log) appendRecordAt(record *api.Record, off uint64) (uint64, uint64, uint64, error) {
+	now, err := l.prepare(record)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	if off < l.activeSegment.nextOffset {
+		return 0, 0, 0, ErrOffsetNotSequential
+	}
+	// relative offsets are kept in 32 bits, so offsets that skip far ahead need a segment of their own
+	if off-l.activeSegment.baseOffset > math.MaxUint32 {
+		if err := l.roll(off); err != nil {
+			return 0, 0, 0, err
+		}
+	}
+
+	var baseOffset, pos uint64
+	off, err = l.appendWith(now, recordBytes(record), func(s *segment) (uint64, error) {
+		var err error
+		off, pos, err = s.appendAt(record, off)
+		baseOffset = s.baseOffset
+		return off, err
+	})
+	return off, baseOffset, pos, err
+}
+
+// prepare runs the middleware on the record, then timestamps and compresses it before it is appended, returning the
+// time it was timestamped at
+func (l *Log) prepare(record *api.Record) (time.Time, error) {
+	now, err := l.intercept(record)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return now, compress(record, l.Config.Compression)
+}
+
+// intercept is prepare without the compression: it runs the middleware on the record and timestamps it
+func (l *Log) intercept(record *api.Record) (time.Time, error) {
+	for _, mw := range l.middleware {
+		if err := mw(record); err != nil {
+			return time.Time{}, err
+		}
+	}
+
+	now := l.Config.Clock.Now()
+	if record.Timestamp == 0 {
+		record.Timestamp = now.UnixNano()
+	}
+	return now, nil
+}
+
+// appendWith rolls the active segment if it has expired, appends to it with fn and rolls it once it is maxed. Appends
+// are refused while the circuit breaker is open. With MaxTotalBytes set, the oldest segments are removed first to make
+// room for the n bytes fn is about to append. The caller is expected to hold the write lock
+func (l *Log) appendWith(now time.Time, n uint64, fn func(s *segment) (uint64, error)) (uint64, error) {
+	if l.Config.ReadOnly {
+		return 0, ErrReadOnly
+	}
+	if l.activeSegment == nil {
+		return 0, ErrNoActiveSegment
+	}
+	if l.Config.ManualRoll && l.activeSegment.IsMaxed() {
+		return 0, ErrSegmentFull
+	}
+	if !l.breaker.allow(now) {
+		return 0, api.ErrLogUnavailable{}
+	}
+	if err := l.makeRoom(n); err != nil {
+		return 0, err
+	}
+
+	off, err := l.appendTo(now, fn)
+	l.breaker.record(now, err, l.Config)
+	return off, unwrapWriteFailure(err)
+}
+
+// appendTo appends to the active segment with fn, rolling the segment before the append when it has expired and after
+// the append when it is maxed. Segments are only rolled by Rotate with ManualRoll set. Errors from writing to storage
+// are marked with writeFailed for the breaker. The caller is expected to hold the write lock
+func (l *Log) appendTo(now time.Time, fn func(s *segment) (uint64, error)) (uint64, error) {
+	if l.activeSegment.IsExpired(now) && !l.Config.ManualRoll {
+		if err := l.roll(l.activeSegment.nextOffset); err != nil {
+			return 0, writeFailed(err)
+		}
+	}
+
+	off, err := fn(l.activeSegment)
+	if err != nil {
+		return 0, err
+	}
+	if l.activeSegment.created.IsZero() {
+		l.activeSegment.created = now
+	}
+
+	if l.activeSegment.IsMaxed() && !l.Config.ManualRoll {
+		err = writeFailed(l.roll(off + 1))
+	}
+	return off, err
+}
+
+// AppendReader appends a record with a value of size bytes read from r. The value is streamed into the store rather
+// than being held in memory, which is why its size has to be known up front. The value isn't compressed, but otherwise
+// the record is appended like it is by Append: it goes through the middleware, without its value, gets its offset from
+// the OffsetAllocator and is synced with SyncOnAppend set
+func (l *Log) AppendReader(r io.Reader, size int64) (uint64, error) {
+	if size < 0 {
+		return 0, ErrNegativeSize
+	}
+
+	off, err := l.appendReader(r, size)
+	if err != nil || !l.Config.SyncOnAppend {
+		return off, err
+	}
+
+	return off, l.Sync()
+}
+
+func (l *Log) appendReader(r io.Reader, size int64) (uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return 0, api.ErrClosed{}
+	}
+
+	// the value is only read as it is written, so there's nothing but the timestamp for the middleware to go by
+	record := &api.Record{}
+	now, err := l.intercept(record)
+	if err != nil {
+		return 0, err
+	}
+	// the record's encoding adds a little to the size of its value
+	return l.appendWith(now, maxFrameOverhead+uint64(size)+entWidth, func(*segment) (uint64, error) {
+		return l.allocate(func(s *segment, cur uint64) (uint64, error) {
+			return s.AppendReaderAt(r, size, record.Timestamp, cur)
+		})
+	})
+}
+
+// AppendAt appends the record at the given offset instead of assigning the next one. The offset has to follow on from
+// the highest offset in the log, unless the log is empty in which case the log is restarted at the given offset. With
+// AllowOffsetGaps set the offset may also skip ahead, and the skipped offsets read as ErrCompacted
+func (l *Log) AppendAt(record *api.Record, off uint64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return api.ErrClosed{}
+	}
+	if l.Config.ReadOnly {
+		return ErrReadOnly
+	}
+	if l.activeSegment == nil {
+		return ErrNoActiveSegment
+	}
+
+	if l.isEmpty() && l.activeSegment.baseOffset != off {
+		// nothing has been written yet, so we swap the empty segment out for one starting at the offset we want
+		if err := l.activeSegment.Remove(); err != nil {
+			return err
+		}
+		l.segments, l.activeSegment = nil, nil
+		if err := l.rollSegment(off); err != nil {
+			return err
+		}
+	}
+
+	next := l.activeSegment.nextOffset
+	if off < next || (off > next && !l.Config.AllowOffsetGaps) {
+		return ErrOffsetNotSequential
+	}
+
+	_, _, _, err := l.appendRecordAt(record, off)
+	return err
+}
+
+// isEmpty reports whether no records have been written to the log. The caller is expected to hold a lock
+func (l *Log) isEmpty() bool {
+	return len(l.segments) == 1 && l.segments[0].nextOffset == l.segments[0].baseOffset
+}
+
+// CopyRange reads the records in [start, end) and appends them to dst. When dst is empty or its next offset is start,
+// the offsets are preserved by using AppendAt, otherwise the records are appended and receive new offsets in dst.
+// The number of records copied is returned
+func (l *Log) CopyRange(dst *Log, start, end uint64) (int, error) {
+	dst.mu.RLock()
+	preserve := dst.isEmpty() || dst.activeSegment.nextOffset == start
+	dst.mu.RUnlock()
+
+	n := 0
+	for off := start; off < end; off++ {
+		record, err := l.Read(off)
+		if err != nil {
+			return n, err
+		}
+
+		if preserve {
+			err = dst.AppendAt(record, off)
+		} else {
+			_, err = dst.Append(record)
+		}
+		if err != nil {
+			return n, err
+		}
+		n++
+	}
+
+	return n, nil
+}
+
+// findSegment Finds a segment which contains the given offset. Segments are ordered by offset and don't overlap, so
+// we binary search for the first segment that ends after the offset and check that it doesn't start after it either
+func (l *Log) findSegment(off uint64) *segment {
+	i := sort.Search(len(l.segments), func(i int) bool {
+		return off < l.segments[i].nextOffset
+	})
+	if i < len(l.segments) && l.segments[i].baseOffset <= off {
+		return l.segments[i]
+	}
+	return nil
+}
+
+func (l *Log) Read(off uint64) (*api.Record, error) {
+	record := &api.Record{}
+	if err := l.ReadReuse(off, record); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+// ReadReuse reads the record at off into the given record instead of allocating a new one, which saves consumers
+// reading in a tight loop from creating garbage for every record. into is reset first, so nothing of the record it
+// held before is left in it
+//
+// Offsets below the lowest offset or past the highest one fail with api.ErrOffsetOutOfRange. Offsets in between without
+// a record fail with api.ErrOffsetNotFound, or ErrCompacted when AllowOffsetGaps is set
+func (l *Log) ReadReuse(off uint64, into *api.Record) error {
+	return l.readFrom(off, func(seg *segment) error {
+		return l.readInto(seg, off, into)
+	})
+}
+
+// readInto reads the record at off from the open segment seg into the given record
+func (l *Log) readInto(seg *segment, off uint64, into *api.Record) error {
+	if l.Config.TrackPageFaults {
+		return l.readCountingFaults(seg, off, into)
+	}
+	return seg.readInto(off, into)
+}
+
+// ReadBatch reads up to max records from start on while holding the read lock once, instead of once per record like
+// calling Read in a loop does. It returns the records along with the offset to read the next batch from. Offsets
+// without a record are skipped, so the records are contiguous apart from the gaps in the log. Reading from the end of
+// the log returns no records and start as the next offset, while reading from below the lowest offset fails with
+// api.ErrOffsetOutOfRange.
+//
+// When a record can't be read, the records before it are returned with the offset of the failing record as the next
+// offset, so that reading the next batch returns the error
+func (l *Log) ReadBatch(start uint64, max int) ([]*api.Record, uint64, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if l.closed {
+		return nil, start, api.ErrClosed{}
+	}
+	if start < l.segments[0].baseOffset {
+		return nil, start, api.ErrOffsetOutOfRange{Offset: start}
+	}
+
+	var records []*api.Record
+	off := start
+	for _, seg := range l.segments {
+		if len(records) >= max {
+			break
+		}
+		if seg.nextOffset <= off {
+			continue
+		}
+		if off < seg.baseOffset {
+			// the offsets between the segments are skipped
+			off = seg.baseOffset
+		}
+
+		batch, next, err := l.readBatchFrom(seg, off, max-len(records))
+		records = append(records, batch...)
+		off = next
+		if err != nil {
+			if len(records) > 0 {
+				return records, off, nil
+			}
+			return nil, off, err
+		}
+	}
+
+	return records, off, nil
 }
 
-func NewLog(dir string, c Config) (*Log, error) {
-	if c.Segment.MaxStoreBytes == 0 {
-		c.Segment.MaxStoreBytes = 1024
+// readBatchFrom reads up to max records from the segment, starting at off, and returns them with the offset after the
+// last one
+func (l *Log) readBatchFrom(seg *segment, off uint64, max int) ([]*api.Record, uint64, error) {
+	release, err := l.open.acquire(seg)
+	if err != nil {
+		return nil, off, err
 	}
+	defer release()
 
-	if c.Segment.MaxIndexBytes == 0 {
-		c.Segment.MaxIndexBytes = 1024
+	o, observed := l.Config.Observer.(ReadObserver)
+	var records []*api.Record
+	for ; off < seg.nextOffset && len(records) < max; off++ {
+		record := &api.Record{}
+		err := l.readInto(seg, off, record)
+		if _, ok := err.(api.ErrOffsetOutOfRange); ok {
+			// offsets can be skipped
+			continue
+		}
+		if err != nil {
+			return records, off, err
+		}
+		if observed {
+			o.SegmentRead(seg == l.activeSegment)
+		}
+		records = append(records, record)
 	}
+	return records, off, nil
+}
 
-	l := &Log{
-		Dir:    dir,
-		Config: c,
+// readFrom calls fn with the open segment holding off while holding the read lock, and turns the errors for offsets
+// without a record into the ones ReadReuse documents
+func (l *Log) readFrom(off uint64, fn func(seg *segment) error) error {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if l.closed {
+		return api.ErrClosed{}
 	}
 
-	return l, l.setup()
-}
+	seg := l.findSegment(off)
+	if seg == nil {
+		if off >= l.segments[0].baseOffset && off < l.activeSegment.nextOffset {
+			return l.missing(off)
+		}
+		return api.ErrOffsetOutOfRange{Offset: off}
+	}
 
-func (l *Log) setup() error {
-	files, err := ioutil.ReadDir(l.Dir)
+	release, err := l.open.acquire(seg)
 	if err != nil {
 		return err
 	}
+	defer release()
 
-	var baseOffsets []uint64
-	for _, file := range files {
-		offstr := strings.TrimSuffix(
-			file.Name(),
-			path.Ext(file.Name()),
-		)
-		off, _ := strconv.ParseUint(offstr, 10, 0)
-		baseOffsets = append(baseOffsets, off)
+	err = fn(seg)
+	if _, ok := err.(api.ErrOffsetOutOfRange); ok {
+		// the segment's range covers the offset, it just has no record for it
+		return l.missing(off)
+	}
+	if o, ok := l.Config.Observer.(ReadObserver); ok && err == nil {
+		o.SegmentRead(seg == l.activeSegment)
+	}
+	return err
+}
+
+// missing is the error for an offset within the log's range that has no record
+func (l *Log) missing(off uint64) error {
+	if l.Config.AllowOffsetGaps {
+		return ErrCompacted{Offset: off}
 	}
+	return api.ErrOffsetNotFound{Offset: off}
+}
 
-	// We want the segment ordering to be from oldest to newest, which is why we sort the offsets here
-	sort.Slice(baseOffsets, func(i, j int) bool {
-		return baseOffsets[i] < baseOffsets[j]
-	})
+// ReadAtTime returns the first record with a timestamp at or after t. Timestamps are expected to mostly increase with
+// the offset, which is the case when they're assigned on append. Each segment's time index is used so that we don't
+// have to scan the whole log
+func (l *Log) ReadAtTime(t time.Time) (*api.Record, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
 
-	for i := 0; i < len(baseOffsets); i++ {
-		if err = l.newSegment(baseOffsets[i]); err != nil {
-			return err
-		}
-		// baseOffsets contains offsets for indexes as well as stores. So we skip every second one
-		i++
+	if l.closed {
+		return nil, api.ErrClosed{}
 	}
-	// in case no previous segments were created - we create one now!
-	if l.segments == nil {
-		if err := l.newSegment(l.Config.Segment.InitialOffset); err != nil {
-			return err
-		}
+	if l.isEmpty() {
+		return nil, api.ErrEmptyLog{}
 	}
 
-	return nil
+	ts := t.UnixNano()
+	segments := l.segments
+	// an empty active segment has no timestamps to search through
+	if n := len(segments); n > 0 && segments[n-1].nextOffset == segments[n-1].baseOffset {
+		segments = segments[:n-1]
+	}
+
+	i := sort.Search(len(segments), func(i int) bool {
+		return segments[i].lastTimestamp() >= ts
+	})
+	if i == len(segments) {
+		return nil, ErrNoRecordAtTime
+	}
+
+	release, err := l.open.acquire(segments[i])
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	return segments[i].ReadAtTime(ts)
 }
 
-// newSegment creates a new segment with the given offsent and appends it to the log segments. The newly created Segment
-// is also set to be the current active segment
-func (l *Log) newSegment(off uint64) error {
-	s, err := newSegment(l.Dir, off, l.Config)
+// OffsetAtTime returns the offset of the first record with a timestamp at or after t, like ReadAtTime, which is where
+// to start reading the records from t on. When there are no such records, the log's next offset is returned instead
+func (l *Log) OffsetAtTime(t time.Time) (uint64, error) {
+	record, err := l.ReadAtTime(t)
+	switch err.(type) {
+	case nil:
+		return record.Offset, nil
+	case api.ErrEmptyLog:
+		return l.PeekNextOffset(), nil
+	}
+	if err == ErrNoRecordAtTime {
+		return l.PeekNextOffset(), nil
+	}
+	return 0, err
+}
+
+// ReadRawAt reads the payload of the frame at the given position in the store of the segment starting at baseOffset.
+// The record's bytes are returned as they are stored, which is mostly useful for diagnostics
+func (l *Log) ReadRawAt(baseOffset uint64, storePos uint64) ([]byte, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if l.closed {
+		return nil, api.ErrClosed{}
+	}
+
+	var seg *segment
+	for _, s := range l.segments {
+		if s.baseOffset == baseOffset {
+			seg = s
+			break
+		}
+	}
+	if seg == nil {
+		return nil, ErrSegmentNotFound
+	}
+
+	release, err := l.open.acquire(seg)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	defer release()
 
-	if l.segments == nil {
-		l.segments = make([]*segment, 0)
+	if storePos >= seg.store.Size() {
+		return nil, ErrInvalidPosition
 	}
+	return seg.store.Read(storePos)
+}
 
-	l.segments = append(l.segments, s)
-	l.activeSegment = s
-	return nil
+// ReadReverse sends the records from the given offset down to the lowest offset in the log, newest first. The error
+// channel receives at most one error, after which both channels are closed. Both channels are also closed once the
+// lowest offset has been sent or the context is cancelled. Records truncated while reading end it with ErrTruncated
+func (l *Log) ReadReverse(ctx context.Context, from uint64) (<-chan *api.Record, <-chan error) {
+	records := make(chan *api.Record)
+	errs := make(chan error, 1)
+
+	go func() {
+		defer close(records)
+		defer close(errs)
+
+		lowest, err := l.LowestOffset()
+		if err != nil {
+			errs <- err
+			return
+		}
+
+		for off := from; off >= lowest; off-- {
+			record, err := l.Read(off)
+			if skippedOffset(err) {
+				if off == lowest {
+					return
+				}
+				continue
+			}
+			if _, ok := err.(api.ErrOffsetOutOfRange); ok {
+				// the rest of the records were truncated while we were reading
+				if lowest, _ = l.LowestOffset(); off < lowest {
+					err = ErrTruncated{Offset: off, Lowest: lowest}
+				}
+			}
+			if err != nil {
+				errs <- err
+				return
+			}
+
+			select {
+			case records <- record:
+			case <-ctx.Done():
+				errs <- ctx.Err()
+				return
+			}
+
+			// off is unsigned, so we stop here rather than letting it wrap around
+			if off == lowest {
+				return
+			}
+		}
+	}()
+
+	return records, errs
 }
 
-func (l *Log) Append(record *api.Record) (uint64, error) {
-	l.mu.Lock()
-	defer l.mu.Unlock()
-	off, err := l.activeSegment.Append(record)
+// Search returns the lowest offset whose record pred returns true for, binary searching the log like sort.Search. It
+// is meant for logs whose records are appended in the order of something they hold, like a sequence number embedded in
+// their values: pred has to be false for the records up to some offset and true for all the records after it. Offsets
+// without a record are left out of the search. Records are passed to pred the way Read returns them. The log's next
+// offset is returned when pred is false for every record
+func (l *Log) Search(pred func(*api.Record) bool) (uint64, error) {
+	lo, err := l.LowestOffset()
 	if err != nil {
 		return 0, err
 	}
+	hi := l.PeekNextOffset()
 
-	if l.activeSegment.IsMaxed() {
-		err = l.newSegment(off + 1)
-	}
-	return off, err
-}
+	// found is the lowest offset known to match, which is what's returned unless one before it matches as well
+	found := hi
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		off, err := l.NextAvailable(mid)
+		if _, ok := err.(api.ErrOffsetOutOfRange); ok || (err == nil && off >= hi) {
+			// there are no records from mid up to hi
+			hi = mid
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
 
-// findSegment Finds a segment which contains the given offset
-func (l *Log) findSegment(off uint64) *segment {
-	for _, seg := range l.segments {
-		if seg.baseOffset <= off && off < seg.nextOffset {
-			return seg
+		record, err := l.Read(off)
+		if err != nil {
+			return 0, err
+		}
+		if pred(record) {
+			found, hi = off, mid
+		} else {
+			lo = off + 1
 		}
 	}
-	return nil
+
+	return found, nil
 }
 
-func (l *Log) Read(off uint64) (*api.Record, error) {
-	l.mu.RLock()
-	defer l.mu.RUnlock()
+// Scan returns up to limit records whose value starts with prefix, newest first, which makes it a simple way of looking
+// up the latest records for a key at the start of the value. Compressed values are decompressed to be matched, but the
+// records are returned as they're stored. Deleted records never match. There is no limit when limit is zero
+func (l *Log) Scan(prefix []byte, limit int) ([]*api.Record, error) {
+	lowest, err := l.LowestOffset()
+	if err != nil {
+		return nil, err
+	}
 
-	seg := l.findSegment(off)
-	if seg == nil || seg.nextOffset <= off {
-		return nil, api.ErrOffsetOutOfRange{Offset: off}
+	var matches []*api.Record
+	for next := l.PeekNextOffset(); next > lowest; next-- {
+		record, err := l.Read(next - 1)
+		if skippedOffset(err) {
+			continue
+		}
+		if _, ok := err.(api.ErrOffsetOutOfRange); ok {
+			// the log was truncated while we were scanning
+			if lowest, err = l.LowestOffset(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if record.Deleted {
+			continue
+		}
+
+		value, err := Decompress(record)
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.HasPrefix(value, prefix) {
+			continue
+		}
+
+		matches = append(matches, record)
+		if len(matches) == limit {
+			break
+		}
 	}
 
-	return seg.Read(off)
+	return matches, nil
 }
 
-// Close closes all the segments
+// Close closes all the segments, once the records queued by AppendAsync have been appended
 func (l *Log) Close() error {
+	l.stopAsync()
+	l.stopCompactor()
+
 	l.mu.Lock()
 	defer l.mu.Unlock()
 
+	l.closed = true
+	l.notifyDurable(l.durable)
+	return l.close()
+}
+
+// close closes all the segments. The caller is expected to hold the write lock
+func (l *Log) close() error {
+	if err := l.writeManifest(); err != nil {
+		return err
+	}
+
 	for _, s := range l.segments {
-		if err := s.Close(); err != nil {
+		if err := s.closeForGood(); err != nil {
 			return err
 		}
 	}
@@ -146,10 +1177,24 @@ func (l *Log) Close() error {
 
 // Remove closes the log and removes all the files used by the log
 func (l *Log) Remove() error {
+	l.stopAsync()
+	l.stopCompactor()
+
 	l.mu.Lock()
 	defer l.mu.Unlock()
 
-	if err := l.Close(); err != nil {
+	if l.Config.ReadOnly {
+		return ErrReadOnly
+	}
+
+	l.closed = true
+	l.notifyDurable(l.durable)
+	return l.remove()
+}
+
+// remove closes the log and removes all its files. The caller is expected to hold the write lock
+func (l *Log) remove() error {
+	if err := l.close(); err != nil {
 		return err
 	}
 
@@ -161,7 +1206,55 @@ func (l *Log) Reset() error {
 	l.mu.Lock()
 	defer l.mu.Unlock()
 
-	if err := l.Remove(); err != nil {
+	if l.Config.ReadOnly {
+		return ErrReadOnly
+	}
+
+	if err := l.remove(); err != nil {
+		return err
+	}
+	if err := makeDir(l.Dir, l.Config); err != nil {
+		return err
+	}
+
+	return l.setup()
+}
+
+// SwapDir replaces the log's directory with newDir, for instance a compacted copy of the log, and reopens the log from
+// it. newDir has to be on the same file system as the log's directory since both are renamed. The old directory is
+// removed once the new one is in place
+func (l *Log) SwapDir(newDir string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.Config.ReadOnly {
+		return ErrReadOnly
+	}
+
+	if _, err := os.Stat(newDir); err != nil {
+		return err
+	}
+
+	if err := l.close(); err != nil {
+		return err
+	}
+
+	old := l.Dir + ".old"
+	if err := os.Rename(l.Dir, old); err != nil {
+		return err
+	}
+	if err := os.Rename(newDir, l.Dir); err != nil {
+		// put the old directory back so that the log can carry on from where it was
+		if rerr := os.Rename(old, l.Dir); rerr != nil {
+			return rerr
+		}
+		if serr := l.setup(); serr != nil {
+			return serr
+		}
+		return err
+	}
+
+	if err := os.RemoveAll(old); err != nil {
 		return err
 	}
 
@@ -179,21 +1272,50 @@ func (l *Log) HighestOffset() (uint64, error) {
 	l.mu.RLock()
 	defer l.mu.RUnlock()
 
+	return l.highestOffset(), nil
+}
+
+// highestOffset is HighestOffset for a caller that holds the lock
+func (l *Log) highestOffset() uint64 {
 	off := l.segments[len(l.segments)-1].nextOffset
 	if off == 0 {
-		return 0, nil
+		return 0
 	}
 
-	return off - 1, nil
+	return off - 1
+}
+
+// SegmentCount returns how many segments the log is made up of
+func (l *Log) SegmentCount() int {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	return len(l.segments)
 }
 
-// Truncate removes all segments whose highest offset is lower than the lowest
+// Truncate removes all segments whose highest offset is lower than the lowest. When that includes the active segment,
+// a new empty one takes its place, so that appends carry on from the log's next offset
 func (l *Log) Truncate(lowest uint64) error {
 	l.mu.Lock()
 	defer l.mu.Unlock()
+
+	if l.Config.ReadOnly {
+		return ErrReadOnly
+	}
+
+	// the log always needs an active segment, so one that is about to be removed is replaced by a new one first. An
+	// empty active segment is kept instead, since its replacement would start at the same offset
+	active := l.activeSegment
+	if active.nextOffset <= lowest+1 && active.nextOffset > active.baseOffset {
+		if err := l.roll(active.nextOffset); err != nil {
+			return err
+		}
+	}
+
 	var segments []*segment
 	for _, s := range l.segments {
-		if s.nextOffset <= lowest+1 {
+		if s.nextOffset <= lowest+1 && s != l.activeSegment {
+			l.open.remove(s)
 			if err := s.Remove(); err != nil {
 				return err
 			}
@@ -203,16 +1325,105 @@ func (l *Log) Truncate(lowest uint64) error {
 	}
 
 	l.segments = segments
-	return nil
+	l.Config.Observer.SegmentCount(len(l.segments))
+	return l.writeManifest()
+}
+
+// TruncateFrom removes the records at off and after it, the opposite end of the log from Truncate, so that they can be
+// appended again, for instance by a follower that found its copy of them to be different from the leader's. The
+// segment holding off is rewritten without them and becomes the active segment again, and the segments after it are
+// removed. Truncating from the lowest offset or before it leaves an empty active segment starting at off. It fails
+// with ErrRewriteUnsupported for segments kept by a custom NewStore
+func (l *Log) TruncateFrom(off uint64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return api.ErrClosed{}
+	}
+	if l.Config.ReadOnly {
+		return ErrReadOnly
+	}
+	if off >= l.activeSegment.nextOffset {
+		return nil
+	}
+
+	var keep []*segment
+	for _, s := range l.segments {
+		if s.baseOffset < off {
+			keep = append(keep, s)
+			continue
+		}
+		l.open.remove(s)
+		if err := s.Remove(); err != nil {
+			return err
+		}
+	}
+	l.segments, l.activeSegment = keep, nil
+
+	if len(keep) == 0 {
+		if err := l.newSegment(off); err != nil {
+			return err
+		}
+	} else {
+		last := keep[len(keep)-1]
+		release, err := l.open.lock(last)
+		if err != nil {
+			return err
+		}
+		if last.nextOffset > off {
+			// the records from off on are left behind unread, since they might be why the log is truncated
+			var end uint64
+			if end, err = last.positionFrom(off); err == nil {
+				err = last.rewriteUntil(end, func(record *api.Record) *api.Record {
+					return record
+				})
+			}
+		}
+		// the active segment is never closed by the cache, which it might be as soon as it is released otherwise
+		l.open.remove(last)
+		release()
+		if err != nil {
+			return err
+		}
+		l.activeSegment, last.sealed = last, false
+		// appends only roll a segment after filling it up, so a full one can't be appended to as it is
+		if last.IsMaxed() && !l.Config.ManualRoll {
+			if err := l.newSegment(last.nextOffset); err != nil {
+				return err
+			}
+		}
+	}
+
+	l.durableMu.Lock()
+	if l.durable > l.activeSegment.nextOffset {
+		l.durable = l.activeSegment.nextOffset
+	}
+	l.durableMu.Unlock()
+
+	l.Config.Observer.SegmentCount(len(l.segments))
+	return l.writeManifest()
 }
 
 type originReader struct {
-	*store
+	log *Log
+	seg *segment
 	off int64
 }
 
 func (o *originReader) Read(p []byte) (int, error) {
-	n, err := o.store.ReadAt(p, o.off)
+	// the segment might have to be reopened, which is only ever done while holding the log's lock, so that everything
+	// that looks at the segment while holding the lock for writing can count on it staying as it is
+	o.log.mu.RLock()
+	defer o.log.mu.RUnlock()
+
+	release, err := o.log.open.acquire(o.seg)
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+
+	n, err := o.seg.store.ReadAt(p, o.off)
 	o.off += int64(n)
 	return n, err
 }
@@ -226,8 +1437,81 @@ func (l *Log) Reader() io.Reader {
 	defer l.mu.RUnlock()
 	readers := make([]io.Reader, len(l.segments))
 	for i, s := range l.segments {
-		readers[i] = &originReader{s.store, 0}
+		readers[i] = &originReader{l, s, 0}
+	}
+
+	return io.MultiReader(readers...)
+}
+
+// ReaderBetween is like Reader, but only reads the store bytes of the records in [startOffset, endOffset). Segments that
+// are only partly in the range are trimmed using their indexes. Records appended after ReaderBetween is called aren't
+// included, even when they fall in the range. Failing to find a record's position surfaces as an error from Read
+func (l *Log) ReaderBetween(startOffset, endOffset uint64) io.Reader {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	var readers []io.Reader
+	for _, s := range l.segments {
+		if s.nextOffset <= startOffset || s.baseOffset >= endOffset || s.nextOffset == s.baseOffset {
+			continue
+		}
+
+		start, end, err := l.storeRange(s, startOffset, endOffset)
+		if err != nil {
+			return &errReader{err}
+		}
+		readers = append(readers, io.LimitReader(&originReader{l, s, int64(start)}, int64(end-start)))
 	}
 
 	return io.MultiReader(readers...)
 }
+
+// errReader fails every read with err
+type errReader struct {
+	err error
+}
+
+func (r *errReader) Read([]byte) (int, error) {
+	return 0, r.err
+}
+
+// storeRange returns the positions in the segment's store between which the records in [startOffset, endOffset) are
+// kept. The caller is expected to hold a lock
+func (l *Log) storeRange(s *segment, startOffset, endOffset uint64) (start, end uint64, err error) {
+	release, err := l.open.acquire(s)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer release()
+
+	// the offsets needn't have records, since an OffsetAllocator or AppendAt might have skipped them
+	if startOffset > s.baseOffset {
+		if start, err = s.positionFrom(startOffset); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	end = s.store.Size()
+	if endOffset < s.nextOffset {
+		if end, err = s.positionFrom(endOffset); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	return start, end, nil
+}
+
+// syncDir flushes the directory's entries to storage, making files created in it durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+
+	if err := d.Sync(); err != nil {
+		d.Close()
+		return err
+	}
+
+	return d.Close()
+}
@@ -0,0 +1,250 @@
+package log
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	api "github.com/burmudar/prolog/api/v1"
+)
+
+// The benchmarks cover appending, reading and a mix of the two for a range of record sizes, each with and without a
+// store flush threshold. Run them with
+//
+//	go test -run '^$' -bench . -benchmem ./internal/log
+//
+// Comparing the flush threshold variants shows how flushing during appends trades append throughput for steadier
+// read latency.
+
+var benchRecordSizes = []int{64, 1024, 16 * 1024}
+
+var benchFlushThresholds = []uint64{0, 64 * 1024}
+
+func benchLog(b *testing.B, flushThreshold uint64) *Log {
+	b.Helper()
+
+	dir, err := ioutil.TempDir("", "log-bench")
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { os.RemoveAll(dir) })
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 64 * 1024 * 1024
+	c.Segment.MaxIndexBytes = 16 * 1024 * 1024
+	c.Segment.FlushThreshold = flushThreshold
+	log, err := NewLog(dir, c)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { log.Close() })
+	return log
+}
+
+func benchCases(b *testing.B, fn func(b *testing.B, size int, flushThreshold uint64)) {
+	for _, size := range benchRecordSizes {
+		for _, threshold := range benchFlushThresholds {
+			b.Run(fmt.Sprintf("size=%d/flush=%d", size, threshold), func(b *testing.B) {
+				fn(b, size, threshold)
+			})
+		}
+	}
+}
+
+func BenchmarkLogAppend(b *testing.B) {
+	benchCases(b, func(b *testing.B, size int, flushThreshold uint64) {
+		log := benchLog(b, flushThreshold)
+		value := make([]byte, size)
+
+		b.SetBytes(int64(size))
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if _, err := log.Append(&api.Record{Value: value}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkLogRead(b *testing.B) {
+	benchCases(b, func(b *testing.B, size int, flushThreshold uint64) {
+		log := benchLog(b, flushThreshold)
+		value := make([]byte, size)
+
+		n := 1024
+		for i := 0; i < n; i++ {
+			if _, err := log.Append(&api.Record{Value: value}); err != nil {
+				b.Fatal(err)
+			}
+		}
+
+		b.SetBytes(int64(size))
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if _, err := log.Read(uint64(i % n)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkLogAppendRead(b *testing.B) {
+	benchCases(b, func(b *testing.B, size int, flushThreshold uint64) {
+		log := benchLog(b, flushThreshold)
+		value := make([]byte, size)
+
+		b.SetBytes(int64(size))
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			off, err := log.Append(&api.Record{Value: value})
+			if err != nil {
+				b.Fatal(err)
+			}
+			// read back every other record, which forces the store to flush what it has buffered
+			if i%2 == 0 {
+				if _, err := log.Read(off / 2); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+}
+
+// BenchmarkLogReadReuse is BenchmarkLogRead reading into the same record every time, compare their allocs/op to see
+// what reusing the record saves
+func BenchmarkLogReadReuse(b *testing.B) {
+	benchCases(b, func(b *testing.B, size int, flushThreshold uint64) {
+		log := benchLog(b, flushThreshold)
+		value := make([]byte, size)
+
+		n := 1024
+		for i := 0; i < n; i++ {
+			if _, err := log.Append(&api.Record{Value: value}); err != nil {
+				b.Fatal(err)
+			}
+		}
+
+		record := &api.Record{}
+		b.SetBytes(int64(size))
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if err := log.ReadReuse(uint64(i%n), record); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// BenchmarkSequentialReader reads the log from start to end like a consumer catching up would, with a plain Read loop
+// and with SequentialReaders prefetching ahead of it. The consumer does a little work with every record, which is the
+// time prefetching hides the log's read latency in
+func BenchmarkSequentialReader(b *testing.B) {
+	const n = 1024
+	// hashing the value a few times takes about as long as reading it
+	consume := func(record *api.Record) {
+		for i := 0; i < 4; i++ {
+			sha256.Sum256(record.Value)
+		}
+	}
+
+	for _, readAhead := range []int{0, 16, 128} {
+		b.Run(fmt.Sprintf("readAhead=%d", readAhead), func(b *testing.B) {
+			log := benchLog(b, 0)
+			value := make([]byte, 1024)
+			for i := 0; i < n; i++ {
+				if _, err := log.Append(&api.Record{Value: value}); err != nil {
+					b.Fatal(err)
+				}
+			}
+
+			b.SetBytes(int64(len(value)) * n)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if readAhead == 0 {
+					for off := uint64(0); off < n; off++ {
+						record, err := log.Read(off)
+						if err != nil {
+							b.Fatal(err)
+						}
+						consume(record)
+					}
+					continue
+				}
+
+				r := log.NewSequentialReader(0, readAhead)
+				for j := 0; j < n; j++ {
+					record, err := r.Next()
+					if err != nil {
+						b.Fatal(err)
+					}
+					consume(record)
+				}
+				r.Close()
+			}
+		})
+	}
+}
+
+// BenchmarkFindSegment looks up offsets in logs made up of thousands of segments, comparing the binary search
+// findSegment does with going through the segments one by one
+func BenchmarkFindSegment(b *testing.B) {
+	for _, n := range []int{10, 1000, 10000} {
+		l := &Log{segments: fakeSegments(n, 100)}
+		last := l.segments[n-1].nextOffset
+
+		b.Run(fmt.Sprintf("segments=%d/binary", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if l.findSegment(uint64(i)%last) == nil {
+					b.Fatal("segment not found")
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("segments=%d/linear", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if findSegmentLinear(l.segments, uint64(i)%last) == nil {
+					b.Fatal("segment not found")
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkLogAppendMany compares appending batches of records with AppendMany to appending them one by one
+func BenchmarkLogAppendMany(b *testing.B) {
+	const batch = 100
+
+	for name, appendFn := range map[string]func(log *Log, records []*api.Record) error{
+		"loop": func(log *Log, records []*api.Record) error {
+			for _, record := range records {
+				if _, err := log.Append(record); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		"many": func(log *Log, records []*api.Record) error {
+			_, _, err := log.AppendMany(records)
+			return err
+		},
+	} {
+		b.Run(name, func(b *testing.B) {
+			log := benchLog(b, 0)
+			value := make([]byte, 64)
+
+			b.SetBytes(int64(batch * len(value)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				records := make([]*api.Record, batch)
+				for j := range records {
+					records[j] = &api.Record{Value: value}
+				}
+				if err := appendFn(log, records); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -1,11 +1,21 @@
 package log
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
 	"io/ioutil"
 	"os"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	api "github.com/burmudar/prolog/api/v1"
+	"github.com/burmudar/prolog/internal/testutil"
 	"github.com/stretchr/testify/require"
 	"google.golang.org/protobuf/proto"
 )
@@ -19,6 +29,11 @@ func TestLog(t *testing.T) {
 		"init with existing segments":       testInitExisting,
 		"reader":                            testReader,
 		"truncate":                          testTruncate,
+		"read reverse":                      testReadReverse,
+		"peek next offset":                  testPeekNextOffset,
+		"append and read bytes":             testAppendReadBytes,
+		"reader between":                    testReaderBetween,
+		"append many":                       testAppendMany,
 	} {
 		t.Run(scenario, func(t *testing.T) {
 			dir, err := ioutil.TempDir("", "log-store-test")
@@ -26,7 +41,7 @@ func TestLog(t *testing.T) {
 			defer os.RemoveAll(dir)
 
 			c := Config{}
-			c.Segment.MaxStoreBytes = 32
+			c.Segment.MaxStoreBytes = 64
 			log, err := NewLog(dir, c)
 			require.NoError(t, err)
 
@@ -35,6 +50,41 @@ func TestLog(t *testing.T) {
 	}
 }
 
+func TestLogMemoryBackend(t *testing.T) {
+	// init with existing segments is left out since nothing survives the log being closed
+	for scenario, fn := range map[string]func(
+		t *testing.T, log *Log,
+	){
+		"append and read a record succeeds": testAppendRead,
+		"offset out of range error":         testOutofRangeErr,
+		"reader":                            testReader,
+		"truncate":                          testTruncate,
+		"peek next offset":                  testPeekNextOffset,
+		"append and read bytes":             testAppendReadBytes,
+		"reader between":                    testReaderBetween,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "log-memory-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			c := Config{}
+			c.Segment.MaxStoreBytes = 64
+			c.Segment.NewStore = NewMemoryStore
+			c.Segment.NewIndex = NewMemoryIndex
+			log, err := NewLog(dir, c)
+			require.NoError(t, err)
+
+			fn(t, log)
+
+			// nothing should have been written to disk
+			files, err := ioutil.ReadDir(dir)
+			require.NoError(t, err)
+			require.Empty(t, files)
+		})
+	}
+}
+
 func testAppendRead(t *testing.T, log *Log) {
 	append := &api.Record{
 		Value: []byte("hello world"),
@@ -104,12 +154,103 @@ func testReader(t *testing.T, log *Log) {
 	all, err := ioutil.ReadAll(reader)
 	require.NoError(t, err)
 
+	f, err := DecodeFrame(bytes.NewReader(all))
+	require.NoError(t, err)
 	rec := &api.Record{}
-	err = proto.Unmarshal(all[recordLenWidth:], rec)
+	err = proto.Unmarshal(f.Payload, rec)
 	require.NoError(t, err)
 	require.Equal(t, append.Value, rec.Value)
 }
 
+func testReaderBetween(t *testing.T, log *Log) {
+	for i := 0; i < 6; i++ {
+		_, err := log.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+	require.Greater(t, len(log.segments), 2)
+
+	for _, r := range []struct{ start, end uint64 }{{0, 6}, {1, 5}, {2, 3}, {4, 100}, {3, 3}} {
+		all, err := ioutil.ReadAll(log.ReaderBetween(r.start, r.end))
+		require.NoError(t, err)
+
+		var offsets []uint64
+		for r := bytes.NewReader(all); r.Len() > 0; {
+			f, err := DecodeFrame(r)
+			require.NoError(t, err)
+			rec := &api.Record{}
+			require.NoError(t, proto.Unmarshal(f.Payload, rec))
+			require.Equal(t, []byte(fmt.Sprintf("record %d", rec.Offset)), rec.Value)
+			offsets = append(offsets, rec.Offset)
+		}
+
+		var want []uint64
+		for off := r.start; off < r.end && off < 6; off++ {
+			want = append(want, off)
+		}
+		require.Equal(t, want, offsets)
+	}
+}
+
+func testReadReverse(t *testing.T, log *Log) {
+	for i := 0; i < 5; i++ {
+		_, err := log.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+	require.Greater(t, len(log.segments), 1)
+
+	records, errs := log.ReadReverse(context.Background(), 4)
+	want := uint64(4)
+	for record := range records {
+		require.Equal(t, want, record.Offset)
+		require.Equal(t, []byte(fmt.Sprintf("record %d", want)), record.Value)
+		want--
+	}
+	require.NoError(t, <-errs)
+	// the loop ends after offset 0 which wraps want around
+	require.Equal(t, ^uint64(0), want)
+
+	_, errs = log.ReadReverse(context.Background(), 5)
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: 5}, <-errs)
+}
+
+func testPeekNextOffset(t *testing.T, log *Log) {
+	// enough records to roll over into new segments along the way
+	for i := 0; i < 5; i++ {
+		next := log.PeekNextOffset()
+		require.Equal(t, next, log.PeekNextOffset())
+
+		off, err := log.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", next))})
+		require.NoError(t, err)
+		require.Equal(t, next, off)
+	}
+}
+
+func testAppendReadBytes(t *testing.T, log *Log) {
+	payloads := [][]byte{
+		[]byte("plain text"),
+		{0x00, 0xff, 0x0a, 0x08, 0x00},
+		{},
+	}
+
+	for i, p := range payloads {
+		off, err := log.AppendBytes(p)
+		require.NoError(t, err)
+		require.Equal(t, uint64(i), off)
+	}
+
+	for i, want := range payloads {
+		got, err := log.ReadBytes(uint64(i))
+		require.NoError(t, err)
+		require.Equal(t, len(want), len(got))
+		if len(want) > 0 {
+			require.Equal(t, want, got)
+		}
+	}
+
+	_, err := log.ReadBytes(uint64(len(payloads)))
+	require.Error(t, err)
+}
+
 func testTruncate(t *testing.T, log *Log) {
 	append := &api.Record{
 		Value: []byte("hello world"),
@@ -125,3 +266,1346 @@ func testTruncate(t *testing.T, log *Log) {
 	_, err = log.Read(0)
 	require.Error(t, err)
 }
+
+func TestLogTruncateAll(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-truncate-all-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 64
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	// truncating an empty log keeps its empty active segment
+	require.NoError(t, log.Truncate(10))
+	require.Equal(t, 1, log.SegmentCount())
+
+	for i := 0; i < 5; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.NoError(t, log.Truncate(log.PeekNextOffset()))
+	require.Equal(t, 1, log.SegmentCount())
+
+	_, err = log.Read(4)
+	require.IsType(t, api.ErrOffsetOutOfRange{}, err)
+
+	off, err := log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), off)
+	record, err := log.Read(off)
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello world"), record.Value)
+
+	// a log that lost its active segment fails appends instead of panicking
+	log.mu.Lock()
+	log.activeSegment = nil
+	log.mu.Unlock()
+	_, err = log.Append(&api.Record{Value: []byte("hello world")})
+	require.Equal(t, ErrNoActiveSegment, err)
+	require.Equal(t, ErrNoActiveSegment, log.AppendAt(&api.Record{Value: []byte("hello world")}, 6))
+}
+
+func TestLogTruncatePastActive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-truncate-past-active-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{Manifest: true}
+	c.Segment.MaxStoreBytes = 64
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+
+	for i := 0; i < 5; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	active := log.activeSegment
+
+	// lowest is well past the end of the active segment, which is replaced rather than left pointing at removed files
+	require.NoError(t, log.Truncate(100))
+	require.NotSame(t, active, log.activeSegment)
+	require.Equal(t, []*segment{log.activeSegment}, log.segments)
+	_, err = os.Stat(path.Join(dir, segmentFileName(active.baseOffset, storeExt)))
+	require.True(t, os.IsNotExist(err))
+
+	off, err := log.Append(&api.Record{Value: []byte("hello again")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), off)
+	require.NoError(t, log.Close())
+
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	record, err := log.Read(5)
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello again"), record.Value)
+	off, err = log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(6), off)
+}
+
+func TestLogCopyRange(t *testing.T) {
+	newTestLog := func() *Log {
+		dir, err := ioutil.TempDir("", "log-copy-test")
+		require.NoError(t, err)
+		t.Cleanup(func() { os.RemoveAll(dir) })
+
+		c := Config{}
+		c.Segment.MaxStoreBytes = 64
+		log, err := NewLog(dir, c)
+		require.NoError(t, err)
+		return log
+	}
+
+	src := newTestLog()
+	for i := 0; i < 5; i++ {
+		_, err := src.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+
+	// dst is empty so offsets are preserved
+	dst := newTestLog()
+	n, err := src.CopyRange(dst, 1, 4)
+	require.NoError(t, err)
+	require.Equal(t, 3, n)
+
+	off, err := dst.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), off)
+	off, err = dst.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), off)
+
+	for off := uint64(1); off < 4; off++ {
+		want, err := src.Read(off)
+		require.NoError(t, err)
+		got, err := dst.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, want.Value, got.Value)
+		require.Equal(t, want.Offset, got.Offset)
+	}
+
+	// dst's next offset is 4, so copying from 0 can't preserve offsets and appends instead
+	n, err = src.CopyRange(dst, 0, 1)
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+
+	got, err := dst.Read(4)
+	require.NoError(t, err)
+	require.Equal(t, []byte("record 0"), got.Value)
+
+	require.Equal(t, ErrOffsetNotSequential, dst.AppendAt(&api.Record{}, 10))
+}
+
+func TestLogRollsExpiredSegments(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-max-age-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	clock := testutil.NewFakeClock(time.Now())
+	c := Config{Clock: clock}
+	c.Segment.MaxAge = time.Minute
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+
+	append := &api.Record{Value: []byte("hello world")}
+	for i := 0; i < 2; i++ {
+		_, err = log.Append(&api.Record{Value: append.Value})
+		require.NoError(t, err)
+		clock.Advance(30 * time.Second)
+	}
+	require.Len(t, log.segments, 1)
+
+	// the segment's first record is now a minute old
+	off, err := log.Append(&api.Record{Value: append.Value})
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), off)
+	require.Len(t, log.segments, 2)
+	require.Equal(t, uint64(2), log.activeSegment.baseOffset)
+
+	rec, err := log.Read(2)
+	require.NoError(t, err)
+	require.Equal(t, append.Value, rec.Value)
+	require.Equal(t, clock.Now().UnixNano(), rec.Timestamp)
+}
+
+func TestLogSwapDir(t *testing.T) {
+	newTestLog := func() *Log {
+		dir, err := ioutil.TempDir("", "log-swap-test")
+		require.NoError(t, err)
+		t.Cleanup(func() { os.RemoveAll(dir) })
+
+		c := Config{}
+		c.Segment.MaxStoreBytes = 64
+		log, err := NewLog(dir, c)
+		require.NoError(t, err)
+		return log
+	}
+
+	log := newTestLog()
+	for i := 0; i < 5; i++ {
+		_, err := log.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+
+	// a missing directory leaves the log as it is
+	require.Error(t, log.SwapDir(log.Dir+"-missing"))
+	_, err := log.Read(0)
+	require.NoError(t, err)
+
+	compacted := newTestLog()
+	n, err := log.CopyRange(compacted, 3, 5)
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+	require.NoError(t, compacted.Close())
+
+	require.NoError(t, log.SwapDir(compacted.Dir))
+	_, err = os.Stat(compacted.Dir)
+	require.True(t, os.IsNotExist(err))
+
+	off, err := log.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), off)
+	_, err = log.Read(0)
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: 0}, err)
+
+	record, err := log.Read(4)
+	require.NoError(t, err)
+	require.Equal(t, []byte("record 4"), record.Value)
+
+	off, err = log.Append(&api.Record{Value: []byte("record 5")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), off)
+	require.NoError(t, log.Close())
+}
+
+func TestLogClosed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-closed-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	log, err := NewLog(dir, Config{})
+	require.NoError(t, err)
+
+	_, err = log.ReadAtTime(time.Now())
+	require.Equal(t, api.ErrEmptyLog{}, err)
+
+	_, err = log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.NoError(t, log.Close())
+
+	_, err = log.Append(&api.Record{Value: []byte("hello world")})
+	require.Equal(t, api.ErrClosed{}, err)
+	require.Equal(t, api.ErrClosed{}, log.AppendAt(&api.Record{}, 1))
+	_, err = log.Read(0)
+	require.Equal(t, api.ErrClosed{}, err)
+	_, err = log.ReadAtTime(time.Now())
+	require.Equal(t, api.ErrClosed{}, err)
+}
+
+func TestSyncDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-sync-dir-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	require.NoError(t, syncDir(dir))
+	require.Error(t, syncDir(dir+"-missing"))
+
+	// rolling segments syncs the directory every time a segment is created, and again once the manifest is replaced
+	c := Config{Manifest: true}
+	c.Segment.MaxStoreBytes = 64
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.Greater(t, len(log.segments), 1)
+}
+
+func TestLogAppendReader(t *testing.T) {
+	for scenario, configure := range map[string]func(c *Config){
+		"file store": func(c *Config) {},
+		"memory store": func(c *Config) {
+			c.Segment.NewStore = NewMemoryStore
+			c.Segment.NewIndex = NewMemoryIndex
+		},
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "log-append-reader-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			c := Config{}
+			c.Segment.MaxStoreBytes = 1 << 20
+			configure(&c)
+			log, err := NewLog(dir, c)
+			require.NoError(t, err)
+			defer log.Close()
+
+			_, err = log.Append(&api.Record{Value: []byte("before")})
+			require.NoError(t, err)
+
+			value := bytes.Repeat([]byte{0x00, 0x01, 0xfe, 0xff}, 4096)
+			off, err := log.AppendReader(bytes.NewReader(value), int64(len(value)))
+			require.NoError(t, err)
+			require.Equal(t, uint64(1), off)
+
+			// a reader that comes up short doesn't leave anything behind
+			_, err = log.AppendReader(bytes.NewReader(value[:10]), int64(len(value)))
+			require.Error(t, err)
+			_, err = log.AppendReader(bytes.NewReader(value), -1)
+			require.Equal(t, ErrNegativeSize, err)
+
+			off, err = log.Append(&api.Record{Value: []byte("after")})
+			require.NoError(t, err)
+			require.Equal(t, uint64(2), off)
+
+			record, err := log.Read(1)
+			require.NoError(t, err)
+			require.Equal(t, value, record.Value)
+			require.Equal(t, uint64(1), record.Offset)
+			require.NotZero(t, record.Timestamp)
+
+			record, err = log.Read(2)
+			require.NoError(t, err)
+			require.Equal(t, []byte("after"), record.Value)
+		})
+	}
+}
+
+func TestLogAppendReaderMiddleware(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-append-reader-middleware-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	log, err := NewLog(dir, Config{SyncOnAppend: true})
+	require.NoError(t, err)
+	defer log.Close()
+
+	// the middleware refuses records until it is given a timestamp to set on them
+	refuse := fmt.Errorf("refused")
+	var timestamp int64
+	log.Use(func(record *api.Record) error {
+		// the value is streamed, so it isn't there yet
+		require.Empty(t, record.Value)
+		if timestamp == 0 {
+			return refuse
+		}
+		record.Timestamp = timestamp
+		return nil
+	})
+
+	_, err = log.AppendReader(strings.NewReader("hello world"), 11)
+	require.Equal(t, refuse, err)
+	require.Equal(t, uint64(0), log.PeekNextOffset())
+
+	timestamp = 42
+	off, err := log.AppendReader(strings.NewReader("hello world"), 11)
+	require.NoError(t, err)
+
+	record, err := log.Read(off)
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello world"), record.Value)
+	require.Equal(t, int64(42), record.Timestamp)
+
+	// with SyncOnAppend set, the record is durable as soon as it's appended
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	require.NoError(t, log.WaitDurable(ctx, off))
+}
+
+func TestLogReadRawAt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-read-raw-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 64
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+
+	// find where offset 1 lives the same way Read does
+	seg := log.findSegment(1)
+	_, pos, err := seg.index.Read(int64(1 - seg.baseOffset))
+	require.NoError(t, err)
+
+	p, err := log.ReadRawAt(seg.baseOffset, pos)
+	require.NoError(t, err)
+	record := &api.Record{}
+	require.NoError(t, proto.Unmarshal(p, record))
+	require.Equal(t, uint64(1), record.Offset)
+	require.Equal(t, []byte("record 1"), record.Value)
+
+	_, err = log.ReadRawAt(seg.baseOffset+100, 0)
+	require.Equal(t, ErrSegmentNotFound, err)
+	_, err = log.ReadRawAt(seg.baseOffset, seg.store.Size())
+	require.Equal(t, ErrInvalidPosition, err)
+}
+
+func TestLogAppendWithPosition(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-append-with-position-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = 2 * entWidth
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	// two records fit in a segment, so the records are spread over a few of them
+	for i := 0; i < 5; i++ {
+		off, baseOffset, pos, err := log.AppendWithPosition(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+		require.Equal(t, uint64(i), off)
+		require.Equal(t, uint64(i/2*2), baseOffset)
+
+		p, err := log.ReadRawAt(baseOffset, pos)
+		require.NoError(t, err)
+		record := &api.Record{}
+		require.NoError(t, proto.Unmarshal(p, record))
+		require.Equal(t, off, record.Offset)
+		require.Equal(t, []byte(fmt.Sprintf("record %d", i)), record.Value)
+	}
+}
+
+// strideAllocator hands out every stride'th offset
+type strideAllocator struct {
+	next, stride uint64
+}
+
+func (a *strideAllocator) Next() uint64 {
+	off := a.next
+	a.next += a.stride
+	return off
+}
+
+func (a *strideAllocator) Release(off uint64) {
+	a.next = off
+}
+
+func TestLogOffsetAllocator(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-allocator-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{OffsetAllocator: &strideAllocator{stride: 2}, FaultInjector: &FaultInjector{}}
+	c.Segment.MaxStoreBytes = 64
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+
+	n := 10
+	for i := 0; i < n; i++ {
+		off, err := log.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+		require.Equal(t, uint64(2*i), off)
+	}
+	require.Greater(t, len(log.segments), 2)
+
+	testReads := func(log *Log) {
+		for i := 0; i < n; i++ {
+			record, err := log.Read(uint64(2 * i))
+			require.NoError(t, err)
+			require.Equal(t, []byte(fmt.Sprintf("record %d", i)), record.Value)
+
+			// the skipped offsets are in the log's range, apart from the one after the last record
+			_, err = log.Read(uint64(2*i + 1))
+			if i < n-1 {
+				require.Equal(t, api.ErrOffsetNotFound{Offset: uint64(2*i + 1)}, err)
+			} else {
+				require.Equal(t, api.ErrOffsetOutOfRange{Offset: uint64(2*i + 1)}, err)
+			}
+		}
+
+		record, err := log.ReadAtTime(time.Unix(0, 0))
+		require.NoError(t, err)
+		require.Equal(t, uint64(0), record.Offset)
+
+		// ranges can start and end at skipped offsets, they cover the records in between
+		p, err := ioutil.ReadAll(log.ReaderBetween(1, 5))
+		require.NoError(t, err)
+		want, err := ioutil.ReadAll(log.ReaderBetween(2, 6))
+		require.NoError(t, err)
+		require.Equal(t, want, p)
+		require.Contains(t, string(p), "record 1")
+		require.Contains(t, string(p), "record 2")
+		require.NotContains(t, string(p), "record 3")
+	}
+	testReads(log)
+
+	// the indexes can be rebuilt from records whose offsets skip ahead
+	for _, s := range log.segments {
+		require.NoError(t, s.RebuildIndex())
+	}
+	testReads(log)
+	require.NoError(t, log.Close())
+
+	// the segments are opened again from the offsets in their indexes
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	testReads(log)
+
+	off, err := log.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2*(n-1)), off)
+
+	// records that are refused or fail to be written don't use up an offset
+	log.Use(func(record *api.Record) error {
+		if string(record.Value) == "refused" {
+			return fmt.Errorf("refused")
+		}
+		return nil
+	})
+	_, err = log.Append(&api.Record{Value: []byte("refused")})
+	require.Error(t, err)
+	c.FaultInjector.Write = FailFrom(1)
+	_, err = log.Append(&api.Record{Value: []byte("failed")})
+	require.Equal(t, ErrInjectedFault, err)
+	c.FaultInjector.Write = nil
+
+	// records appended from a reader get their offsets from the allocator too
+	off, err = log.AppendReader(bytes.NewReader([]byte("streamed")), int64(len("streamed")))
+	require.NoError(t, err)
+	require.Equal(t, uint64(2*n), off)
+	record, err := log.Read(off)
+	require.NoError(t, err)
+	require.Equal(t, []byte("streamed"), record.Value)
+
+	// an allocator that goes backwards is refused
+	c.OffsetAllocator.(*strideAllocator).next = 0
+	_, err = log.Append(&api.Record{Value: []byte("too low")})
+	require.Equal(t, ErrOffsetNotSequential, err)
+}
+
+func TestLogRotate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-rotate-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	log, err := NewLog(dir, Config{})
+	require.NoError(t, err)
+	defer log.Close()
+
+	// an empty active segment is left alone
+	require.NoError(t, log.Rotate())
+	require.Len(t, log.segments, 1)
+
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+	require.NoError(t, log.Rotate())
+	require.Len(t, log.segments, 2)
+	require.Equal(t, uint64(3), log.activeSegment.baseOffset)
+	require.NoError(t, log.Rotate())
+	require.Len(t, log.segments, 2)
+
+	off, err := log.Append(&api.Record{Value: []byte("record 3")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), off)
+
+	for off := uint64(0); off < 4; off++ {
+		record, err := log.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, []byte(fmt.Sprintf("record %d", off)), record.Value)
+	}
+
+	require.NoError(t, log.Close())
+	require.Equal(t, api.ErrClosed{}, log.Rotate())
+}
+
+func TestLogManualRoll(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-manual-roll-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	clock := testutil.NewFakeClock(time.Now())
+	c := Config{ManualRoll: true, Clock: clock}
+	c.Segment.MaxIndexBytes = entWidth * 2
+	c.Segment.MaxAge = time.Minute
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	appendRecord := func(off int) error {
+		_, err := log.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", off))})
+		return err
+	}
+
+	require.NoError(t, appendRecord(0))
+	require.NoError(t, appendRecord(1))
+
+	// the segment is full, but it's up to us to roll it
+	for i := 0; i < 2; i++ {
+		require.Equal(t, ErrSegmentFull, appendRecord(2))
+	}
+	require.Len(t, log.segments, 1)
+	require.Equal(t, uint64(2), log.PeekNextOffset())
+
+	require.NoError(t, log.Rotate())
+	require.NoError(t, appendRecord(2))
+
+	// expired segments aren't rolled either
+	clock.Advance(time.Hour)
+	require.NoError(t, appendRecord(3))
+	require.Len(t, log.segments, 2)
+	require.Equal(t, ErrSegmentFull, appendRecord(4))
+
+	for off := uint64(0); off < 4; off++ {
+		record, err := log.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, []byte(fmt.Sprintf("record %d", off)), record.Value)
+	}
+}
+
+func TestLogDirMissing(t *testing.T) {
+	parent, err := ioutil.TempDir("", "log-dir-missing-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(parent)
+
+	// NewLog creates the directory, parents and all
+	dir := path.Join(parent, "a", "b")
+	log, err := NewLog(dir, Config{})
+	require.NoError(t, err)
+	_, err = log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+
+	// Reset removes the directory along with the log, and creates it again to start over in
+	require.NoError(t, log.Reset())
+	require.Equal(t, uint64(0), log.PeekNextOffset())
+
+	// but reopening the log from a directory that was removed underneath it says so
+	require.NoError(t, log.Close())
+	require.NoError(t, os.RemoveAll(dir))
+	err = log.setup()
+	require.IsType(t, ErrLogDirMissing{}, err)
+	require.Equal(t, dir, err.(ErrLogDirMissing).Dir)
+	require.True(t, os.IsNotExist(err.(ErrLogDirMissing).Err))
+}
+
+func TestLogReadMissingOffsets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-missing-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 3
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+
+	for i := 0; i < 9; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.Len(t, log.segments, 4)
+	require.NoError(t, log.Close())
+
+	// losing a middle segment leaves a gap in the log
+	for _, ext := range []string{".store", ".index", ".tindex", ".header"} {
+		require.NoError(t, os.Remove(fmt.Sprintf("%s/3%s", dir, ext)))
+	}
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	for off := uint64(0); off < 10; off++ {
+		_, err := log.Read(off)
+		switch {
+		case off >= 3 && off < 6:
+			require.Equal(t, api.ErrOffsetNotFound{Offset: off}, err)
+		case off >= 9:
+			require.Equal(t, api.ErrOffsetOutOfRange{Offset: off}, err)
+		default:
+			require.NoError(t, err)
+		}
+	}
+}
+
+func TestLogReadReuse(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-read-reuse-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	log, err := NewLog(dir, Config{})
+	require.NoError(t, err)
+	defer log.Close()
+
+	values := [][]byte{[]byte("a much longer first record"), []byte("short"), nil}
+	for _, v := range values {
+		_, err := log.Append(&api.Record{Value: v})
+		require.NoError(t, err)
+	}
+	require.NoError(t, log.Delete(1))
+
+	record := &api.Record{}
+	for off, v := range values {
+		require.NoError(t, log.ReadReuse(uint64(off), record))
+		want, err := log.Read(uint64(off))
+		require.NoError(t, err)
+		require.True(t, proto.Equal(want, record))
+		require.Equal(t, uint64(off), record.Offset)
+		if off == 1 {
+			require.True(t, record.Deleted)
+			require.Empty(t, record.Value)
+			continue
+		}
+		// nothing of the record read before is left behind
+		require.False(t, record.Deleted)
+		require.Equal(t, string(v), string(record.Value))
+	}
+
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: 3}, log.ReadReuse(3, record))
+}
+
+func TestLogEmptyRecord(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-empty-record-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// records at offset 0 timestamped at the epoch encode to nothing at all
+	log, err := NewLog(dir, Config{Clock: testutil.NewFakeClock(time.Unix(0, 0))})
+	require.NoError(t, err)
+	defer log.Close()
+
+	for want := uint64(0); want < 3; want++ {
+		off, err := log.Append(&api.Record{})
+		require.NoError(t, err)
+		require.Equal(t, want, off)
+		require.Equal(t, want+1, log.PeekNextOffset())
+	}
+	off, err := log.AppendBytes(nil)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), off)
+
+	for off := uint64(0); off < 4; off++ {
+		record, err := log.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, off, record.Offset)
+		require.NotNil(t, record.Value)
+		require.Empty(t, record.Value)
+	}
+	p, err := log.ReadBytes(3)
+	require.NoError(t, err)
+	require.NotNil(t, p)
+	require.Empty(t, p)
+
+	// the records are found again when the log is reopened
+	require.NoError(t, log.Close())
+	log, err = NewLog(dir, Config{})
+	require.NoError(t, err)
+	defer log.Close()
+	require.Equal(t, uint64(4), log.PeekNextOffset())
+	record, err := log.Read(0)
+	require.NoError(t, err)
+	require.NotNil(t, record.Value)
+}
+
+func TestLogFindSegment(t *testing.T) {
+	segments := fakeSegments(50, 10)
+	// an empty segment, as left behind by rolling, and a gap between segments, as left behind by AppendAt
+	segments[20].nextOffset = segments[20].baseOffset
+	segments[30].nextOffset -= 5
+	l := &Log{segments: segments}
+
+	last := segments[len(segments)-1].nextOffset
+	for off := uint64(0); off < last+10; off++ {
+		require.Equal(t, findSegmentLinear(segments, off), l.findSegment(off), "segment of offset %d", off)
+	}
+	require.Nil(t, (&Log{}).findSegment(0))
+}
+
+// fakeSegments returns n segments of size offsets each, which are only good for looking up segments by offset
+func fakeSegments(n int, size uint64) []*segment {
+	segments := make([]*segment, n)
+	for i := range segments {
+		base := uint64(i) * size
+		segments[i] = &segment{baseOffset: base, nextOffset: base + size}
+	}
+	return segments
+}
+
+// findSegmentLinear is how findSegment used to go through the segments, one by one
+func findSegmentLinear(segments []*segment, off uint64) *segment {
+	for _, seg := range segments {
+		if seg.baseOffset <= off && off < seg.nextOffset {
+			return seg
+		}
+	}
+	return nil
+}
+
+func TestLogReadBatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-read-batch-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{AllowOffsetGaps: true}
+	c.Segment.MaxIndexBytes = entWidth * 3
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	// the records are spread over several segments, with offsets 3 and 4 skipped
+	offsets := []uint64{0, 1, 2, 5, 6, 7, 8}
+	for _, off := range offsets {
+		require.NoError(t, log.AppendAt(&api.Record{Value: []byte(fmt.Sprintf("record %d", off))}, off))
+	}
+
+	var read []uint64
+	next := uint64(0)
+	for {
+		records, n, err := log.ReadBatch(next, 2)
+		require.NoError(t, err)
+		if len(records) == 0 {
+			require.Equal(t, next, n)
+			break
+		}
+		require.LessOrEqual(t, len(records), 2)
+		for _, record := range records {
+			require.Equal(t, []byte(fmt.Sprintf("record %d", record.Offset)), record.Value)
+			read = append(read, record.Offset)
+		}
+		require.Equal(t, records[len(records)-1].Offset+1, n)
+		next = n
+	}
+	require.Equal(t, offsets, read)
+	require.Equal(t, uint64(9), next)
+
+	records, next, err := log.ReadBatch(2, 10)
+	require.NoError(t, err)
+	require.Len(t, records, 5)
+	require.Equal(t, uint64(9), next)
+
+	require.NoError(t, log.Truncate(2))
+	_, _, err = log.ReadBatch(0, 10)
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: 0}, err)
+}
+
+func TestLogOffsetGaps(t *testing.T) {
+	for scenario, allow := range map[string]bool{
+		"gaps are refused":       false,
+		"gaps read as compacted": true,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "log-gaps-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			log, err := NewLog(dir, Config{AllowOffsetGaps: allow})
+			require.NoError(t, err)
+			defer log.Close()
+
+			require.NoError(t, log.AppendAt(&api.Record{Value: []byte("record 0")}, 0))
+			require.NoError(t, log.AppendAt(&api.Record{Value: []byte("record 1")}, 1))
+			err = log.AppendAt(&api.Record{Value: []byte("record 5")}, 5)
+			if !allow {
+				require.Equal(t, ErrOffsetNotSequential, err)
+				return
+			}
+			require.NoError(t, err)
+
+			for off := uint64(2); off < 5; off++ {
+				_, err := log.Read(off)
+				require.Equal(t, ErrCompacted{Offset: off}, err)
+			}
+
+			record, err := log.Read(5)
+			require.NoError(t, err)
+			require.Equal(t, []byte("record 5"), record.Value)
+
+			_, err = log.Read(6)
+			require.Equal(t, api.ErrOffsetOutOfRange{Offset: 6}, err)
+
+			// offsets behind the log are still refused
+			require.Equal(t, ErrOffsetNotSequential, log.AppendAt(&api.Record{}, 3))
+		})
+	}
+}
+
+func TestLogRecordTooLarge(t *testing.T) {
+	for scenario, allow := range map[string]bool{
+		"oversized records fail":       false,
+		"oversized records if allowed": true,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "log-too-large-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			c := Config{AllowOversizedRecords: allow}
+			c.Segment.MaxStoreBytes = 64
+			log, err := NewLog(dir, c)
+			require.NoError(t, err)
+			defer log.Close()
+
+			big := make([]byte, 64)
+			_, err = log.Append(&api.Record{Value: big})
+			_, streamErr := log.AppendReader(bytes.NewReader(big), int64(len(big)))
+			if !allow {
+				require.Equal(t, ErrRecordTooLarge, err)
+				require.Equal(t, ErrRecordTooLarge, streamErr)
+				// nothing was written, so records that fit carry on from where the log was
+				off, err := log.Append(&api.Record{Value: []byte("hello world")})
+				require.NoError(t, err)
+				require.Equal(t, uint64(0), off)
+				return
+			}
+
+			require.NoError(t, err)
+			require.NoError(t, streamErr)
+			// each oversized record fills a segment on its own, so the log rolls after every one of them
+			require.Equal(t, 3, len(log.segments))
+			require.NoError(t, log.Close())
+
+			reopened, err := NewLog(dir, c)
+			require.NoError(t, err)
+			defer reopened.Close()
+			for off := uint64(0); off < 2; off++ {
+				record, err := reopened.Read(off)
+				require.NoError(t, err)
+				require.Equal(t, big, record.Value)
+			}
+			require.NoError(t, reopened.CheckConsistency())
+		})
+	}
+}
+
+func TestLogIndexInterval(t *testing.T) {
+	for _, interval := range []uint64{1, 4} {
+		t.Run(fmt.Sprintf("interval %d", interval), func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "log-index-interval-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			c := Config{}
+			c.Segment.IndexInterval = interval
+			log, err := NewLog(dir, c)
+			require.NoError(t, err)
+
+			n := 10
+			for i := 0; i < n; i++ {
+				_, err := log.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+				require.NoError(t, err)
+			}
+			entries := (uint64(n) + interval - 1) / interval
+			require.Equal(t, entries*entWidth, log.activeSegment.index.Size())
+
+			check := func() {
+				for i := 0; i < n; i++ {
+					record, err := log.Read(uint64(i))
+					require.NoError(t, err)
+					require.Equal(t, uint64(i), record.Offset)
+					require.Equal(t, []byte(fmt.Sprintf("record %d", i)), record.Value)
+				}
+				_, err := log.Read(uint64(n))
+				require.Equal(t, api.ErrOffsetOutOfRange{Offset: uint64(n)}, err)
+				require.NoError(t, log.CheckConsistency())
+			}
+			check()
+
+			// the records after the last index entry are found again when the log is reopened
+			require.NoError(t, log.Close())
+			log, err = NewLog(dir, c)
+			require.NoError(t, err)
+			defer log.Close()
+			check()
+
+			off, err := log.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", n))})
+			require.NoError(t, err)
+			require.Equal(t, uint64(n), off)
+			n++
+			check()
+		})
+	}
+}
+
+func TestLogIndexIntervalChanged(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-index-interval-changed-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.IndexInterval = 4
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		_, err := log.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+	require.NoError(t, log.Close())
+
+	// the segment keeps the interval it was created with when the log is opened with another one
+	c.Segment.IndexInterval = 1
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	require.Equal(t, uint64(4), log.activeSegment.indexInterval)
+
+	_, err = log.Append(&api.Record{Value: []byte("record 10")})
+	require.NoError(t, err)
+	for i := 0; i < 11; i++ {
+		record, err := log.Read(uint64(i))
+		require.NoError(t, err)
+		require.Equal(t, []byte(fmt.Sprintf("record %d", i)), record.Value)
+	}
+	require.NoError(t, log.CheckConsistency())
+
+	// while new segments get the one the log is configured with
+	require.NoError(t, log.Rotate())
+	require.Equal(t, uint64(1), log.activeSegment.indexInterval)
+}
+
+func TestLogSearch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-search-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{AllowOffsetGaps: true}
+	c.Segment.MaxIndexBytes = entWidth * 4
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	// the records hold sequence numbers that go up by 10, and offsets 5 to 7 are skipped
+	seq := func(record *api.Record) uint64 {
+		return binary.BigEndian.Uint64(record.Value)
+	}
+	for _, off := range []uint64{0, 1, 2, 3, 4, 8, 9, 10, 11} {
+		value := make([]byte, 8)
+		binary.BigEndian.PutUint64(value, off*10)
+		require.NoError(t, log.AppendAt(&api.Record{Value: value}, off))
+	}
+
+	for want, atLeast := range map[uint64]uint64{
+		0:  0,
+		3:  25,
+		4:  40,
+		8:  41,
+		11: 110,
+		12: 111,
+	} {
+		off, err := log.Search(func(record *api.Record) bool {
+			return seq(record) >= atLeast
+		})
+		require.NoError(t, err)
+		require.Equal(t, want, off, "first sequence number >= %d", atLeast)
+	}
+
+	// a record is read for every halving of the offsets, rather than every record being read
+	reads := 0
+	_, err = log.Search(func(record *api.Record) bool {
+		reads++
+		return seq(record) >= 90
+	})
+	require.NoError(t, err)
+	require.LessOrEqual(t, reads, 4)
+}
+
+func TestLogScan(t *testing.T) {
+	for scenario, codec := range map[string]api.CompressionCodec{
+		"uncompressed": api.CompressionCodec_COMPRESSION_NONE,
+		"compressed":   api.CompressionCodec_COMPRESSION_GZIP,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "log-scan-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			c := Config{Compression: codec}
+			c.Segment.MaxStoreBytes = 128
+			log, err := NewLog(dir, c)
+			require.NoError(t, err)
+			defer log.Close()
+
+			for _, v := range []string{"user:1=a", "order:1=x", "user:2=b", "user:1=c", "order:2=y", "user:3=d"} {
+				_, err := log.Append(&api.Record{Value: []byte(v)})
+				require.NoError(t, err)
+			}
+			require.NoError(t, log.Delete(5))
+
+			offsets := func(records []*api.Record) []uint64 {
+				var offs []uint64
+				for _, r := range records {
+					offs = append(offs, r.Offset)
+				}
+				return offs
+			}
+
+			records, err := log.Scan([]byte("user:"), 0)
+			require.NoError(t, err)
+			require.Equal(t, []uint64{3, 2, 0}, offsets(records))
+
+			records, err = log.Scan([]byte("user:"), 2)
+			require.NoError(t, err)
+			require.Equal(t, []uint64{3, 2}, offsets(records))
+
+			records, err = log.Scan([]byte("user:1="), 1)
+			require.NoError(t, err)
+			require.Equal(t, []uint64{3}, offsets(records))
+			value, err := Decompress(records[0])
+			require.NoError(t, err)
+			require.Equal(t, []byte("user:1=c"), value)
+
+			records, err = log.Scan([]byte("invoice:"), 0)
+			require.NoError(t, err)
+			require.Empty(t, records)
+		})
+	}
+}
+
+func testAppendMany(t *testing.T, log *Log) {
+	_, err := log.Append(&api.Record{Value: []byte("first")})
+	require.NoError(t, err)
+
+	var records []*api.Record
+	for i := 0; i < 5; i++ {
+		records = append(records, &api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+	}
+	first, n, err := log.AppendMany(records)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), first)
+	require.Equal(t, len(records), n)
+
+	// the records got contiguous offsets, rolling the active segment as it filled up
+	for i := 0; i < n; i++ {
+		record, err := log.Read(first + uint64(i))
+		require.NoError(t, err)
+		require.Equal(t, first+uint64(i), record.Offset)
+		require.Equal(t, []byte(fmt.Sprintf("record %d", i)), record.Value)
+	}
+	require.Greater(t, log.SegmentCount(), 2)
+
+	// the positions of records appended together are what ReadRawAt reads them back with, across segments too
+	positions, err := log.AppendManyWithPositions(records[:3])
+	require.NoError(t, err)
+	require.Len(t, positions, 3)
+	for i, position := range positions {
+		p, err := log.ReadRawAt(position.BaseOffset, position.Pos)
+		require.NoError(t, err)
+		var record api.Record
+		require.NoError(t, proto.Unmarshal(p, &record))
+		require.Equal(t, uint64(6+i), record.Offset)
+		require.Equal(t, records[i].Offset, record.Offset)
+	}
+
+	first, n, err = log.AppendMany(nil)
+	require.NoError(t, err)
+	require.Equal(t, uint64(9), first)
+	require.Equal(t, 0, n)
+
+	require.NoError(t, log.Close())
+	_, n, err = log.AppendMany(records)
+	require.Equal(t, api.ErrClosed{}, err)
+	require.Equal(t, 0, n)
+}
+
+func TestLogTruncateFrom(t *testing.T) {
+	for _, from := range []uint64{7, 6, 0, 10, 12} {
+		t.Run(fmt.Sprintf("from %d", from), func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "log-truncate-from-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			c := Config{}
+			c.Segment.MaxIndexBytes = entWidth * 3
+			log, err := NewLog(dir, c)
+			require.NoError(t, err)
+
+			n := uint64(10)
+			for i := uint64(0); i < n; i++ {
+				_, err := log.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+				require.NoError(t, err)
+			}
+
+			require.NoError(t, log.TruncateFrom(from))
+			next := from
+			if next > n {
+				next = n
+			}
+			require.Equal(t, next, log.PeekNextOffset())
+
+			// the records that were truncated are appended again, and survive the log being reopened
+			for i := next; i < n; i++ {
+				off, err := log.Append(&api.Record{Value: []byte(fmt.Sprintf("again %d", i))})
+				require.NoError(t, err)
+				require.Equal(t, i, off)
+			}
+			require.NoError(t, log.Close())
+
+			log, err = NewLog(dir, c)
+			require.NoError(t, err)
+			defer log.Close()
+			for i := uint64(0); i < n; i++ {
+				record, err := log.Read(i)
+				require.NoError(t, err)
+				want := fmt.Sprintf("record %d", i)
+				if i >= next {
+					want = fmt.Sprintf("again %d", i)
+				}
+				require.Equal(t, []byte(want), record.Value)
+			}
+			require.Equal(t, n, log.PeekNextOffset())
+		})
+	}
+}
+
+// barrierStore counts how its records are read, and holds up the ones read with ReadSealed until as many have started
+// as the barrier waits for
+type barrierStore struct {
+	StoreBackend
+	barrier       *sync.WaitGroup
+	reads, sealed *int32
+}
+
+func (s *barrierStore) Read(pos uint64) ([]byte, error) {
+	atomic.AddInt32(s.reads, 1)
+	return s.StoreBackend.Read(pos)
+}
+
+func (s *barrierStore) ReadSealed(pos uint64) ([]byte, error) {
+	atomic.AddInt32(s.sealed, 1)
+	if s.barrier != nil {
+		s.barrier.Done()
+		s.barrier.Wait()
+	}
+	return readSealed(s.StoreBackend, pos)
+}
+
+func TestLogConcurrentSealedReads(t *testing.T) {
+	for scenario, concurrent := range map[string]bool{
+		"sealed segments are read side by side": true,
+		"all segments are read one at a time":   false,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "log-concurrent-sealed-reads-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			c := Config{ConcurrentSealedReads: concurrent}
+			c.Segment.MaxStoreBytes = 1 << 20
+			c.Segment.MaxIndexBytes = entWidth * 64
+			log, err := NewLog(dir, c)
+			require.NoError(t, err)
+			defer log.Close()
+
+			value := bytes.Repeat([]byte("a"), 1024)
+			n := uint64(200)
+			for i := uint64(0); i < n; i++ {
+				_, err := log.Append(&api.Record{Value: value})
+				require.NoError(t, err)
+			}
+			require.Equal(t, 4, log.SegmentCount())
+
+			var reads, sealed int32
+			for _, s := range log.segments {
+				s.store = &barrierStore{StoreBackend: s.store, reads: &reads, sealed: &sealed}
+			}
+
+			for off := uint64(0); off < n; off++ {
+				_, err := log.Read(off)
+				require.NoError(t, err)
+			}
+			if !concurrent {
+				require.Equal(t, int32(n), reads)
+				require.Zero(t, sealed)
+				return
+			}
+			// only the records of the active segment are read the way appends are waited for
+			active := int32(n - log.activeSegment.baseOffset)
+			require.Equal(t, active, reads)
+			require.Equal(t, int32(n)-active, sealed)
+
+			// every tailer only gets past the barrier once all of them are reading a sealed segment at the same
+			// time, which they can't do if one has to wait for another. One that is in the middle of reading the
+			// first segment already doesn't keep them out either
+			tailers := 4
+			barrier := &sync.WaitGroup{}
+			barrier.Add(tailers)
+			for _, s := range log.segments {
+				s.store.(*barrierStore).barrier = barrier
+			}
+			inner := log.segments[0].store.(*barrierStore).StoreBackend.(*store)
+			inner.mu.RLock()
+
+			// the tailers are spread over the sealed segments, two of them reading the same one
+			errs := make(chan error, tailers)
+			for i := 0; i < tailers; i++ {
+				go func(off uint64) {
+					record, err := log.Read(off)
+					if err == nil && record.Offset != off {
+						err = fmt.Errorf("read offset %d, got record with offset %d", off, record.Offset)
+					}
+					errs <- err
+				}(uint64(i) * 48)
+			}
+			for i := 0; i < tailers; i++ {
+				require.NoError(t, <-errs)
+			}
+			inner.mu.RUnlock()
+		})
+	}
+}
+
+func TestLogAppendIf(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-append-if-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	highest, err := log.HighestOffset()
+	require.NoError(t, err)
+
+	// all of them expect the same highest offset, so only the first one to get the lock appends
+	writers := 8
+	start := make(chan struct{})
+	errs := make(chan error, writers)
+	for i := 0; i < writers; i++ {
+		go func(i int) {
+			<-start
+			_, err := log.AppendIf(highest, &api.Record{Value: []byte(fmt.Sprintf("writer %d", i))})
+			errs <- err
+		}(i)
+	}
+	close(start)
+
+	won := 0
+	for i := 0; i < writers; i++ {
+		err := <-errs
+		if err == nil {
+			won++
+			continue
+		}
+		require.Equal(t, ErrConcurrentModification, err)
+	}
+	require.Equal(t, 1, won)
+
+	off, err := log.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, highest+1, off)
+
+	// whoever lost can try again with the offset it reads now
+	off, err = log.AppendIf(off, &api.Record{Value: []byte("again")})
+	require.NoError(t, err)
+	require.Equal(t, highest+2, off)
+}
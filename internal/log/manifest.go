@@ -0,0 +1,66 @@
+package log
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+)
+
+const manifestFile = "manifest.json"
+
+// manifest records the segments of a log, oldest to newest, so that opening a log doesn't have to rely on the names
+// of whatever files happen to be in the log's directory
+type manifest struct {
+	Segments []uint64 `json:"segments"`
+	Active   uint64   `json:"active"`
+}
+
+// readManifest reads the manifest in dir. A nil manifest is returned when there is no manifest
+func readManifest(dir string) (*manifest, error) {
+	p, err := ioutil.ReadFile(path.Join(dir, manifestFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var m manifest
+	if err := json.Unmarshal(p, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// writeManifest replaces the manifest in dir. The manifest is written to a temporary file which is then renamed over
+// the old one, so that a crash midway leaves either the old or the new manifest behind. The directory is synced after the
+// rename, like it is after a segment is created, so that the new manifest is the one left behind once it returns
+func writeManifest(dir string, m *manifest, c Config) error {
+	p, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	tmp := path.Join(dir, manifestFile+".tmp")
+	f, err := openLogFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, c)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(p); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, path.Join(dir, manifestFile)); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
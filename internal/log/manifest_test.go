@@ -0,0 +1,79 @@
+package log
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	api "github.com/burmudar/prolog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogManifest(t *testing.T) {
+	for scenario, fn := range map[string]func(
+		t *testing.T, dir string, c Config,
+	){
+		"stray files are ignored":              testManifestIgnoresStrayFiles,
+		"directory is scanned if it's missing": testManifestMissing,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "log-manifest-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			c := Config{Manifest: true}
+			c.Segment.MaxStoreBytes = 41
+			log, err := NewLog(dir, c)
+			require.NoError(t, err)
+
+			for i := 0; i < 3; i++ {
+				_, err := log.Append(&api.Record{Value: []byte("hello world")})
+				require.NoError(t, err)
+			}
+			require.Equal(t, 3, len(log.segments))
+			require.NoError(t, log.Close())
+
+			fn(t, dir, c)
+		})
+	}
+}
+
+func testManifestIgnoresStrayFiles(t *testing.T, dir string, c Config) {
+	// a scan would mistake this for a segment starting at offset 0
+	require.NoError(t, ioutil.WriteFile(path.Join(dir, "backup.store"), []byte("junk"), 0644))
+
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	require.Equal(t, 3, len(log.segments))
+	testManifestOffsets(t, log)
+}
+
+func testManifestMissing(t *testing.T, dir string, c Config) {
+	require.NoError(t, os.Remove(path.Join(dir, manifestFile)))
+
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	testManifestOffsets(t, log)
+	_, err = os.Stat(path.Join(dir, manifestFile))
+	require.NoError(t, err)
+}
+
+func testManifestOffsets(t *testing.T, log *Log) {
+	lowest, err := log.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), lowest)
+	highest, err := log.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), highest)
+
+	for i := uint64(0); i < 3; i++ {
+		record, err := log.Read(i)
+		require.NoError(t, err)
+		require.Equal(t, []byte("hello world"), record.Value)
+	}
+}
@@ -0,0 +1,179 @@
+package log
+
+import (
+	"fmt"
+	"io"
+	"sync"
+)
+
+// NewMemoryStore is a NewStoreFn which keeps the store's records in memory. Nothing is persisted, so a Log using it
+// starts empty every time it is created
+func NewMemoryStore(dir string, baseOffset uint64, c Config) (StoreBackend, error) {
+	return &memoryStore{
+		name: segmentFilePath(dir, baseOffset, storeExt),
+	}, nil
+}
+
+// NewMemoryIndex is a NewIndexFn which keeps the index entries in memory. Like the file index, it can hold at most
+// MaxIndexBytes worth of entries
+func NewMemoryIndex(dir string, baseOffset uint64, c Config) (IndexBackend, error) {
+	return &memoryIndex{
+		name:     segmentFilePath(dir, baseOffset, indexExt),
+		maxBytes: c.Segment.MaxIndexBytes,
+	}, nil
+}
+
+type memoryStore struct {
+	mu   sync.Mutex
+	name string
+	buf  []byte
+}
+
+func (s *memoryStore) Append(p []byte) (n uint64, pos uint64, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// records are kept in bare frames, without a magic or checksum, since they never leave memory
+	pos = uint64(len(s.buf))
+	s.buf = append(append(s.buf, bareFrames.header(uint64(len(p)))...), p...)
+
+	return bareFrames.overhead() + uint64(len(p)), pos, nil
+}
+
+func (s *memoryStore) Read(pos uint64) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if uint64(len(s.buf)) < pos+recordLenWidth {
+		return nil, ErrTruncatedRecord{Pos: pos}
+	}
+	size := enc.Uint64(s.buf[pos : pos+recordLenWidth])
+	start := pos + recordLenWidth
+	if uint64(len(s.buf)) < start+size {
+		return nil, ErrTruncatedRecord{Pos: pos}
+	}
+
+	// hand out a copy so that callers can't modify what we have stored
+	record := make([]byte, size)
+	copy(record, s.buf[start:start+size])
+	return record, nil
+}
+
+func (s *memoryStore) ReadAt(p []byte, off int64) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if off >= int64(len(s.buf)) {
+		return 0, io.EOF
+	}
+
+	n := copy(p, s.buf[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (s *memoryStore) Name() string {
+	return s.name
+}
+
+func (s *memoryStore) Size() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return uint64(len(s.buf))
+}
+
+func (s *memoryStore) Rewrite(pos uint64, p []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if uint64(len(s.buf)) < pos+recordLenWidth {
+		return ErrTruncatedRecord{Pos: pos}
+	}
+	if n := enc.Uint64(s.buf[pos : pos+recordLenWidth]); n != uint64(len(p)) {
+		return fmt.Errorf("record at position %d is %d bytes long, can't rewrite it with %d bytes", pos, n, len(p))
+	}
+
+	copy(s.buf[pos+recordLenWidth:], p)
+	return nil
+}
+
+func (s *memoryStore) Flush() error {
+	return nil
+}
+
+func (s *memoryStore) Sync() error {
+	return nil
+}
+
+func (s *memoryStore) Close() error {
+	return nil
+}
+
+func (s *memoryStore) Remove() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.buf = nil
+	return nil
+}
+
+type memoryIndex struct {
+	name     string
+	maxBytes uint64
+	entries  []memoryEntry
+}
+
+type memoryEntry struct {
+	off uint32
+	pos uint64
+}
+
+func (i *memoryIndex) Read(in int64) (out uint32, pos uint64, err error) {
+	if len(i.entries) == 0 {
+		return 0, 0, io.EOF
+	}
+
+	if in == -1 {
+		in = int64(len(i.entries) - 1)
+	}
+	if in < 0 || in >= int64(len(i.entries)) {
+		return 0, 0, io.EOF
+	}
+
+	e := i.entries[in]
+	return e.off, e.pos, nil
+}
+
+func (i *memoryIndex) Write(off uint32, pos uint64) error {
+	// same as the file index, we can't grow past the configured max size
+	if i.maxBytes < i.Size()+entWidth {
+		return io.EOF
+	}
+
+	i.entries = append(i.entries, memoryEntry{off: off, pos: pos})
+	return nil
+}
+
+func (i *memoryIndex) Name() string {
+	return i.name
+}
+
+func (i *memoryIndex) Size() uint64 {
+	return uint64(len(i.entries)) * entWidth
+}
+
+func (i *memoryIndex) Sync() error {
+	return nil
+}
+
+func (i *memoryIndex) Close() error {
+	return nil
+}
+
+func (i *memoryIndex) Remove() error {
+	i.entries = nil
+	return nil
+}
@@ -0,0 +1,88 @@
+package log
+
+import (
+	"fmt"
+
+	api "github.com/burmudar/prolog/api/v1"
+)
+
+// mergeBatch is how many records MergeLogs reads from a source at a time
+const mergeBatch = 256
+
+// ErrOverlappingOffsets is returned by MergeLogs when more than one of the logs it merges has a record at Offset
+type ErrOverlappingOffsets struct {
+	Offset uint64
+}
+
+func (e ErrOverlappingOffsets) Error() string {
+	return fmt.Sprintf("more than one log has a record at offset %d", e.Offset)
+}
+
+// mergeCursor goes through the records of one of the logs being merged, a batch at a time
+type mergeCursor struct {
+	log     *Log
+	next    uint64
+	records []*api.Record
+}
+
+// head returns the cursor's current record, reading the next batch when it has gone through the last one. It returns
+// nil once the cursor has reached the end of its log
+func (c *mergeCursor) head() (*api.Record, error) {
+	if len(c.records) == 0 {
+		records, next, err := c.log.ReadBatch(c.next, mergeBatch)
+		if err != nil {
+			return nil, err
+		}
+		c.records, c.next = records, next
+	}
+	if len(c.records) == 0 {
+		return nil, nil
+	}
+	return c.records[0], nil
+}
+
+// MergeLogs appends the records of srcs to dst in the order of their offsets, keeping their offsets with AppendAt. It
+// is meant for consolidating shards that were given offsets that don't overlap, whether in ranges of their own or
+// interleaved, like with an OffsetAllocator that strides. When the offsets leave gaps, dst needs AllowOffsetGaps, and
+// dst mustn't hold any offsets beyond those of the first record merged.
+//
+// Merging stops with ErrOverlappingOffsets when two sources have a record at the same offset, leaving dst with the
+// records before it
+func MergeLogs(dst *Log, srcs ...*Log) error {
+	var cursors []*mergeCursor
+	for _, src := range srcs {
+		lowest, err := src.LowestOffset()
+		if err != nil {
+			return err
+		}
+		cursors = append(cursors, &mergeCursor{log: src, next: lowest})
+	}
+
+	for {
+		var min *mergeCursor
+		var record *api.Record
+		for _, c := range cursors {
+			head, err := c.head()
+			if err != nil {
+				return err
+			}
+			if head == nil {
+				continue
+			}
+			if record != nil && head.Offset == record.Offset {
+				return ErrOverlappingOffsets{Offset: head.Offset}
+			}
+			if record == nil || head.Offset < record.Offset {
+				min, record = c, head
+			}
+		}
+		if min == nil {
+			return nil
+		}
+
+		if err := dst.AppendAt(record, record.Offset); err != nil {
+			return err
+		}
+		min.records = min.records[1:]
+	}
+}
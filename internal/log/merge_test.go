@@ -0,0 +1,78 @@
+package log
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	api "github.com/burmudar/prolog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMergeLogs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "merge-logs-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{AllowOffsetGaps: true}
+	c.Segment.MaxStoreBytes = 128
+	newLog := func(name string, offsets ...uint64) *Log {
+		log, err := NewLog(path.Join(dir, name), c)
+		require.NoError(t, err)
+		t.Cleanup(func() { log.Close() })
+		for _, off := range offsets {
+			require.NoError(t, log.AppendAt(&api.Record{Value: []byte(fmt.Sprintf("record %d", off))}, off))
+		}
+		return log
+	}
+
+	for scenario, want := range map[string]struct {
+		srcs    [][]uint64
+		offsets []uint64
+		err     error
+	}{
+		"ranges": {
+			srcs:    [][]uint64{{10, 11, 12, 13}, {0, 1, 2, 3, 4, 5, 6, 7, 8, 9}},
+			offsets: []uint64{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13},
+		},
+		"interleaved": {
+			srcs:    [][]uint64{{0, 3, 6, 9}, {1, 4, 7}, {2, 5, 8}},
+			offsets: []uint64{0, 1, 2, 3, 4, 5, 6, 7, 8, 9},
+		},
+		"gaps": {
+			srcs:    [][]uint64{{2, 3}, {7, 9}},
+			offsets: []uint64{2, 3, 7, 9},
+		},
+		"overlapping": {
+			srcs:    [][]uint64{{0, 1, 2}, {2, 3}},
+			offsets: []uint64{0, 1},
+			err:     ErrOverlappingOffsets{Offset: 2},
+		},
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			var srcs []*Log
+			for i, offsets := range want.srcs {
+				srcs = append(srcs, newLog(fmt.Sprintf("%s-%d", scenario, i), offsets...))
+			}
+			dst := newLog(scenario + "-dst")
+
+			require.Equal(t, want.err, MergeLogs(dst, srcs...))
+
+			lowest, err := dst.LowestOffset()
+			require.NoError(t, err)
+			var read []uint64
+			for off := lowest; off < dst.PeekNextOffset(); off++ {
+				record, err := dst.Read(off)
+				if skippedOffset(err) {
+					continue
+				}
+				require.NoError(t, err)
+				require.Equal(t, []byte(fmt.Sprintf("record %d", off)), record.Value)
+				read = append(read, off)
+			}
+			require.Equal(t, want.offsets, read)
+		})
+	}
+}
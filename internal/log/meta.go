@@ -0,0 +1,142 @@
+package log
+
+import (
+	"fmt"
+	"io"
+
+	api "github.com/burmudar/prolog/api/v1"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+var errMalformedRecord = fmt.Errorf("malformed record")
+
+// RecordMeta is what there is to know about a record apart from its value
+type RecordMeta struct {
+	Offset           uint64
+	Timestamp        int64
+	CompressionCodec api.CompressionCodec
+	Deleted          bool
+	// Size is the length of the value as it is stored, so compressed if the record is compressed
+	Size uint64
+}
+
+// ReadMeta returns the metadata of the record at off without reading its value, which saves reading large values when
+// only their sizes are needed, for instance to list the records in the log. Reading fails as it does with ReadReuse
+func (l *Log) ReadMeta(off uint64) (RecordMeta, error) {
+	var meta RecordMeta
+	err := l.readFrom(off, func(seg *segment) error {
+		var err error
+		meta, err = seg.ReadMeta(off)
+		return err
+	})
+	return meta, err
+}
+
+// ReadMeta reads the fields of a protobuf record straight from the store, skipping over the value. Records stored with
+// other codecs, or encrypted, are read whole
+func (s *segment) ReadMeta(off uint64) (RecordMeta, error) {
+	if s.codec != ProtoCodec || s.encrypted {
+		record, err := s.Read(off)
+		if err != nil {
+			return RecordMeta{}, err
+		}
+		return RecordMeta{
+			Offset:           record.Offset,
+			Timestamp:        record.Timestamp,
+			CompressionCodec: record.CompressionCodec,
+			Deleted:          record.Deleted,
+			Size:             uint64(len(record.Value)),
+		}, nil
+	}
+
+	pos, err := s.position(off)
+	if err != nil {
+		return RecordMeta{}, err
+	}
+	header := make([]byte, s.layout.headerWidth())
+	if _, err := s.store.ReadAt(header, int64(pos)); err != nil {
+		if err == io.EOF {
+			return RecordMeta{}, ErrTruncatedRecord{Pos: pos}
+		}
+		return RecordMeta{}, err
+	}
+
+	r := fieldReader{store: s.store, pos: pos + s.layout.headerWidth()}
+	r.end = r.pos + s.layout.length(header)
+
+	var meta RecordMeta
+	for r.pos < r.end {
+		tag, err := r.varint()
+		if err != nil {
+			return RecordMeta{}, err
+		}
+
+		num, typ := protowire.DecodeTag(tag)
+		switch typ {
+		case protowire.VarintType:
+			v, err := r.varint()
+			if err != nil {
+				return RecordMeta{}, err
+			}
+			switch num {
+			case 2:
+				meta.Offset = v
+			case 3:
+				meta.Timestamp = int64(v)
+			case 4:
+				meta.CompressionCodec = api.CompressionCodec(v)
+			case 5:
+				meta.Deleted = v != 0
+			}
+		case protowire.BytesType:
+			n, err := r.varint()
+			if err != nil {
+				return RecordMeta{}, err
+			}
+			if num == 1 {
+				meta.Size = n
+			}
+			// the value, or a tombstone's padding, is skipped rather than read
+			r.pos += n
+		case protowire.Fixed32Type:
+			r.pos += 4
+		case protowire.Fixed64Type:
+			r.pos += 8
+		default:
+			return RecordMeta{}, errMalformedRecord
+		}
+	}
+	if r.pos != r.end {
+		return RecordMeta{}, errMalformedRecord
+	}
+	return meta, nil
+}
+
+// fieldReader reads the varints of a record in the store between pos and end
+type fieldReader struct {
+	store    StoreBackend
+	pos, end uint64
+}
+
+func (r *fieldReader) varint() (uint64, error) {
+	n := r.end - r.pos
+	if n > maxVarintLen {
+		n = maxVarintLen
+	}
+
+	p := make([]byte, n)
+	read, err := r.store.ReadAt(p, int64(r.pos))
+	if err != nil && !(err == io.EOF && read == len(p)) {
+		if err == io.EOF {
+			return 0, errMalformedRecord
+		}
+		return 0, err
+	}
+
+	v, w := protowire.ConsumeVarint(p)
+	if w < 0 {
+		return 0, errMalformedRecord
+	}
+	r.pos += uint64(w)
+	return v, nil
+}
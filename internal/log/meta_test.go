@@ -0,0 +1,84 @@
+package log
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"testing"
+
+	api "github.com/burmudar/prolog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+// countingStore counts the bytes read from the wrapped store
+type countingStore struct {
+	StoreBackend
+	read *int64
+}
+
+func (s *countingStore) Read(pos uint64) ([]byte, error) {
+	p, err := s.StoreBackend.Read(pos)
+	atomic.AddInt64(s.read, int64(len(p)))
+	return p, err
+}
+
+func (s *countingStore) ReadAt(p []byte, off int64) (int, error) {
+	n, err := s.StoreBackend.ReadAt(p, off)
+	atomic.AddInt64(s.read, int64(n))
+	return n, err
+}
+
+func TestLogReadMeta(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-read-meta-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	var read int64
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1 << 20
+	c.Segment.NewStore = func(dir string, baseOffset uint64, c Config) (StoreBackend, error) {
+		s, err := newFileStore(dir, baseOffset, c)
+		return &countingStore{StoreBackend: s, read: &read}, err
+	}
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	value := bytes.Repeat([]byte("a"), 64*1024)
+	_, err = log.Append(&api.Record{Value: value, Timestamp: 42})
+	require.NoError(t, err)
+	_, err = log.AppendReader(bytes.NewReader(value), int64(len(value)))
+	require.NoError(t, err)
+	_, err = log.Append(&api.Record{Value: value, CompressionCodec: api.CompressionCodec_COMPRESSION_GZIP})
+	require.NoError(t, err)
+	_, err = log.Append(&api.Record{Value: value})
+	require.NoError(t, err)
+	require.NoError(t, log.Delete(3))
+
+	for off, want := range []RecordMeta{
+		{Offset: 0, Timestamp: 42, Size: uint64(len(value))},
+		{Offset: 1, Size: uint64(len(value))},
+		{Offset: 2, CompressionCodec: api.CompressionCodec_COMPRESSION_GZIP, Size: uint64(len(value))},
+		{Offset: 3, Deleted: true},
+	} {
+		read = 0
+		meta, err := log.ReadMeta(uint64(off))
+		require.NoError(t, err)
+		// only the first record's timestamp was set by the producer
+		if off > 0 {
+			require.NotZero(t, meta.Timestamp)
+			want.Timestamp = meta.Timestamp
+		}
+		require.Equal(t, want, meta)
+		// the value is skipped, so only a handful of bytes are read
+		require.Less(t, atomic.LoadInt64(&read), int64(100))
+
+		record, err := log.Read(uint64(off))
+		require.NoError(t, err)
+		require.Equal(t, record.Timestamp, meta.Timestamp)
+	}
+
+	_, err = log.ReadMeta(4)
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: 4}, err)
+}
@@ -0,0 +1,21 @@
+package log
+
+import (
+	api "github.com/burmudar/prolog/api/v1"
+)
+
+// AppendMiddleware is run on every record before it is appended. It can inspect and change the record, or reject it by
+// returning an error, which Append then fails with. It runs with the log's write lock held, so it mustn't call back
+// into the log
+type AppendMiddleware func(record *api.Record) error
+
+// Use adds mw to the middleware run on appended records, after the middleware added before it. Middleware runs before
+// the log timestamps and compresses the record, so it sees the value as it was produced and can set the timestamp
+// itself. Records appended with AppendReader go through it without their value, which is streamed straight into the
+// store
+func (l *Log) Use(mw AppendMiddleware) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.middleware = append(l.middleware, mw)
+}
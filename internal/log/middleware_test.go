@@ -0,0 +1,59 @@
+package log
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	api "github.com/burmudar/prolog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogUse(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-middleware-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	log, err := NewLog(dir, Config{Compression: api.CompressionCodec_COMPRESSION_GZIP})
+	require.NoError(t, err)
+	defer log.Close()
+
+	errEmpty := fmt.Errorf("record value is empty")
+	var order []string
+	// records don't have headers of their own, so the header is put in front of the value
+	log.Use(func(record *api.Record) error {
+		order = append(order, "header")
+		record.Value = append([]byte("source: test\n"), record.Value...)
+		return nil
+	})
+	log.Use(func(record *api.Record) error {
+		order = append(order, "reject")
+		// the header has been added by now, so we check what comes after it
+		if bytes.HasSuffix(record.Value, []byte("\n")) {
+			return errEmpty
+		}
+		return nil
+	})
+
+	off, err := log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, []string{"header", "reject"}, order)
+
+	// the middleware saw the value before it was compressed
+	record, err := log.Read(off)
+	require.NoError(t, err)
+	value, err := Decompress(record)
+	require.NoError(t, err)
+	require.Equal(t, []byte("source: test\nhello world"), value)
+
+	_, err = log.Append(&api.Record{})
+	require.Equal(t, errEmpty, err)
+	require.Equal(t, errEmpty, log.AppendAt(&api.Record{}, 1))
+
+	// rejected records take up no offsets
+	off, err = log.Append(&api.Record{Value: []byte("hello again")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), off)
+}
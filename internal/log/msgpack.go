@@ -0,0 +1,269 @@
+package log
+
+import (
+	"fmt"
+	"math"
+
+	api "github.com/burmudar/prolog/api/v1"
+)
+
+// The MessagePack codec only has to deal with records, so rather than pulling in a general purpose library it encodes
+// the handful of types a record is made of itself. See https://github.com/msgpack/msgpack/blob/master/spec.md
+
+var errMalformedMsgpack = fmt.Errorf("malformed msgpack record")
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) Name() string {
+	return "msgpack"
+}
+
+func (msgpackCodec) Marshal(record *api.Record) ([]byte, error) {
+	p := []byte{0x80 | 5}
+	p = appendMsgpackString(p, "value")
+	p = appendMsgpackBin(p, record.Value)
+	p = appendMsgpackString(p, "offset")
+	p = appendMsgpackUint(p, record.Offset)
+	p = appendMsgpackString(p, "timestamp")
+	p = appendMsgpackInt(p, record.Timestamp)
+	p = appendMsgpackString(p, "compression_codec")
+	p = appendMsgpackInt(p, int64(record.CompressionCodec))
+	p = appendMsgpackString(p, "deleted")
+	p = appendMsgpackBool(p, record.Deleted)
+	return p, nil
+}
+
+func (msgpackCodec) Unmarshal(p []byte, record *api.Record) error {
+	d := msgpackDecoder{p: p}
+	n, err := d.mapLen()
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < n; i++ {
+		key, err := d.bytes()
+		if err != nil {
+			return err
+		}
+		switch string(key) {
+		case "value":
+			var v []byte
+			if v, err = d.bytes(); len(v) > 0 {
+				record.Value = append([]byte(nil), v...)
+			}
+		case "offset":
+			var v int64
+			v, err = d.int()
+			record.Offset = uint64(v)
+		case "timestamp":
+			record.Timestamp, err = d.int()
+		case "compression_codec":
+			var v int64
+			v, err = d.int()
+			record.CompressionCodec = api.CompressionCodec(v)
+		case "deleted":
+			record.Deleted, err = d.bool()
+		default:
+			err = d.skip()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func appendMsgpackString(p []byte, s string) []byte {
+	switch n := len(s); {
+	case n < 32:
+		p = append(p, 0xa0|byte(n))
+	case n <= math.MaxUint8:
+		p = append(p, 0xd9, byte(n))
+	case n <= math.MaxUint16:
+		p = append(p, 0xda, byte(n>>8), byte(n))
+	default:
+		p = append(p, 0xdb, 0, 0, 0, 0)
+		enc.PutUint32(p[len(p)-4:], uint32(n))
+	}
+	return append(p, s...)
+}
+
+func appendMsgpackBin(p []byte, b []byte) []byte {
+	switch n := len(b); {
+	case n <= math.MaxUint8:
+		p = append(p, 0xc4, byte(n))
+	case n <= math.MaxUint16:
+		p = append(p, 0xc5, byte(n>>8), byte(n))
+	default:
+		p = append(p, 0xc6, 0, 0, 0, 0)
+		enc.PutUint32(p[len(p)-4:], uint32(n))
+	}
+	return append(p, b...)
+}
+
+func appendMsgpackUint(p []byte, v uint64) []byte {
+	if v < 0x80 {
+		return append(p, byte(v))
+	}
+	p = append(p, 0xcf, 0, 0, 0, 0, 0, 0, 0, 0)
+	enc.PutUint64(p[len(p)-8:], v)
+	return p
+}
+
+func appendMsgpackInt(p []byte, v int64) []byte {
+	if v >= 0 {
+		return appendMsgpackUint(p, uint64(v))
+	}
+	p = append(p, 0xd3, 0, 0, 0, 0, 0, 0, 0, 0)
+	enc.PutUint64(p[len(p)-8:], uint64(v))
+	return p
+}
+
+func appendMsgpackBool(p []byte, v bool) []byte {
+	if v {
+		return append(p, 0xc3)
+	}
+	return append(p, 0xc2)
+}
+
+// msgpackDecoder reads the types appendMsgpack* write, along with the other encodings of them so that records written
+// by other MessagePack implementations can be read too
+type msgpackDecoder struct {
+	p []byte
+}
+
+func (d *msgpackDecoder) next(n uint64) ([]byte, error) {
+	if uint64(len(d.p)) < n {
+		return nil, errMalformedMsgpack
+	}
+	b := d.p[:n]
+	d.p = d.p[n:]
+	return b, nil
+}
+
+// length reads a big endian length of n bytes
+func (d *msgpackDecoder) length(n uint64) (uint64, error) {
+	b, err := d.next(n)
+	if err != nil {
+		return 0, err
+	}
+	var v uint64
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return v, nil
+}
+
+func (d *msgpackDecoder) mapLen() (int, error) {
+	t, err := d.next(1)
+	if err != nil {
+		return 0, err
+	}
+
+	var n uint64
+	switch {
+	case t[0]&0xf0 == 0x80:
+		n = uint64(t[0] & 0x0f)
+	case t[0] == 0xde:
+		n, err = d.length(2)
+	case t[0] == 0xdf:
+		n, err = d.length(4)
+	default:
+		return 0, errMalformedMsgpack
+	}
+	return int(n), err
+}
+
+// bytes reads a string or a bin
+func (d *msgpackDecoder) bytes() ([]byte, error) {
+	t, err := d.next(1)
+	if err != nil {
+		return nil, err
+	}
+
+	var n uint64
+	switch {
+	case t[0]&0xe0 == 0xa0:
+		n = uint64(t[0] & 0x1f)
+	case t[0] == 0xc0:
+		return nil, nil
+	case t[0] == 0xc4 || t[0] == 0xd9:
+		n, err = d.length(1)
+	case t[0] == 0xc5 || t[0] == 0xda:
+		n, err = d.length(2)
+	case t[0] == 0xc6 || t[0] == 0xdb:
+		n, err = d.length(4)
+	default:
+		return nil, errMalformedMsgpack
+	}
+	if err != nil {
+		return nil, err
+	}
+	return d.next(n)
+}
+
+func (d *msgpackDecoder) int() (int64, error) {
+	t, err := d.next(1)
+	if err != nil {
+		return 0, err
+	}
+
+	switch {
+	case t[0] < 0x80:
+		return int64(t[0]), nil
+	case t[0] >= 0xe0:
+		return int64(int8(t[0])), nil
+	case t[0] == 0xc0:
+		return 0, nil
+	case t[0] >= 0xcc && t[0] <= 0xcf:
+		v, err := d.length(1 << (t[0] - 0xcc))
+		return int64(v), err
+	case t[0] >= 0xd0 && t[0] <= 0xd3:
+		n := uint64(1) << (t[0] - 0xd0)
+		v, err := d.length(n)
+		// sign extend from the width the value was written with
+		shift := 64 - 8*n
+		return int64(v<<shift) >> shift, err
+	}
+	return 0, errMalformedMsgpack
+}
+
+func (d *msgpackDecoder) bool() (bool, error) {
+	t, err := d.next(1)
+	if err != nil {
+		return false, err
+	}
+
+	switch t[0] {
+	case 0xc2, 0xc0:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	}
+	return false, errMalformedMsgpack
+}
+
+// skip reads past a value of a field records don't have. Only scalars, strings and bins can be skipped
+func (d *msgpackDecoder) skip() error {
+	if len(d.p) == 0 {
+		return errMalformedMsgpack
+	}
+
+	switch t := d.p[0]; {
+	case t == 0xc2 || t == 0xc3:
+		_, err := d.bool()
+		return err
+	case t&0xe0 == 0xa0 || (t >= 0xc4 && t <= 0xc6) || (t >= 0xd9 && t <= 0xdb):
+		_, err := d.bytes()
+		return err
+	case t == 0xca:
+		_, err := d.next(5)
+		return err
+	case t == 0xcb:
+		_, err := d.next(9)
+		return err
+	default:
+		_, err := d.int()
+		return err
+	}
+}
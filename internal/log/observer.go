@@ -0,0 +1,56 @@
+package log
+
+import "time"
+
+// Observer is told about changes to the shape of a log so that they can be turned into metrics, for instance by
+// updating Prometheus counters and gauges
+type Observer interface {
+	// SegmentRolled is called after the active segment has been rolled with the base offset of the segment that was
+	// sealed and the number of bytes in its store at the moment it was rolled
+	SegmentRolled(baseOffset uint64, storeBytes uint64)
+	// SegmentCount is called with the number of segments in the log whenever it changes
+	SegmentCount(n int)
+}
+
+// ReadObserver is an Observer that is also told which segments serve reads, which shows whether consumers keep up with
+// the end of the log or read back through the sealed segments
+type ReadObserver interface {
+	Observer
+	// SegmentRead is called after every record read, or its metadata, with whether it was read from the active segment.
+	// Reads can happen concurrently, so it has to be safe to call concurrently
+	SegmentRead(active bool)
+}
+
+// CompactionObserver is an Observer that is also told about the compactions scheduled by Config.CompactionInterval
+type CompactionObserver interface {
+	Observer
+	// SegmentCompacted is called after a segment has been compacted with its base offset, the number of superseded
+	// records that were deleted and the number of bytes its store and index shrank by
+	SegmentCompacted(baseOffset uint64, records int, reclaimedBytes uint64)
+	// CompactionFailed is called when compacting a segment fails. The segment is tried again in the next round
+	CompactionFailed(baseOffset uint64, err error)
+}
+
+// CallObserver is an Observer that is also told how long calls to the log took. The log doesn't time its calls itself,
+// they are timed by the server when the log is wrapped with server.NewMeasuredCommitLog
+type CallObserver interface {
+	Observer
+	// CallObserved is called after every timed call with the name of the method called, like "Append" or "Read", how
+	// long the call took and the error it returned, if any. Calls can happen concurrently, so it has to be safe to call
+	// concurrently
+	CallObserved(method string, d time.Duration, err error)
+}
+
+// ReplicationObserver is an Observer that is also told how far a follower's log is behind its leader, by the replicator
+// keeping it in step
+type ReplicationObserver interface {
+	Observer
+	// ReplicationLag is called with the number of records the leader has that the follower doesn't, every time the
+	// follower receives a record or polls the leader's highest offset. It has to be safe to call concurrently
+	ReplicationLag(lag uint64)
+}
+
+type nopObserver struct{}
+
+func (nopObserver) SegmentRolled(uint64, uint64) {}
+func (nopObserver) SegmentCount(int)             {}
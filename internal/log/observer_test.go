@@ -0,0 +1,103 @@
+package log
+
+import (
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"testing"
+
+	api "github.com/burmudar/prolog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+type countingObserver struct {
+	rolls    int
+	sizes    []uint64
+	segments int
+}
+
+func (o *countingObserver) SegmentRolled(baseOffset uint64, storeBytes uint64) {
+	o.rolls++
+	o.sizes = append(o.sizes, storeBytes)
+}
+
+func (o *countingObserver) SegmentCount(n int) {
+	o.segments = n
+}
+
+func TestLogObserver(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-observer-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	o := &countingObserver{}
+	c := Config{Observer: o}
+	c.Segment.MaxStoreBytes = 64
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	require.Equal(t, 1, o.segments)
+
+	for i := 0; i < 10; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+
+	// every segment but the active one was rolled exactly once
+	require.Equal(t, len(log.segments)-1, o.rolls)
+	require.Greater(t, o.rolls, 1)
+	require.Equal(t, len(log.segments), o.segments)
+	for _, size := range o.sizes {
+		require.GreaterOrEqual(t, size, c.Segment.MaxStoreBytes)
+	}
+
+	require.NoError(t, log.Truncate(1))
+	require.Equal(t, len(log.segments), o.segments)
+}
+
+// readObserver counts the reads from the active and sealed segments
+type readObserver struct {
+	nopObserver
+	active, sealed int64
+}
+
+func (o *readObserver) SegmentRead(active bool) {
+	if active {
+		atomic.AddInt64(&o.active, 1)
+		return
+	}
+	atomic.AddInt64(&o.sealed, 1)
+}
+
+func TestLogReadObserver(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-read-observer-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	o := &readObserver{}
+	c := Config{Observer: o}
+	c.Segment.MaxIndexBytes = entWidth * 4
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	// the first four records are sealed away, the last two are in the active segment
+	for i := 0; i < 6; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.Equal(t, uint64(4), log.activeSegment.baseOffset)
+
+	for off := uint64(0); off < 6; off++ {
+		_, err := log.Read(off)
+		require.NoError(t, err)
+	}
+	_, err = log.ReadMeta(5)
+	require.NoError(t, err)
+	// failed reads aren't counted
+	_, err = log.Read(6)
+	require.Error(t, err)
+
+	require.Equal(t, int64(4), atomic.LoadInt64(&o.sealed))
+	require.Equal(t, int64(3), atomic.LoadInt64(&o.active))
+}
@@ -0,0 +1,43 @@
+package log
+
+import (
+	"fmt"
+	"runtime"
+
+	api "github.com/burmudar/prolog/api/v1"
+)
+
+var ErrPageFaultsUnsupported = fmt.Errorf("counting page faults is only supported on linux")
+
+// PageFaultObserver is an Observer that is also told about the page faults caused by reading a segment, which shows
+// when the memory mapped indexes are thrashing. It is only told about them when Config.TrackPageFaults is set
+type PageFaultObserver interface {
+	Observer
+	// SegmentPageFaults is called after every read with the major and minor page faults taken while reading from the
+	// segment starting at baseOffset. Reads can happen concurrently, so it has to be safe to call concurrently
+	SegmentPageFaults(baseOffset uint64, major, minor uint64)
+}
+
+// readCountingFaults reads off from seg into the given record while counting the page faults taken by the reading
+// thread, which it tells the observer about if it is a PageFaultObserver
+func (l *Log) readCountingFaults(seg *segment, off uint64, into *api.Record) error {
+	o, ok := l.Config.Observer.(PageFaultObserver)
+	if !ok {
+		return seg.readInto(off, into)
+	}
+
+	// the faults are counted for the thread, so the goroutine mustn't move to another one halfway through the read
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	beforeMajor, beforeMinor, err := threadPageFaults()
+	if err != nil {
+		return err
+	}
+	err = seg.readInto(off, into)
+	afterMajor, afterMinor, ferr := threadPageFaults()
+	if ferr == nil {
+		o.SegmentPageFaults(seg.baseOffset, afterMajor-beforeMajor, afterMinor-beforeMinor)
+	}
+	return err
+}
@@ -0,0 +1,19 @@
+package log
+
+import "syscall"
+
+// rusageThread is Linux's RUSAGE_THREAD, which the syscall package doesn't define
+const rusageThread = 1
+
+func pageFaultsSupported() bool {
+	return true
+}
+
+// threadPageFaults returns the major and minor page faults the calling thread has taken so far
+func threadPageFaults() (major, minor uint64, err error) {
+	var usage syscall.Rusage
+	if err := syscall.Getrusage(rusageThread, &usage); err != nil {
+		return 0, 0, err
+	}
+	return uint64(usage.Majflt), uint64(usage.Minflt), nil
+}
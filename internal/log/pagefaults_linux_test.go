@@ -0,0 +1,68 @@
+package log
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+
+	api "github.com/burmudar/prolog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+type faultObserver struct {
+	nopObserver
+	mu    sync.Mutex
+	reads map[uint64]int
+}
+
+func (o *faultObserver) SegmentPageFaults(baseOffset uint64, major, minor uint64) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.reads[baseOffset]++
+}
+
+func TestThreadPageFaults(t *testing.T) {
+	major, minor, err := threadPageFaults()
+	require.NoError(t, err)
+
+	// the counters only ever go up
+	p := make([]byte, 1<<20)
+	for i := range p {
+		p[i] = 1
+	}
+	laterMajor, laterMinor, err := threadPageFaults()
+	require.NoError(t, err)
+	require.GreaterOrEqual(t, laterMajor, major)
+	require.GreaterOrEqual(t, laterMinor, minor)
+}
+
+func TestLogTrackPageFaults(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-page-faults-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	o := &faultObserver{reads: map[uint64]int{}}
+	c := Config{Observer: o, TrackPageFaults: true}
+	c.Segment.MaxStoreBytes = 64
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	for i := 0; i < 4; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	for off := uint64(0); off < 4; off++ {
+		_, err := log.Read(off)
+		require.NoError(t, err)
+	}
+
+	// every read was counted against the segment it read from
+	reads := 0
+	for _, seg := range log.segments {
+		reads += o.reads[seg.baseOffset]
+	}
+	require.Equal(t, 4, reads)
+	require.Greater(t, len(o.reads), 1)
+}
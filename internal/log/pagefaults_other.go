@@ -0,0 +1,11 @@
+//go:build !linux
+
+package log
+
+func pageFaultsSupported() bool {
+	return false
+}
+
+func threadPageFaults() (major, minor uint64, err error) {
+	return 0, 0, ErrPageFaultsUnsupported
+}
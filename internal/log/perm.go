@@ -0,0 +1,65 @@
+package log
+
+import "os"
+
+const (
+	defaultFileMode os.FileMode = 0644
+	defaultDirMode  os.FileMode = 0755
+)
+
+func (c Config) fileMode() os.FileMode {
+	if c.FileMode == 0 {
+		return defaultFileMode
+	}
+	return c.FileMode
+}
+
+func (c Config) dirMode() os.FileMode {
+	if c.DirMode == 0 {
+		return defaultDirMode
+	}
+	return c.DirMode
+}
+
+// openLogFile opens the named file, creating it with the configured FileMode when flag asks for it. Files are created
+// subject to the process' umask, so when a FileMode is configured the file is changed to it afterwards
+func openLogFile(name string, flag int, c Config) (*os.File, error) {
+	f, err := os.OpenFile(name, flag, c.fileMode())
+	if err != nil {
+		return nil, err
+	}
+
+	if c.FileMode != 0 {
+		if err := f.Chmod(c.FileMode); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// writeFile writes p to the named file like ioutil.WriteFile, creating the file with the configured FileMode
+func writeFile(name string, p []byte, c Config) error {
+	f, err := openLogFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, c)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(p); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// makeDir creates dir and any missing parents with the configured DirMode. Like openLogFile it works around the umask
+// when a DirMode is configured, but only for dir itself
+func makeDir(dir string, c Config) error {
+	if err := os.MkdirAll(dir, c.dirMode()); err != nil {
+		return err
+	}
+
+	if c.DirMode != 0 {
+		return os.Chmod(dir, c.DirMode)
+	}
+	return nil
+}
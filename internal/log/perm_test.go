@@ -0,0 +1,43 @@
+//go:build !windows
+
+package log
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	api "github.com/burmudar/prolog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogPermissions(t *testing.T) {
+	// a umask that would take away what we ask for shows that the modes are applied regardless
+	defer syscall.Umask(syscall.Umask(0077))
+
+	parent, err := ioutil.TempDir("", "log-perm-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(parent)
+	dir := filepath.Join(parent, "log")
+
+	c := Config{FileMode: 0660, DirMode: 0770, Manifest: true}
+	c.Segment.IndexChecksum = true
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	_, err = log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.NoError(t, log.Close())
+
+	fi, err := os.Stat(dir)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0770), fi.Mode().Perm())
+
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	require.NotEmpty(t, files)
+	for _, fi := range files {
+		require.Equal(t, os.FileMode(0660), fi.Mode().Perm(), fi.Name())
+	}
+}
@@ -0,0 +1,135 @@
+package log
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	api "github.com/burmudar/prolog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogReadOnly(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-read-only-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{Manifest: true}
+	c.Segment.MaxIndexBytes = entWidth * 3
+	c.Segment.IndexChecksum = true
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	n := uint64(7)
+	for i := uint64(0); i < n; i++ {
+		_, err := log.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+	require.NoError(t, log.Close())
+
+	// the files are backdated, so that any write to them would show up as a new modification time
+	before := map[string]os.FileInfo{}
+	past := time.Now().Add(-time.Hour)
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	for _, f := range files {
+		name := filepath.Join(dir, f.Name())
+		require.NoError(t, os.Chtimes(name, past, past))
+		fi, err := os.Stat(name)
+		require.NoError(t, err)
+		before[f.Name()] = fi
+	}
+
+	log, err = OpenReadOnly(dir, c)
+	require.NoError(t, err)
+
+	for i := uint64(0); i < n; i++ {
+		record, err := log.Read(i)
+		require.NoError(t, err)
+		require.Equal(t, []byte(fmt.Sprintf("record %d", i)), record.Value)
+	}
+	records, _, err := log.ReadBatch(0, int(n))
+	require.NoError(t, err)
+	require.Len(t, records, int(n))
+	_, err = log.Read(n)
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: n}, err)
+
+	_, err = log.Append(&api.Record{Value: []byte("nope")})
+	require.Equal(t, ErrReadOnly, err)
+	require.Equal(t, ErrReadOnly, log.AppendAt(&api.Record{}, n))
+	require.Equal(t, ErrReadOnly, log.Truncate(3))
+	require.Equal(t, ErrReadOnly, log.Delete(0))
+	require.Equal(t, ErrReadOnly, log.Rotate())
+	require.Equal(t, ErrReadOnly, log.Reset())
+	require.Equal(t, ErrReadOnly, log.Remove())
+	require.Equal(t, n, log.PeekNextOffset())
+	require.NoError(t, log.Close())
+
+	files, err = ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, files, len(before))
+	for _, f := range files {
+		want, ok := before[f.Name()]
+		require.True(t, ok, "%s was created", f.Name())
+		require.Equal(t, want.Size(), f.Size(), "size of %s", f.Name())
+		require.Equal(t, want.ModTime(), f.ModTime(), "modification time of %s", f.Name())
+	}
+}
+
+func TestLogReadOnlyEmpty(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-read-only-empty-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	log, err := NewLog(dir, Config{ReadOnly: true})
+	require.NoError(t, err)
+	defer log.Close()
+
+	_, err = log.Read(0)
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: 0}, err)
+	_, err = log.Append(&api.Record{})
+	require.Equal(t, ErrReadOnly, err)
+
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	require.Empty(t, files)
+
+	_, err = NewLog(filepath.Join(dir, "missing"), Config{ReadOnly: true})
+	require.IsType(t, ErrLogDirMissing{}, err)
+}
+
+func TestLogReadOnlyWhileOpen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-read-only-open-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// the writer keeps its indexes padded out to MaxIndexBytes for as long as it has the log open, the one of the empty
+	// active segment it rolled after the last record included
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 2
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	n := uint64(4)
+	for i := uint64(0); i < n; i++ {
+		_, err := log.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+	require.NoError(t, log.Sync())
+	require.Len(t, log.segments, 3)
+
+	reader, err := OpenReadOnly(dir, c)
+	require.NoError(t, err)
+	defer reader.Close()
+
+	require.Equal(t, n, reader.PeekNextOffset())
+	for i := uint64(0); i < n; i++ {
+		record, err := reader.Read(i)
+		require.NoError(t, err)
+		require.Equal(t, []byte(fmt.Sprintf("record %d", i)), record.Value)
+	}
+	_, err = reader.Read(n)
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: n}, err)
+}
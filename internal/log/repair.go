@@ -0,0 +1,71 @@
+package log
+
+import (
+	"bytes"
+	"context"
+
+	api "github.com/burmudar/prolog/api/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// RepairFromReplica recovers the log from a healthy replica of it, such as the leader it follows. The records the log
+// has in common with replica are found by comparing digests of ever longer runs of records from the log's lowest offset
+// on, and everything after them is truncated and fetched from replica again, appended with AppendAt so that the
+// records keep their offsets. Records that can't be read locally, or that replica doesn't have, count as different. It
+// returns the offset the log was repaired from, which is the log's next offset when all of its records were good.
+// Nothing else may append to the log while it is being repaired
+func (l *Log) RepairFromReplica(ctx context.Context, replica api.LogClient) (uint64, error) {
+	lowest, err := l.LowestOffset()
+	if err != nil {
+		return 0, err
+	}
+
+	// the records in [lowest, good) are known to match replica's, and those in [lowest, bad) known not to
+	good, bad := lowest, l.PeekNextOffset()+1
+	for bad-good > 1 {
+		mid := good + (bad-good)/2
+		ok, err := l.matchesReplica(ctx, replica, lowest, mid)
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			good = mid
+		} else {
+			bad = mid
+		}
+	}
+
+	if err := l.TruncateFrom(good); err != nil {
+		return 0, err
+	}
+	for off := good; ; {
+		batch, err := replica.ConsumeBatch(ctx, &api.ConsumeBatchRequest{Offset: off})
+		if err != nil {
+			return 0, err
+		}
+		if len(batch.Records) == 0 {
+			return good, nil
+		}
+		for _, record := range batch.Records {
+			if err := l.AppendAt(record, record.Offset); err != nil {
+				return 0, err
+			}
+		}
+		off = batch.NextOffset
+	}
+}
+
+// matchesReplica reports whether the records in [start, end) are the same in the log as in replica
+func (l *Log) matchesReplica(ctx context.Context, replica api.LogClient, start, end uint64) (bool, error) {
+	res, err := replica.Digest(ctx, &api.DigestRequest{Start: start, End: end})
+	if status.Code(err) == codes.OutOfRange {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	local, err := l.Digest(start, end)
+	return err == nil && bytes.Equal(local, res.Digest), nil
+}
@@ -0,0 +1,116 @@
+package log
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+
+	api "github.com/burmudar/prolog/api/v1"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+)
+
+// replicaClient serves the calls RepairFromReplica makes straight from the replica's log, the way the server would
+type replicaClient struct {
+	api.LogClient
+	log *Log
+}
+
+func (c *replicaClient) Digest(
+	ctx context.Context,
+	req *api.DigestRequest,
+	opts ...grpc.CallOption,
+) (*api.DigestResponse, error) {
+	digest, err := c.log.Digest(req.Start, req.End)
+	if err != nil {
+		return nil, err
+	}
+	return &api.DigestResponse{Digest: digest}, nil
+}
+
+func (c *replicaClient) ConsumeBatch(
+	ctx context.Context,
+	req *api.ConsumeBatchRequest,
+	opts ...grpc.CallOption,
+) (*api.ConsumeBatchResponse, error) {
+	records, next, err := c.log.ReadBatch(req.Offset, 100)
+	if err != nil {
+		return nil, err
+	}
+	return &api.ConsumeBatchResponse{Records: records, NextOffset: next}, nil
+}
+
+func TestLogRepairFromReplica(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-repair-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = 3 * entWidth
+	peer, err := NewLog(path.Join(dir, "peer"), c)
+	require.NoError(t, err)
+	defer peer.Close()
+	local, err := NewLog(path.Join(dir, "local"), c)
+	require.NoError(t, err)
+
+	// the local log starts out as an exact copy of the peer's
+	for i := 0; i < 10; i++ {
+		off, err := peer.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+		record, err := peer.Read(off)
+		require.NoError(t, err)
+		require.NoError(t, local.AppendAt(record, off))
+	}
+	// and then they go their own ways
+	_, err = local.Append(&api.Record{Value: []byte("local only")})
+	require.NoError(t, err)
+	for i := 10; i < 12; i++ {
+		_, err := peer.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+	require.NoError(t, local.Close())
+
+	// records 6 and 8 get corrupted on disk
+	stores, err := filepath.Glob(path.Join(dir, "local", "*"+storeExt))
+	require.NoError(t, err)
+	for _, name := range stores {
+		p, err := ioutil.ReadFile(name)
+		require.NoError(t, err)
+		p = bytes.Replace(p, []byte("record 6"), []byte("recorX 6"), 1)
+		p = bytes.Replace(p, []byte("record 8"), []byte("recorX 8"), 1)
+		require.NoError(t, ioutil.WriteFile(name, p, 0644))
+	}
+
+	local, err = NewLog(path.Join(dir, "local"), c)
+	require.NoError(t, err)
+	defer local.Close()
+
+	replica := &replicaClient{log: peer}
+
+	from, err := local.RepairFromReplica(context.Background(), replica)
+	require.NoError(t, err)
+	require.Equal(t, uint64(6), from)
+
+	require.Equal(t, peer.PeekNextOffset(), local.PeekNextOffset())
+	for i := uint64(0); i < peer.PeekNextOffset(); i++ {
+		record, err := local.Read(i)
+		require.NoError(t, err)
+		require.Equal(t, []byte(fmt.Sprintf("record %d", i)), record.Value)
+	}
+	want, err := peer.Digest(0, peer.PeekNextOffset())
+	require.NoError(t, err)
+	got, err := local.Digest(0, local.PeekNextOffset())
+	require.NoError(t, err)
+	require.Equal(t, want, got)
+	require.NoError(t, local.CheckConsistency())
+
+	// a log that matches its replica has nothing to repair
+	from, err = local.RepairFromReplica(context.Background(), replica)
+	require.NoError(t, err)
+	require.Equal(t, local.PeekNextOffset(), from)
+}
@@ -0,0 +1,19 @@
+package log
+
+import "time"
+
+// ioRetryBackoff is how long the first retry of a failed IO operation waits. Every retry after it waits twice as long
+const ioRetryBackoff = time.Millisecond
+
+// retryIO runs op, and runs it again up to retries times for as long as it fails, backing off in between. It returns
+// the error of the last attempt. op has to be safe to run again after failing, like syncing or flushing is
+func retryIO(retries int, op func() error) error {
+	err := op()
+	backoff := ioRetryBackoff
+	for i := 0; err != nil && i < retries; i++ {
+		time.Sleep(backoff)
+		backoff *= 2
+		err = op()
+	}
+	return err
+}
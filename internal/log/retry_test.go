@@ -0,0 +1,66 @@
+package log
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	api "github.com/burmudar/prolog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogIOSyncRetries(t *testing.T) {
+	for scenario, tc := range map[string]struct {
+		faults  *FaultInjector
+		retries int
+		fn      func(log *Log) error
+		want    error
+	}{
+		"close succeeds once the flush is retried": {
+			faults:  &FaultInjector{Flush: FailNth(1)},
+			retries: 2,
+			fn:      (*Log).Close,
+		},
+		"close fails without retries": {
+			faults: &FaultInjector{Flush: FailNth(1)},
+			fn:     (*Log).Close,
+			want:   ErrInjectedFault,
+		},
+		"sync succeeds once it is retried": {
+			faults:  &FaultInjector{Sync: FailNth(1)},
+			retries: 1,
+			fn:      (*Log).Sync,
+		},
+		"sync fails when it keeps failing": {
+			faults:  &FaultInjector{Sync: FailFrom(1)},
+			retries: 3,
+			fn:      (*Log).Sync,
+			want:    ErrInjectedFault,
+		},
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "log-io-sync-retries-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			log, err := NewLog(dir, Config{FaultInjector: tc.faults, IOSyncRetries: tc.retries})
+			require.NoError(t, err)
+			_, err = log.Append(&api.Record{Value: []byte("hello world")})
+			require.NoError(t, err)
+
+			require.Equal(t, tc.want, tc.fn(log))
+			if tc.want != nil {
+				return
+			}
+
+			// the record made it to the store
+			require.NoError(t, log.Close())
+			log, err = NewLog(dir, Config{})
+			require.NoError(t, err)
+			defer log.Close()
+			record, err := log.Read(0)
+			require.NoError(t, err)
+			require.Equal(t, []byte("hello world"), record.Value)
+		})
+	}
+}
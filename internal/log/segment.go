@@ -2,127 +2,804 @@ package log
 
 import (
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
 	"path"
+	"sync"
+	"time"
 
 	api "github.com/burmudar/prolog/api/v1"
-	"github.com/golang/protobuf/proto"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+var (
+	ErrRewriteUnsupported = fmt.Errorf("segments kept by a custom NewStore can't be rewritten")
+	// ErrSegmentRemoved is returned when reading from a segment that was removed, or closed along with its log, after
+	// the reader got hold of it, like a Reader of a log that was truncated since
+	ErrSegmentRemoved = fmt.Errorf("segment has been removed or its log closed")
 )
 
 type segment struct {
-	store                  *store
-	index                  *index
+	store                  StoreBackend
+	index                  IndexBackend
+	timeIndex              *timeIndex
 	baseOffset, nextOffset uint64
 	config                 Config
+	// created is when the first record was appended to the segment. It is zero while the segment is empty
+	created time.Time
+	dir     string
+	// mu keeps the segment from being closed or removed while it is read from, see segmentCache. Reads hold it for
+	// reading, and whatever closes, reopens or rewrites the segment's files holds it for writing
+	mu sync.RWMutex
+	// closed is set once the segment has been closed, after which it can be reopened with reopen. A dead segment was
+	// removed, or closed for good along with its log, and is never reopened
+	closed bool
+	dead   bool
+	// codec is what the segment's records are stored with
+	codec RecordCodec
+	// encrypted is set when the segment's records are sealed with Config.AEAD, which adds overhead bytes to every record
+	encrypted bool
+	overhead  uint64
+	// layout is how the store lays out the frames of the records, see frameSize. For an empty store other than the
+	// file backed one, which might wrap the file backed one, it can't be told until the first record is appended,
+	// which is what unframed is set for
+	layout   frameLayout
+	unframed bool
+	// indexInterval is how many records apart the index entries are, and unindexed is how many records were appended
+	// since the last entry
+	indexInterval uint64
+	unindexed     uint64
+	// sealed is set once the segment is no longer the active segment, which is when nothing is appended to it anymore.
+	// With Config.ConcurrentSealedReads set, its records are read with ReadSealed
+	sealed bool
 }
 
 func newSegment(dir string, baseOffset uint64, c Config) (*segment, error) {
 	s := &segment{
 		baseOffset: baseOffset,
 		config:     c,
+		dir:        dir,
 	}
 
-	var err error
-	storeFile, err := os.OpenFile(
-		path.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".store")),
-		os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
-	if err != nil {
-		return nil, err
+	newStore := c.Segment.NewStore
+	if newStore == nil {
+		newStore = newFileStore
+	}
+	newIndex := c.Segment.NewIndex
+	if newIndex == nil {
+		newIndex = newFileIndex
 	}
 
-	if s.store, err = newStore(storeFile); err != nil {
+	var err error
+	if s.store, err = newStore(dir, baseOffset, c); err != nil {
 		return nil, err
 	}
+	raw, framed := s.store.(*store)
+	switch {
+	case framed:
+		s.layout = raw.frame
+	case s.store.Size() == 0:
+		s.layout, s.unframed = bareFrames, true
+	default:
+		if s.layout, err = peekFrameLayout(s.store); err != nil {
+			return nil, err
+		}
+	}
+	s.store = c.FaultInjector.wrap(s.store)
 
-	indexFile, err := os.OpenFile(
-		path.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".index")),
-		os.O_RDWR|os.O_CREATE, 0644,
-	)
-	if err != nil {
-		return nil, err
+	// like the time index, the header is only persisted next to the default file backed store
+	header := configSegmentHeader(c)
+	if c.Segment.NewStore == nil {
+		if header, err = readSegmentHeader(dir, baseOffset, c, s.store.Size() == 0); err != nil {
+			return nil, err
+		}
+	}
+	s.codec, s.encrypted, s.indexInterval = header.codec, header.encrypted, header.indexInterval
+	if framed {
+		raw.setFrameFlags(frameFlags(s.codec, s.encrypted))
+	}
+	if s.encrypted {
+		s.store = encryptStore(s.store, c.AEAD)
+		if c.AEAD != nil {
+			s.overhead = encryptionOverhead(c.AEAD)
+		}
 	}
+	// without the AEAD the records can't be read, so the segment is opened without looking at them, and reading them
+	// fails with ErrEncrypted
+	locked := s.encrypted && c.AEAD == nil
 
-	if s.index, err = newIndex(indexFile, c); err != nil {
+	if s.index, err = newIndex(dir, baseOffset, c); err != nil {
 		return nil, err
 	}
-	if off, _, err := s.index.Read(-1); err != nil {
+	// the index of a log that another process still has open is padded out with zeros
+	if idx, ok := s.index.(*index); ok && c.ReadOnly {
+		idx.trimPadding(s.store.Size() == 0)
+	}
+	if off, pos, err := s.index.Read(-1); err != nil {
 		s.nextOffset = baseOffset
 	} else {
 		s.nextOffset = baseOffset + uint64(off) + 1
+		// the records after the last entry of a sparse index have to be read to find out where the segment ends
+		if s.indexInterval > 1 {
+			if err := s.loadUnindexed(pos); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// the time index is only persisted next to the default file backed store
+	var existed bool
+	if s.timeIndex, existed, err = newTimeIndex(dir, baseOffset, c, c.Segment.NewStore == nil && !locked); err != nil {
+		return nil, err
+	}
+	if locked {
+		return s, nil
+	}
+	if existed {
+		err = s.loadLastTimestamp()
+	} else {
+		err = s.rebuildTimeIndex()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// we don't keep track of when an existing segment was created, but its first record's timestamp is close enough,
+	// unless the record is damaged
+	if s.nextOffset > s.baseOffset {
+		off, _, err := s.index.Read(0)
+		if err != nil {
+			return nil, err
+		}
+		first, err := s.Read(s.baseOffset + uint64(off))
+		if err != nil && !isCorrupt(err) {
+			return nil, err
+		}
+		if err == nil {
+			s.created = time.Unix(0, first.Timestamp)
+		}
 	}
 
 	return s, nil
 }
 
+// loadUnindexed reads the records that follow the one at pos, which has the last entry in the index
+func (s *segment) loadUnindexed(pos uint64) error {
+	_, pos, err := s.readAt(pos)
+	if err != nil {
+		return err
+	}
+
+	for ; pos < s.store.Size(); s.unindexed++ {
+		var record *api.Record
+		if record, pos, err = s.readAt(pos); err != nil {
+			return err
+		}
+		s.nextOffset = record.Offset + 1
+	}
+	return nil
+}
+
+// readAt reads the record at pos in the store and returns it along with the position of the record after it
+func (s *segment) readAt(pos uint64) (*api.Record, uint64, error) {
+	p, err := s.store.Read(pos)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var record api.Record
+	if err := s.codec.Unmarshal(p, &record); err != nil {
+		return nil, 0, err
+	}
+	return &record, pos + s.frameSize(uint64(len(p))), nil
+}
+
+// indexRecord adds an entry for the record at offset cur to the index, unless the index is sparse and the last entry
+// is fewer than IndexInterval records back. The first record always gets an entry, so that reads can start from it
+func (s *segment) indexRecord(cur, pos uint64) error {
+	if s.index.Size() > 0 && s.unindexed+1 < s.indexInterval {
+		s.unindexed++
+		return nil
+	}
+
+	if err := s.index.Write(uint32(cur-s.baseOffset), pos); err != nil {
+		return err
+	}
+	s.unindexed = 0
+	return nil
+}
+
+// RebuildIndex recreates the index from the records in the store, for when the index has been lost or damaged but the
+// store is intact. Every record carries its offset, which may skip ahead of the one before it, as offsets handed out by
+// an OffsetAllocator or appended with AppendAt do, but never falls behind it
+func (s *segment) RebuildIndex() error {
+	if err := s.index.Close(); err != nil {
+		return err
+	}
+	if err := s.index.Remove(); err != nil {
+		return err
+	}
+
+	newIndex := s.config.Segment.NewIndex
+	if newIndex == nil {
+		newIndex = newFileIndex
+	}
+	var err error
+	if s.index, err = newIndex(s.dir, s.baseOffset, s.config); err != nil {
+		return err
+	}
+
+	s.nextOffset, s.unindexed = s.baseOffset, 0
+	for pos := uint64(0); pos < s.store.Size(); {
+		record, next, err := s.readAt(pos)
+		if err != nil {
+			return err
+		}
+		if record.Offset < s.nextOffset {
+			return fmt.Errorf("record at position %d has offset %d, expected at least %d", pos, record.Offset, s.nextOffset)
+		}
+
+		if err := s.indexRecord(record.Offset, pos); err != nil {
+			return err
+		}
+		s.nextOffset = record.Offset + 1
+		pos = next
+	}
+
+	return s.rebuildTimeIndex()
+}
+
+// rebuildTimeIndex recreates the time index by reading every record in the segment
+func (s *segment) rebuildTimeIndex() error {
+	if err := s.timeIndex.Reset(); err != nil {
+		return err
+	}
+
+	for off := s.baseOffset; off < s.nextOffset; off++ {
+		record, err := s.Read(off)
+		if _, ok := err.(api.ErrOffsetOutOfRange); ok || isCorrupt(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := s.timeIndex.Add(uint32(off-s.baseOffset), record.Timestamp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadLastTimestamp restores the highest timestamp in the segment, which isn't stored in the sparse time index.
+// Since timestamps might be out of order, we scan from the last entry in the time index to the end of the segment.
+// Damaged records are skipped, so that a log with some can still be opened and repaired
+func (s *segment) loadLastTimestamp() error {
+	from := s.baseOffset
+	if n := len(s.timeIndex.entries); n > 0 {
+		s.timeIndex.last = s.timeIndex.entries[n-1].ts
+		from += uint64(s.timeIndex.entries[n-1].off)
+	}
+
+	for off := from; off < s.nextOffset; off++ {
+		record, err := s.Read(off)
+		if _, ok := err.(api.ErrOffsetOutOfRange); ok || isCorrupt(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if record.Timestamp > s.timeIndex.last {
+			s.timeIndex.last = record.Timestamp
+		}
+	}
+	return nil
+}
+
 func (s *segment) Append(record *api.Record) (offset uint64, err error) {
-	cur := s.nextOffset
+	return s.AppendAt(record, s.nextOffset)
+}
+
+// AppendAt appends the record at the given offset, which may skip ahead of the segment's next offset but not fall
+// behind it. Offsets that are skipped are simply never found when reading
+func (s *segment) AppendAt(record *api.Record, cur uint64) (offset uint64, err error) {
+	offset, _, err = s.appendAt(record, cur)
+	return offset, err
+}
+
+// appendAt is AppendAt that also returns the position the record was stored at in the segment's store
+func (s *segment) appendAt(record *api.Record, cur uint64) (offset uint64, pos uint64, err error) {
+	if cur < s.nextOffset {
+		return 0, 0, ErrOffsetNotSequential
+	}
 	record.Offset = cur
-	p, err := proto.Marshal(record)
+	p, err := s.codec.Marshal(record)
 	if err != nil {
-		return 0, err
+		return 0, 0, err
+	}
+	if s.codec == ProtoCodec {
+		p = appendPadding(p, s.padding(uint64(len(p))))
+	}
+	if s.tooLarge(uint64(len(p))) {
+		return 0, 0, ErrRecordTooLarge
 	}
 
-	_, pos, err := s.store.Append(p)
+	n, pos, err := s.store.Append(p)
 	if err != nil {
-		return 0, err
+		return 0, 0, writeFailed(err)
 	}
+	s.learnLayout(n, uint64(len(p)))
 
 	// first we need to figure out where in the index the position should be put
 	// then we put the position there!
-	if err := s.index.Write(
-		// index offsets are relative to the base offset
-		uint32(s.nextOffset-s.baseOffset),
-		pos,
-	); err != nil {
-		return 0, err
+	if err := s.indexRecord(cur, pos); err != nil {
+		return 0, 0, writeFailed(err)
+	}
+
+	if err := s.timeIndex.Add(uint32(cur-s.baseOffset), record.Timestamp); err != nil {
+		return 0, 0, writeFailed(err)
+	}
+	s.nextOffset = cur + 1
+	return cur, pos, nil
+}
+
+// AppendReader appends a record with a value of size bytes read from r. The record is encoded by hand so that the
+// value can be streamed into the store: protobuf doesn't mind in which order fields come, so the offset and timestamp
+// are written first, followed by the value's tag and length, and then the value itself. Records stored with other
+// codecs have their value read into memory and are appended as usual
+func (s *segment) AppendReader(r io.Reader, size int64, timestamp int64) (offset uint64, err error) {
+	return s.AppendReaderAt(r, size, timestamp, s.nextOffset)
+}
+
+// AppendReaderAt is AppendReader for a record at the given offset, which may skip ahead of the segment's next offset
+// like it may with AppendAt
+func (s *segment) AppendReaderAt(r io.Reader, size int64, timestamp int64, cur uint64) (offset uint64, err error) {
+	if cur < s.nextOffset {
+		return 0, ErrOffsetNotSequential
+	}
+	if s.codec != ProtoCodec {
+		value := make([]byte, size)
+		if _, err := io.ReadFull(r, value); err != nil {
+			return 0, err
+		}
+		return s.AppendAt(&api.Record{Value: value, Timestamp: timestamp}, cur)
+	}
+
+	var header []byte
+	header = protowire.AppendTag(header, 2, protowire.VarintType)
+	header = protowire.AppendVarint(header, cur)
+	header = protowire.AppendTag(header, 3, protowire.VarintType)
+	header = protowire.AppendVarint(header, uint64(timestamp))
+	// fields can come in any order, so the padding goes ahead of the value
+	value := uint64(protowire.SizeTag(1)+protowire.SizeVarint(uint64(size))) + uint64(size)
+	header = appendPadding(header, s.padding(uint64(len(header))+value))
+	header = protowire.AppendTag(header, 1, protowire.BytesType)
+	header = protowire.AppendVarint(header, uint64(size))
+	if s.tooLarge(uint64(len(header)) + uint64(size)) {
+		return 0, ErrRecordTooLarge
 	}
-	s.nextOffset++
+
+	// errors reading r are the caller's, not failures to write, so they're kept apart from the store's own
+	cr := &callerReader{Reader: r}
+	var n, pos uint64
+	if sa, ok := s.store.(streamAppender); ok {
+		n, pos, err = sa.AppendStream(header, cr, size)
+	} else {
+		// backends that can't stream get the whole record at once
+		p := make([]byte, int64(len(header))+size)
+		copy(p, header)
+		if _, err = io.ReadFull(cr, p[len(header):]); err == nil {
+			n, pos, err = s.store.Append(p)
+		}
+	}
+	if err != nil {
+		if cr.failed(err) {
+			return 0, err
+		}
+		return 0, writeFailed(err)
+	}
+	s.learnLayout(n, uint64(len(header))+uint64(size))
+
+	if err := s.indexRecord(cur, pos); err != nil {
+		return 0, writeFailed(err)
+	}
+	if err := s.timeIndex.Add(uint32(cur-s.baseOffset), timestamp); err != nil {
+		return 0, writeFailed(err)
+	}
+	s.nextOffset = cur + 1
 	return cur, nil
 }
 
+// callerReader keeps the error a reader passed to AppendReader failed with
+type callerReader struct {
+	io.Reader
+	err error
+}
+
+func (r *callerReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if err != nil {
+		r.err = err
+	}
+	return n, err
+}
+
+// failed reports whether err came from the reader rather than the store, counting a reader that came up short too
+func (r *callerReader) failed(err error) bool {
+	if r.err == nil {
+		return false
+	}
+	return err == r.err || err == io.EOF || err == io.ErrUnexpectedEOF
+}
+
+// ReadAtTime returns the first record in the segment with a timestamp of at least ts. The time index is used to skip
+// straight to the vicinity of the record, from where we scan forward
+func (s *segment) ReadAtTime(ts int64) (*api.Record, error) {
+	for off := s.baseOffset + uint64(s.timeIndex.Lookup(ts)); off < s.nextOffset; off++ {
+		record, err := s.Read(off)
+		if _, ok := err.(api.ErrOffsetOutOfRange); ok {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if record.Timestamp >= ts {
+			return record, nil
+		}
+	}
+
+	return nil, ErrNoRecordAtTime
+}
+
 func (s *segment) Read(off uint64) (*api.Record, error) {
+	var ret api.Record
+	if err := s.readInto(off, &ret); err != nil {
+		return nil, err
+	}
+	return &ret, nil
+}
+
+// readStore reads the record at pos from the store, side by side with other readers when the segment is sealed and the
+// store supports it
+func (s *segment) readStore(pos uint64) ([]byte, error) {
+	if s.sealed && s.config.ConcurrentSealedReads {
+		return readSealed(s.store, pos)
+	}
+	return s.store.Read(pos)
+}
+
+// seal marks the segment as sealed once another segment has become the active one. The store is flushed first, so
+// that reads needn't flush it anymore
+func (s *segment) seal() error {
+	if s.config.ConcurrentSealedReads {
+		if err := retryIO(s.config.IOSyncRetries, s.store.Flush); err != nil {
+			return err
+		}
+	}
+	s.sealed = true
+	return nil
+}
+
+// readInto is Read for a record that is reset and unmarshalled into
+func (s *segment) readInto(off uint64, into *api.Record) error {
 	// We ask the index - For where art thou position in store for this offset ?
+	pos, err := s.position(off)
+	if err != nil {
+		return err
+	}
+	p, err := s.readStore(pos)
+	if err != nil {
+		return err
+	}
+
+	into.Reset()
+	if err := s.codec.Unmarshal(p, into); err != nil {
+		return ErrCorruptRecord{Offset: off, Err: err}
+	}
+	dropPadding(into.ProtoReflect())
+	if into.Value == nil {
+		// an empty value isn't encoded at all, but it is a value nonetheless
+		into.Value = []byte{}
+	}
+	return nil
+}
+
+// padding is how many bytes of padding the next record, which is n bytes long, needs for the records to stay aligned
+func (s *segment) padding(n uint64) int {
+	return alignmentPadding(s.store.Size(), s.frameSize(n), s.config.Segment.Alignment)
+}
+
+// learnLayout learns how the store lays out frames from the first record appended to it, which took up n bytes for a
+// record of size bytes, when the layout couldn't be told when the segment was opened
+func (s *segment) learnLayout(n, size uint64) {
+	if !s.unframed {
+		return
+	}
+	s.unframed = false
+	if n-s.overhead-size == maxFrameOverhead {
+		s.layout = frameLayout{}
+	}
+}
+
+// frameSize is how many bytes a record of n bytes takes up in the store, once it is sealed and framed
+func (s *segment) frameSize(n uint64) uint64 {
+	return s.layout.overhead() + s.overhead + n
+}
+
+// position finds the position of the record with the given offset in the store. Usually offsets are contiguous, so
+// the record's entry is at its relative offset in the index. When offsets have been skipped, the entry comes earlier
+// and we binary search for it instead, which works since entries are ordered by offset. A sparse index might not have
+// an entry for the record, in which case we scan the store from the closest entry before it
+func (s *segment) position(off uint64) (uint64, error) {
 	// off - s.baseOffset = relative offset
-	_, pos, err := s.index.Read(int64(off - s.baseOffset))
+	rel := uint32(off - s.baseOffset)
+	if s.indexInterval == 1 {
+		out, pos, err := s.index.Read(int64(rel))
+		if err == nil && out == rel {
+			return pos, nil
+		}
+	}
+
+	out, pos, ok, err := s.closestEntry(rel)
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
-	p, err := s.store.Read(pos)
+	if !ok {
+		return 0, api.ErrOffsetOutOfRange{Offset: off}
+	}
+	if out == rel {
+		return pos, nil
+	}
+
+	if s.indexInterval > 1 {
+		for pos < s.store.Size() {
+			record, next, err := s.readAt(pos)
+			if err != nil {
+				return 0, err
+			}
+			if record.Offset == off {
+				return pos, nil
+			}
+			if record.Offset > off {
+				break
+			}
+			pos = next
+		}
+	}
+
+	return 0, api.ErrOffsetOutOfRange{Offset: off}
+}
+
+// positionFrom finds the position of the first record with an offset of at least off in the store, which is the end of
+// the store when there is none. Unlike position, off doesn't need to have a record, which lets ranges start and end in
+// the offsets that were skipped
+func (s *segment) positionFrom(off uint64) (uint64, error) {
+	pos := uint64(0)
+	if off > s.baseOffset {
+		rel := uint32(off - s.baseOffset)
+		out, closest, ok, err := s.closestEntry(rel)
+		if err != nil {
+			return 0, err
+		}
+		if ok && out == rel {
+			return closest, nil
+		}
+		if ok {
+			pos = closest
+		}
+	}
+
+	for pos < s.store.Size() {
+		record, next, err := s.readAt(pos)
+		if err != nil {
+			return 0, err
+		}
+		if record.Offset >= off {
+			return pos, nil
+		}
+		pos = next
+	}
+	return pos, nil
+}
+
+// closestEntry finds the index entry with the highest relative offset that is at most rel, reporting whether there is
+// one. Entries are ordered by offset, so we binary search for the first entry past rel, the one before it is the
+// closest one
+func (s *segment) closestEntry(rel uint32) (out uint32, pos uint64, ok bool, err error) {
+	lo, hi := int64(0), int64(s.index.Size()/entWidth)
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		out, _, err := s.index.Read(mid)
+		if err != nil {
+			return 0, 0, false, err
+		}
+		if out <= rel {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+	if lo == 0 {
+		return 0, 0, false, nil
+	}
+
+	out, pos, err = s.index.Read(lo - 1)
 	if err != nil {
-		return nil, err
+		return 0, 0, false, err
 	}
+	return out, pos, true, nil
+}
 
-	var ret api.Record
-	err = proto.Unmarshal(p, &ret)
-	return &ret, err
+// tooLarge reports whether a record of n bytes would be too large for any segment's store on its own, unless such
+// records are allowed
+func (s *segment) tooLarge(n uint64) bool {
+	return !s.config.AllowOversizedRecords && s.layout.overhead()+n > s.config.Segment.MaxStoreBytes
 }
 
 func (s *segment) IsMaxed() bool {
-	return s.store.size >= s.config.Segment.MaxStoreBytes ||
-		s.index.size >= s.config.Segment.MaxIndexBytes
+	return s.store.Size() >= s.config.Segment.MaxStoreBytes ||
+		s.index.Size() >= s.config.Segment.MaxIndexBytes
+}
+
+// IsExpired reports whether the segment has been around for longer than MaxAge. Empty segments never expire
+func (s *segment) IsExpired(now time.Time) bool {
+	if s.config.Segment.MaxAge <= 0 || s.created.IsZero() {
+		return false
+	}
+
+	return now.Sub(s.created) >= s.config.Segment.MaxAge
 }
 
 func (s *segment) Remove() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.dead = true
 	if err := s.Close(); err != nil {
 		return err
 	}
 
-	if err := os.Remove(s.index.Name()); err != nil {
+	if err := s.index.Remove(); err != nil {
+		return err
+	}
+
+	if err := s.timeIndex.Remove(); err != nil {
+		return err
+	}
+
+	if err := s.store.Remove(); err != nil {
+		return err
+	}
+
+	if s.config.Segment.NewStore == nil {
+		return removeSegmentHeader(s.dir, s.baseOffset)
+	}
+	return nil
+}
+
+// Sync makes the segment's records durable. The time index is left out since it can be rebuilt from the records
+func (s *segment) Sync() error {
+	if err := retryIO(s.config.IOSyncRetries, s.store.Sync); err != nil {
+		return err
+	}
+
+	return retryIO(s.config.IOSyncRetries, s.index.Sync)
+}
+
+// rewrite copies the segment's records to new files, passing each one through fn, which returns the record to write in
+// its place, or nil to leave it out, and replaces the segment's files with the new ones. The new files are written to
+// a directory of their own and moved over the old ones once they're complete, but the files are moved one by one, so
+// a crash in between can leave the store and indexes out of step. CheckOnOpen finds that, and RebuildIndex repairs it.
+// Segments kept by a custom NewStore can't be rewritten
+func (s *segment) rewrite(fn func(*api.Record) *api.Record) error {
+	return s.rewriteUntil(s.store.Size(), fn)
+}
+
+// rewriteUntil is rewrite for the records before position end in the store, leaving out the ones after it without
+// reading them, so that they can't fail the rewrite when they are damaged
+func (s *segment) rewriteUntil(end uint64, fn func(*api.Record) *api.Record) error {
+	if s.config.Segment.NewStore != nil {
+		return ErrRewriteUnsupported
+	}
+
+	tmp, err := ioutil.TempDir(s.dir, ".rewrite")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	c := s.config
+	// existing segments keep the codec they were written with
+	c.Codec = s.codec
+	out, err := newSegment(tmp, s.baseOffset, c)
+	if err != nil {
 		return err
 	}
 
-	if err := os.Remove(s.store.Name()); err != nil {
+	for pos := uint64(0); pos < end; {
+		record, next, err := s.readAt(pos)
+		if err != nil {
+			out.Close()
+			return err
+		}
+		pos = next
+
+		// the record is padded again if need be, to the alignment of its new position
+		dropPadding(record.ProtoReflect())
+		if record = fn(record); record == nil {
+			continue
+		}
+		if _, err := out.AppendAt(record, record.Offset); err != nil {
+			out.Close()
+			return unwrapWriteFailure(err)
+		}
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+
+	files, err := ioutil.ReadDir(tmp)
+	if err != nil {
+		return err
+	}
+	if err := s.Close(); err != nil {
 		return err
 	}
+	for _, file := range files {
+		if err := os.Rename(path.Join(tmp, file.Name()), path.Join(s.dir, file.Name())); err != nil {
+			return err
+		}
+	}
 
+	o, err := s.open()
+	if err != nil {
+		return err
+	}
+	// a segment that was rewritten ends somewhere else than it did before
+	s.nextOffset, s.unindexed = o.nextOffset, o.unindexed
 	return nil
 }
 
+// reopen opens a closed segment's store and indexes again. The segment's offsets are left alone, since they don't
+// change while it is closed and are looked at without keeping the segment open
+func (s *segment) reopen() error {
+	_, err := s.open()
+	return err
+}
+
+// open opens the segment's files and makes their store and indexes the segment's, returning the segment they were
+// opened as
+func (s *segment) open() (*segment, error) {
+	o, err := newSegment(s.dir, s.baseOffset, s.config)
+	if err != nil {
+		return nil, err
+	}
+
+	s.store, s.index, s.timeIndex = o.store, o.index, o.timeIndex
+	s.closed = false
+	return o, nil
+}
+
+// Close closes the segment's store and indexes. Closing a segment that is already closed does nothing
 func (s *segment) Close() error {
+	if s.closed {
+		return nil
+	}
+
+	// closing can't be retried once it is under way, so the store's buffered records are flushed beforehand, which can
+	if err := retryIO(s.config.IOSyncRetries, s.store.Flush); err != nil {
+		return err
+	}
+	s.closed = true
+
 	if err := s.index.Close(); err != nil {
 		return err
 	}
 
+	if err := s.timeIndex.Close(); err != nil {
+		return err
+	}
+
 	if err := s.store.Close(); err != nil {
 		return err
 	}
@@ -130,6 +807,33 @@ func (s *segment) Close() error {
 	return nil
 }
 
+// size returns how many bytes the segment's store and index take up. Like lastTimestamp, it can be called without
+// acquiring the segment, since it keeps the segment from being reopened while it looks
+func (s *segment) size() uint64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.store.Size() + s.index.Size()
+}
+
+// lastTimestamp returns the timestamp of the last record in the segment's time index
+func (s *segment) lastTimestamp() int64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.timeIndex.last
+}
+
+// closeForGood closes the segment once nobody is reading it, and keeps it from being reopened by readers that are left
+// over, like those returned by Log.Reader, which is what closing the log does
+func (s *segment) closeForGood() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.dead = true
+	return s.Close()
+}
+
 func nearestMultiple(j, k uint64) uint64 {
 	if j >= 0 {
 		return (j / k) * k
@@ -1,9 +1,12 @@
 package log
 
 import (
+	"bytes"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
+	"path"
 	"testing"
 
 	api "github.com/burmudar/prolog/api/v1"
@@ -56,3 +59,95 @@ func TestSegment(t *testing.T) {
 	require.False(t, s.IsMaxed())
 
 }
+
+func TestSegmentRebuildIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "segment-rebuild-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = 1024
+
+	s, err := newSegment(dir, 16, c)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		_, err := s.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+	require.NoError(t, s.Close())
+
+	require.NoError(t, os.Remove(path.Join(dir, "16.index")))
+
+	s, err = newSegment(dir, 16, c)
+	require.NoError(t, err)
+	defer s.Close()
+	// without an index the segment doesn't know about any of its records
+	require.Equal(t, uint64(16), s.nextOffset)
+
+	require.NoError(t, s.RebuildIndex())
+	require.Equal(t, uint64(19), s.nextOffset)
+	for i := uint64(0); i < 3; i++ {
+		record, err := s.Read(16 + i)
+		require.NoError(t, err)
+		require.Equal(t, 16+i, record.Offset)
+		require.Equal(t, []byte(fmt.Sprintf("record %d", i)), record.Value)
+	}
+
+	off, err := s.Append(&api.Record{Value: []byte("record 3")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(19), off)
+}
+
+func TestSegmentAlignment(t *testing.T) {
+	dir, err := ioutil.TempDir("", "segment-alignment-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024 * 1024
+	c.Segment.MaxIndexBytes = 1024
+	alignment := uint64(64)
+	c.Segment.Alignment = alignment
+
+	s, err := newSegment(dir, 0, c)
+	require.NoError(t, err)
+
+	// values of all sorts of lengths, including ones that leave the record a byte short of the boundary
+	var values [][]byte
+	for n := 0; n < 150; n += 7 {
+		values = append(values, bytes.Repeat([]byte("a"), n))
+	}
+	for i, v := range values {
+		if i%2 == 0 {
+			_, err = s.Append(&api.Record{Value: v})
+		} else {
+			_, err = s.AppendReader(bytes.NewReader(v), int64(len(v)), 1)
+		}
+		require.NoError(t, err)
+	}
+
+	check := func(s *segment) {
+		for i, v := range values {
+			pos, err := s.position(uint64(i))
+			require.NoError(t, err)
+			require.Zero(t, pos%alignment, "position of record %d", i)
+
+			record, err := s.Read(uint64(i))
+			require.NoError(t, err)
+			require.Equal(t, string(v), string(record.Value))
+			require.Empty(t, record.ProtoReflect().GetUnknown())
+		}
+		require.Zero(t, s.store.Size()%alignment)
+	}
+	check(s)
+
+	// the padding is skipped the same way when the segment is opened without an alignment
+	require.NoError(t, s.Close())
+	c.Segment.Alignment = 0
+	s, err = newSegment(dir, 0, c)
+	require.NoError(t, err)
+	defer s.Close()
+	check(s)
+	require.NoError(t, s.checkConsistency())
+}
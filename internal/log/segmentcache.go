@@ -0,0 +1,193 @@
+package log
+
+import (
+	"container/list"
+	"sync"
+)
+
+// segmentCache keeps a limited number of sealed segments open. Sealed segments that haven't been read in a while are
+// closed to free their files and memory maps, and are reopened the next time they're read from. The active segment is
+// never part of the cache since it always stays open.
+//
+// Segments are read while holding their own lock for reading, so any number of them can be read at once, and a
+// segment is only closed once nobody is reading it. Segments in use when the cache is over its size are closed when
+// they're released. mu only guards the cache's bookkeeping and is never held while reading
+type segmentCache struct {
+	mu  sync.Mutex
+	max int
+	// order holds the open sealed segments with the most recently used one at the front
+	order *list.List
+	elems map[*segment]*list.Element
+	// err is the error closing a segment failed with when the segment was released
+	err error
+}
+
+func newSegmentCache(max int) *segmentCache {
+	// the segment being read has to stay open, so at least one sealed segment is kept open
+	if max < 1 {
+		max = 1
+	}
+
+	return &segmentCache{
+		max:   max,
+		order: list.New(),
+		elems: make(map[*segment]*list.Element),
+	}
+}
+
+// add starts tracking a segment that has just been sealed. A nil cache tracks nothing
+func (c *segmentCache) add(s *segment) error {
+	if c == nil {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.elems[s] = c.order.PushFront(s)
+	return c.evict()
+}
+
+// acquire makes sure the segment is open and keeps it open until the returned release func is called. Acquiring a
+// segment that was removed in the meantime fails with ErrSegmentRemoved
+func (c *segmentCache) acquire(s *segment) (release func(), err error) {
+	for {
+		s.mu.RLock()
+		if s.dead {
+			s.mu.RUnlock()
+			return nil, ErrSegmentRemoved
+		}
+		if !s.closed || c == nil {
+			break
+		}
+		s.mu.RUnlock()
+
+		// reopening keeps everyone else out of the segment, and it might have been closed again by the time we're
+		// back to reading it, in which case we go round again
+		if err := c.reopen(s); err != nil {
+			return nil, err
+		}
+	}
+	if c == nil {
+		return s.mu.RUnlock, nil
+	}
+
+	if err := c.touch(s); err != nil {
+		s.mu.RUnlock()
+		return nil, err
+	}
+	return func() {
+		s.mu.RUnlock()
+		c.release()
+	}, nil
+}
+
+// lock is acquire for callers that change the segment's files, like rewriting it. It waits for everyone reading the
+// segment to be done and keeps them out until the returned unlock func is called
+func (c *segmentCache) lock(s *segment) (unlock func(), err error) {
+	s.mu.Lock()
+	if s.dead {
+		s.mu.Unlock()
+		return nil, ErrSegmentRemoved
+	}
+	if c == nil {
+		return s.mu.Unlock, nil
+	}
+
+	if s.closed {
+		if err := s.reopen(); err != nil {
+			s.mu.Unlock()
+			return nil, err
+		}
+		c.mu.Lock()
+		c.elems[s] = c.order.PushFront(s)
+		c.mu.Unlock()
+	}
+	return func() {
+		s.mu.Unlock()
+		c.release()
+	}, nil
+}
+
+// reopen opens the closed segment s again and starts tracking it
+func (c *segmentCache) reopen(s *segment) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.dead || !s.closed {
+		return nil
+	}
+	if err := s.reopen(); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.elems[s] = c.order.PushFront(s)
+	return nil
+}
+
+// touch marks s as the most recently used segment, and closes the least recently used ones that aren't in use if
+// there are too many open. It returns the error closing a segment failed with since it was last called, if any
+func (c *segmentCache) touch(s *segment) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.elems[s]; ok {
+		c.order.MoveToFront(e)
+	}
+	if err := c.err; err != nil {
+		c.err = nil
+		return err
+	}
+	return c.evict()
+}
+
+// release closes the segments that were kept open past the limit because they were in use. A release has no one to
+// return an error to, so it is kept for the next acquire
+func (c *segmentCache) release() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.evict(); err != nil {
+		c.err = err
+	}
+}
+
+// remove stops tracking a segment, which is expected to be removed right after
+func (c *segmentCache) remove(s *segment) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.elems[s]; ok {
+		c.order.Remove(e)
+		delete(c.elems, s)
+	}
+}
+
+// evict closes the least recently used segments that nobody is reading until there are no more than max open, or
+// only ones in use are left to close. The caller is expected to hold the lock
+func (c *segmentCache) evict() error {
+	for e := c.order.Back(); e != nil && c.order.Len() > c.max; {
+		s, prev := e.Value.(*segment), e.Prev()
+		// segments are locked before the cache everywhere else, so we mustn't wait for one here
+		if !s.mu.TryLock() {
+			e = prev
+			continue
+		}
+		c.order.Remove(e)
+		delete(c.elems, s)
+		err := s.Close()
+		s.mu.Unlock()
+		if err != nil {
+			return err
+		}
+		e = prev
+	}
+
+	return nil
+}
@@ -0,0 +1,110 @@
+package log
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	api "github.com/burmudar/prolog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogMaxOpenSegments(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-max-open-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{MaxOpenSegments: 3}
+	c.Segment.MaxStoreBytes = 64
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+
+	n := 20
+	for i := 0; i < n; i++ {
+		_, err := log.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+	require.Greater(t, len(log.segments), 10)
+	requireOpenSegments(t, log, c.MaxOpenSegments)
+
+	// reading from the oldest segments onwards reopens every segment
+	require.True(t, log.segments[0].closed)
+	for i := 0; i < n; i++ {
+		record, err := log.Read(uint64(i))
+		require.NoError(t, err)
+		require.Equal(t, []byte(fmt.Sprintf("record %d", i)), record.Value)
+		require.False(t, log.findSegment(uint64(i)).closed)
+		requireOpenSegments(t, log, c.MaxOpenSegments)
+	}
+
+	b, err := ioutil.ReadAll(log.Reader())
+	require.NoError(t, err)
+	require.NotEmpty(t, b)
+	requireOpenSegments(t, log, c.MaxOpenSegments)
+
+	require.NoError(t, log.Close())
+
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	requireOpenSegments(t, log, c.MaxOpenSegments)
+
+	record, err := log.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("record 0"), record.Value)
+}
+
+func requireOpenSegments(t *testing.T, log *Log, max int) {
+	t.Helper()
+	open := 0
+	for _, s := range log.segments {
+		if !s.closed {
+			open++
+		}
+	}
+	require.LessOrEqual(t, open, max)
+	require.False(t, log.activeSegment.closed)
+}
+
+func TestSegmentCacheAcquire(t *testing.T) {
+	dir, err := ioutil.TempDir("", "segment-cache-acquire-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{MaxOpenSegments: 2}
+	c.Segment.MaxIndexBytes = entWidth * 2
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	for i := 0; i < 7; i++ {
+		_, err := log.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+	require.Equal(t, 4, len(log.segments))
+
+	// segments are acquired independently of each other, and the ones in use stay open past the limit until they're
+	// released
+	var releases []func()
+	for _, s := range log.segments[:3] {
+		release, err := log.open.acquire(s)
+		require.NoError(t, err)
+		require.False(t, s.closed)
+		releases = append(releases, release)
+	}
+	for _, release := range releases {
+		release()
+	}
+	requireOpenSegments(t, log, c.MaxOpenSegments)
+
+	// a reader left over from before the log was truncated doesn't bring the removed segments back
+	r := log.Reader()
+	require.NoError(t, log.Truncate(3))
+	_, err = ioutil.ReadAll(r)
+	require.Equal(t, ErrSegmentRemoved, err)
+	for _, base := range []uint64{0, 2} {
+		_, err := os.Stat(segmentFilePath(dir, base, storeExt))
+		require.True(t, os.IsNotExist(err))
+	}
+}
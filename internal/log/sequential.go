@@ -0,0 +1,83 @@
+package log
+
+import (
+	api "github.com/burmudar/prolog/api/v1"
+)
+
+// SequentialReader reads a log from an offset onwards, prefetching the records after the one asked for in the
+// background so that the consumer doesn't have to wait on the log for every record. It isn't safe to use concurrently
+type SequentialReader struct {
+	log       *Log
+	readAhead int
+	// next is the offset of the record Next returns next, skipped offsets aside
+	next uint64
+	// prefetched receives the records read ahead of the consumer. It is nil while nothing is being prefetched
+	prefetched chan prefetchResult
+	stop       chan struct{}
+}
+
+type prefetchResult struct {
+	record *api.Record
+	err    error
+}
+
+// NewSequentialReader returns a reader that starts at offset start and keeps up to readAhead records prefetched.
+// readAhead is at least 1
+func (l *Log) NewSequentialReader(start uint64, readAhead int) *SequentialReader {
+	if readAhead < 1 {
+		readAhead = 1
+	}
+
+	return &SequentialReader{
+		log:       l,
+		readAhead: readAhead,
+		next:      start,
+	}
+}
+
+// Next returns the next record in the log. Offsets without a record are skipped. Once the end of the log is reached it
+// returns api.ErrOffsetOutOfRange, after which it can be called again to carry on once more records have been appended
+func (r *SequentialReader) Next() (*api.Record, error) {
+	if r.prefetched == nil {
+		r.prefetched = make(chan prefetchResult, r.readAhead)
+		r.stop = make(chan struct{})
+		go r.prefetch(r.next, r.prefetched, r.stop)
+	}
+
+	res := <-r.prefetched
+	if res.err != nil {
+		// prefetching stops at the first error, and starts again from where it stopped on the next call
+		r.prefetched = nil
+		return nil, res.err
+	}
+
+	r.next = res.record.Offset + 1
+	return res.record, nil
+}
+
+// Close stops the prefetching
+func (r *SequentialReader) Close() {
+	if r.prefetched != nil {
+		close(r.stop)
+		r.prefetched = nil
+	}
+}
+
+// prefetch reads the records from off on into results, until it fails to read one or is told to stop
+func (r *SequentialReader) prefetch(off uint64, results chan<- prefetchResult, stop <-chan struct{}) {
+	for ; ; off++ {
+		record, err := r.log.Read(off)
+		if skippedOffset(err) {
+			continue
+		}
+
+		select {
+		case results <- prefetchResult{record: record, err: err}:
+		case <-stop:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package log
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	api "github.com/burmudar/prolog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSequentialReader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-sequential-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{OffsetAllocator: &strideAllocator{stride: 2}}
+	c.Segment.MaxIndexBytes = entWidth * 4
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	appendRecords := func(from, to int) {
+		for i := from; i < to; i++ {
+			_, err := log.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+			require.NoError(t, err)
+		}
+	}
+	appendRecords(0, 10)
+
+	r := log.NewSequentialReader(4, 3)
+	defer r.Close()
+
+	// the skipped offsets in between the records are passed over
+	for i := 2; i < 10; i++ {
+		record, err := r.Next()
+		require.NoError(t, err)
+		require.Equal(t, uint64(2*i), record.Offset)
+		require.Equal(t, []byte(fmt.Sprintf("record %d", i)), record.Value)
+	}
+	_, err = r.Next()
+	require.IsType(t, api.ErrOffsetOutOfRange{}, err)
+
+	// the reader picks up the records appended after it reached the end
+	appendRecords(10, 12)
+	for i := 10; i < 12; i++ {
+		record, err := r.Next()
+		require.NoError(t, err)
+		require.Equal(t, []byte(fmt.Sprintf("record %d", i)), record.Value)
+	}
+}
@@ -0,0 +1,111 @@
+package log
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	api "github.com/burmudar/prolog/api/v1"
+)
+
+const (
+	// shipChunkRecords is how many records StreamTo ships in one chunk at most
+	shipChunkRecords = 256
+	// checkpointWidth is the size of a FileCheckpoint, which holds the offset big endian
+	checkpointWidth = 8
+)
+
+// Sink is where StreamTo ships the log to, for instance a bucket in object storage
+type Sink interface {
+	// Ship receives a chunk with the store bytes of the records in [from, to), which is a run of frames as described by
+	// Frame. Chunks are shipped in order, and the same chunk may be shipped again when StreamTo resumes after Ship
+	// failed or the checkpoint couldn't be saved
+	Ship(ctx context.Context, from, to uint64, chunk []byte) error
+}
+
+// Checkpoint persists how far StreamTo got, so that shipping resumes from there after a restart
+type Checkpoint interface {
+	// Load returns the last offset that was shipped. The second return value is false when nothing was shipped yet
+	Load() (offset uint64, shipped bool, err error)
+	// Save records that everything up to and including offset was shipped
+	Save(offset uint64) error
+}
+
+// FileCheckpoint is a Checkpoint kept in a file of its own, which is replaced as a whole whenever it is saved
+type FileCheckpoint struct {
+	Path string
+}
+
+func (c FileCheckpoint) Load() (uint64, bool, error) {
+	p, err := ioutil.ReadFile(c.Path)
+	if os.IsNotExist(err) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	if len(p) != checkpointWidth {
+		return 0, false, fmt.Errorf("checkpoint %s is %d bytes long, expected %d", c.Path, len(p), checkpointWidth)
+	}
+	return enc.Uint64(p), true, nil
+}
+
+func (c FileCheckpoint) Save(offset uint64) error {
+	p := make([]byte, checkpointWidth)
+	enc.PutUint64(p, offset)
+
+	tmp := c.Path + ".tmp"
+	if err := ioutil.WriteFile(tmp, p, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.Path)
+}
+
+// StreamTo ships the records in the log to sink, in chunks, starting after the last offset in checkpoint, and saves
+// the checkpoint after every chunk. Only the records that are in the log when StreamTo is called are shipped, call it
+// again to ship the ones appended since. Records that retention removed before they were shipped are skipped.
+//
+// A chunk is only checkpointed once sink has taken it, so when shipping fails partway, calling StreamTo again with the
+// same checkpoint carries on with the chunk that failed, without shipping the ones before it again
+func (l *Log) StreamTo(ctx context.Context, sink Sink, checkpoint Checkpoint) error {
+	last, shipped, err := checkpoint.Load()
+	if err != nil {
+		return err
+	}
+
+	l.mu.RLock()
+	if l.closed {
+		l.mu.RUnlock()
+		return api.ErrClosed{}
+	}
+	from, next := l.segments[0].baseOffset, l.activeSegment.nextOffset
+	l.mu.RUnlock()
+
+	if shipped && last+1 > from {
+		from = last + 1
+	}
+
+	for from < next {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		to := from + shipChunkRecords
+		if to > next {
+			to = next
+		}
+		chunk, err := ioutil.ReadAll(l.ReaderBetween(from, to))
+		if err != nil {
+			return err
+		}
+		if err := sink.Ship(ctx, from, to, chunk); err != nil {
+			return err
+		}
+		if err := checkpoint.Save(to - 1); err != nil {
+			return err
+		}
+		from = to
+	}
+	return nil
+}
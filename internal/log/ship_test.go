@@ -0,0 +1,109 @@
+package log
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	api "github.com/burmudar/prolog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeSink keeps the chunks shipped to it, and fails the chunk starting at failAt once
+type fakeSink struct {
+	shipped bytes.Buffer
+	chunks  int
+	failAt  uint64
+	failed  bool
+}
+
+func (s *fakeSink) Ship(ctx context.Context, from, to uint64, chunk []byte) error {
+	if from == s.failAt && !s.failed {
+		s.failed = true
+		return fmt.Errorf("sink is unavailable")
+	}
+	s.chunks++
+	s.shipped.Write(chunk)
+	return nil
+}
+
+func TestLogStreamTo(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-stream-to-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	log, err := NewLog(path.Join(dir, "log"), Config{})
+	require.NoError(t, err)
+	defer log.Close()
+
+	n := 2*shipChunkRecords + 10
+	for i := 0; i < n; i++ {
+		_, err := log.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+
+	checkpoint := FileCheckpoint{Path: path.Join(dir, "checkpoint")}
+	sink := &fakeSink{failAt: shipChunkRecords}
+	require.Error(t, log.StreamTo(context.Background(), sink, checkpoint))
+	require.Equal(t, 1, sink.chunks)
+
+	last, shipped, err := checkpoint.Load()
+	require.NoError(t, err)
+	require.True(t, shipped)
+	require.Equal(t, uint64(shipChunkRecords-1), last)
+
+	// resuming ships the rest, starting with the chunk that failed
+	require.NoError(t, log.StreamTo(context.Background(), sink, checkpoint))
+	require.Equal(t, 3, sink.chunks)
+
+	for i := 0; i < n; i++ {
+		f, err := DecodeFrame(&sink.shipped)
+		require.NoError(t, err)
+		var record api.Record
+		require.NoError(t, ProtoCodec.Unmarshal(f.Payload, &record))
+		require.Equal(t, uint64(i), record.Offset)
+		require.Equal(t, []byte(fmt.Sprintf("record %d", i)), record.Value)
+	}
+	_, err = DecodeFrame(&sink.shipped)
+	require.Equal(t, io.EOF, err)
+
+	// there's nothing left to ship until more is appended
+	require.NoError(t, log.StreamTo(context.Background(), sink, checkpoint))
+	require.Equal(t, 3, sink.chunks)
+
+	_, err = log.Append(&api.Record{Value: []byte("one more")})
+	require.NoError(t, err)
+	require.NoError(t, log.StreamTo(context.Background(), sink, checkpoint))
+	require.Equal(t, 4, sink.chunks)
+	last, _, err = checkpoint.Load()
+	require.NoError(t, err)
+	require.Equal(t, uint64(n), last)
+}
+
+func TestLogStreamToCanceled(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-stream-to-canceled-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	log, err := NewLog(dir, Config{})
+	require.NoError(t, err)
+	defer log.Close()
+
+	_, err = log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	checkpoint := FileCheckpoint{Path: path.Join(dir, "..", path.Base(dir)+".checkpoint")}
+	defer os.Remove(checkpoint.Path)
+	require.Equal(t, context.Canceled, log.StreamTo(ctx, &fakeSink{}, checkpoint))
+
+	_, shipped, err := checkpoint.Load()
+	require.NoError(t, err)
+	require.False(t, shipped)
+}
@@ -3,8 +3,15 @@ package log
 import (
 	"bufio"
 	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
 	"os"
 	"sync"
+
+	api "github.com/burmudar/prolog/api/v1"
+	"github.com/tysonmote/gommap"
 )
 
 var (
@@ -15,54 +22,258 @@ const (
 	// defines the number of bytes used to store the record's length
 	// http://golang.org/ref/spec#Size_and_alignment_guarantees
 	//
-	// Entry storage in file:
-	// [record length - 8 bytes][     record      ]
-	// [record length - 8 bytes][     record      ]
+	// Entry storage in file, in frames laid out as Frame describes:
+	// [frame header - 12 bytes][     record      ][crc - 4 bytes]
+	// [frame header - 12 bytes][     record      ][crc - 4 bytes]
 	recordLenWidth = 8
 )
 
+// ErrTruncatedRecord is returned when a record can't be read in full because the store ends before it does, which
+// happens when the store's file was cut short by something other than the log
+type ErrTruncatedRecord struct {
+	// Pos is the position in the store at which the truncated record starts
+	Pos uint64
+}
+
+func (e ErrTruncatedRecord) Error() string {
+	return fmt.Sprintf("record at position %d is truncated", e.Pos)
+}
+
+// ErrWriteOutOfBounds is returned by WriteAt when the bytes it was given don't fit within a single record
+type ErrWriteOutOfBounds struct {
+	// Pos and Len are where the write started and how many bytes it was
+	Pos uint64
+	Len int
+}
+
+func (e ErrWriteOutOfBounds) Error() string {
+	return fmt.Sprintf("writing %d bytes at position %d doesn't fit within a single record", e.Len, e.Pos)
+}
+
+// StoreBackend is where a segment persists its length prefixed records
+type StoreBackend interface {
+	Append(p []byte) (n uint64, pos uint64, err error)
+	Read(pos uint64) ([]byte, error)
+	ReadAt(p []byte, off int64) (int, error)
+	Name() string
+	Size() uint64
+	// Rewrite replaces the record at pos with p, which has to be exactly as long as the record it replaces
+	Rewrite(pos uint64, p []byte) error
+	// Flush hands everything appended so far to the operating system, so that it can be read through other handles to
+	// the storage. Unlike Sync it doesn't wait for it to become durable
+	Flush() error
+	// Sync makes everything appended so far durable
+	Sync() error
+	Close() error
+	// Remove removes the underlying storage. The backend is expected to be closed before Remove is called
+	Remove() error
+}
+
+// streamAppender is implemented by backends that can append a record without having all of it in memory
+type streamAppender interface {
+	// AppendStream appends a record made up of header followed by size bytes read from r
+	AppendStream(header []byte, r io.Reader, size int64) (n uint64, pos uint64, err error)
+}
+
+// sealedReader is implemented by backends that can read the records of a sealed segment without waiting for appends.
+// Nothing is appended to a sealed segment, so there's nothing buffered to flush before reading it
+type sealedReader interface {
+	ReadSealed(pos uint64) ([]byte, error)
+}
+
+// readSealed reads the record at pos from s with ReadSealed, or with Read when s can't read side by side with others
+func readSealed(s StoreBackend, pos uint64) ([]byte, error) {
+	if sr, ok := s.(sealedReader); ok {
+		return sr.ReadSealed(pos)
+	}
+	return s.Read(pos)
+}
+
+var _ StoreBackend = (*store)(nil)
+var _ streamAppender = (*store)(nil)
+var _ sealedReader = (*store)(nil)
+
+// store guards its buffer and size with mu, so that it can be read while the log is being appended to. The store never
+// calls back into the log, so mu is always the last lock taken: the log's lock, if any, is held before it. Only
+// ReadSealed takes mu for reading, everything else takes it for writing
 type store struct {
 	*os.File
-	mu   sync.Mutex
+	mu   sync.RWMutex
 	buf  *bufio.Writer
 	size uint64
+	// mmap is a read only mapping of the file used by View. Whenever the file outgrows it, a bigger mapping is made.
+	// The old mappings are kept in mmaps, since views into them might still be in use, and are unmapped on Close
+	mmap  gommap.MMap
+	mmaps []gommap.MMap
+	// flushThreshold is how many bytes are buffered before Append flushes them to the file. Buffered bytes are only
+	// flushed when they're read or the store is closed when it is zero
+	flushThreshold uint64
+	// header is the width of the file's format header, which is zero for files from before there were headers.
+	// Positions in the store are relative to the end of the header
+	header  uint64
+	version uint16
+	// frame is how the records in the file are laid out, which depends on the version it was written in
+	frame frameLayout
+}
+
+// newFileStore is the default NewStoreFn which stores records in a "<baseOffset>.store" file in dir
+func newFileStore(dir string, baseOffset uint64, c Config) (StoreBackend, error) {
+	flag := os.O_RDWR | os.O_CREATE | os.O_APPEND
+	if c.ReadOnly {
+		flag = os.O_RDONLY
+	}
+	f, err := openLogFile(segmentFilePath(dir, baseOffset, storeExt), flag, c)
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := openStore(f, c.ReadOnly)
+	if err != nil {
+		return nil, err
+	}
+	s.flushThreshold = c.Segment.FlushThreshold
+	return s, nil
 }
 
 func newStore(f *os.File) (*store, error) {
+	return openStore(f, false)
+}
+
+// openStore is newStore for a file that is only read from when readOnly is set, in which case an empty file doesn't get
+// a header
+func openStore(f *os.File, readOnly bool) (*store, error) {
 	info, err := os.Stat(f.Name())
 	if err != nil {
 		return nil, err
 	}
 
-	return &store{
+	s := &store{
 		File: f,
-		mu:   sync.Mutex{},
+		mu:   sync.RWMutex{},
 		buf:  bufio.NewWriter(f),
-		size: uint64(info.Size()),
-	}, nil
+	}
+
+	size := uint64(info.Size())
+	if size == 0 && readOnly {
+		s.version, s.frame = formatVersion, storeFrameLayout(formatVersion)
+		return s, nil
+	}
+	if size == 0 {
+		// a new store, which gets a header in the current format
+		if _, err := f.Write(formatHeader(storeMagic, storeHeaderWidth)); err != nil {
+			return nil, err
+		}
+		s.header, s.version, s.frame = storeHeaderWidth, formatVersion, storeFrameLayout(formatVersion)
+		return s, nil
+	}
+
+	if s.version, s.header, err = ReadStoreHeader(f); err != nil {
+		return nil, err
+	}
+	s.frame = storeFrameLayout(s.version)
+	s.size = size - s.header
+	return s, nil
+}
+
+// FormatVersion is the version of the format the store's file is written in. Stores from before files had a format
+// header are version 0
+func (s *store) FormatVersion() uint16 {
+	return s.version
+}
+
+// setFrameFlags sets the flags of the frames appended from now on
+func (s *store) setFrameFlags(flags FrameFlags) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.frame.flags = flags
 }
 
 func (s *store) Append(p []byte) (n uint64, pos uint64, err error) {
+	return s.AppendV(p)
+}
+
+// AppendV appends a record made up of parts, one after the other, without putting them together in memory first. The
+// record is stored exactly as Append stores the parts concatenated, in a single frame
+func (s *store) AppendV(parts ...[]byte) (n uint64, pos uint64, err error) {
+	n, pos, _, err = s.appendFrame(parts...)
+	return n, pos, err
+}
+
+// AppendChecksummed appends p like Append and also returns a CRC32 of the bytes written for it, frame header included.
+// The same record always has the same checksum, so followers can compare the checksum of what they appended with the
+// one the leader got to make sure they stored the record identically
+func (s *store) AppendChecksummed(p []byte) (n uint64, pos uint64, crc uint32, err error) {
+	return s.appendFrame(p)
+}
+
+// appendFrame appends a frame whose payload is made up of parts and returns the checksum of its header and payload
+func (s *store) appendFrame(parts ...[]byte) (n uint64, pos uint64, crc uint32, err error) {
+	var size uint64
+	for _, part := range parts {
+		size += uint64(len(part))
+	}
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	pos = s.size
-	// Write the length of the record using the binary encoding
-	if err := binary.Write(s.buf, enc, uint64(len(p))); err != nil {
-		return 0, 0, err
+	header := s.frame.header(size)
+	if _, err := s.buf.Write(header); err != nil {
+		return 0, 0, 0, err
+	}
+	for _, part := range parts {
+		if _, err := s.buf.Write(part); err != nil {
+			return 0, 0, 0, err
+		}
+	}
+	crc = frameChecksum(header, parts...)
+	if _, err := s.buf.Write(s.frame.trailer(crc)); err != nil {
+		return 0, 0, 0, err
 	}
 
-	// Write the record data
-	w, err := s.buf.Write(p)
-	if err != nil {
-		return 0, 0, err
+	// update the size so that we know where our next write should start at
+	w := s.frame.overhead() + size
+	s.size += w
+
+	if s.flushThreshold > 0 && uint64(s.buf.Buffered()) >= s.flushThreshold {
+		if err := s.buf.Flush(); err != nil {
+			return 0, 0, 0, err
+		}
 	}
+	return w, pos, crc, nil
+}
 
-	// append the size of the length we wrote first using binary.Write
-	w += recordLenWidth
+func (s *store) AppendStream(header []byte, r io.Reader, size int64) (n uint64, pos uint64, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pos = s.size
 
-	// update the size so that we know where our next write should start at
-	s.size += uint64(w)
-	return uint64(w), pos, nil
+	frameHeader := s.frame.header(uint64(len(header)) + uint64(size))
+	crc := crc32.NewIEEE()
+	w := io.MultiWriter(s.buf, crc)
+	if _, err := w.Write(frameHeader); err != nil {
+		return 0, 0, err
+	}
+	if _, err := w.Write(header); err != nil {
+		return 0, 0, err
+	}
+	if _, err := io.CopyN(w, r, size); err != nil {
+		// r came up short, so we get rid of what was written of the record to keep the store intact
+		if ferr := s.buf.Flush(); ferr != nil {
+			return 0, 0, ferr
+		}
+		if terr := s.File.Truncate(int64(s.header + pos)); terr != nil {
+			return 0, 0, terr
+		}
+		return 0, 0, err
+	}
+	if _, err := s.buf.Write(s.frame.trailer(crc.Sum32())); err != nil {
+		return 0, 0, err
+	}
+
+	n = s.frame.overhead() + uint64(len(header)) + uint64(size)
+	s.size += n
+	return n, pos, nil
 }
 
 func (s *store) Read(pos uint64) ([]byte, error) {
@@ -74,21 +285,77 @@ func (s *store) Read(pos uint64) ([]byte, error) {
 		return nil, err
 	}
 
-	// size is the byte array that will keep the size encoded in binary
-	// recordLenWidth = the length of the binary array encoded size
-	size := make([]byte, recordLenWidth)
-	if _, err := s.File.ReadAt(size, int64(pos)); err != nil {
-		return nil, err
+	return s.read(pos)
+}
+
+// ReadSealed is Read for a store that nothing is appended to anymore, with everything appended flushed already. Since
+// it doesn't flush, readers only keep out rewrites and go ahead side by side, so that one reading a lot doesn't hold
+// up the others
+func (s *store) ReadSealed(pos uint64) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.read(pos)
+}
+
+// read reads the record at pos from the file, with the caller holding mu
+func (s *store) read(pos uint64) ([]byte, error) {
+	f, err := s.frame.decode(io.NewSectionReader(s.File, int64(s.header+pos), math.MaxInt64-int64(s.header+pos)))
+	switch err.(type) {
+	case nil:
+		return f.Payload, nil
+	case api.ErrChecksumMismatch:
+		return nil, api.ErrChecksumMismatch{Name: s.Name()}
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil, ErrTruncatedRecord{Pos: pos}
 	}
+	return nil, err
+}
+
+// View returns the record at pos as a slice of the memory mapped store file, which saves the copy Read makes, after
+// checking it against the frame's checksum. The
+// returned slice is only valid until the store is closed and must never be written to: the mapping is read only, so a
+// write crashes the process instead of modifying the record
+func (s *store) View(pos uint64) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	// encode the binary of the size into it's uint64 representation and create a slice of that size
-	record := make([]byte, enc.Uint64(size))
-	// read into the record slice, adjust the pos with the record length so that we start reading AT the record
-	if _, err := s.File.ReadAt(record, int64(pos+recordLenWidth)); err != nil {
+	if err := s.buf.Flush(); err != nil {
 		return nil, err
 	}
 
-	return record, nil
+	width := s.frame.headerWidth()
+	if pos+width > s.size {
+		return nil, io.EOF
+	}
+
+	// the record might have been written after we last mapped the file
+	if uint64(len(s.mmap)) < s.header+s.size {
+		m, err := gommap.Map(s.File.Fd(), gommap.PROT_READ, gommap.MAP_SHARED)
+		if err != nil {
+			return nil, err
+		}
+		s.mmap = m
+		s.mmaps = append(s.mmaps, m)
+	}
+
+	header := s.mmap[s.header+pos : s.header+pos+width]
+	size := s.frame.length(header)
+	start := s.header + pos + width
+	end := start + size + s.frame.overhead() - width
+	if size > uint64(len(s.mmap)) || end > uint64(len(s.mmap)) {
+		return nil, io.EOF
+	}
+	if !s.frame.bare {
+		crc := enc.Uint32(s.mmap[start+size : end])
+		if string(header[:frameMagicWidth]) != frameMagic || crc != frameChecksum(header, s.mmap[start:start+size]) {
+			return nil, api.ErrChecksumMismatch{Name: s.Name()}
+		}
+	}
+
+	// cap the slice so that appending to it can't touch the records after it
+	return s.mmap[start : start+size : start+size], nil
 }
 
 func (s *store) ReadAt(p []byte, off int64) (int, error) {
@@ -99,7 +366,122 @@ func (s *store) ReadAt(p []byte, off int64) (int, error) {
 		return 0, err
 	}
 
-	return s.File.ReadAt(p, off)
+	return s.File.ReadAt(p, int64(s.header)+off)
+}
+
+func (s *store) Rewrite(pos uint64, p []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.buf.Flush(); err != nil {
+		return err
+	}
+
+	header, err := s.readHeader(pos)
+	if err != nil {
+		return err
+	}
+	if n := s.frame.length(header); n != uint64(len(p)) {
+		return fmt.Errorf("record at position %d is %d bytes long, can't rewrite it with %d bytes", pos, n, len(p))
+	}
+
+	width := s.frame.headerWidth()
+	_, err = s.writeAt(append(p[:len(p):len(p)], s.frame.trailer(frameChecksum(header, p))...), pos+width)
+	return err
+}
+
+// WriteAt overwrites the bytes at pos with p, which is what edits in place, like repairing a record, are made of. The
+// bytes written have to lie within the value of a single record, so that WriteAt can neither grow the store nor touch
+// the header of a record or the records around it. The record's checksum is updated to match what was written.
+// Finding the record pos is in walks the store from its start
+func (s *store) WriteAt(p []byte, pos uint64) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.buf.Flush(); err != nil {
+		return 0, err
+	}
+
+	end := pos + uint64(len(p))
+	for start := uint64(0); start < s.size; {
+		header, err := s.readHeader(start)
+		if err != nil {
+			return 0, err
+		}
+
+		value := start + s.frame.headerWidth()
+		size := s.frame.length(header)
+		next := start + s.frame.overhead() + size
+		if pos < next {
+			if pos < value || end > value+size {
+				break
+			}
+			n, err := s.writeAt(p, pos)
+			if err != nil || s.frame.bare {
+				return n, err
+			}
+			return n, s.resum(start, header, size)
+		}
+		start = next
+	}
+	return 0, ErrWriteOutOfBounds{Pos: pos, Len: len(p)}
+}
+
+// readHeader reads the header of the frame at pos, with the buffer already flushed
+func (s *store) readHeader(pos uint64) ([]byte, error) {
+	header := make([]byte, s.frame.headerWidth())
+	if _, err := s.File.ReadAt(header, int64(s.header+pos)); err == io.EOF {
+		return nil, ErrTruncatedRecord{Pos: pos}
+	} else if err != nil {
+		return nil, err
+	}
+	return header, nil
+}
+
+// resum rewrites the checksum of the frame at pos, which has the given header and a payload of size bytes, to match
+// the payload in the file
+func (s *store) resum(pos uint64, header []byte, size uint64) error {
+	payload := make([]byte, size)
+	if _, err := s.File.ReadAt(payload, int64(s.header+pos+s.frame.headerWidth())); err != nil {
+		return err
+	}
+	_, err := s.writeAt(s.frame.trailer(frameChecksum(header, payload)), pos+s.frame.headerWidth()+size)
+	return err
+}
+
+// writeAt writes p at pos, with the buffer already flushed
+func (s *store) writeAt(p []byte, pos uint64) (int, error) {
+	// the file is opened for appending, which doesn't allow writing at a position, so we write through a handle of
+	// our own
+	f, err := os.OpenFile(s.Name(), os.O_WRONLY, 0)
+	if err != nil {
+		return 0, err
+	}
+	n, err := f.WriteAt(p, int64(s.header+pos))
+	if err != nil {
+		f.Close()
+		return n, err
+	}
+	return n, f.Close()
+}
+
+func (s *store) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.buf.Flush()
+}
+
+// Sync flushes the buffered records and syncs the file to storage
+func (s *store) Sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.buf.Flush(); err != nil {
+		return err
+	}
+
+	return s.File.Sync()
 }
 
 func (s *store) Close() error {
@@ -110,5 +492,23 @@ func (s *store) Close() error {
 		return err
 	}
 
+	for _, m := range s.mmaps {
+		if err := m.UnsafeUnmap(); err != nil {
+			return err
+		}
+	}
+	s.mmap, s.mmaps = nil, nil
+
 	return s.File.Close()
 }
+
+func (s *store) Size() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.size
+}
+
+func (s *store) Remove() error {
+	return os.Remove(s.Name())
+}
@@ -1,16 +1,19 @@
 package log
 
 import (
+	"hash/crc32"
+	"io"
 	"io/ioutil"
 	"os"
 	"testing"
 
+	api "github.com/burmudar/prolog/api/v1"
 	"github.com/stretchr/testify/require"
 )
 
 var (
 	write = []byte("hello world")
-	width = uint64(len(write)) + recordLenWidth
+	width = uint64(len(write)) + maxFrameOverhead
 )
 
 func TestStoreAppendRead(t *testing.T) {
@@ -53,19 +56,20 @@ func testRead(t *testing.T, s *store) {
 func testReadAt(t *testing.T, s *store) {
 	t.Helper()
 	for i, off := uint64(1), int64(0); i < 4; i++ {
-		b := make([]byte, recordLenWidth)
+		b := make([]byte, FrameHeaderWidth)
 		n, err := s.ReadAt(b, off)
 		require.NoError(t, err)
-		require.Equal(t, recordLenWidth, n)
+		require.Equal(t, FrameHeaderWidth, n)
+		require.Equal(t, frameMagic, string(b[:frameMagicWidth]))
 		off += int64(n)
 
-		size := enc.Uint64(b)
+		size := frameLayout{}.length(b)
 		b = make([]byte, size)
 		n, err = s.ReadAt(b, off)
 		require.NoError(t, err)
 		require.Equal(t, write, b)
 		require.Equal(t, int(size), n)
-		off += int64(n)
+		off += int64(n) + FrameTrailerWidth
 	}
 }
 
@@ -91,6 +95,38 @@ func TestStoreClose(t *testing.T) {
 	require.True(t, afterSize > beforeSize)
 }
 
+func TestStoreTruncatedRecord(t *testing.T) {
+	f, err := ioutil.TempFile("", "store_truncated_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	s, err := newStore(f)
+	require.NoError(t, err)
+	testAppend(t, s)
+	require.NoError(t, s.Close())
+
+	// cut the last record off halfway through its value
+	require.NoError(t, os.Truncate(f.Name(), int64(storeHeaderWidth+3*width-8)))
+
+	f, err = os.OpenFile(f.Name(), os.O_RDWR|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	s, err = newStore(f)
+	require.NoError(t, err)
+	defer s.Close()
+
+	read, err := s.Read(width)
+	require.NoError(t, err)
+	require.Equal(t, write, read)
+
+	_, err = s.Read(2 * width)
+	require.Equal(t, ErrTruncatedRecord{Pos: 2 * width}, err)
+
+	// the record's header itself is cut short
+	require.NoError(t, os.Truncate(f.Name(), int64(storeHeaderWidth+2*width+4)))
+	_, err = s.Read(2 * width)
+	require.Equal(t, ErrTruncatedRecord{Pos: 2 * width}, err)
+}
+
 func openFile(name string) (file *os.File, size int64, err error) {
 	f, err := os.OpenFile(
 		name,
@@ -108,3 +144,258 @@ func openFile(name string) (file *os.File, size int64, err error) {
 	}
 	return f, fi.Size(), nil
 }
+
+func TestStoreView(t *testing.T) {
+	f, err := ioutil.TempFile("", "store_view_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	s, err := newStore(f)
+	require.NoError(t, err)
+
+	_, err = s.View(0)
+	require.Equal(t, io.EOF, err)
+
+	var positions []uint64
+	for i := 0; i < 3; i++ {
+		_, pos, err := s.Append(write)
+		require.NoError(t, err)
+		positions = append(positions, pos)
+
+		// every append grows the file past the previous mapping
+		view, err := s.View(pos)
+		require.NoError(t, err)
+		require.Equal(t, write, view)
+	}
+
+	for _, pos := range positions {
+		read, err := s.Read(pos)
+		require.NoError(t, err)
+		view, err := s.View(pos)
+		require.NoError(t, err)
+		require.Equal(t, read, view)
+		require.Equal(t, len(view), cap(view))
+	}
+
+	_, err = s.View(width * 3)
+	require.Equal(t, io.EOF, err)
+	require.NoError(t, s.Close())
+}
+
+func TestStoreEmptyRecord(t *testing.T) {
+	dir, err := ioutil.TempDir("", "store_empty_record_test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	for scenario, want := range map[string]struct {
+		newStore NewStoreFn
+		overhead uint64
+	}{
+		"file":   {newStore: newFileStore, overhead: maxFrameOverhead},
+		"memory": {newStore: NewMemoryStore, overhead: recordLenWidth},
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			s, err := want.newStore(dir, 0, Config{})
+			require.NoError(t, err)
+			defer s.Remove()
+			defer s.Close()
+
+			// only the frame around it is written for an empty record
+			n, pos, err := s.Append([]byte{})
+			require.NoError(t, err)
+			require.Equal(t, want.overhead, n)
+			_, next, err := s.Append(write)
+			require.NoError(t, err)
+			require.Equal(t, pos+want.overhead, next)
+
+			p, err := s.Read(pos)
+			require.NoError(t, err)
+			require.NotNil(t, p)
+			require.Empty(t, p)
+			p, err = s.Read(next)
+			require.NoError(t, err)
+			require.Equal(t, write, p)
+		})
+	}
+}
+
+func TestStoreFlushThreshold(t *testing.T) {
+	dir, err := ioutil.TempDir("", "store_flush_threshold_test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.FlushThreshold = 2 * width
+	b, err := newFileStore(dir, 0, c)
+	require.NoError(t, err)
+	s := b.(*store)
+	defer s.Close()
+
+	fileSize := func() uint64 {
+		fi, err := os.Stat(s.Name())
+		require.NoError(t, err)
+		return uint64(fi.Size()) - storeHeaderWidth
+	}
+
+	_, _, err = s.Append(write)
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), fileSize())
+
+	// the second record reaches the threshold
+	_, _, err = s.Append(write)
+	require.NoError(t, err)
+	require.Equal(t, 2*width, fileSize())
+
+	_, _, err = s.Append(write)
+	require.NoError(t, err)
+	require.Equal(t, 2*width, fileSize())
+}
+
+func TestStoreAppendChecksummed(t *testing.T) {
+	var crcs []uint32
+	for i := 0; i < 2; i++ {
+		f, err := ioutil.TempFile("", "store_checksummed_test")
+		require.NoError(t, err)
+		defer os.Remove(f.Name())
+
+		s, err := newStore(f)
+		require.NoError(t, err)
+
+		_, pos, crc, err := s.AppendChecksummed(write)
+		require.NoError(t, err)
+		crcs = append(crcs, crc)
+
+		// the checksum covers exactly what ended up in the store ahead of it, which is where it ends up as well
+		p := make([]byte, width-FrameTrailerWidth)
+		_, err = s.ReadAt(p, int64(pos))
+		require.NoError(t, err)
+		require.Equal(t, crc32.ChecksumIEEE(p), crc)
+		trailer := make([]byte, FrameTrailerWidth)
+		_, err = s.ReadAt(trailer, int64(pos+width-FrameTrailerWidth))
+		require.NoError(t, err)
+		require.Equal(t, crc, enc.Uint32(trailer))
+
+		_, _, other, err := s.AppendChecksummed([]byte("hello there"))
+		require.NoError(t, err)
+		require.NotEqual(t, crc, other)
+		require.NoError(t, s.Close())
+	}
+
+	require.Equal(t, crcs[0], crcs[1])
+}
+
+func TestStoreAppendV(t *testing.T) {
+	var files [][]byte
+	for _, appendFn := range []func(s *store) (uint64, uint64, error){
+		func(s *store) (uint64, uint64, error) { return s.Append([]byte("header|hello world")) },
+		func(s *store) (uint64, uint64, error) {
+			return s.AppendV([]byte("header|"), nil, []byte("hello world"))
+		},
+	} {
+		f, err := ioutil.TempFile("", "store_append_v_test")
+		require.NoError(t, err)
+		defer os.Remove(f.Name())
+
+		s, err := newStore(f)
+		require.NoError(t, err)
+
+		n, pos, err := appendFn(s)
+		require.NoError(t, err)
+		require.Equal(t, uint64(0), pos)
+		require.Equal(t, maxFrameOverhead+uint64(len("header|hello world")), n)
+
+		// the next record starts right after it
+		_, pos, err = s.AppendV()
+		require.NoError(t, err)
+		require.Equal(t, n, pos)
+
+		read, err := s.Read(0)
+		require.NoError(t, err)
+		require.Equal(t, []byte("header|hello world"), read)
+		require.NoError(t, s.Close())
+
+		p, err := ioutil.ReadFile(f.Name())
+		require.NoError(t, err)
+		files = append(files, p)
+	}
+
+	require.Equal(t, files[0], files[1])
+}
+
+func TestStoreWriteAt(t *testing.T) {
+	f, err := ioutil.TempFile("", "store_write_at_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	s, err := newStore(f)
+	require.NoError(t, err)
+	defer s.Close()
+
+	var positions []uint64
+	for _, value := range []string{"first", "hello world", "last"} {
+		_, pos, err := s.Append([]byte(value))
+		require.NoError(t, err)
+		positions = append(positions, pos)
+	}
+
+	// the writes are allowed anywhere within a record's value
+	value := positions[1] + FrameHeaderWidth
+	n, err := s.WriteAt([]byte("HELLO"), value)
+	require.NoError(t, err)
+	require.Equal(t, 5, n)
+	_, err = s.WriteAt([]byte("D"), value+10)
+	require.NoError(t, err)
+
+	for pos, want := range map[uint64]string{positions[0]: "first", positions[1]: "HELLO worlD", positions[2]: "last"} {
+		read, err := s.Read(pos)
+		require.NoError(t, err)
+		require.Equal(t, []byte(want), read)
+	}
+
+	size := s.Size()
+	for name, pos := range map[string]uint64{
+		"into a record's header":    positions[1] + 2,
+		"over the next record":      value + 8,
+		"past the end of the store": positions[2] + FrameHeaderWidth + 2,
+	} {
+		_, err := s.WriteAt([]byte("oops"), pos)
+		require.Equal(t, ErrWriteOutOfBounds{Pos: pos, Len: 4}, err, name)
+	}
+	require.Equal(t, size, s.Size())
+	read, err := s.Read(positions[2])
+	require.NoError(t, err)
+	require.Equal(t, []byte("last"), read)
+}
+
+func TestStoreChecksumMismatch(t *testing.T) {
+	f, err := ioutil.TempFile("", "store_checksum_mismatch_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	s, err := newStore(f)
+	require.NoError(t, err)
+	testAppend(t, s)
+	require.NoError(t, s.Close())
+
+	// a bit flips in the value of the second record
+	p, err := ioutil.ReadFile(f.Name())
+	require.NoError(t, err)
+	p[storeHeaderWidth+width+FrameHeaderWidth] ^= 1
+	require.NoError(t, ioutil.WriteFile(f.Name(), p, 0644))
+
+	f, err = os.OpenFile(f.Name(), os.O_RDWR|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	s, err = newStore(f)
+	require.NoError(t, err)
+	defer s.Close()
+
+	for _, pos := range []uint64{0, 2 * width} {
+		read, err := s.Read(pos)
+		require.NoError(t, err)
+		require.Equal(t, write, read)
+	}
+	_, err = s.Read(width)
+	require.Equal(t, api.ErrChecksumMismatch{Name: f.Name()}, err)
+	_, err = s.View(width)
+	require.Equal(t, api.ErrChecksumMismatch{Name: f.Name()}, err)
+}
@@ -0,0 +1,105 @@
+package log
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+
+	api "github.com/burmudar/prolog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+// TestLogConcurrentAccess hammers a log with appenders and readers at the same time, so that races between them show up
+// when the tests are run with -race
+func TestLogConcurrentAccess(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-stress-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// few segments are kept open, so that readers keep closing and reopening the ones the others are using
+	c := Config{MaxOpenSegments: 3}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.FlushThreshold = 256
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	appenders, readers, perAppender := 8, 8, 100
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var appended sync.WaitGroup
+	errs := make(chan error, appenders+readers)
+	for i := 0; i < appenders; i++ {
+		appended.Add(1)
+		go func(i int) {
+			defer appended.Done()
+			for j := 0; j < perAppender; j++ {
+				value := []byte(fmt.Sprintf("appender %d record %d", i, j))
+				if _, err := log.Append(&api.Record{Value: value}); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(i)
+	}
+
+	var read sync.WaitGroup
+	for i := 0; i < readers; i++ {
+		read.Add(1)
+		go func(i int) {
+			defer read.Done()
+			for off := uint64(0); ctx.Err() == nil; off++ {
+				next := log.PeekNextOffset()
+				if next == 0 {
+					continue
+				}
+				record, err := log.Read(off % next)
+				if err != nil {
+					errs <- err
+					return
+				}
+				if record.Offset != off%next {
+					errs <- fmt.Errorf("read offset %d, got record with offset %d", off%next, record.Offset)
+					return
+				}
+				// readers that go through the store's bytes rather than its records, outside of the log's lock
+				var r io.Reader
+				switch i % 4 {
+				case 0:
+					r = log.ReaderBetween(off%next, next)
+				case 1:
+					r = log.Reader()
+				}
+				if r == nil {
+					continue
+				}
+				if _, err := ioutil.ReadAll(r); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(i)
+	}
+
+	appended.Wait()
+	cancel()
+	read.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+
+	require.Equal(t, uint64(appenders*perAppender), log.PeekNextOffset())
+	seen := make(map[string]bool)
+	for off := uint64(0); off < log.PeekNextOffset(); off++ {
+		record, err := log.Read(off)
+		require.NoError(t, err)
+		require.False(t, seen[string(record.Value)])
+		seen[string(record.Value)] = true
+	}
+}
@@ -0,0 +1,145 @@
+package log
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	api "github.com/burmudar/prolog/api/v1"
+)
+
+// subscriptionPollInterval is how long a subscription that has caught up with the log waits before looking for new
+// records again
+const subscriptionPollInterval = 20 * time.Millisecond
+
+var ErrAckUndelivered = fmt.Errorf("can't ack a record that hasn't been delivered")
+
+// PositionStore keeps the positions of durable subscriptions, the offset each consumer resumes from. The OffsetStore
+// of the server package is one, which keeps them in a log of its own
+type PositionStore interface {
+	CommitOffset(consumer string, offset uint64) error
+	FetchOffset(consumer string) (uint64, bool)
+}
+
+// Subscription delivers the records of a log to a consumer at least once. Records are delivered in order, and the
+// consumer acks them once it is done with them, which moves its position in the PositionStore on. Records that weren't
+// acked by the time the subscription ends are delivered again by the next subscription of the same consumer
+type Subscription struct {
+	log       *Log
+	consumer  string
+	positions PositionStore
+	records   chan *api.Record
+	err       error
+
+	mu sync.Mutex
+	// position is the offset the consumer resumes from, which is the one after the last record acked, and delivered
+	// the one after the last record delivered
+	position  uint64
+	delivered uint64
+}
+
+// Subscribe delivers the records in the log to consumer, starting from its position in positions, or the lowest offset
+// in the log when it doesn't have one yet. The subscription keeps going as records are appended, until ctx is done or
+// reading from the log fails, after which Records is closed and Err returns why. Records that retention removes before
+// they're delivered are skipped
+func (l *Log) Subscribe(ctx context.Context, consumer string, positions PositionStore) (*Subscription, error) {
+	from, ok := positions.FetchOffset(consumer)
+	if !ok {
+		var err error
+		if from, err = l.LowestOffset(); err != nil {
+			return nil, err
+		}
+	}
+
+	s := &Subscription{
+		log:       l,
+		consumer:  consumer,
+		positions: positions,
+		records:   make(chan *api.Record),
+		position:  from,
+		delivered: from,
+	}
+	go s.run(ctx, from)
+	return s, nil
+}
+
+// Records returns the channel the records are delivered on
+func (s *Subscription) Records() <-chan *api.Record {
+	return s.records
+}
+
+// Err returns the error that ended the subscription, once Records has been closed
+func (s *Subscription) Err() error {
+	return s.err
+}
+
+// Ack acks the record at offset along with every record delivered before it, and stores the offset after it as the
+// consumer's position. Acking a record that was acked already does nothing
+func (s *Subscription) Ack(offset uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if offset >= s.delivered {
+		return ErrAckUndelivered
+	}
+	if offset < s.position {
+		return nil
+	}
+
+	if err := s.positions.CommitOffset(s.consumer, offset+1); err != nil {
+		return err
+	}
+	s.position = offset + 1
+	return nil
+}
+
+// run delivers the records from off on until ctx is done or reading fails
+func (s *Subscription) run(ctx context.Context, off uint64) {
+	defer close(s.records)
+
+	for {
+		record, err := s.log.Read(off)
+		if skippedOffset(err) {
+			off++
+			continue
+		}
+		if _, ok := err.(api.ErrOffsetOutOfRange); ok {
+			lowest, err := s.log.LowestOffset()
+			if err != nil {
+				s.err = err
+				return
+			}
+			if off < lowest {
+				off = lowest
+				continue
+			}
+
+			// we've caught up with the log, so we wait a bit for new records
+			select {
+			case <-ctx.Done():
+				s.err = ctx.Err()
+				return
+			case <-time.After(subscriptionPollInterval):
+			}
+			continue
+		}
+		if err != nil {
+			s.err = err
+			return
+		}
+
+		// the record counts as delivered before it is sent, so that the consumer can ack it as soon as it has it
+		s.mu.Lock()
+		s.delivered = off + 1
+		s.mu.Unlock()
+
+		select {
+		case s.records <- record:
+		case <-ctx.Done():
+			s.err = ctx.Err()
+			return
+		}
+		off++
+	}
+}
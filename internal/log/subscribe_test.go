@@ -0,0 +1,109 @@
+package log
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	api "github.com/burmudar/prolog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+// memPositions is a PositionStore that keeps the positions in memory
+type memPositions struct {
+	mu        sync.Mutex
+	positions map[string]uint64
+}
+
+func (p *memPositions) CommitOffset(consumer string, offset uint64) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.positions[consumer] = offset
+	return nil
+}
+
+func (p *memPositions) FetchOffset(consumer string) (uint64, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	offset, ok := p.positions[consumer]
+	return offset, ok
+}
+
+// receive receives the next record of the subscription, failing the test if it doesn't arrive in time
+func receive(t *testing.T, sub *Subscription) *api.Record {
+	t.Helper()
+	select {
+	case record, ok := <-sub.Records():
+		require.True(t, ok, "subscription ended: %v", sub.Err())
+		return record
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "no record delivered")
+		return nil
+	}
+}
+
+func TestLogSubscribe(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-subscribe-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	log, err := NewLog(dir, Config{})
+	require.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		_, err := log.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+
+	positions := &memPositions{positions: map[string]uint64{}}
+	ctx, cancel := context.WithCancel(context.Background())
+	sub, err := log.Subscribe(ctx, "billing", positions)
+	require.NoError(t, err)
+
+	for i := uint64(0); i < 4; i++ {
+		require.Equal(t, i, receive(t, sub).Offset)
+	}
+	require.NoError(t, sub.Ack(1))
+	// acks are cumulative, so acking an earlier record again changes nothing
+	require.NoError(t, sub.Ack(0))
+	require.Equal(t, ErrAckUndelivered, sub.Ack(7))
+
+	// the subscription ends without records 2 and 3 having been acked
+	cancel()
+	for range sub.Records() {
+	}
+	require.Equal(t, context.Canceled, sub.Err())
+	require.NoError(t, log.Close())
+
+	log, err = NewLog(dir, Config{})
+	require.NoError(t, err)
+	defer log.Close()
+
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	sub, err = log.Subscribe(ctx, "billing", positions)
+	require.NoError(t, err)
+	for i := uint64(2); i < 5; i++ {
+		require.Equal(t, i, receive(t, sub).Offset)
+	}
+
+	// records appended while subscribed are delivered too
+	_, err = log.Append(&api.Record{Value: []byte("record 5")})
+	require.NoError(t, err)
+	record := receive(t, sub)
+	require.Equal(t, uint64(5), record.Offset)
+	require.Equal(t, []byte("record 5"), record.Value)
+	require.NoError(t, sub.Ack(5))
+
+	offset, ok := positions.FetchOffset("billing")
+	require.True(t, ok)
+	require.Equal(t, uint64(6), offset)
+
+	// other consumers start from the lowest offset
+	other, err := log.Subscribe(ctx, "audit", positions)
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), receive(t, other).Offset)
+}
@@ -0,0 +1,147 @@
+package log
+
+import (
+	"io/ioutil"
+	"os"
+	"sort"
+)
+
+// defaultTimeIndexInterval is how many records apart entries are made in the time index when the config doesn't say
+// otherwise
+const defaultTimeIndexInterval = 16
+
+var (
+	tsWidth   uint64 = 8
+	tentWidth        = tsWidth + offWidth
+)
+
+// An entry in the time index consists of two parts
+// <[ timestamp width ][ off width ]>
+// <[ timestamp width ][ off width ]>
+//
+// The time index is sparse, only every Config.Segment.TimeIndexInterval'th record gets an entry. The timestamp stored is
+// the highest timestamp seen up to that record so that the entries are always ordered, even if producers hand us
+// timestamps out of order.
+
+type timeEntry struct {
+	ts  int64
+	off uint32
+}
+
+type timeIndex struct {
+	// file is nil when the time index isn't persisted, in which case it is rebuilt every time the segment is opened
+	file     *os.File
+	interval uint64
+	entries  []timeEntry
+	// last is the highest timestamp of any record in the segment, not just the ones with entries
+	last int64
+}
+
+// newTimeIndex opens the "<baseOffset>.tindex" file in dir and loads its entries. When persist is false nothing is
+// written to dir and the index only lives in memory
+func newTimeIndex(dir string, baseOffset uint64, c Config, persist bool) (*timeIndex, bool, error) {
+	t := &timeIndex{
+		interval: c.Segment.TimeIndexInterval,
+	}
+	if t.interval == 0 {
+		t.interval = defaultTimeIndexInterval
+	}
+
+	if !persist {
+		return t, false, nil
+	}
+
+	name := segmentFilePath(dir, baseOffset, timeIndexExt)
+	_, err := os.Stat(name)
+	existed := err == nil
+
+	flag := os.O_RDWR | os.O_CREATE | os.O_APPEND
+	if c.ReadOnly {
+		if !existed {
+			// a log opened read only rebuilds missing time indexes in memory
+			return t, false, nil
+		}
+		flag = os.O_RDONLY
+	}
+	if t.file, err = openLogFile(name, flag, c); err != nil {
+		return nil, false, err
+	}
+
+	p, err := ioutil.ReadAll(t.file)
+	if err != nil {
+		return nil, false, err
+	}
+	// a partially written entry at the end is ignored
+	for pos := uint64(0); pos+tentWidth <= uint64(len(p)); pos += tentWidth {
+		t.entries = append(t.entries, timeEntry{
+			ts:  int64(enc.Uint64(p[pos : pos+tsWidth])),
+			off: enc.Uint32(p[pos+tsWidth : pos+tentWidth]),
+		})
+	}
+
+	return t, existed, nil
+}
+
+// Add records that the record at the relative offset off has the timestamp ts. Only every interval'th record is
+// written as an entry
+func (t *timeIndex) Add(off uint32, ts int64) error {
+	if ts > t.last {
+		t.last = ts
+	}
+
+	if uint64(off)%t.interval != 0 {
+		return nil
+	}
+
+	e := timeEntry{ts: t.last, off: off}
+	if t.file != nil {
+		p := make([]byte, tentWidth)
+		enc.PutUint64(p[:tsWidth], uint64(e.ts))
+		enc.PutUint32(p[tsWidth:], e.off)
+		if _, err := t.file.Write(p); err != nil {
+			return err
+		}
+	}
+	t.entries = append(t.entries, e)
+	return nil
+}
+
+// Lookup returns the relative offset from which to start scanning for the first record with a timestamp of at least
+// ts. Records before the returned offset are guaranteed to be older than ts
+func (t *timeIndex) Lookup(ts int64) uint32 {
+	i := sort.Search(len(t.entries), func(i int) bool {
+		return t.entries[i].ts >= ts
+	})
+	if i == 0 {
+		return 0
+	}
+
+	// the entry before i is older than ts, but the records between it and entry i might not be
+	return t.entries[i-1].off
+}
+
+func (t *timeIndex) Reset() error {
+	t.entries = nil
+	t.last = 0
+	if t.file == nil {
+		return nil
+	}
+
+	return t.file.Truncate(0)
+}
+
+func (t *timeIndex) Close() error {
+	if t.file == nil {
+		return nil
+	}
+
+	return t.file.Close()
+}
+
+func (t *timeIndex) Remove() error {
+	if t.file == nil {
+		return nil
+	}
+
+	return os.Remove(t.file.Name())
+}
@@ -0,0 +1,98 @@
+package log
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	api "github.com/burmudar/prolog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadAtTime(t *testing.T) {
+	dir, err := ioutil.TempDir("", "time-index-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 128
+	c.Segment.TimeIndexInterval = 4
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+
+	// record i has a timestamp of (i+1)*10
+	for i := 0; i < 20; i++ {
+		_, err := log.Append(&api.Record{
+			Value:     []byte(fmt.Sprintf("record %d", i)),
+			Timestamp: int64(i+1) * 10,
+		})
+		require.NoError(t, err)
+	}
+	require.Greater(t, len(log.segments), 2)
+
+	testLookups := func(log *Log) {
+		t.Helper()
+		for _, tc := range []struct {
+			ts   int64
+			want uint64
+		}{
+			{ts: 0, want: 0},
+			// offset 5 and 6 sit between the entries for offsets 4 and 8
+			{ts: 60, want: 5},
+			{ts: 65, want: 6},
+			{ts: 200, want: 19},
+		} {
+			rec, err := log.ReadAtTime(time.Unix(0, tc.ts))
+			require.NoError(t, err)
+			require.Equal(t, tc.want, rec.Offset, "ts %d", tc.ts)
+		}
+
+		// right at and right before the start of the second segment
+		boundary := log.segments[1].baseOffset
+		rec, err := log.ReadAtTime(time.Unix(0, int64(boundary+1)*10))
+		require.NoError(t, err)
+		require.Equal(t, boundary, rec.Offset)
+
+		rec, err = log.ReadAtTime(time.Unix(0, int64(boundary)*10-5))
+		require.NoError(t, err)
+		require.Equal(t, boundary-1, rec.Offset)
+
+		_, err = log.ReadAtTime(time.Unix(0, 201))
+		require.Equal(t, ErrNoRecordAtTime, err)
+
+		// OffsetAtTime points past the last record instead
+		off, err := log.OffsetAtTime(time.Unix(0, 201))
+		require.NoError(t, err)
+		require.Equal(t, uint64(20), off)
+		off, err = log.OffsetAtTime(time.Unix(0, 65))
+		require.NoError(t, err)
+		require.Equal(t, uint64(6), off)
+	}
+	testLookups(log)
+	require.NoError(t, log.Close())
+
+	// the time indexes are rebuilt when they're missing
+	tindexes, err := filepath.Glob(filepath.Join(dir, "*.tindex"))
+	require.NoError(t, err)
+	require.Len(t, tindexes, len(log.segments))
+	for _, name := range tindexes {
+		require.NoError(t, os.Remove(name))
+	}
+
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	testLookups(log)
+
+	tindexes, err = filepath.Glob(filepath.Join(dir, "*.tindex"))
+	require.NoError(t, err)
+	require.Len(t, tindexes, len(log.segments))
+	require.NoError(t, log.Close())
+
+	// and when they're there they are loaded as is
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	testLookups(log)
+}
@@ -0,0 +1,117 @@
+package log
+
+import (
+	"fmt"
+
+	api "github.com/burmudar/prolog/api/v1"
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+var ErrNothingToDelete = fmt.Errorf("record has no value to delete")
+
+const (
+	// tombstonePaddingField is the field number of the bytes field that pads a tombstone to the length of the record
+	// it replaces. Record doesn't define it, so it is skipped when the tombstone is read
+	tombstonePaddingField = 15
+	// maxVarintLen is the most bytes a varint can be spread over
+	maxVarintLen = 10
+)
+
+// Delete erases the value of the record at the given offset. The record is rewritten in place as a tombstone which
+// keeps the record's offset and timestamp, so that the offsets around it are unaffected. Reading a deleted record
+// returns it with Deleted set and no value. Records without a value can't be deleted
+func (l *Log) Delete(offset uint64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return api.ErrClosed{}
+	}
+	if l.Config.ReadOnly {
+		return ErrReadOnly
+	}
+
+	seg := l.findSegment(offset)
+	if seg == nil || seg.nextOffset <= offset {
+		return api.ErrOffsetOutOfRange{Offset: offset}
+	}
+
+	release, err := l.open.acquire(seg)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	return seg.Delete(offset)
+}
+
+// Delete replaces the record at off with a tombstone of the same length
+func (s *segment) Delete(off uint64) error {
+	pos, err := s.position(off)
+	if err != nil {
+		return err
+	}
+	p, err := s.store.Read(pos)
+	if err != nil {
+		return err
+	}
+
+	t, ok := s.codec.(tombstoner)
+	if !ok {
+		return ErrDeleteUnsupported
+	}
+
+	var record api.Record
+	if err := s.codec.Unmarshal(p, &record); err != nil {
+		return err
+	}
+	if record.Deleted {
+		return nil
+	}
+
+	tombstone, err := t.Tombstone(&record, len(p))
+	if err != nil {
+		return err
+	}
+	return s.store.Rewrite(pos, tombstone)
+}
+
+// encodeTombstone encodes a deleted record with the offset and timestamp of record that is exactly size bytes long.
+// The space the value took up is filled by spreading the deleted flag over more bytes than it needs, which protobuf
+// allows for varints, or by a padding field when that isn't enough
+func encodeTombstone(record *api.Record, size int) ([]byte, error) {
+	p, err := proto.Marshal(&api.Record{Offset: record.Offset, Timestamp: record.Timestamp})
+	if err != nil {
+		return nil, err
+	}
+
+	rest := size - len(p)
+	p = protowire.AppendTag(p, 5, protowire.VarintType)
+	rest--
+	switch {
+	case rest < 1:
+		return nil, ErrNothingToDelete
+	case rest <= maxVarintLen:
+		return appendPaddedVarint(p, 1, rest), nil
+	}
+
+	p = protowire.AppendVarint(p, 1)
+	rest--
+	p = protowire.AppendTag(p, tombstonePaddingField, protowire.BytesType)
+	rest--
+	// the padding's length is spread over as many bytes as the whole rest would need, which leaves room to spare for
+	// the shorter length itself
+	n := protowire.SizeVarint(uint64(rest))
+	p = appendPaddedVarint(p, uint64(rest-n), n)
+	return append(p, make([]byte, rest-n)...), nil
+}
+
+// appendPaddedVarint appends v as a varint spread over exactly n bytes
+func appendPaddedVarint(p []byte, v uint64, n int) []byte {
+	for i := 0; i < n-1; i++ {
+		p = append(p, byte(v&0x7f|0x80))
+		v >>= 7
+	}
+	return append(p, byte(v))
+}
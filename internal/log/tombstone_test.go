@@ -0,0 +1,88 @@
+package log
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	api "github.com/burmudar/prolog/api/v1"
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogDelete(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-delete-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+
+	values := [][]byte{[]byte("first"), []byte("personal data"), []byte("last")}
+	for _, v := range values {
+		_, err := log.Append(&api.Record{Value: v})
+		require.NoError(t, err)
+	}
+	before, err := log.Read(1)
+	require.NoError(t, err)
+
+	require.NoError(t, log.Delete(1))
+	// deleting a record twice is fine
+	require.NoError(t, log.Delete(1))
+
+	check := func() {
+		read, err := log.Read(1)
+		require.NoError(t, err)
+		require.True(t, read.Deleted)
+		require.Empty(t, read.Value)
+		require.Equal(t, uint64(1), read.Offset)
+		require.Equal(t, before.Timestamp, read.Timestamp)
+
+		for _, off := range []uint64{0, 2} {
+			read, err := log.Read(off)
+			require.NoError(t, err)
+			require.False(t, read.Deleted)
+			require.Equal(t, values[off], read.Value)
+		}
+	}
+	check()
+
+	// the tombstone is what's stored, so it survives the log being reopened
+	require.NoError(t, log.Close())
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	check()
+
+	_, err = log.Append(&api.Record{})
+	require.NoError(t, err)
+	require.Equal(t, ErrNothingToDelete, log.Delete(3))
+
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: 4}, log.Delete(4))
+}
+
+func TestEncodeTombstone(t *testing.T) {
+	// value lengths around where the padding's length needs another byte
+	for n := 0; n < 300; n++ {
+		record := &api.Record{Value: make([]byte, n), Offset: 1234, Timestamp: 1600000000000000000}
+		p, err := proto.Marshal(record)
+		require.NoError(t, err)
+
+		tombstone, err := encodeTombstone(record, len(p))
+		if n == 0 {
+			require.Equal(t, ErrNothingToDelete, err)
+			continue
+		}
+		require.NoError(t, err)
+		require.Len(t, tombstone, len(p))
+
+		var read api.Record
+		require.NoError(t, proto.Unmarshal(tombstone, &read))
+		require.True(t, read.Deleted)
+		require.Empty(t, read.Value)
+		require.Equal(t, record.Offset, read.Offset)
+		require.Equal(t, record.Timestamp, read.Timestamp)
+	}
+}
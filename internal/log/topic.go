@@ -0,0 +1,204 @@
+package log
+
+import (
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	api "github.com/burmudar/prolog/api/v1"
+)
+
+var (
+	ErrInvalidTopic     = fmt.Errorf("topic names can't be empty, start with a dot or hold a slash")
+	ErrInvalidPartition = fmt.Errorf("no such partition")
+)
+
+// ErrPartitionCount is returned when a topic is opened with a different number of partitions than it was created with,
+// which would send keys to other partitions than before
+type ErrPartitionCount struct {
+	Topic string
+	Found int
+}
+
+func (e ErrPartitionCount) Error() string {
+	return fmt.Sprintf("topic %s was created with %d partitions", e.Topic, e.Found)
+}
+
+// TopicManager keeps topics in a directory, each split into a fixed number of partitions that are logs of their own:
+//
+//	<dir>/<topic>/<partition>/<segment files>
+//
+// Records are routed to a partition by hashing their key, so records with the same key always end up in the same
+// partition, in the order they were appended. Offsets are per partition. Topics are created by the first append to
+// them, and their partitions are opened when they're first used
+type TopicManager struct {
+	mu         sync.Mutex
+	Dir        string
+	Config     Config
+	partitions int
+	topics     map[string][]*Log
+}
+
+// NewTopicManager manages the topics in dir, creating new ones with the given number of partitions. The partitions are
+// opened with c
+func NewTopicManager(dir string, partitions int, c Config) (*TopicManager, error) {
+	if partitions < 1 {
+		return nil, fmt.Errorf("topics need at least one partition")
+	}
+	if err := makeDir(dir, c); err != nil {
+		return nil, err
+	}
+
+	return &TopicManager{
+		Dir:        dir,
+		Config:     c,
+		partitions: partitions,
+		topics:     make(map[string][]*Log),
+	}, nil
+}
+
+// PartitionForKey returns which of n partitions records with the given key go to, from an FNV-1a hash of the key
+func PartitionForKey(key []byte, n int) int {
+	h := fnv.New32a()
+	h.Write(key)
+	return int(h.Sum32() % uint32(n))
+}
+
+// AppendKeyed appends a record holding value to the partition of topic that key belongs to, and returns the partition
+// along with the record's offset in it. The key only picks the partition, it isn't stored with the record
+func (tm *TopicManager) AppendKeyed(topic string, key, value []byte) (partition int, offset uint64, err error) {
+	partitions, err := tm.topic(topic)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	partition = PartitionForKey(key, len(partitions))
+	offset, err = partitions[partition].Append(&api.Record{Value: value})
+	return partition, offset, err
+}
+
+// Read reads the record at offset in the given partition of topic
+func (tm *TopicManager) Read(topic string, partition int, offset uint64) (*api.Record, error) {
+	log, err := tm.Partition(topic, partition)
+	if err != nil {
+		return nil, err
+	}
+	return log.Read(offset)
+}
+
+// Partition returns the log of the given partition of topic, creating the topic if it doesn't exist yet
+func (tm *TopicManager) Partition(topic string, partition int) (*Log, error) {
+	partitions, err := tm.topic(topic)
+	if err != nil {
+		return nil, err
+	}
+	if partition < 0 || partition >= len(partitions) {
+		return nil, ErrInvalidPartition
+	}
+	return partitions[partition], nil
+}
+
+// Topics returns the names of the topics in the manager's directory, sorted
+func (tm *TopicManager) Topics() ([]string, error) {
+	files, err := ioutil.ReadDir(tm.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var topics []string
+	for _, file := range files {
+		if file.IsDir() && validTopic(file.Name()) {
+			topics = append(topics, file.Name())
+		}
+	}
+	return topics, nil
+}
+
+// Close closes the partitions of all the topics that were opened
+func (tm *TopicManager) Close() error {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	names := make([]string, 0, len(tm.topics))
+	for name := range tm.topics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		for _, log := range tm.topics[name] {
+			if err := log.Close(); err != nil {
+				return err
+			}
+		}
+		delete(tm.topics, name)
+	}
+	return nil
+}
+
+// topic returns the partitions of topic, opening them, and creating the topic, if need be
+func (tm *TopicManager) topic(name string) ([]*Log, error) {
+	if !validTopic(name) {
+		return nil, ErrInvalidTopic
+	}
+
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	if partitions, ok := tm.topics[name]; ok {
+		return partitions, nil
+	}
+
+	dir := path.Join(tm.Dir, name)
+	if err := makeDir(dir, tm.Config); err != nil {
+		return nil, err
+	}
+	found, err := countPartitions(dir)
+	if err != nil {
+		return nil, err
+	}
+	if found != 0 && found != tm.partitions {
+		return nil, ErrPartitionCount{Topic: name, Found: found}
+	}
+
+	var partitions []*Log
+	for i := 0; i < tm.partitions; i++ {
+		log, err := NewLog(path.Join(dir, strconv.Itoa(i)), tm.Config)
+		if err != nil {
+			for _, opened := range partitions {
+				opened.Close()
+			}
+			return nil, err
+		}
+		partitions = append(partitions, log)
+	}
+
+	tm.topics[name] = partitions
+	return partitions, nil
+}
+
+// countPartitions returns the number of partition directories in the directory of a topic
+func countPartitions(dir string) (int, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for _, file := range files {
+		if _, err := strconv.Atoi(file.Name()); err == nil && file.IsDir() {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// validTopic reports whether name can be used as the name of a topic's directory
+func validTopic(name string) bool {
+	return name != "" && !strings.HasPrefix(name, ".") && !strings.ContainsAny(name, `/\`)
+}
@@ -0,0 +1,72 @@
+package log
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTopicManager(t *testing.T) {
+	dir, err := ioutil.TempDir("", "topic-manager-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	tm, err := NewTopicManager(dir, 4, Config{})
+	require.NoError(t, err)
+
+	// the same key always lands in the same partition, where offsets count up by themselves
+	partitionOf := make(map[string]int)
+	next := make(map[int]uint64)
+	for i := 0; i < 40; i++ {
+		key := fmt.Sprintf("user-%d", i%8)
+		partition, off, err := tm.AppendKeyed("orders", []byte(key), []byte(fmt.Sprintf("order %d", i)))
+		require.NoError(t, err)
+		if p, ok := partitionOf[key]; ok {
+			require.Equal(t, p, partition)
+		}
+		partitionOf[key] = partition
+		require.Equal(t, PartitionForKey([]byte(key), 4), partition)
+
+		require.Equal(t, next[partition], off)
+		next[partition]++
+
+		record, err := tm.Read("orders", partition, off)
+		require.NoError(t, err)
+		require.Equal(t, []byte(fmt.Sprintf("order %d", i)), record.Value)
+	}
+	require.Greater(t, len(next), 1)
+
+	// topics don't share offsets either
+	_, off, err := tm.AppendKeyed("payments", []byte("user-0"), []byte("payment"))
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+
+	topics, err := tm.Topics()
+	require.NoError(t, err)
+	require.Equal(t, []string{"orders", "payments"}, topics)
+
+	_, err = tm.Read("orders", 4, 0)
+	require.Equal(t, ErrInvalidPartition, err)
+	for _, topic := range []string{"", "..", "a/b"} {
+		_, _, err = tm.AppendKeyed(topic, []byte("user-0"), []byte("order"))
+		require.Equal(t, ErrInvalidTopic, err)
+	}
+	require.NoError(t, tm.Close())
+
+	// the partitions pick up where they left off, but only with the number of partitions they were created with
+	tm, err = NewTopicManager(dir, 4, Config{})
+	require.NoError(t, err)
+	defer tm.Close()
+	partition, off, err := tm.AppendKeyed("orders", []byte("user-0"), []byte("order 40"))
+	require.NoError(t, err)
+	require.Equal(t, partitionOf["user-0"], partition)
+	require.Equal(t, next[partition], off)
+
+	other, err := NewTopicManager(dir, 2, Config{})
+	require.NoError(t, err)
+	_, _, err = other.AppendKeyed("orders", []byte("user-0"), []byte("order"))
+	require.Equal(t, ErrPartitionCount{Topic: "orders", Found: 4}, err)
+}
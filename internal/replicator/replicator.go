@@ -0,0 +1,141 @@
+package replicator
+
+import (
+	"bytes"
+	"context"
+	"sync/atomic"
+	"time"
+
+	api "github.com/burmudar/prolog/api/v1"
+	"github.com/burmudar/prolog/internal/log"
+)
+
+// Replicator keeps a local log in step with a leader by consuming the leader's log and appending every record at the
+// same offset locally. The replication lag is reported to the local log's Observer when it is a
+// log.ReplicationObserver
+type Replicator struct {
+	Leader api.LogClient
+	Local  *log.Log
+	// PollInterval is how often the leader's highest offset is polled while Run is running, which keeps the lag up to
+	// date when no records are coming in. The leader isn't polled when it is zero
+	PollInterval time.Duration
+
+	lag uint64
+}
+
+// Run replicates from the local log's next offset onwards until the context is cancelled or replication fails
+func (r *Replicator) Run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if r.PollInterval > 0 {
+		polled := make(chan struct{})
+		defer func() { <-polled }()
+		go func() {
+			defer close(polled)
+			r.poll(ctx)
+		}()
+	}
+
+	stream, err := r.Leader.ConsumeStream(ctx, &api.ConsumeRequest{Offset: r.Local.PeekNextOffset()})
+	if err != nil {
+		return err
+	}
+
+	for {
+		res, err := stream.Recv()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+
+		if err := r.Local.AppendAt(res.Record, res.Record.Offset); err != nil {
+			return err
+		}
+		r.updateLag(res.HighestOffset, res.Record.Offset)
+	}
+}
+
+// Verify compares the follower's records in [start, end) with the leader's, by their digests, and fetches them from
+// the leader again when they differ. The follower's records from start on are truncated first, so that the fetched
+// records can be appended at their offsets, and the ones after end are fetched again by Run. It reports whether the
+// records had to be fetched again. Verify mustn't be called while Run is running, since both append to the local log
+func (r *Replicator) Verify(ctx context.Context, start, end uint64) (bool, error) {
+	if end > r.Local.PeekNextOffset() {
+		return false, api.ErrOffsetOutOfRange{Offset: end - 1}
+	}
+
+	res, err := r.Leader.Digest(ctx, &api.DigestRequest{Start: start, End: end})
+	if err != nil {
+		return false, err
+	}
+	// records that can't be read locally differ from the leader's as well
+	local, err := r.Local.Digest(start, end)
+	if err == nil && bytes.Equal(local, res.Digest) {
+		return false, nil
+	}
+
+	if err := r.Local.TruncateFrom(start); err != nil {
+		return false, err
+	}
+	for off := start; off < end; {
+		batch, err := r.Leader.ConsumeBatch(ctx, &api.ConsumeBatchRequest{Offset: off})
+		if err != nil {
+			return false, err
+		}
+		if len(batch.Records) == 0 {
+			break
+		}
+		for _, record := range batch.Records {
+			if err := r.Local.AppendAt(record, record.Offset); err != nil {
+				return false, err
+			}
+		}
+		off = batch.NextOffset
+	}
+	return true, nil
+}
+
+// Lag returns the number of records the follower was behind its leader when it last received a record or polled the
+// leader's highest offset
+func (r *Replicator) Lag() uint64 {
+	return atomic.LoadUint64(&r.lag)
+}
+
+// poll updates the lag from the leader's highest offset every PollInterval until the context is cancelled. Failed polls
+// are skipped, replication failing is left to Run to report
+func (r *Replicator) poll(ctx context.Context) {
+	ticker := time.NewTicker(r.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		res, err := r.Leader.GetMetadata(ctx, &api.GetMetadataRequest{})
+		if err != nil {
+			continue
+		}
+		local, err := r.Local.HighestOffset()
+		if err != nil {
+			continue
+		}
+		r.updateLag(res.HighestOffset, local)
+	}
+}
+
+func (r *Replicator) updateLag(leaderHighest, localHighest uint64) {
+	var lag uint64
+	if leaderHighest > localHighest {
+		lag = leaderHighest - localHighest
+	}
+
+	atomic.StoreUint64(&r.lag, lag)
+	if o, ok := r.Local.Config.Observer.(log.ReplicationObserver); ok {
+		o.ReplicationLag(lag)
+	}
+}
@@ -0,0 +1,222 @@
+package replicator
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	api "github.com/burmudar/prolog/api/v1"
+	"github.com/burmudar/prolog/internal/log"
+	"github.com/burmudar/prolog/internal/server"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+)
+
+// lagObserver passes on the lags it is told about, dropping them when they aren't taken in time
+type lagObserver chan uint64
+
+func (o lagObserver) SegmentRolled(uint64, uint64) {}
+func (o lagObserver) SegmentCount(int)             {}
+
+func (o lagObserver) ReplicationLag(lag uint64) {
+	select {
+	case o <- lag:
+	default:
+	}
+}
+
+// stalledLeader is a leader whose stream never sends any records, which leaves polling as the only way to learn about
+// its highest offset
+type stalledLeader struct {
+	api.LogClient
+}
+
+func (l stalledLeader) ConsumeStream(
+	ctx context.Context,
+	req *api.ConsumeRequest,
+	opts ...grpc.CallOption,
+) (api.Log_ConsumeStreamClient, error) {
+	return stalledStream{ctx: ctx}, nil
+}
+
+type stalledStream struct {
+	api.Log_ConsumeStreamClient
+	ctx context.Context
+}
+
+func (s stalledStream) Recv() (*api.ConsumeResponse, error) {
+	<-s.ctx.Done()
+	return nil, s.ctx.Err()
+}
+
+func TestReplicatorLag(t *testing.T) {
+	leader, client, tearDown := setupLeader(t)
+	defer tearDown()
+
+	n := 5
+	for i := 0; i < n; i++ {
+		_, err := leader.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+
+	dir, err := ioutil.TempDir("", "replicator-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	lags := make(lagObserver, n)
+	follower, err := log.NewLog(dir, log.Config{Observer: lags})
+	require.NoError(t, err)
+	defer follower.Close()
+
+	r := &Replicator{Leader: client, Local: follower}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- r.Run(ctx)
+	}()
+
+	// the follower starts out 4 records behind once it has the first record and catches up one record at a time
+	for want := n - 1; want >= 0; want-- {
+		require.Equal(t, uint64(want), <-lags)
+	}
+	require.Equal(t, uint64(0), r.Lag())
+
+	cancel()
+	require.NoError(t, <-done)
+
+	for i := 0; i < n; i++ {
+		record, err := follower.Read(uint64(i))
+		require.NoError(t, err)
+		require.Equal(t, []byte(fmt.Sprintf("record %d", i)), record.Value)
+	}
+}
+
+func TestReplicatorPollLag(t *testing.T) {
+	leader, client, tearDown := setupLeader(t)
+	defer tearDown()
+
+	dir, err := ioutil.TempDir("", "replicator-poll-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	lags := make(lagObserver, 1)
+	follower, err := log.NewLog(dir, log.Config{Observer: lags})
+	require.NoError(t, err)
+	defer follower.Close()
+
+	// the follower has the first 2 of the leader's 5 records
+	for i := 0; i < 5; i++ {
+		off, err := leader.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+		if i < 2 {
+			record, err := leader.Read(off)
+			require.NoError(t, err)
+			require.NoError(t, follower.AppendAt(record, off))
+		}
+	}
+
+	r := &Replicator{Leader: stalledLeader{client}, Local: follower, PollInterval: 10 * time.Millisecond}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- r.Run(ctx)
+	}()
+
+	require.Equal(t, uint64(3), <-lags)
+	require.Equal(t, uint64(3), r.Lag())
+
+	// the leader moving on shows up with the next poll
+	_, err = leader.Append(&api.Record{Value: []byte("record 5")})
+	require.NoError(t, err)
+	for lag := range lags {
+		if lag == 4 {
+			break
+		}
+		require.Equal(t, uint64(3), lag)
+	}
+
+	cancel()
+	require.NoError(t, <-done)
+}
+
+func TestReplicatorVerify(t *testing.T) {
+	leader, client, tearDown := setupLeader(t)
+	defer tearDown()
+
+	dir, err := ioutil.TempDir("", "replicator-verify-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	follower, err := log.NewLog(dir, log.Config{})
+	require.NoError(t, err)
+	defer follower.Close()
+
+	// the follower's copy of record 2 differs from the leader's
+	n := 5
+	for i := 0; i < n; i++ {
+		off, err := leader.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+		record, err := leader.Read(off)
+		require.NoError(t, err)
+		if i == 2 {
+			record.Value = []byte("recorX 2")
+		}
+		require.NoError(t, follower.AppendAt(record, off))
+	}
+
+	r := &Replicator{Leader: client, Local: follower}
+	ctx := context.Background()
+
+	repaired, err := r.Verify(ctx, 0, 2)
+	require.NoError(t, err)
+	require.False(t, repaired)
+
+	repaired, err = r.Verify(ctx, 1, uint64(n))
+	require.NoError(t, err)
+	require.True(t, repaired)
+	require.Equal(t, uint64(n), follower.PeekNextOffset())
+	for i := 0; i < n; i++ {
+		record, err := follower.Read(uint64(i))
+		require.NoError(t, err)
+		require.Equal(t, []byte(fmt.Sprintf("record %d", i)), record.Value)
+	}
+
+	repaired, err = r.Verify(ctx, 0, uint64(n))
+	require.NoError(t, err)
+	require.False(t, repaired)
+
+	_, err = r.Verify(ctx, 0, uint64(n+1))
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: uint64(n)}, err)
+}
+
+func setupLeader(t *testing.T) (*log.Log, api.LogClient, func()) {
+	t.Helper()
+
+	l, err := net.Listen("tcp", ":0")
+	require.NoError(t, err)
+
+	cc, err := grpc.Dial(l.Addr().String(), grpc.WithInsecure())
+	require.NoError(t, err)
+
+	dir, err := ioutil.TempDir("", "replicator-leader-test")
+	require.NoError(t, err)
+
+	clog, err := log.NewLog(dir, log.Config{})
+	require.NoError(t, err)
+
+	srv, err := server.NewGRPCServer(&server.Config{CommitLog: clog})
+	require.NoError(t, err)
+
+	go func() {
+		srv.Serve(l)
+	}()
+
+	return clog, api.NewLogClient(cc), func() {
+		srv.Stop()
+		cc.Close()
+		l.Close()
+		clog.Remove()
+	}
+}
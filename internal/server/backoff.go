@@ -0,0 +1,52 @@
+package server
+
+import (
+	"math/rand"
+	"time"
+)
+
+const (
+	defaultMinBackoff = time.Millisecond
+	defaultMaxBackoff = 100 * time.Millisecond
+)
+
+// backoff hands out exponentially growing waits capped at max. Each wait is jittered so that many streams tailing
+// the log don't all poll at the same moment
+type backoff struct {
+	min, max time.Duration
+	cur      time.Duration
+}
+
+func newBackoff(min, max time.Duration) *backoff {
+	if min <= 0 {
+		min = defaultMinBackoff
+	}
+	if max <= 0 {
+		max = defaultMaxBackoff
+	}
+	if max < min {
+		max = min
+	}
+
+	return &backoff{min: min, max: max}
+}
+
+// next doubles the current backoff and returns a wait somewhere between half of it and all of it
+func (b *backoff) next() time.Duration {
+	if b.cur == 0 {
+		b.cur = b.min
+	} else {
+		b.cur *= 2
+	}
+	if b.cur > b.max {
+		b.cur = b.max
+	}
+
+	half := b.cur / 2
+	return half + time.Duration(rand.Int63n(int64(b.cur-half)+1))
+}
+
+// reset starts the backoff over at min
+func (b *backoff) reset() {
+	b.cur = 0
+}
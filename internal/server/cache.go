@@ -0,0 +1,66 @@
+package server
+
+import (
+	"container/list"
+	"sync"
+
+	api "github.com/burmudar/prolog/api/v1"
+	"github.com/golang/protobuf/proto"
+)
+
+// cachingCommitLog keeps the most recently read records in memory. Records never change once they've been appended,
+// so nothing ever has to be invalidated. Every read returns a copy of the cached record, which callers are free to
+// change
+type cachingCommitLog struct {
+	CommitLog
+
+	mu   sync.Mutex
+	size int
+	// order holds the cached offsets with the most recently read one at the front
+	order   *list.List
+	records map[uint64]*list.Element
+}
+
+type cacheEntry struct {
+	off    uint64
+	record *api.Record
+}
+
+// NewCachingCommitLog wraps inner with a cache of up to size records. Appends go straight to inner
+func NewCachingCommitLog(inner CommitLog, size int) CommitLog {
+	return &cachingCommitLog{
+		CommitLog: inner,
+		size:      size,
+		order:     list.New(),
+		records:   make(map[uint64]*list.Element),
+	}
+}
+
+func (c *cachingCommitLog) Read(off uint64) (*api.Record, error) {
+	c.mu.Lock()
+	if e, ok := c.records[off]; ok {
+		c.order.MoveToFront(e)
+		c.mu.Unlock()
+		return proto.Clone(e.Value.(*cacheEntry).record).(*api.Record), nil
+	}
+	c.mu.Unlock()
+
+	record, err := c.CommitLog.Read(off)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// another read might have cached the record while we were reading it
+	if _, ok := c.records[off]; !ok && c.size > 0 {
+		c.records[off] = c.order.PushFront(&cacheEntry{off: off, record: record})
+		for c.order.Len() > c.size {
+			e := c.order.Back()
+			c.order.Remove(e)
+			delete(c.records, e.Value.(*cacheEntry).off)
+		}
+	}
+
+	return proto.Clone(record).(*api.Record), nil
+}
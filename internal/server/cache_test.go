@@ -0,0 +1,67 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"testing"
+
+	api "github.com/burmudar/prolog/api/v1"
+	"github.com/burmudar/prolog/internal/log"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCachingCommitLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "caching-commit-log-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	clog, err := log.NewLog(dir, log.Config{})
+	require.NoError(t, err)
+	defer clog.Close()
+
+	counter := &countingLog{CommitLog: clog}
+	cache := NewCachingCommitLog(counter, 2)
+
+	for i := 0; i < 3; i++ {
+		_, err := cache.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+
+	record, err := cache.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello world"), record.Value)
+	require.Equal(t, int64(1), atomic.LoadInt64(&counter.reads))
+
+	// a second read is served from the cache, and changing what the first read returned doesn't change the cache
+	record.Value[0] = 'j'
+	record.Offset = 42
+	cached, err := cache.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello world"), cached.Value)
+	require.Equal(t, uint64(0), cached.Offset)
+	require.Equal(t, int64(1), atomic.LoadInt64(&counter.reads))
+
+	cached.Value[0] = 'j'
+	cached, err = cache.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello world"), cached.Value)
+	require.Equal(t, int64(1), atomic.LoadInt64(&counter.reads))
+
+	// reading two more offsets pushes offset 0 out of the cache
+	for off := uint64(1); off < 3; off++ {
+		_, err := cache.Read(off)
+		require.NoError(t, err)
+	}
+	require.Equal(t, int64(3), atomic.LoadInt64(&counter.reads))
+	_, err = cache.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, int64(4), atomic.LoadInt64(&counter.reads))
+
+	// errors aren't cached
+	_, err = cache.Read(3)
+	require.Error(t, err)
+	_, err = cache.Read(3)
+	require.Error(t, err)
+	require.Equal(t, int64(6), atomic.LoadInt64(&counter.reads))
+}
@@ -0,0 +1,172 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	api "github.com/burmudar/prolog/api/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Coordinator spreads the records in the log over the members of consumer groups, so that a group can consume the log
+// with several members without any two of them getting the same record. The log isn't partitioned, so the coordinator
+// splits its offsets into a fixed number of partitions instead, with the record at an offset being in partition
+// offset % partitions. Every member is assigned a range of partitions that doesn't overlap with those of the others,
+// and the partitions are assigned again whenever a member joins or leaves the group.
+//
+// Assignments are stored in the OffsetStore, so that they survive restarts
+type Coordinator struct {
+	mu         sync.Mutex
+	offsets    *OffsetStore
+	partitions uint32
+}
+
+// NewCoordinator creates a Coordinator that splits the log into partitions, and stores assignments in offsets
+func NewCoordinator(offsets *OffsetStore, partitions uint32) (*Coordinator, error) {
+	if partitions == 0 {
+		return nil, fmt.Errorf("a coordinator needs at least one partition")
+	}
+	return &Coordinator{offsets: offsets, partitions: partitions}, nil
+}
+
+// Partitions returns the number of partitions the coordinator splits the log into
+func (c *Coordinator) Partitions() uint32 {
+	return c.partitions
+}
+
+// Partition returns the partition the record at off is in
+func (c *Coordinator) Partition(off uint64) uint32 {
+	return uint32(off % uint64(c.partitions))
+}
+
+// Join adds member to group and returns the group's assignment, which is rebalanced if member wasn't in the group yet
+func (c *Coordinator) Join(group, member string) (*api.GroupAssignment, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	assignment, _ := c.offsets.FetchAssignment(group)
+	members := assignedMembers(assignment)
+	for _, m := range members {
+		if m == member {
+			return assignment, nil
+		}
+	}
+	return c.rebalance(group, assignment, append(members, member))
+}
+
+// Leave removes member from group and returns the group's assignment, which is rebalanced if member was in the group
+func (c *Coordinator) Leave(group, member string) (*api.GroupAssignment, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	assignment, _ := c.offsets.FetchAssignment(group)
+	members := assignedMembers(assignment)
+	for i, m := range members {
+		if m == member {
+			return c.rebalance(group, assignment, append(members[:i], members[i+1:]...))
+		}
+	}
+	return assignment, nil
+}
+
+// Assignment returns the partitions assigned to member of group, along with the generation of the assignment. The
+// third return value is false when member isn't in group
+func (c *Coordinator) Assignment(group, member string) ([]uint32, uint64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	assignment, ok := c.offsets.FetchAssignment(group)
+	if !ok {
+		return nil, 0, false
+	}
+	partitions, ok := memberPartitions(assignment, member)
+	return partitions, assignment.Generation, ok
+}
+
+// rebalance assigns the partitions to members and stores the result as the next generation of group's assignment. The
+// members are sorted, and each one gets a contiguous range of partitions, with the first ones getting one partition
+// more when they don't divide evenly. Members beyond the number of partitions get none
+func (c *Coordinator) rebalance(
+	group string, prev *api.GroupAssignment, members []string,
+) (*api.GroupAssignment, error) {
+	sort.Strings(members)
+
+	next := &api.GroupAssignment{Group: group, Generation: 1}
+	if prev != nil {
+		next.Generation = prev.Generation + 1
+	}
+
+	n := uint32(len(members))
+	partition := uint32(0)
+	for i, member := range members {
+		count := c.partitions / n
+		if uint32(i) < c.partitions%n {
+			count++
+		}
+		m := &api.MemberAssignment{Member: member}
+		for j := uint32(0); j < count; j++ {
+			m.Partitions = append(m.Partitions, partition)
+			partition++
+		}
+		next.Members = append(next.Members, m)
+	}
+
+	if err := c.offsets.StoreAssignment(next); err != nil {
+		return nil, err
+	}
+	return next, nil
+}
+
+// assignedMembers returns the members of assignment, which may be nil
+func assignedMembers(assignment *api.GroupAssignment) []string {
+	var members []string
+	for _, m := range assignment.GetMembers() {
+		members = append(members, m.Member)
+	}
+	return members
+}
+
+// memberPartitions returns the partitions assignment gives member. The second return value is false when member isn't
+// in assignment
+func memberPartitions(assignment *api.GroupAssignment, member string) ([]uint32, bool) {
+	for _, m := range assignment.GetMembers() {
+		if m.Member == member {
+			return m.Partitions, true
+		}
+	}
+	return nil, false
+}
+
+func (s *grpcServer) JoinGroup(ctx context.Context, req *api.JoinGroupRequest) (*api.JoinGroupResponse, error) {
+	if s.Coordinator == nil {
+		return nil, status.Error(codes.Unimplemented, "consumer groups aren't coordinated by this server")
+	}
+	if req.Group == "" || req.Member == "" {
+		return nil, status.Error(codes.InvalidArgument, "joining a group needs both a group and a member")
+	}
+
+	assignment, err := s.Coordinator.Join(req.Group, req.Member)
+	if err != nil {
+		return nil, err
+	}
+	partitions, _ := memberPartitions(assignment, req.Member)
+	return &api.JoinGroupResponse{
+		Generation:     assignment.Generation,
+		Partitions:     partitions,
+		PartitionCount: s.Coordinator.Partitions(),
+	}, nil
+}
+
+func (s *grpcServer) LeaveGroup(ctx context.Context, req *api.LeaveGroupRequest) (*api.LeaveGroupResponse, error) {
+	if s.Coordinator == nil {
+		return nil, status.Error(codes.Unimplemented, "consumer groups aren't coordinated by this server")
+	}
+
+	if _, err := s.Coordinator.Leave(req.Group, req.Member); err != nil {
+		return nil, err
+	}
+	return &api.LeaveGroupResponse{}, nil
+}
@@ -0,0 +1,147 @@
+package server
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	api "github.com/burmudar/prolog/api/v1"
+	"github.com/burmudar/prolog/internal/log"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestCoordinator(t *testing.T) {
+	dir, err := ioutil.TempDir("", "coordinator-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	setup := func() (*Coordinator, func()) {
+		offsetsLog, err := log.NewLog(dir, log.Config{})
+		require.NoError(t, err)
+		offsets, err := NewOffsetStore(offsetsLog)
+		require.NoError(t, err)
+		coordinator, err := NewCoordinator(offsets, 5)
+		require.NoError(t, err)
+		return coordinator, func() {
+			require.NoError(t, offsetsLog.Close())
+		}
+	}
+
+	coordinator, tearDown := setup()
+
+	_, err = coordinator.Join("billing", "b")
+	require.NoError(t, err)
+	assignment, err := coordinator.Join("billing", "a")
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), assignment.Generation)
+
+	a, _, ok := coordinator.Assignment("billing", "a")
+	require.True(t, ok)
+	b, _, ok := coordinator.Assignment("billing", "b")
+	require.True(t, ok)
+	require.Equal(t, []uint32{0, 1, 2}, a)
+	require.Equal(t, []uint32{3, 4}, b)
+
+	// every offset belongs to exactly one of the members
+	for off := uint64(0); off < 20; off++ {
+		partition := coordinator.Partition(off)
+		require.NotEqual(t, contains(a, partition), contains(b, partition))
+	}
+
+	// joining again doesn't rebalance
+	assignment, err = coordinator.Join("billing", "a")
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), assignment.Generation)
+
+	// the assignments are restored from the offsets log after a restart
+	tearDown()
+	coordinator, tearDown = setup()
+	defer tearDown()
+
+	a, generation, ok := coordinator.Assignment("billing", "a")
+	require.True(t, ok)
+	require.Equal(t, uint64(2), generation)
+	require.Equal(t, []uint32{0, 1, 2}, a)
+
+	// the member that is left gets all the partitions
+	assignment, err = coordinator.Leave("billing", "a")
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), assignment.Generation)
+
+	_, _, ok = coordinator.Assignment("billing", "a")
+	require.False(t, ok)
+	b, _, ok = coordinator.Assignment("billing", "b")
+	require.True(t, ok)
+	require.Equal(t, []uint32{0, 1, 2, 3, 4}, b)
+}
+
+func TestServerJoinGroup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "join-group-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	offsetsLog, err := log.NewLog(dir, log.Config{})
+	require.NoError(t, err)
+	defer offsetsLog.Close()
+	offsets, err := NewOffsetStore(offsetsLog)
+	require.NoError(t, err)
+	coordinator, err := NewCoordinator(offsets, 4)
+	require.NoError(t, err)
+
+	client, _, tearDown := setupTest(t, func(c *Config) {
+		c.Offsets = offsets
+		c.Coordinator = coordinator
+	})
+	defer tearDown()
+
+	ctx := context.Background()
+	_, err = client.CommitOffset(ctx, &api.CommitOffsetRequest{Group: "billing", Offset: 3})
+	require.NoError(t, err)
+
+	_, err = client.JoinGroup(ctx, &api.JoinGroupRequest{Group: "billing", Member: "a"})
+	require.NoError(t, err)
+	res, err := client.JoinGroup(ctx, &api.JoinGroupRequest{Group: "billing", Member: "b"})
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), res.Generation)
+	require.Equal(t, []uint32{2, 3}, res.Partitions)
+	require.Equal(t, uint32(4), res.PartitionCount)
+
+	_, err = client.LeaveGroup(ctx, &api.LeaveGroupRequest{Group: "billing", Member: "a"})
+	require.NoError(t, err)
+	res, err = client.JoinGroup(ctx, &api.JoinGroupRequest{Group: "billing", Member: "b"})
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), res.Generation)
+	require.Equal(t, []uint32{0, 1, 2, 3}, res.Partitions)
+
+	// assignments don't get in the way of the offsets stored alongside them
+	restored, err := NewOffsetStore(offsetsLog)
+	require.NoError(t, err)
+	offset, ok := restored.FetchOffset("billing")
+	require.True(t, ok)
+	require.Equal(t, uint64(3), offset)
+	_, ok = restored.FetchAssignment("billing")
+	require.True(t, ok)
+
+	_, err = client.JoinGroup(ctx, &api.JoinGroupRequest{Group: "billing"})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestServerJoinGroupDisabled(t *testing.T) {
+	client, _, tearDown := setupTest(t, nil)
+	defer tearDown()
+
+	_, err := client.JoinGroup(context.Background(), &api.JoinGroupRequest{Group: "billing", Member: "a"})
+	require.Equal(t, codes.Unimplemented, status.Code(err))
+}
+
+func contains(partitions []uint32, partition uint32) bool {
+	for _, p := range partitions {
+		if p == partition {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,193 @@
+package server
+
+import (
+	"fmt"
+	"time"
+
+	api "github.com/burmudar/prolog/api/v1"
+	"github.com/burmudar/prolog/internal/log"
+)
+
+// errUnsupported is returned by a measured commit log for calls the commit log it wraps can't make. The server never
+// makes them, since it looks through the wrapper with implements
+var errUnsupported = fmt.Errorf("commit log doesn't support the call")
+
+// wrapper is implemented by commit logs that wrap another one, like the one NewMeasuredCommitLog returns
+type wrapper interface {
+	Unwrap() CommitLog
+}
+
+// implements returns clog as T when it can do what T asks of it. Wrappers implement every optional interface, so they
+// are only taken to implement T when the commit log they wrap does as well
+func implements[T any](clog CommitLog) (T, bool) {
+	t, ok := clog.(T)
+	for inner := clog; ok; {
+		w, isWrapper := inner.(wrapper)
+		if !isWrapper {
+			break
+		}
+		inner = w.Unwrap()
+		_, ok = inner.(T)
+	}
+	return t, ok
+}
+
+// measuredCommitLog times the calls to the commit log it wraps, optional ones included
+type measuredCommitLog struct {
+	CommitLog
+	obs log.CallObserver
+	now func() time.Time
+}
+
+var (
+	_ wrapper              = (*measuredCommitLog)(nil)
+	_ positionAppender     = (*measuredCommitLog)(nil)
+	_ manyAppender         = (*measuredCommitLog)(nil)
+	_ positionManyAppender = (*measuredCommitLog)(nil)
+	_ offsetter            = (*measuredCommitLog)(nil)
+	_ timeSeeker           = (*measuredCommitLog)(nil)
+	_ batchReader          = (*measuredCommitLog)(nil)
+	_ digester             = (*measuredCommitLog)(nil)
+	_ describer            = (*measuredCommitLog)(nil)
+)
+
+// NewMeasuredCommitLog wraps inner so that obs is told how long every call to it took, which keeps the metrics out of
+// the log itself and lets the server opt in to them. obs can be the same observer the log is configured with
+func NewMeasuredCommitLog(inner CommitLog, obs log.CallObserver) CommitLog {
+	return &measuredCommitLog{
+		CommitLog: inner,
+		obs:       obs,
+		now:       time.Now,
+	}
+}
+
+func (m *measuredCommitLog) Unwrap() CommitLog {
+	return m.CommitLog
+}
+
+// observe tells the observer how long the call to method that started at start took
+func (m *measuredCommitLog) observe(method string, start time.Time, err error) {
+	m.obs.CallObserved(method, m.now().Sub(start), err)
+}
+
+func (m *measuredCommitLog) Append(record *api.Record) (uint64, error) {
+	start := m.now()
+	off, err := m.CommitLog.Append(record)
+	m.observe("Append", start, err)
+	return off, err
+}
+
+func (m *measuredCommitLog) Read(off uint64) (*api.Record, error) {
+	start := m.now()
+	record, err := m.CommitLog.Read(off)
+	m.observe("Read", start, err)
+	return record, err
+}
+
+func (m *measuredCommitLog) AppendWithPosition(record *api.Record) (uint64, uint64, uint64, error) {
+	a, ok := m.CommitLog.(positionAppender)
+	if !ok {
+		return 0, 0, 0, errUnsupported
+	}
+
+	start := m.now()
+	off, baseOffset, pos, err := a.AppendWithPosition(record)
+	m.observe("AppendWithPosition", start, err)
+	return off, baseOffset, pos, err
+}
+
+func (m *measuredCommitLog) AppendMany(records []*api.Record) (uint64, int, error) {
+	a, ok := m.CommitLog.(manyAppender)
+	if !ok {
+		return 0, 0, errUnsupported
+	}
+
+	start := m.now()
+	first, n, err := a.AppendMany(records)
+	m.observe("AppendMany", start, err)
+	return first, n, err
+}
+
+func (m *measuredCommitLog) AppendManyWithPositions(records []*api.Record) ([]log.RecordPosition, error) {
+	a, ok := m.CommitLog.(positionManyAppender)
+	if !ok {
+		return nil, errUnsupported
+	}
+
+	start := m.now()
+	positions, err := a.AppendManyWithPositions(records)
+	m.observe("AppendManyWithPositions", start, err)
+	return positions, err
+}
+
+func (m *measuredCommitLog) HighestOffset() (uint64, error) {
+	o, ok := m.CommitLog.(offsetter)
+	if !ok {
+		return 0, errUnsupported
+	}
+
+	start := m.now()
+	off, err := o.HighestOffset()
+	m.observe("HighestOffset", start, err)
+	return off, err
+}
+
+func (m *measuredCommitLog) LowestOffset() (uint64, error) {
+	d, ok := m.CommitLog.(describer)
+	if !ok {
+		return 0, errUnsupported
+	}
+
+	start := m.now()
+	off, err := d.LowestOffset()
+	m.observe("LowestOffset", start, err)
+	return off, err
+}
+
+func (m *measuredCommitLog) SegmentCount() int {
+	d, ok := m.CommitLog.(describer)
+	if !ok {
+		return 0
+	}
+
+	start := m.now()
+	n := d.SegmentCount()
+	m.observe("SegmentCount", start, nil)
+	return n
+}
+
+func (m *measuredCommitLog) OffsetAtTime(t time.Time) (uint64, error) {
+	s, ok := m.CommitLog.(timeSeeker)
+	if !ok {
+		return 0, errUnsupported
+	}
+
+	start := m.now()
+	off, err := s.OffsetAtTime(t)
+	m.observe("OffsetAtTime", start, err)
+	return off, err
+}
+
+func (m *measuredCommitLog) ReadBatch(off uint64, max int) ([]*api.Record, uint64, error) {
+	b, ok := m.CommitLog.(batchReader)
+	if !ok {
+		return nil, 0, errUnsupported
+	}
+
+	start := m.now()
+	records, next, err := b.ReadBatch(off, max)
+	m.observe("ReadBatch", start, err)
+	return records, next, err
+}
+
+func (m *measuredCommitLog) Digest(off, end uint64) ([]byte, error) {
+	d, ok := m.CommitLog.(digester)
+	if !ok {
+		return nil, errUnsupported
+	}
+
+	start := m.now()
+	digest, err := d.Digest(off, end)
+	m.observe("Digest", start, err)
+	return digest, err
+}
@@ -0,0 +1,147 @@
+package server
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	api "github.com/burmudar/prolog/api/v1"
+	"github.com/burmudar/prolog/internal/log"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// call is a call recorded by recordingObserver
+type call struct {
+	method string
+	d      time.Duration
+	failed bool
+}
+
+type recordingObserver struct {
+	mu    sync.Mutex
+	calls []call
+}
+
+func (o *recordingObserver) SegmentRolled(uint64, uint64) {}
+func (o *recordingObserver) SegmentCount(int)             {}
+
+func (o *recordingObserver) CallObserved(method string, d time.Duration, err error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.calls = append(o.calls, call{method: method, d: d, failed: err != nil})
+}
+
+func TestMeasuredCommitLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "measured-commit-log-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	clog, err := log.NewLog(dir, log.Config{})
+	require.NoError(t, err)
+	defer clog.Close()
+
+	obs := &recordingObserver{}
+	measured := NewMeasuredCommitLog(clog, obs)
+
+	// every call takes 4 milliseconds longer than the one before it
+	var ticks time.Duration
+	now := time.Now()
+	measured.(*measuredCommitLog).now = func() time.Time {
+		ticks++
+		return now.Add(ticks * ticks * time.Millisecond)
+	}
+
+	for i := 0; i < 2; i++ {
+		_, err := measured.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	record, err := measured.Read(1)
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello world"), record.Value)
+	_, err = measured.Read(2)
+	require.Error(t, err)
+
+	// the calls the server makes when the commit log can make them are timed as well
+	_, _, _, err = measured.(positionAppender).AppendWithPosition(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	_, err = measured.(offsetter).HighestOffset()
+	require.NoError(t, err)
+	_, err = measured.(timeSeeker).OffsetAtTime(time.Now())
+	require.NoError(t, err)
+	records, _, err := measured.(batchReader).ReadBatch(0, 10)
+	require.NoError(t, err)
+	require.Len(t, records, 3)
+	_, err = measured.(digester).Digest(0, 3)
+	require.NoError(t, err)
+	_, err = measured.(describer).LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, 1, measured.(describer).SegmentCount())
+
+	require.Equal(t, []call{
+		{method: "Append", d: 3 * time.Millisecond},
+		{method: "Append", d: 7 * time.Millisecond},
+		{method: "Read", d: 11 * time.Millisecond},
+		{method: "Read", d: 15 * time.Millisecond, failed: true},
+		{method: "AppendWithPosition", d: 19 * time.Millisecond},
+		{method: "HighestOffset", d: 23 * time.Millisecond},
+		{method: "OffsetAtTime", d: 27 * time.Millisecond},
+		{method: "ReadBatch", d: 31 * time.Millisecond},
+		{method: "Digest", d: 35 * time.Millisecond},
+		{method: "LowestOffset", d: 39 * time.Millisecond},
+		{method: "SegmentCount", d: 43 * time.Millisecond},
+	}, obs.calls)
+}
+
+func TestMeasuredCommitLogServer(t *testing.T) {
+	for scenario, want := range map[string]struct {
+		wrap     func(clog CommitLog) CommitLog
+		position bool
+	}{
+		"commit log that can tell where it stored a record": {
+			wrap:     func(clog CommitLog) CommitLog { return clog },
+			position: true,
+		},
+		"commit log that can only append and read": {
+			wrap:     func(clog CommitLog) CommitLog { return &countingLog{CommitLog: clog} },
+			position: false,
+		},
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			obs := &recordingObserver{}
+			client, _, tearDown := setupTest(t, func(c *Config) {
+				c.CommitLog = NewMeasuredCommitLog(want.wrap(c.CommitLog), obs)
+			})
+			defer tearDown()
+
+			// the server only makes the calls the commit log underneath the wrapper can make
+			ctx := context.Background()
+			_, err := client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("hello world")}})
+			require.NoError(t, err)
+			res, err := client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("hello world")}})
+			require.NoError(t, err)
+			require.Equal(t, want.position, res.Position != 0)
+
+			_, err = client.ConsumeBatch(ctx, &api.ConsumeBatchRequest{Offset: 0})
+			if want.position {
+				require.NoError(t, err)
+			} else {
+				require.Equal(t, codes.Unimplemented, status.Code(err))
+			}
+
+			obs.mu.Lock()
+			defer obs.mu.Unlock()
+			require.NotEmpty(t, obs.calls)
+			if want.position {
+				require.Equal(t, "AppendWithPosition", obs.calls[0].method)
+			} else {
+				require.Equal(t, "Append", obs.calls[0].method)
+			}
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"context"
+	"net/http"
+
+	api "github.com/burmudar/prolog/api/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// describer is implemented by commit logs that can describe the range of offsets they hold
+type describer interface {
+	LowestOffset() (uint64, error)
+	HighestOffset() (uint64, error)
+	SegmentCount() int
+}
+
+func (s *grpcServer) GetMetadata(ctx context.Context, req *api.GetMetadataRequest) (*api.GetMetadataResponse, error) {
+	return getMetadata(s.Config)
+}
+
+func getMetadata(config *Config) (*api.GetMetadataResponse, error) {
+	d, ok := implements[describer](config.CommitLog)
+	if !ok {
+		return nil, status.Error(codes.Unimplemented, "commit log can't describe itself")
+	}
+
+	lowest, err := d.LowestOffset()
+	if err != nil {
+		return nil, err
+	}
+	highest, err := d.HighestOffset()
+	if err != nil {
+		return nil, err
+	}
+
+	res := &api.GetMetadataResponse{
+		LowestOffset:  lowest,
+		HighestOffset: highest,
+		NumSegments:   uint32(d.SegmentCount()),
+	}
+	if config.Topics != nil {
+		if res.Topics, err = config.Topics.Topics(); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// NewMetadataHandler serves what GetMetadata returns as JSON to GET requests, for clients that don't speak gRPC
+func NewMetadataHandler(config *Config) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		res, err := getMetadata(config)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		p, err := protojson.Marshal(res)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(p)
+	})
+}
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	api "github.com/burmudar/prolog/api/v1"
+	"github.com/burmudar/prolog/internal/log"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+func TestServerGetMetadata(t *testing.T) {
+	client, config, tearDown := setupTest(t, nil)
+	defer tearDown()
+
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		_, err := client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("hello world")}})
+		require.NoError(t, err)
+	}
+
+	want := &api.GetMetadataResponse{LowestOffset: 0, HighestOffset: 2, NumSegments: 1}
+	res, err := client.GetMetadata(ctx, &api.GetMetadataRequest{})
+	require.NoError(t, err)
+	require.Equal(t, want.LowestOffset, res.LowestOffset)
+	require.Equal(t, want.HighestOffset, res.HighestOffset)
+	require.Equal(t, want.NumSegments, res.NumSegments)
+
+	srv := httptest.NewServer(NewMetadataHandler(config))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/metadata")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	p, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	var got api.GetMetadataResponse
+	require.NoError(t, protojson.Unmarshal(p, &got))
+	require.Equal(t, want.HighestOffset, got.HighestOffset)
+	require.Equal(t, want.NumSegments, got.NumSegments)
+}
+
+func TestServerGetMetadataTopics(t *testing.T) {
+	dir, err := ioutil.TempDir("", "server-metadata-topics-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	topics, err := log.NewTopicManager(dir, 2, log.Config{})
+	require.NoError(t, err)
+	defer topics.Close()
+	for _, topic := range []string{"users", "orders"} {
+		_, _, err := topics.AppendKeyed(topic, []byte("key"), []byte("hello world"))
+		require.NoError(t, err)
+	}
+
+	client, _, tearDown := setupTest(t, func(c *Config) {
+		c.Topics = topics
+	})
+	defer tearDown()
+
+	res, err := client.GetMetadata(context.Background(), &api.GetMetadataRequest{})
+	require.NoError(t, err)
+	require.Equal(t, []string{"orders", "users"}, res.Topics)
+}
@@ -0,0 +1,153 @@
+package server
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	api "github.com/burmudar/prolog/api/v1"
+)
+
+// subscriptions holds the cursors of a ConsumeMulti stream's subscriptions. The stream's requests change them while
+// records are being sent, so every access goes through mu
+type subscriptions struct {
+	mu sync.Mutex
+	// ids is in the order the subscriptions were added, which is the order they take turns in
+	ids     []string
+	cursors map[string]uint64
+	// changed is signalled whenever a subscription is added or removed
+	changed chan struct{}
+}
+
+func newSubscriptions() *subscriptions {
+	return &subscriptions{
+		cursors: make(map[string]uint64),
+		changed: make(chan struct{}, 1),
+	}
+}
+
+func (s *subscriptions) apply(req *api.ConsumeMultiRequest) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if sub := req.Add; sub != nil {
+		if _, ok := s.cursors[sub.Id]; !ok {
+			s.ids = append(s.ids, sub.Id)
+		}
+		s.cursors[sub.Id] = sub.Offset
+	}
+	if id := req.Remove; id != "" {
+		if _, ok := s.cursors[id]; ok {
+			delete(s.cursors, id)
+			for i := range s.ids {
+				if s.ids[i] == id {
+					s.ids = append(s.ids[:i], s.ids[i+1:]...)
+					break
+				}
+			}
+		}
+	}
+
+	select {
+	case s.changed <- struct{}{}:
+	default:
+	}
+}
+
+// snapshot returns the subscriptions and where their cursors are
+func (s *subscriptions) snapshot() ([]string, map[string]uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ids := make([]string, len(s.ids))
+	copy(ids, s.ids)
+	cursors := make(map[string]uint64, len(s.cursors))
+	for id, off := range s.cursors {
+		cursors[id] = off
+	}
+	return ids, cursors
+}
+
+// advance moves the subscription's cursor past off, unless the subscription was moved or removed in the meantime
+func (s *subscriptions) advance(id string, off uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if cur, ok := s.cursors[id]; ok && cur == off {
+		s.cursors[id] = off + 1
+	}
+}
+
+// ConsumeMulti streams records for any number of subscriptions, which the client adds and removes as it goes. The
+// subscriptions take turns, one record each, so that a subscription far behind the end of the log doesn't hold up the
+// others. Once every subscription has caught up, the stream waits for new records the same way ConsumeStream does
+func (s *grpcServer) ConsumeMulti(stream api.Log_ConsumeMultiServer) error {
+	subs := newSubscriptions()
+	recvErr := make(chan error, 1)
+	go func() {
+		for {
+			req, err := stream.Recv()
+			if err != nil {
+				recvErr <- err
+				return
+			}
+			subs.apply(req)
+		}
+	}()
+
+	ctx := stream.Context()
+	b := newBackoff(s.MinConsumeBackoff, s.MaxConsumeBackoff)
+	for {
+		sent, err := s.consumeSubscriptions(stream, subs)
+		if err != nil {
+			return err
+		}
+		if sent {
+			b.reset()
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return s.streamDone(ctx)
+		case err := <-recvErr:
+			// a client that is done changing its subscriptions still gets records for them
+			if err != io.EOF {
+				return err
+			}
+			recvErr = nil
+		case <-subs.changed:
+		case <-time.After(b.next()):
+		}
+	}
+}
+
+// consumeSubscriptions sends the record at each subscription's cursor, skipping subscriptions that have caught up to
+// the end of the log. It reports whether any record was sent
+func (s *grpcServer) consumeSubscriptions(stream api.Log_ConsumeMultiServer, subs *subscriptions) (bool, error) {
+	ids, cursors := subs.snapshot()
+
+	sent := false
+	for _, id := range ids {
+		off := cursors[id]
+		record, err := s.CommitLog.Read(off)
+		if _, ok := err.(api.ErrOffsetOutOfRange); ok {
+			continue
+		}
+		switch err.(type) {
+		case api.ErrOffsetNotFound, api.ErrCompacted:
+			subs.advance(id, off)
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+
+		if err := stream.Send(&api.ConsumeMultiResponse{SubscriptionId: id, Record: record}); err != nil {
+			return false, err
+		}
+		subs.advance(id, off)
+		sent = true
+	}
+	return sent, nil
+}
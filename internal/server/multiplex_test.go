@@ -0,0 +1,63 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	api "github.com/burmudar/prolog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServerConsumeMulti(t *testing.T) {
+	client, _, tearDown := setupTest(t, nil)
+	defer tearDown()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	for i := 0; i < 4; i++ {
+		_, err := client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte(fmt.Sprintf("record %d", i))},
+		})
+		require.NoError(t, err)
+	}
+
+	stream, err := client.ConsumeMulti(ctx)
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(&api.ConsumeMultiRequest{Add: &api.Subscription{Id: "head", Offset: 0}}))
+	require.NoError(t, stream.Send(&api.ConsumeMultiRequest{Add: &api.Subscription{Id: "tail", Offset: 2}}))
+
+	// every subscription sees its own range of the log in order, whichever way they're interleaved
+	want := map[string][]uint64{"head": {0, 1, 2, 3}, "tail": {2, 3}}
+	got := map[string][]uint64{}
+	for i := 0; i < 6; i++ {
+		res, err := stream.Recv()
+		require.NoError(t, err)
+		require.Equal(t, []byte(fmt.Sprintf("record %d", res.Record.Offset)), res.Record.Value)
+		got[res.SubscriptionId] = append(got[res.SubscriptionId], res.Record.Offset)
+	}
+	require.Equal(t, want, got)
+
+	// removed subscriptions stop receiving records while the others carry on tailing the log
+	require.NoError(t, stream.Send(&api.ConsumeMultiRequest{Remove: "head"}))
+	require.NoError(t, stream.Send(&api.ConsumeMultiRequest{Add: &api.Subscription{Id: "replay", Offset: 1}}))
+	for _, off := range []uint64{1, 2, 3} {
+		res, err := stream.Recv()
+		require.NoError(t, err)
+		require.Equal(t, "replay", res.SubscriptionId)
+		require.Equal(t, off, res.Record.Offset)
+	}
+
+	_, err = client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("record 4")}})
+	require.NoError(t, err)
+
+	want = map[string][]uint64{"tail": {4}, "replay": {4}}
+	got = map[string][]uint64{}
+	for i := 0; i < 2; i++ {
+		res, err := stream.Recv()
+		require.NoError(t, err)
+		got[res.SubscriptionId] = append(got[res.SubscriptionId], res.Record.Offset)
+	}
+	require.Equal(t, want, got)
+}
@@ -0,0 +1,212 @@
+package server
+
+import (
+	"context"
+	"sync"
+
+	api "github.com/burmudar/prolog/api/v1"
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// OffsetStore keeps track of the offsets consumer groups have committed, of how their partitions are assigned, and of
+// the markers clients have set
+type OffsetStore struct {
+	mu          sync.Mutex
+	log         CommitLog
+	offsets     map[string]uint64
+	assignments map[string]*api.GroupAssignment
+	markers     map[string]uint64
+}
+
+// lowestOffsetter is implemented by commit logs whose records may not start at offset 0, like logs that were truncated
+type lowestOffsetter interface {
+	LowestOffset() (uint64, error)
+}
+
+// NewOffsetStore creates an OffsetStore which persists commits in log. Every commit is appended to log, so the offsets
+// are restored by replaying it, with later commits for a group replacing earlier ones
+func NewOffsetStore(log CommitLog) (*OffsetStore, error) {
+	s := &OffsetStore{
+		log:         log,
+		offsets:     make(map[string]uint64),
+		assignments: make(map[string]*api.GroupAssignment),
+		markers:     make(map[string]uint64),
+	}
+
+	// the log doesn't start at offset 0 anymore once it has been truncated
+	start := uint64(0)
+	if l, ok := implements[lowestOffsetter](log); ok {
+		var err error
+		if start, err = l.LowestOffset(); err != nil {
+			return nil, err
+		}
+	}
+
+	for off := start; ; off++ {
+		record, err := log.Read(off)
+		if _, ok := err.(api.ErrOffsetOutOfRange); ok {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		// assignments don't share field numbers with commits, so a record is an assignment when it has a group as one
+		var assignment api.GroupAssignment
+		if err := proto.Unmarshal(record.Value, &assignment); err != nil {
+			return nil, err
+		}
+		if assignment.Group != "" {
+			s.assignments[assignment.Group] = &assignment
+			continue
+		}
+
+		// and the same goes for markers, which have a name
+		var marker api.Marker
+		if err := proto.Unmarshal(record.Value, &marker); err != nil {
+			return nil, err
+		}
+		if marker.Name != "" {
+			s.markers[marker.Name] = marker.Offset
+			continue
+		}
+
+		var commit api.CommitOffsetRequest
+		if err := proto.Unmarshal(record.Value, &commit); err != nil {
+			return nil, err
+		}
+		s.offsets[commit.Group] = commit.Offset
+	}
+
+	return s, nil
+}
+
+// CommitOffset stores offset as the offset group resumes consuming from
+func (s *OffsetStore) CommitOffset(group string, offset uint64) error {
+	p, err := proto.Marshal(&api.CommitOffsetRequest{Group: group, Offset: offset})
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.log.Append(&api.Record{Value: p}); err != nil {
+		return err
+	}
+	s.offsets[group] = offset
+	return nil
+}
+
+// FetchOffset returns the offset group last committed. The second return value is false when group never committed
+func (s *OffsetStore) FetchOffset(group string) (uint64, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	offset, ok := s.offsets[group]
+	return offset, ok
+}
+
+// StoreAssignment stores assignment as the way its group's partitions are spread over its members
+func (s *OffsetStore) StoreAssignment(assignment *api.GroupAssignment) error {
+	p, err := proto.Marshal(assignment)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.log.Append(&api.Record{Value: p}); err != nil {
+		return err
+	}
+	s.assignments[assignment.Group] = assignment
+	return nil
+}
+
+// FetchAssignment returns the assignment last stored for group. The second return value is false when there is none
+func (s *OffsetStore) FetchAssignment(group string) (*api.GroupAssignment, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	assignment, ok := s.assignments[group]
+	return assignment, ok
+}
+
+// SetMarker points the marker called name at offset, replacing the offset it pointed at before
+func (s *OffsetStore) SetMarker(name string, offset uint64) error {
+	p, err := proto.Marshal(&api.Marker{Name: name, Offset: offset})
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.log.Append(&api.Record{Value: p}); err != nil {
+		return err
+	}
+	s.markers[name] = offset
+	return nil
+}
+
+// FetchMarker returns the offset the marker called name points at. The second return value is false when there is no
+// such marker
+func (s *OffsetStore) FetchMarker(name string) (uint64, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	offset, ok := s.markers[name]
+	return offset, ok
+}
+
+func (s *grpcServer) CommitOffset(ctx context.Context, req *api.CommitOffsetRequest) (*api.CommitOffsetResponse, error) {
+	if s.Offsets == nil {
+		return nil, status.Error(codes.Unimplemented, "consumer offsets aren't stored by this server")
+	}
+
+	if err := s.Offsets.CommitOffset(req.Group, req.Offset); err != nil {
+		return nil, err
+	}
+	return &api.CommitOffsetResponse{}, nil
+}
+
+func (s *grpcServer) FetchOffset(ctx context.Context, req *api.FetchOffsetRequest) (*api.FetchOffsetResponse, error) {
+	if s.Offsets == nil {
+		return nil, status.Error(codes.Unimplemented, "consumer offsets aren't stored by this server")
+	}
+
+	offset, ok := s.Offsets.FetchOffset(req.Group)
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "consumer group %q hasn't committed an offset", req.Group)
+	}
+	return &api.FetchOffsetResponse{Offset: offset}, nil
+}
+
+func (s *grpcServer) SetMarker(ctx context.Context, req *api.SetMarkerRequest) (*api.SetMarkerResponse, error) {
+	if s.Offsets == nil {
+		return nil, status.Error(codes.Unimplemented, "markers aren't stored by this server")
+	}
+	if req.Marker == nil || req.Marker.Name == "" {
+		return nil, status.Error(codes.InvalidArgument, "marker needs a name")
+	}
+
+	if err := s.Offsets.SetMarker(req.Marker.Name, req.Marker.Offset); err != nil {
+		return nil, err
+	}
+	return &api.SetMarkerResponse{}, nil
+}
+
+func (s *grpcServer) GetMarker(ctx context.Context, req *api.GetMarkerRequest) (*api.GetMarkerResponse, error) {
+	if s.Offsets == nil {
+		return nil, status.Error(codes.Unimplemented, "markers aren't stored by this server")
+	}
+
+	offset, ok := s.Offsets.FetchMarker(req.Name)
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "there's no marker called %q", req.Name)
+	}
+	return &api.GetMarkerResponse{Marker: &api.Marker{Name: req.Name, Offset: offset}}, nil
+}
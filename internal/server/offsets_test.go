@@ -0,0 +1,217 @@
+package server
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	api "github.com/burmudar/prolog/api/v1"
+	"github.com/burmudar/prolog/internal/log"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestServerOffsets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "offsets-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	setup := func() (api.LogClient, func()) {
+		offsetsLog, err := log.NewLog(dir, log.Config{})
+		require.NoError(t, err)
+		offsets, err := NewOffsetStore(offsetsLog)
+		require.NoError(t, err)
+
+		client, _, tearDown := setupTest(t, func(c *Config) {
+			c.Offsets = offsets
+		})
+		return client, func() {
+			tearDown()
+			require.NoError(t, offsetsLog.Close())
+		}
+	}
+
+	ctx := context.Background()
+	client, tearDown := setup()
+
+	_, err = client.FetchOffset(ctx, &api.FetchOffsetRequest{Group: "dashboard"})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	for _, commit := range []*api.CommitOffsetRequest{
+		{Group: "dashboard", Offset: 3},
+		{Group: "billing", Offset: 7},
+		{Group: "dashboard", Offset: 5},
+	} {
+		_, err := client.CommitOffset(ctx, commit)
+		require.NoError(t, err)
+	}
+
+	res, err := client.FetchOffset(ctx, &api.FetchOffsetRequest{Group: "dashboard"})
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), res.Offset)
+
+	// the offsets are restored from the offsets log after a restart
+	tearDown()
+	client, tearDown = setup()
+	defer tearDown()
+
+	for group, want := range map[string]uint64{"dashboard": 5, "billing": 7} {
+		res, err := client.FetchOffset(ctx, &api.FetchOffsetRequest{Group: group})
+		require.NoError(t, err)
+		require.Equal(t, want, res.Offset)
+	}
+}
+
+func TestOffsetStoreTruncatedLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "offsets-truncated-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := log.Config{}
+	c.Segment.MaxStoreBytes = 64
+	offsetsLog, err := log.NewLog(dir, c)
+	require.NoError(t, err)
+	defer offsetsLog.Close()
+	offsets, err := NewOffsetStore(offsetsLog)
+	require.NoError(t, err)
+
+	for i, group := range []string{"dashboard", "billing", "dashboard", "billing", "audit"} {
+		require.NoError(t, offsets.CommitOffset(group, uint64(i)))
+	}
+
+	// the segment holding the first two commits is gone, so replaying starts from the log's lowest offset
+	require.NoError(t, offsetsLog.Truncate(2))
+	lowest, err := offsetsLog.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), lowest)
+
+	offsets, err = NewOffsetStore(offsetsLog)
+	require.NoError(t, err)
+	for group, want := range map[string]uint64{"dashboard": 2, "billing": 3, "audit": 4} {
+		offset, ok := offsets.FetchOffset(group)
+		require.True(t, ok)
+		require.Equal(t, want, offset)
+	}
+}
+
+func TestServerOffsetsDisabled(t *testing.T) {
+	client, _, tearDown := setupTest(t, nil)
+	defer tearDown()
+
+	_, err := client.CommitOffset(context.Background(), &api.CommitOffsetRequest{Group: "dashboard", Offset: 1})
+	require.Equal(t, codes.Unimplemented, status.Code(err))
+}
+
+func TestServerMarkers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "markers-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	offsetsLog, err := log.NewLog(dir, log.Config{})
+	require.NoError(t, err)
+	defer offsetsLog.Close()
+	offsets, err := NewOffsetStore(offsetsLog)
+	require.NoError(t, err)
+
+	client, _, tearDown := setupTest(t, func(c *Config) {
+		c.Offsets = offsets
+	})
+	defer tearDown()
+
+	ctx := context.Background()
+	produce := func(value string) uint64 {
+		res, err := client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte(value)}})
+		require.NoError(t, err)
+		return res.Offset
+	}
+
+	produce("before")
+	_, err = client.SetMarker(ctx, &api.SetMarkerRequest{Marker: &api.Marker{Name: "nightly-start", Offset: 1}})
+	require.NoError(t, err)
+	_, err = client.CommitOffset(ctx, &api.CommitOffsetRequest{Group: "dashboard", Offset: 1})
+	require.NoError(t, err)
+	produce("nightly")
+	produce("after")
+
+	res, err := client.GetMarker(ctx, &api.GetMarkerRequest{Name: "nightly-start"})
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), res.Marker.Offset)
+
+	_, err = client.GetMarker(ctx, &api.GetMarkerRequest{Name: "weekly-start"})
+	require.Equal(t, codes.NotFound, status.Code(err))
+	_, err = client.SetMarker(ctx, &api.SetMarkerRequest{Marker: &api.Marker{Offset: 1}})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{FromMarker: "nightly-start"})
+	require.NoError(t, err)
+	for _, want := range []string{"nightly", "after"} {
+		res, err := stream.Recv()
+		require.NoError(t, err)
+		require.Equal(t, []byte(want), res.Record.Value)
+	}
+
+	stream, err = client.ConsumeStream(ctx, &api.ConsumeRequest{FromMarker: "weekly-start"})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	// markers are restored from the offsets log alongside the committed offsets
+	restored, err := NewOffsetStore(offsetsLog)
+	require.NoError(t, err)
+	offset, ok := restored.FetchMarker("nightly-start")
+	require.True(t, ok)
+	require.Equal(t, uint64(1), offset)
+	offset, ok = restored.FetchOffset("dashboard")
+	require.True(t, ok)
+	require.Equal(t, uint64(1), offset)
+	_, ok = restored.FetchOffset("")
+	require.False(t, ok)
+}
+
+var _ log.PositionStore = (*OffsetStore)(nil)
+
+func TestOffsetStoreSubscription(t *testing.T) {
+	dir, err := ioutil.TempDir("", "offsets-subscription-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	records, err := log.NewLog(path.Join(dir, "records"), log.Config{})
+	require.NoError(t, err)
+	defer records.Close()
+	for i := 0; i < 3; i++ {
+		_, err := records.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+
+	// subscribe runs a subscription for the consumer until it has received n records, and acks the ack-th one
+	subscribe := func(n int, ack int) []uint64 {
+		offsetsLog, err := log.NewLog(path.Join(dir, "offsets"), log.Config{})
+		require.NoError(t, err)
+		defer offsetsLog.Close()
+		offsets, err := NewOffsetStore(offsetsLog)
+		require.NoError(t, err)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		sub, err := records.Subscribe(ctx, "billing", offsets)
+		require.NoError(t, err)
+
+		var received []uint64
+		for i := 0; i < n; i++ {
+			record := <-sub.Records()
+			require.NotNil(t, record)
+			received = append(received, record.Offset)
+			if i == ack {
+				require.NoError(t, sub.Ack(record.Offset))
+			}
+		}
+		return received
+	}
+
+	require.Equal(t, []uint64{0, 1, 2}, subscribe(3, 0))
+	// after a restart the records that weren't acked are delivered again
+	require.Equal(t, []uint64{1, 2}, subscribe(2, -1))
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// tokenBucket allows rate requests per second on average, with bursts of up to burst requests
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func (b *tokenBucket) allow(now time.Time) bool {
+	if b.last.IsZero() {
+		b.tokens = b.burst
+	} else {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// rateLimiter hands out a token bucket per key, the key being the peer's address when requests are limited per peer
+type rateLimiter struct {
+	mu      sync.Mutex
+	rate    float64
+	burst   int
+	perPeer bool
+	buckets map[string]*tokenBucket
+	now     func() time.Time
+}
+
+func newRateLimiter(rate float64, burst int, perPeer bool) *rateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+
+	return &rateLimiter{
+		rate:    rate,
+		burst:   burst,
+		perPeer: perPeer,
+		buckets: make(map[string]*tokenBucket),
+		now:     time.Now,
+	}
+}
+
+func (l *rateLimiter) allow(ctx context.Context) error {
+	key := ""
+	if p, ok := peer.FromContext(ctx); ok && l.perPeer {
+		key = p.Addr.String()
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{rate: l.rate, burst: float64(l.burst)}
+		l.buckets[key] = b
+	}
+	if !b.allow(l.now()) {
+		return status.Error(codes.ResourceExhausted, "rate limit exceeded")
+	}
+	return nil
+}
+
+func (l *rateLimiter) unaryInterceptor(
+	ctx context.Context,
+	req interface{},
+	info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler,
+) (interface{}, error) {
+	if err := l.allow(ctx); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+// streamInterceptor limits the rate at which streams are opened. The messages sent on a stream aren't limited
+func (l *rateLimiter) streamInterceptor(
+	srv interface{},
+	ss grpc.ServerStream,
+	info *grpc.StreamServerInfo,
+	handler grpc.StreamHandler,
+) error {
+	if err := l.allow(ss.Context()); err != nil {
+		return err
+	}
+	return handler(srv, ss)
+}
@@ -0,0 +1,55 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	api "github.com/burmudar/prolog/api/v1"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestServerRateLimit(t *testing.T) {
+	client, _, tearDown := setupTest(t, func(c *Config) {
+		c.RateLimit = 20
+		c.RateBurst = 2
+	})
+	defer tearDown()
+
+	ctx := context.Background()
+	produce := func() error {
+		_, err := client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("hello world")}})
+		return err
+	}
+
+	require.NoError(t, produce())
+	require.NoError(t, produce())
+	require.Equal(t, codes.ResourceExhausted, status.Code(produce()))
+
+	// a token is added every 50ms
+	time.Sleep(60 * time.Millisecond)
+	require.NoError(t, produce())
+}
+
+func TestTokenBucket(t *testing.T) {
+	b := &tokenBucket{rate: 2, burst: 3}
+	now := time.Now()
+
+	for i := 0; i < 3; i++ {
+		require.True(t, b.allow(now))
+	}
+	require.False(t, b.allow(now))
+
+	now = now.Add(500 * time.Millisecond)
+	require.True(t, b.allow(now))
+	require.False(t, b.allow(now))
+
+	// the bucket never holds more than burst tokens, however long it sits idle
+	now = now.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		require.True(t, b.allow(now))
+	}
+	require.False(t, b.allow(now))
+}
@@ -2,9 +2,15 @@ package server
 
 import (
 	"context"
+	"time"
 
 	api "github.com/burmudar/prolog/api/v1"
+	"github.com/burmudar/prolog/internal/log"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
 )
 
 type CommitLog interface {
@@ -12,10 +18,101 @@ type CommitLog interface {
 	Read(uint64) (*api.Record, error)
 }
 
+// offsetter is implemented by commit logs that can tell what their highest offset is
+type offsetter interface {
+	HighestOffset() (uint64, error)
+}
+
+// timeSeeker is implemented by commit logs that can find the offset records from a given time on start at
+type timeSeeker interface {
+	OffsetAtTime(t time.Time) (uint64, error)
+}
+
+// batchReader is implemented by commit logs that can read several records at once
+type batchReader interface {
+	ReadBatch(start uint64, max int) ([]*api.Record, uint64, error)
+}
+
+// digester is implemented by commit logs that can hash a range of their records, see log.Log.Digest
+type digester interface {
+	Digest(start, end uint64) ([]byte, error)
+}
+
+// manyAppender is implemented by commit logs that can append several records at once, see log.Log.AppendMany. Like
+// it, they set the offset of every record they appended
+type manyAppender interface {
+	AppendMany(records []*api.Record) (firstOffset uint64, n int, err error)
+}
+
+// positionManyAppender is implemented by commit logs that can append several records at once and tell where they
+// stored each of them, see log.Log.AppendManyWithPositions
+type positionManyAppender interface {
+	AppendManyWithPositions(records []*api.Record) ([]log.RecordPosition, error)
+}
+
+// positionAppender is implemented by commit logs that can tell where they stored a record, see log.Log.AppendWithPosition
+type positionAppender interface {
+	AppendWithPosition(*api.Record) (off uint64, baseOffset uint64, pos uint64, err error)
+}
+
 type Config struct {
 	CommitLog CommitLog
+	// Validator is run on every record before it is appended to the CommitLog. Records for which it returns an error
+	// are rejected with codes.InvalidArgument
+	Validator func(*api.Record) error
+	// MinConsumeBackoff and MaxConsumeBackoff bound how long ConsumeStream waits before polling the log again once it
+	// has caught up to the end of the log
+	MinConsumeBackoff time.Duration
+	MaxConsumeBackoff time.Duration
+	// ReportConsumeCancel makes ConsumeStream return codes.Canceled when its stream is cancelled. By default a
+	// cancelled stream is treated as the client disconnecting and ends without an error. Streams that run past their
+	// deadline always end with codes.DeadlineExceeded
+	ReportConsumeCancel bool
+	// Keepalive controls how long connections may live and sit idle before the server closes them, which keeps
+	// connections from clients that went away without closing them from piling up
+	Keepalive keepalive.ServerParameters
+	// MaxConcurrentStreams limits the number of concurrent streams, RPCs included, per connection. There is no limit
+	// when it is zero
+	MaxConcurrentStreams uint32
+	// Offsets stores the offsets committed by consumer groups, and the markers set by clients. CommitOffset,
+	// FetchOffset, SetMarker and GetMarker are unimplemented when it is nil, and so is consuming from a marker
+	Offsets *OffsetStore
+	// Topics, when set, are the topics GetMetadata lists
+	Topics *log.TopicManager
+	// Coordinator assigns partitions to the members of consumer groups. JoinGroup and LeaveGroup are unimplemented
+	// when it is nil
+	Coordinator *Coordinator
+	// RateLimit is how many requests per second the server accepts on average, with bursts of up to RateBurst
+	// requests. Requests over the limit fail with codes.ResourceExhausted. Requests aren't limited when it is zero
+	RateLimit float64
+	RateBurst int
+	// RateLimitPerPeer gives every client address a rate limit of its own instead of sharing one between all of them
+	RateLimitPerPeer bool
+	// MaxProduceStreamBatch is how many of the records a ProduceStream has received it appends before sending their
+	// offsets back, all at once when the commit log can append several records at once. Defaults to 64
+	MaxProduceStreamBatch int
+	// EnableReflection registers the gRPC reflection service, which lets tools like grpcurl discover the API. It is
+	// meant for debugging and best left off in production
+	EnableReflection bool
+	// TCP tunes the connections the gRPC server accepts, whichever listener it serves on
+	TCP TCPConfig
+	// StreamMetrics, when set, keeps count of the streams open on the server and how long they stayed open
+	StreamMetrics *StreamMetrics
+	// ProduceAckBatch and ProduceAckInterval make ProduceStream acknowledge records in batches rather than one by one.
+	// A batch is a run of records appended at consecutive offsets, which is sent once it holds ProduceAckBatch records
+	// or ProduceAckInterval after its first record was appended, whichever comes first. Records are acknowledged one by
+	// one when both are zero. Without an interval a batch isn't sent until it is full or the stream ends
+	ProduceAckBatch    int
+	ProduceAckInterval time.Duration
 }
 
+const (
+	defaultProduceStreamBatch = 64
+	// defaultConsumeBatch and maxConsumeBatch are how many records ConsumeBatch reads when it isn't told, and at most
+	defaultConsumeBatch = 100
+	maxConsumeBatch     = 1000
+)
+
 var _ api.LogServer = (*grpcServer)(nil)
 
 type grpcServer struct {
@@ -24,13 +121,35 @@ type grpcServer struct {
 }
 
 func NewGRPCServer(config *Config) (*grpc.Server, error) {
-	gsrv := grpc.NewServer()
+	opts := []grpc.ServerOption{grpc.KeepaliveParams(config.Keepalive)}
+	if config.MaxConcurrentStreams > 0 {
+		opts = append(opts, grpc.MaxConcurrentStreams(config.MaxConcurrentStreams))
+	}
+	if config.RateLimit > 0 {
+		limiter := newRateLimiter(config.RateLimit, config.RateBurst, config.RateLimitPerPeer)
+		opts = append(opts,
+			grpc.ChainUnaryInterceptor(limiter.unaryInterceptor),
+			grpc.ChainStreamInterceptor(limiter.streamInterceptor),
+		)
+	}
+	if config.StreamMetrics != nil {
+		// streams turned away by the rate limiter never opened, so they aren't counted
+		opts = append(opts, grpc.ChainStreamInterceptor(config.StreamMetrics.streamInterceptor))
+	}
+	if config.TCP != (TCPConfig{}) {
+		opts = append(opts, grpc.Creds(tcpCredentials{config: config.TCP}))
+	}
+
+	gsrv := grpc.NewServer(opts...)
 	srv, err := newgrpcServer(config)
 	if err != nil {
 		return nil, err
 	}
 
 	api.RegisterLogServer(gsrv, srv)
+	if config.EnableReflection {
+		reflection.Register(gsrv)
+	}
 	return gsrv, nil
 }
 
@@ -42,6 +161,20 @@ func newgrpcServer(config *Config) (srv *grpcServer, err error) {
 }
 
 func (s *grpcServer) Produce(context context.Context, req *api.ProduceRequest) (*api.ProduceResponse, error) {
+	if s.Validator != nil {
+		if err := s.Validator(req.Record); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+
+	if a, ok := implements[positionAppender](s.CommitLog); ok {
+		offset, baseOffset, pos, err := a.AppendWithPosition(req.Record)
+		if err != nil {
+			return nil, err
+		}
+		return &api.ProduceResponse{Offset: offset, BaseOffset: baseOffset, Position: pos}, nil
+	}
+
 	offset, err := s.CommitLog.Append(req.Record)
 	if err != nil {
 		return nil, err
@@ -50,48 +183,325 @@ func (s *grpcServer) Produce(context context.Context, req *api.ProduceRequest) (
 	return &api.ProduceResponse{Offset: offset}, nil
 }
 
+// ProduceBatch appends every record in the batch in order. A record that fails validation or can't be appended doesn't
+// stop the rest of the batch, its error is reported in its result instead
+func (s *grpcServer) ProduceBatch(ctx context.Context, req *api.ProduceBatchRequest) (*api.ProduceBatchResponse, error) {
+	results := make([]*api.ProduceResult, len(req.Records))
+	for i, record := range req.Records {
+		res, err := s.Produce(ctx, &api.ProduceRequest{Record: record})
+		if err != nil {
+			results[i] = &api.ProduceResult{Error: err.Error()}
+			continue
+		}
+		results[i] = &api.ProduceResult{Offset: res.Offset}
+	}
+
+	return &api.ProduceBatchResponse{Results: results}, nil
+}
+
 func (s *grpcServer) Consume(context context.Context, req *api.ConsumeRequest) (*api.ConsumeResponse, error) {
 	record, err := s.CommitLog.Read(req.Offset)
 	if err != nil {
 		return nil, err
 	}
-	return &api.ConsumeResponse{Record: record}, nil
+
+	res := &api.ConsumeResponse{Record: record}
+	// followers use the highest offset to tell how far behind they are
+	if o, ok := implements[offsetter](s.CommitLog); ok {
+		if res.HighestOffset, err = o.HighestOffset(); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// Digest returns a digest of the records in [req.Start, req.End), which followers compare with their own to make sure
+// they hold the same records as the leader
+func (s *grpcServer) Digest(ctx context.Context, req *api.DigestRequest) (*api.DigestResponse, error) {
+	d, ok := implements[digester](s.CommitLog)
+	if !ok {
+		return nil, status.Error(codes.Unimplemented, "commit log can't digest its records")
+	}
+
+	digest, err := d.Digest(req.Start, req.End)
+	if err != nil {
+		return nil, err
+	}
+	return &api.DigestResponse{Digest: digest}, nil
 }
 
+// ConsumeBatch reads up to req.MaxRecords records from req.Offset on, which saves clients catching up on the log from
+// making a call for every record. It returns fewer records at the end of the log, and none past it
+func (s *grpcServer) ConsumeBatch(ctx context.Context, req *api.ConsumeBatchRequest) (*api.ConsumeBatchResponse, error) {
+	b, ok := implements[batchReader](s.CommitLog)
+	if !ok {
+		return nil, status.Error(codes.Unimplemented, "commit log can't read batches")
+	}
+
+	max := int(req.MaxRecords)
+	if max == 0 {
+		max = defaultConsumeBatch
+	} else if max > maxConsumeBatch {
+		max = maxConsumeBatch
+	}
+
+	records, next, err := b.ReadBatch(req.Offset, max)
+	if err != nil {
+		return nil, err
+	}
+	return &api.ConsumeBatchResponse{Records: records, NextOffset: next}, nil
+}
+
+// ProduceStream receives requests while it appends the ones it received before, appending up to
+// MaxProduceStreamBatch records at a time. The records of a stream are appended in the order they were sent and their
+// offsets are sent back in that same order, however many other streams are producing at the same time. The offsets
+// are sent in batches when ProduceAckBatch or ProduceAckInterval is set
 func (s *grpcServer) ProduceStream(stream api.Log_ProduceStreamServer) error {
+	batch := s.MaxProduceStreamBatch
+	if batch <= 0 {
+		batch = defaultProduceStreamBatch
+	}
+
+	// reqs is closed once receiving fails, after the error has been put on recvErr
+	reqs := make(chan *api.ProduceRequest, batch)
+	recvErr := make(chan error, 1)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			req, err := stream.Recv()
+			if err != nil {
+				recvErr <- err
+				close(reqs)
+				return
+			}
+			select {
+			case reqs <- req:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	acks := &produceAcks{
+		stream:   stream,
+		max:      s.ProduceAckBatch,
+		interval: s.ProduceAckInterval,
+		batching: s.ProduceAckBatch > 0 || s.ProduceAckInterval > 0,
+	}
 	for {
+		var req *api.ProduceRequest
+		var ok bool
+		if d, due := acks.due(); due {
+			timer := time.NewTimer(d)
+			select {
+			case req, ok = <-reqs:
+				timer.Stop()
+			case <-timer.C:
+				if err := acks.flush(); err != nil {
+					return err
+				}
+				continue
+			}
+		} else {
+			req, ok = <-reqs
+		}
+		if !ok {
+			if err := acks.flush(); err != nil {
+				return err
+			}
+			return <-recvErr
+		}
 
-		// Receive the request over the stream
-		req, err := stream.Recv()
-		if err != nil {
-			return err
+		// take whatever else has been received already, without waiting for more
+		pending := []*api.ProduceRequest{req}
+	drain:
+		for len(pending) < batch {
+			select {
+			case req, ok := <-reqs:
+				if !ok {
+					break drain
+				}
+				pending = append(pending, req)
+			default:
+				break drain
+			}
 		}
 
-		// Action the request by sending it to the Produce endpoint and receive a result with a record back
-		resp, err := s.Produce(stream.Context(), req)
-		if err != nil {
-			return err
+		resps, produceErr := s.produceMany(stream.Context(), pending)
+
+		// the records appended before one failed still get their offsets
+		for _, resp := range resps {
+			if err := acks.add(resp); err != nil {
+				return err
+			}
+		}
+		if produceErr != nil {
+			if err := acks.flush(); err != nil {
+				return err
+			}
+			return produceErr
 		}
+	}
+}
+
+// produceMany appends the records of reqs in order, with a single AppendManyWithPositions or AppendMany when the commit
+// log can do that, and returns the responses to the ones appended before one failed along with the error it failed
+// with. Like Produce's, the responses tell where the records were stored when the commit log can tell
+func (s *grpcServer) produceMany(ctx context.Context, reqs []*api.ProduceRequest) ([]*api.ProduceResponse, error) {
+	pa, positioned := implements[positionManyAppender](s.CommitLog)
+	a, ok := implements[manyAppender](s.CommitLog)
+	if !positioned && !ok {
+		resps := make([]*api.ProduceResponse, 0, len(reqs))
+		for _, req := range reqs {
+			resp, err := s.Produce(ctx, req)
+			if err != nil {
+				return resps, err
+			}
+			resps = append(resps, resp)
+		}
+		return resps, nil
+	}
+
+	// the records after one that fails validation aren't appended, just like they aren't when appending fails
+	records := make([]*api.Record, 0, len(reqs))
+	var invalid error
+	for _, req := range reqs {
+		if s.Validator != nil {
+			if err := s.Validator(req.Record); err != nil {
+				invalid = status.Error(codes.InvalidArgument, err.Error())
+				break
+			}
+		}
+		records = append(records, req.Record)
+	}
+	if len(records) == 0 {
+		return nil, invalid
+	}
+
+	var positions []log.RecordPosition
+	var n int
+	var err error
+	if positioned {
+		positions, err = pa.AppendManyWithPositions(records)
+		n = len(positions)
+	} else {
+		_, n, err = a.AppendMany(records)
+	}
+	resps := make([]*api.ProduceResponse, n)
+	for i, record := range records[:n] {
+		resps[i] = &api.ProduceResponse{Offset: record.Offset}
+		if positioned {
+			resps[i].BaseOffset, resps[i].Position = positions[i].BaseOffset, positions[i].Pos
+		}
+	}
+	if err != nil {
+		return resps, err
+	}
+	return resps, invalid
+}
+
+// produceAcks sends the responses to the records a ProduceStream appended, either one by one or in batches of records
+// appended at consecutive offsets
+type produceAcks struct {
+	stream   api.Log_ProduceStreamServer
+	max      int
+	interval time.Duration
+	batching bool
+	// pending is the batch that hasn't been sent yet, which was started at since
+	pending *api.ProduceResponse
+	since   time.Time
+}
+
+// add acknowledges the record that resp is the response to
+func (a *produceAcks) add(resp *api.ProduceResponse) error {
+	if !a.batching {
+		return a.stream.Send(resp)
+	}
 
-		// Respond to the client on the stream by sending the record
-		if err = stream.Send(resp); err != nil {
+	if a.pending != nil && resp.Offset != a.pending.Offset+uint64(a.pending.Count) {
+		// the offsets of a batch have to be consecutive, so a gap ends it
+		if err := a.flush(); err != nil {
 			return err
 		}
+	}
+	if a.pending == nil {
+		a.pending, a.since = &api.ProduceResponse{Offset: resp.Offset}, time.Now()
+	}
+	a.pending.Count++
+
+	if a.max > 0 && int(a.pending.Count) >= a.max {
+		return a.flush()
+	}
+	return nil
+}
 
+// due returns how long until the pending batch has to be sent, if there is one with an interval to be sent by
+func (a *produceAcks) due() (time.Duration, bool) {
+	if a.pending == nil || a.interval <= 0 {
+		return 0, false
 	}
+	return a.interval - time.Since(a.since), true
+}
+
+// flush sends the pending batch, if there is one
+func (a *produceAcks) flush() error {
+	if a.pending == nil {
+		return nil
+	}
+
+	resp := a.pending
+	a.pending = nil
+	return a.stream.Send(resp)
 }
 
 func (s *grpcServer) ConsumeStream(req *api.ConsumeRequest, stream api.Log_ConsumeStreamServer) error {
+	if req.FromMarker != "" {
+		if req.FromTimestamp != 0 {
+			return status.Error(codes.InvalidArgument, "can't consume from both a marker and a time")
+		}
+		if s.Offsets == nil {
+			return status.Error(codes.Unimplemented, "markers aren't stored by this server")
+		}
+		off, ok := s.Offsets.FetchMarker(req.FromMarker)
+		if !ok {
+			return status.Errorf(codes.NotFound, "there's no marker called %q", req.FromMarker)
+		}
+		req = &api.ConsumeRequest{Offset: off}
+	}
+	if req.FromTimestamp != 0 {
+		seeker, ok := implements[timeSeeker](s.CommitLog)
+		if !ok {
+			return status.Error(codes.Unimplemented, "commit log can't be consumed from a time")
+		}
+		off, err := seeker.OffsetAtTime(time.Unix(0, req.FromTimestamp))
+		if err != nil {
+			return err
+		}
+		req = &api.ConsumeRequest{Offset: off}
+	}
+
+	b := newBackoff(s.MinConsumeBackoff, s.MaxConsumeBackoff)
 	for {
 		select {
 		case <-stream.Context().Done():
-			return nil
+			return s.streamDone(stream.Context())
 		default:
 			resp, err := s.Consume(stream.Context(), req)
 
 			switch err.(type) {
 			case nil:
 			case api.ErrOffsetOutOfRange:
+				// we've caught up to the end of the log, so we wait a bit for new records before trying again
+				select {
+				case <-stream.Context().Done():
+					return s.streamDone(stream.Context())
+				case <-time.After(b.next()):
+				}
+				continue
+			case api.ErrOffsetNotFound, api.ErrCompacted:
+				// there's no record at this offset and there never will be, so we move on to the next one
+				req.Offset++
 				continue
 			default:
 				return err
@@ -100,7 +510,17 @@ func (s *grpcServer) ConsumeStream(req *api.ConsumeRequest, stream api.Log_Consu
 			if err = stream.Send(resp); err != nil {
 				return err
 			}
+			b.reset()
 			req.Offset++
 		}
 	}
 }
+
+// streamDone turns the error of a stream's context that is done into the status the stream ends with
+func (s *grpcServer) streamDone(ctx context.Context) error {
+	if ctx.Err() == context.Canceled && !s.ReportConsumeCancel {
+		return nil
+	}
+
+	return status.FromContextError(ctx.Err()).Err()
+}
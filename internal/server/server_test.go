@@ -2,14 +2,23 @@ package server
 
 import (
 	"context"
+	"fmt"
 	"io/ioutil"
 	"net"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	api "github.com/burmudar/prolog/api/v1"
 	"github.com/burmudar/prolog/internal/log"
 	"github.com/stretchr/testify/require"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/keepalive"
+	rpb "google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
 )
 
 func TestServer(t *testing.T) {
@@ -30,16 +39,492 @@ func TestServer(t *testing.T) {
 	}
 }
 
-func setupTest(t *testing.T, fn func(c *Config)) (client api.LogClient, cfg *Config, tearDown func()) {
-	t.Helper()
+func TestServerValidator(t *testing.T) {
+	client, _, tearDown := setupTest(t, func(c *Config) {
+		c.Validator = func(r *api.Record) error {
+			if len(r.Value) == 0 {
+				return fmt.Errorf("record value is empty")
+			}
+			return nil
+		}
+	})
+	defer tearDown()
 
-	l, err := net.Listen("tcp", ":0")
+	ctx := context.Background()
+
+	_, err := client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{}})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	produce, err := client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello world")},
+	})
 	require.NoError(t, err)
+	require.Equal(t, uint64(0), produce.Offset)
 
-	clientOptions := []grpc.DialOption{grpc.WithInsecure()}
-	cc, err := grpc.Dial(l.Addr().String(), clientOptions...)
+	stream, err := client.ProduceStream(ctx)
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(&api.ProduceRequest{Record: &api.Record{}}))
+	_, err = stream.Recv()
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+// batchCountingLog records the size of every batch appended to the log with AppendMany, and counts the records
+// appended one by one
+type batchCountingLog struct {
+	*log.Log
+	mu      sync.Mutex
+	batches []int
+	single  int
+}
+
+func (l *batchCountingLog) Append(record *api.Record) (uint64, error) {
+	l.mu.Lock()
+	l.single++
+	l.mu.Unlock()
+	return l.Log.Append(record)
+}
+
+func (l *batchCountingLog) AppendWithPosition(record *api.Record) (uint64, uint64, uint64, error) {
+	l.mu.Lock()
+	l.single++
+	l.mu.Unlock()
+	return l.Log.AppendWithPosition(record)
+}
+
+func (l *batchCountingLog) AppendMany(records []*api.Record) (uint64, int, error) {
+	l.mu.Lock()
+	l.batches = append(l.batches, len(records))
+	l.mu.Unlock()
+	return l.Log.AppendMany(records)
+}
+
+func (l *batchCountingLog) AppendManyWithPositions(records []*api.Record) ([]log.RecordPosition, error) {
+	l.mu.Lock()
+	l.batches = append(l.batches, len(records))
+	l.mu.Unlock()
+	return l.Log.AppendManyWithPositions(records)
+}
+
+func TestServerProduceStreamPipelined(t *testing.T) {
+	clog := &batchCountingLog{}
+	client, _, tearDown := setupTest(t, func(c *Config) {
+		c.MaxProduceStreamBatch = 8
+		clog.Log = c.CommitLog.(*log.Log)
+		c.CommitLog = clog
+	})
+	defer tearDown()
+
+	stream, err := client.ProduceStream(context.Background())
+	require.NoError(t, err)
+
+	// everything is sent before any offset is received, so that the server has requests to batch
+	n := 100
+	for i := 0; i < n; i++ {
+		require.NoError(t, stream.Send(&api.ProduceRequest{
+			Record: &api.Record{Value: []byte(fmt.Sprintf("record %d", i))},
+		}))
+	}
+	for i := 0; i < n; i++ {
+		res, err := stream.Recv()
+		require.NoError(t, err)
+		require.Equal(t, uint64(i), res.Offset)
+	}
+	require.NoError(t, stream.CloseSend())
+
+	// every drained batch went to the log in a single call
+	clog.mu.Lock()
+	defer clog.mu.Unlock()
+	require.Zero(t, clog.single)
+	var appended int
+	for _, batch := range clog.batches {
+		require.LessOrEqual(t, batch, 8)
+		appended += batch
+	}
+	require.Equal(t, n, appended)
+}
+
+func TestServerProduceStreamBatchedAcks(t *testing.T) {
+	client, _, tearDown := setupTest(t, func(c *Config) {
+		c.ProduceAckBatch = 10
+		c.ProduceAckInterval = 50 * time.Millisecond
+	})
+	defer tearDown()
+
+	stream, err := client.ProduceStream(context.Background())
+	require.NoError(t, err)
+
+	// two full batches, and a last one that is sent once the interval is up
+	n := 25
+	for i := 0; i < n; i++ {
+		require.NoError(t, stream.Send(&api.ProduceRequest{
+			Record: &api.Record{Value: []byte(fmt.Sprintf("record %d", i))},
+		}))
+	}
+
+	var next uint64
+	var counts []uint32
+	for next < uint64(n) {
+		res, err := stream.Recv()
+		require.NoError(t, err)
+		require.Equal(t, next, res.Offset)
+		require.NotZero(t, res.Count)
+		counts = append(counts, res.Count)
+		next += uint64(res.Count)
+	}
+	require.Equal(t, uint64(n), next)
+	require.Equal(t, []uint32{10, 10, 5}, counts)
+	require.NoError(t, stream.CloseSend())
+}
+
+func TestServerProducePosition(t *testing.T) {
+	client, cfg, tearDown := setupTest(t, nil)
+	defer tearDown()
+
+	ctx := context.Background()
+	clog := cfg.CommitLog.(*log.Log)
+	for i := 0; i < 3; i++ {
+		value := []byte(fmt.Sprintf("record %d", i))
+		res, err := client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: value}})
+		require.NoError(t, err)
+
+		// the position is all it takes to read the record back raw
+		p, err := clog.ReadRawAt(res.BaseOffset, res.Position)
+		require.NoError(t, err)
+		var record api.Record
+		require.NoError(t, proto.Unmarshal(p, &record))
+		require.Equal(t, res.Offset, record.Offset)
+		require.Equal(t, value, record.Value)
+	}
+
+	// records produced on a stream are appended in batches, and their responses tell where they were stored all the same
+	stream, err := client.ProduceStream(ctx)
+	require.NoError(t, err)
+	for i := 3; i < 6; i++ {
+		require.NoError(t, stream.Send(&api.ProduceRequest{
+			Record: &api.Record{Value: []byte(fmt.Sprintf("record %d", i))},
+		}))
+	}
+	for i := 3; i < 6; i++ {
+		res, err := stream.Recv()
+		require.NoError(t, err)
+		p, err := clog.ReadRawAt(res.BaseOffset, res.Position)
+		require.NoError(t, err)
+		var record api.Record
+		require.NoError(t, proto.Unmarshal(p, &record))
+		require.Equal(t, res.Offset, record.Offset)
+		require.Equal(t, []byte(fmt.Sprintf("record %d", i)), record.Value)
+	}
+	require.NoError(t, stream.CloseSend())
+}
+
+func TestServerProducePositionUnsupported(t *testing.T) {
+	client, _, tearDown := setupTest(t, func(c *Config) {
+		c.CommitLog = &countingLog{CommitLog: c.CommitLog}
+	})
+	defer tearDown()
+
+	// commit logs that can't tell where they stored a record only report its offset
+	ctx := context.Background()
+	for i := uint64(0); i < 2; i++ {
+		res, err := client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("hello world")}})
+		require.NoError(t, err)
+		require.Equal(t, i, res.Offset)
+		require.Zero(t, res.Position)
+	}
+}
+
+func TestServerConsumeBatch(t *testing.T) {
+	client, _, tearDown := setupTest(t, nil)
+	defer tearDown()
+
+	ctx := context.Background()
+	for i := 0; i < 5; i++ {
+		_, err := client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte(fmt.Sprintf("record %d", i))},
+		})
+		require.NoError(t, err)
+	}
+
+	res, err := client.ConsumeBatch(ctx, &api.ConsumeBatchRequest{Offset: 1, MaxRecords: 3})
+	require.NoError(t, err)
+	require.Len(t, res.Records, 3)
+	for i, record := range res.Records {
+		require.Equal(t, uint64(i+1), record.Offset)
+		require.Equal(t, []byte(fmt.Sprintf("record %d", i+1)), record.Value)
+	}
+	require.Equal(t, uint64(4), res.NextOffset)
+
+	// the batch stops at the tail of the log
+	res, err = client.ConsumeBatch(ctx, &api.ConsumeBatchRequest{Offset: res.NextOffset, MaxRecords: 3})
+	require.NoError(t, err)
+	require.Len(t, res.Records, 1)
+	require.Equal(t, uint64(4), res.Records[0].Offset)
+	require.Equal(t, uint64(5), res.NextOffset)
+
+	res, err = client.ConsumeBatch(ctx, &api.ConsumeBatchRequest{Offset: res.NextOffset})
+	require.NoError(t, err)
+	require.Empty(t, res.Records)
+	require.Equal(t, uint64(5), res.NextOffset)
+}
+
+func TestServerDigest(t *testing.T) {
+	client, cfg, tearDown := setupTest(t, nil)
+	defer tearDown()
+
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		_, err := client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte(fmt.Sprintf("record %d", i))},
+		})
+		require.NoError(t, err)
+	}
+
+	res, err := client.Digest(ctx, &api.DigestRequest{Start: 1, End: 3})
+	require.NoError(t, err)
+	want, err := cfg.CommitLog.(digester).Digest(1, 3)
+	require.NoError(t, err)
+	require.Equal(t, want, res.Digest)
+
+	_, err = client.Digest(ctx, &api.DigestRequest{Start: 0, End: 4})
+	require.Error(t, err)
+}
+
+func TestServerReflection(t *testing.T) {
+	for scenario, enabled := range map[string]bool{
+		"reflection is off by default": false,
+		"reflection lists the log":     true,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			_, _, conn, tearDown := setupTestConn(t, func(c *Config) {
+				c.EnableReflection = enabled
+			})
+			defer tearDown()
+
+			stream, err := rpb.NewServerReflectionClient(conn).ServerReflectionInfo(context.Background())
+			require.NoError(t, err)
+			require.NoError(t, stream.Send(&rpb.ServerReflectionRequest{
+				MessageRequest: &rpb.ServerReflectionRequest_ListServices{},
+			}))
+			res, err := stream.Recv()
+			if !enabled {
+				require.Equal(t, codes.Unimplemented, status.Code(err))
+				return
+			}
+			require.NoError(t, err)
+
+			var services []string
+			for _, s := range res.GetListServicesResponse().Service {
+				services = append(services, s.Name)
+			}
+			require.Contains(t, services, "log.v1.Log")
+		})
+	}
+}
+
+// countingLog counts the reads made against the wrapped CommitLog
+type countingLog struct {
+	CommitLog
+	reads int64
+}
+
+func (c *countingLog) Read(off uint64) (*api.Record, error) {
+	atomic.AddInt64(&c.reads, 1)
+	return c.CommitLog.Read(off)
+}
+
+func TestServerConsumeStreamBackoff(t *testing.T) {
+	maxBackoff := 20 * time.Millisecond
+	var counter *countingLog
+	client, _, tearDown := setupTest(t, func(c *Config) {
+		counter = &countingLog{CommitLog: c.CommitLog}
+		c.CommitLog = counter
+		c.MinConsumeBackoff = time.Millisecond
+		c.MaxConsumeBackoff = maxBackoff
+	})
+	defer tearDown()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{Offset: 0})
+	require.NoError(t, err)
+
+	// while idle we should be polling roughly once every maxBackoff instead of spinning
+	idle := 200 * time.Millisecond
+	time.Sleep(idle)
+	reads := atomic.LoadInt64(&counter.reads)
+	require.Greater(t, reads, int64(0))
+	require.Less(t, reads, int64(2*idle/(maxBackoff/2)))
+
+	start := time.Now()
+	_, err = client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello world")},
+	})
+	require.NoError(t, err)
+
+	res, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello world"), res.Record.Value)
+	require.Less(t, time.Since(start), maxBackoff+50*time.Millisecond)
+}
+
+func TestServerConsumeStreamFromTimestamp(t *testing.T) {
+	client, _, tearDown := setupTest(t, nil)
+	defer tearDown()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 6; i++ {
+		_, err := client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{
+			Value:     []byte(fmt.Sprintf("record %d", i)),
+			Timestamp: start.Add(time.Duration(i) * time.Minute).UnixNano(),
+		}})
+		require.NoError(t, err)
+	}
+
+	from := start.Add(150 * time.Second)
+	stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{FromTimestamp: from.UnixNano()})
+	require.NoError(t, err)
+	for off := uint64(3); off < 6; off++ {
+		res, err := stream.Recv()
+		require.NoError(t, err)
+		require.Equal(t, off, res.Record.Offset)
+	}
+
+	// a time after the last record starts the stream at the end of the log, where it waits for new records
+	stream, err = client.ConsumeStream(ctx, &api.ConsumeRequest{FromTimestamp: start.Add(time.Hour).UnixNano()})
+	require.NoError(t, err)
+	_, err = client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("record 6")}})
+	require.NoError(t, err)
+	res, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, uint64(6), res.Record.Offset)
+}
+
+func TestServerConsumeStreamFromTimestampUnsupported(t *testing.T) {
+	client, _, tearDown := setupTest(t, func(c *Config) {
+		c.CommitLog = &countingLog{CommitLog: c.CommitLog}
+	})
+	defer tearDown()
+
+	stream, err := client.ConsumeStream(context.Background(), &api.ConsumeRequest{FromTimestamp: time.Now().UnixNano()})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.Equal(t, codes.Unimplemented, status.Code(err))
+}
+
+func TestServerConnectionLimits(t *testing.T) {
+	client, _, tearDown := setupTest(t, func(c *Config) {
+		c.MaxConcurrentStreams = 1
+	})
+	defer tearDown()
+
+	_, err := client.Produce(context.Background(), &api.ProduceRequest{Record: &api.Record{Value: []byte("hello world")}})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{Offset: 0})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.NoError(t, err)
+
+	// the stream takes up the only slot on the connection, so other calls have to wait for it to end
+	short, shortCancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer shortCancel()
+	_, err = client.Produce(short, &api.ProduceRequest{Record: &api.Record{Value: []byte("hello world")}})
+	require.Equal(t, codes.DeadlineExceeded, status.Code(err))
+
+	cancel()
+	_, err = client.Produce(context.Background(), &api.ProduceRequest{Record: &api.Record{Value: []byte("hello world")}})
+	require.NoError(t, err)
+}
+
+func TestServerKeepalive(t *testing.T) {
+	client, _, tearDown := setupTest(t, func(c *Config) {
+		c.Keepalive = keepalive.ServerParameters{
+			MaxConnectionAge:      100 * time.Millisecond,
+			MaxConnectionAgeGrace: 100 * time.Millisecond,
+		}
+	})
+	defer tearDown()
+
+	stream, err := client.ConsumeStream(context.Background(), &api.ConsumeRequest{Offset: 0})
 	require.NoError(t, err)
 
+	// nothing is ever produced, so the stream only ends once the connection has gotten too old
+	start := time.Now()
+	_, err = stream.Recv()
+	require.Equal(t, codes.Unavailable, status.Code(err))
+	require.Less(t, time.Since(start), time.Second)
+}
+
+// consumeStream is a server side ConsumeStream stream that isn't connected to a client
+type consumeStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *consumeStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *consumeStream) Send(*api.ConsumeResponse) error {
+	return nil
+}
+
+func TestServerConsumeStreamContextErrors(t *testing.T) {
+	for scenario, want := range map[string]struct {
+		reportCancel bool
+		deadline     bool
+		code         codes.Code
+	}{
+		"deadline exceeded":          {deadline: true, code: codes.DeadlineExceeded},
+		"cancelled":                  {code: codes.OK},
+		"cancelled and reported":     {reportCancel: true, code: codes.Canceled},
+		"deadline exceeded reported": {reportCancel: true, deadline: true, code: codes.DeadlineExceeded},
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "server-ctx-test")
+			require.NoError(t, err)
+			clog, err := log.NewLog(dir, log.Config{})
+			require.NoError(t, err)
+			defer clog.Remove()
+
+			srv, err := newgrpcServer(&Config{CommitLog: clog, ReportConsumeCancel: want.reportCancel})
+			require.NoError(t, err)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			if want.deadline {
+				ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+			} else {
+				time.AfterFunc(20*time.Millisecond, cancel)
+			}
+			defer cancel()
+
+			err = srv.ConsumeStream(&api.ConsumeRequest{Offset: 0}, &consumeStream{ctx: ctx})
+			require.Equal(t, want.code, status.Code(err))
+		})
+	}
+}
+
+func setupTest(t *testing.T, fn func(c *Config)) (client api.LogClient, cfg *Config, tearDown func()) {
+	t.Helper()
+
+	client, cfg, _, tearDown = setupTestConn(t, fn)
+	return client, cfg, tearDown
+}
+
+// setupTestConn is setupTest for tests that need the client's connection to make other clients with
+func setupTestConn(t *testing.T, fn func(c *Config)) (
+	client api.LogClient,
+	cfg *Config,
+	cc *grpc.ClientConn,
+	tearDown func(),
+) {
+	t.Helper()
+
 	dir, err := ioutil.TempDir("", "server-test")
 	require.NoError(t, err)
 
@@ -52,6 +537,14 @@ func setupTest(t *testing.T, fn func(c *Config)) (client api.LogClient, cfg *Con
 	if fn != nil {
 		fn(cfg)
 	}
+
+	l, err := net.Listen("tcp", ":0")
+	require.NoError(t, err)
+
+	clientOptions := []grpc.DialOption{grpc.WithInsecure()}
+	cc, err = grpc.Dial(l.Addr().String(), clientOptions...)
+	require.NoError(t, err)
+
 	server, err := NewGRPCServer(cfg)
 	require.NoError(t, err)
 
@@ -61,7 +554,7 @@ func setupTest(t *testing.T, fn func(c *Config)) (client api.LogClient, cfg *Con
 
 	client = api.NewLogClient(cc)
 
-	return client, cfg, func() {
+	return client, cfg, cc, func() {
 		server.Stop()
 		cc.Close()
 		l.Close()
@@ -83,6 +576,7 @@ func testProduceConsume(t *testing.T, client api.LogClient, cfg *Config) {
 	require.NoError(t, err)
 	require.Equal(t, want.Value, consume.Record.Value)
 	require.Equal(t, want.Offset, consume.Record.Offset)
+	require.Equal(t, produceResp.Offset, consume.HighestOffset)
 }
 
 func testConsumePastBoundary(t *testing.T, client api.LogClient, cfg *Config) {
@@ -149,10 +643,45 @@ func testProduceConsumeStream(t *testing.T, client api.LogClient, cfg *Config) {
 		for i, record := range records {
 			res, err := stream.Recv()
 			require.NoError(t, err)
+			// the timestamp is assigned by the log when the record is appended
+			require.NotZero(t, res.Record.Timestamp)
 			require.Equal(t, res.Record, &api.Record{
-				Value:  record.Value,
-				Offset: uint64(i),
+				Value:     record.Value,
+				Offset:    uint64(i),
+				Timestamp: res.Record.Timestamp,
 			})
 		}
 	}
 }
+
+func TestServerConsumeCompacted(t *testing.T) {
+	client, cfg, tearDown := setupTest(t, nil)
+	defer tearDown()
+
+	// the records at offsets 2 and 3 were compacted away before they could be replicated
+	clog := cfg.CommitLog.(*log.Log)
+	clog.Config.AllowOffsetGaps = true
+	for _, off := range []uint64{0, 1, 4} {
+		require.NoError(t, clog.AppendAt(&api.Record{Value: []byte(fmt.Sprintf("record %d", off))}, off))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{Offset: 0})
+	require.NoError(t, err)
+	for _, off := range []uint64{0, 1, 4} {
+		res, err := stream.Recv()
+		require.NoError(t, err)
+		require.Equal(t, off, res.Record.Offset)
+	}
+
+	multi, err := client.ConsumeMulti(ctx)
+	require.NoError(t, err)
+	require.NoError(t, multi.Send(&api.ConsumeMultiRequest{Add: &api.Subscription{Id: "gaps", Offset: 1}}))
+	for _, off := range []uint64{1, 4} {
+		res, err := multi.Recv()
+		require.NoError(t, err)
+		require.Equal(t, off, res.Record.Offset)
+	}
+}
@@ -0,0 +1,95 @@
+package server
+
+import (
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+// StreamDurationBuckets are the upper bounds of the buckets of the stream duration histogram. Streams that last longer
+// than the last bound are counted in an extra bucket
+var StreamDurationBuckets = []time.Duration{
+	time.Second,
+	10 * time.Second,
+	time.Minute,
+	10 * time.Minute,
+	time.Hour,
+}
+
+// StreamMetrics keeps count of the streams, like ProduceStream and ConsumeStream, that are open on a server and of how
+// long the ones that were closed stayed open, both by the stream's full method name. A count of open streams that keeps
+// growing points at clients leaking streams
+type StreamMetrics struct {
+	mu        sync.Mutex
+	open      map[string]int
+	durations map[string][]uint64
+	now       func() time.Time
+}
+
+func NewStreamMetrics() *StreamMetrics {
+	return &StreamMetrics{
+		open:      make(map[string]int),
+		durations: make(map[string][]uint64),
+		now:       time.Now,
+	}
+}
+
+// Open returns how many streams of the given method are open right now
+func (m *StreamMetrics) Open(method string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.open[method]
+}
+
+// Durations returns how many streams of the given method were closed after being open for as long as each of the
+// StreamDurationBuckets, with the streams open for longer than the last bucket counted last
+func (m *StreamMetrics) Durations(method string) []uint64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	counts := make([]uint64, len(StreamDurationBuckets)+1)
+	copy(counts, m.durations[method])
+	return counts
+}
+
+func (m *StreamMetrics) opened(method string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.open[method]++
+}
+
+func (m *StreamMetrics) closed(method string, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.open[method]--
+	counts, ok := m.durations[method]
+	if !ok {
+		counts = make([]uint64, len(StreamDurationBuckets)+1)
+		m.durations[method] = counts
+	}
+
+	i := 0
+	for i < len(StreamDurationBuckets) && d > StreamDurationBuckets[i] {
+		i++
+	}
+	counts[i]++
+}
+
+func (m *StreamMetrics) streamInterceptor(
+	srv interface{},
+	ss grpc.ServerStream,
+	info *grpc.StreamServerInfo,
+	handler grpc.StreamHandler,
+) error {
+	start := m.now()
+	m.opened(info.FullMethod)
+	defer func() {
+		m.closed(info.FullMethod, m.now().Sub(start))
+	}()
+
+	return handler(srv, ss)
+}
@@ -0,0 +1,67 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	api "github.com/burmudar/prolog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServerStreamMetrics(t *testing.T) {
+	metrics := NewStreamMetrics()
+	client, _, tearDown := setupTest(t, func(c *Config) {
+		c.StreamMetrics = metrics
+	})
+	defer tearDown()
+
+	const (
+		produceMethod = "/log.v1.Log/ProduceStream"
+		consumeMethod = "/log.v1.Log/ConsumeStream"
+	)
+	openStreams := func(produce, consume int) func() bool {
+		return func() bool {
+			return metrics.Open(produceMethod) == produce && metrics.Open(consumeMethod) == consume
+		}
+	}
+
+	produce, err := client.ProduceStream(context.Background())
+	require.NoError(t, err)
+	require.NoError(t, produce.Send(&api.ProduceRequest{Record: &api.Record{Value: []byte("hello world")}}))
+	_, err = produce.Recv()
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	consume, err := client.ConsumeStream(ctx, &api.ConsumeRequest{Offset: 0})
+	require.NoError(t, err)
+	_, err = consume.Recv()
+	require.NoError(t, err)
+
+	require.Eventually(t, openStreams(1, 1), time.Second, 10*time.Millisecond)
+
+	require.NoError(t, produce.CloseSend())
+	// the stream ends once the server sees that nothing more is coming
+	_, err = produce.Recv()
+	require.Error(t, err)
+	cancel()
+
+	require.Eventually(t, openStreams(0, 0), time.Second, 10*time.Millisecond)
+	for _, method := range []string{produceMethod, consumeMethod} {
+		// both streams were closed well within the first bucket
+		require.Equal(t, uint64(1), metrics.Durations(method)[0])
+	}
+}
+
+func TestStreamMetricsDurations(t *testing.T) {
+	m := NewStreamMetrics()
+	for _, d := range []time.Duration{0, time.Second, 2 * time.Second, time.Hour, 2 * time.Hour} {
+		m.opened("stream")
+		m.closed("stream", d)
+	}
+
+	require.Equal(t, 0, m.Open("stream"))
+	require.Equal(t, []uint64{2, 1, 0, 0, 1, 1}, m.Durations("stream"))
+	require.Equal(t, []uint64{0, 0, 0, 0, 0, 0}, m.Durations("other"))
+}
@@ -0,0 +1,137 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+
+	"google.golang.org/grpc/credentials"
+)
+
+// TCPConfig tunes the connections accepted by the gRPC server, or by a listener made with Listen. The zero value leaves
+// them as Go and the operating system set them up
+type TCPConfig struct {
+	// DisableNoDelay turns off TCP_NODELAY, which Go turns on for every TCP connection, so that small writes are held
+	// back to be coalesced by Nagle's algorithm. Produce responses are small and a client waits on each of them, so
+	// coalescing them mostly adds latency
+	DisableNoDelay bool
+	// ReadBuffer and WriteBuffer are the sizes of the connections' socket buffers in bytes. They're left to the
+	// operating system when they're zero
+	ReadBuffer  int
+	WriteBuffer int
+}
+
+// Listen listens on the TCP address addr like net.Listen, applying c to every connection it accepts. Pass the listener
+// to the Serve method of the gRPC server, or use ListenAndServe for the HTTP server
+func Listen(addr string, c TCPConfig) (net.Listener, error) {
+	var lc net.ListenConfig
+	l, err := lc.Listen(context.Background(), "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &tcpListener{Listener: l, config: c}, nil
+}
+
+// ListenAndServe is srv.ListenAndServe with its connections tuned by c
+func ListenAndServe(srv *http.Server, c TCPConfig) error {
+	addr := srv.Addr
+	if addr == "" {
+		addr = ":http"
+	}
+
+	l, err := Listen(addr, c)
+	if err != nil {
+		return err
+	}
+	return srv.Serve(l)
+}
+
+type tcpListener struct {
+	net.Listener
+	config TCPConfig
+}
+
+// Accept accepts the next connection that could be tuned. Connections that can't be are closed, since failing Accept
+// would stop the server
+func (l *tcpListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		tcp, ok := conn.(*net.TCPConn)
+		if !ok {
+			return conn, nil
+		}
+		if err := l.config.tune(tcp); err != nil {
+			conn.Close()
+			continue
+		}
+		return conn, nil
+	}
+}
+
+func (c TCPConfig) tune(conn *net.TCPConn) error {
+	if c.DisableNoDelay {
+		if err := conn.SetNoDelay(false); err != nil {
+			return err
+		}
+	}
+	if c.ReadBuffer > 0 {
+		if err := conn.SetReadBuffer(c.ReadBuffer); err != nil {
+			return err
+		}
+	}
+	if c.WriteBuffer > 0 {
+		if err := conn.SetWriteBuffer(c.WriteBuffer); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tcpCredentials tunes the connections the gRPC server accepts as part of their handshake, which is the one point at
+// which the server hands them over whatever listener it serves on. Connections are served as they are without
+// credentials otherwise, so clients connect without any
+type tcpCredentials struct {
+	config TCPConfig
+}
+
+var _ credentials.TransportCredentials = tcpCredentials{}
+
+// tcpAuthInfo is the auth info of connections that were tuned rather than authenticated
+type tcpAuthInfo struct {
+	credentials.CommonAuthInfo
+}
+
+func (tcpAuthInfo) AuthType() string {
+	return "insecure"
+}
+
+func (c tcpCredentials) ServerHandshake(conn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		if err := c.config.tune(tcp); err != nil {
+			return nil, nil, err
+		}
+	}
+	info := tcpAuthInfo{credentials.CommonAuthInfo{SecurityLevel: credentials.NoSecurity}}
+	return conn, info, nil
+}
+
+func (c tcpCredentials) ClientHandshake(context.Context, string, net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	return nil, nil, fmt.Errorf("tcp credentials only tune the connections servers accept")
+}
+
+func (c tcpCredentials) Info() credentials.ProtocolInfo {
+	return credentials.ProtocolInfo{SecurityProtocol: "insecure"}
+}
+
+func (c tcpCredentials) Clone() credentials.TransportCredentials {
+	return c
+}
+
+func (c tcpCredentials) OverrideServerName(string) error {
+	return nil
+}
@@ -0,0 +1,72 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+
+	api "github.com/burmudar/prolog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListen(t *testing.T) {
+	c := TCPConfig{DisableNoDelay: true, ReadBuffer: 64 << 10, WriteBuffer: 64 << 10}
+	l, err := Listen("127.0.0.1:0", c)
+	require.NoError(t, err)
+	defer l.Close()
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("ping"))
+	require.NoError(t, err)
+	p := make([]byte, 4)
+	_, err = io.ReadFull(conn, p)
+	require.NoError(t, err)
+	require.Equal(t, []byte("ping"), p)
+}
+
+func TestGRPCServerTCP(t *testing.T) {
+	// setupTest serves on a plain listener, so the connections are tuned by the server itself
+	client, _, tearDown := setupTest(t, func(c *Config) {
+		c.TCP = TCPConfig{DisableNoDelay: true, ReadBuffer: 64 << 10, WriteBuffer: 64 << 10}
+	})
+	defer tearDown()
+
+	_, err := client.Produce(context.Background(), &api.ProduceRequest{Record: &api.Record{Value: []byte("hello")}})
+	require.NoError(t, err)
+}
+
+func TestTCPCredentials(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+
+	client, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer client.Close()
+	conn, err := l.Accept()
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// the connection is tuned and handed back as it is, with nothing to authenticate
+	creds := tcpCredentials{config: TCPConfig{DisableNoDelay: true, ReadBuffer: 64 << 10}}
+	tuned, info, err := creds.ServerHandshake(conn)
+	require.NoError(t, err)
+	require.Equal(t, conn, tuned)
+	require.Equal(t, "insecure", info.AuthType())
+
+	_, _, err = creds.ClientHandshake(context.Background(), l.Addr().String(), client)
+	require.Error(t, err)
+}